@@ -0,0 +1,227 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/immutable/metavisor-cli/pkg/config"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// ErrInvalidProfiles is returned if config validate finds problems
+var ErrInvalidProfiles = errors.New("the config file has problems")
+
+// applyProfile sets the settings of the selected profile as the defaults of
+// the flags of the command, so that flags and env vars take precedence over
+// the profile. Settings that are not flags of the command are ignored, so
+// that a profile can be used with several commands.
+func applyProfile(a *kingpin.Application, args []string) error {
+	ctx, err := a.ParseContext(args)
+	if err != nil || ctx == nil {
+		// The error is shown when parsing for real
+		return nil
+	}
+	path, profile := os.Getenv(envConfig), os.Getenv(envProfile)
+	cmds := []*kingpin.CmdClause{}
+	for _, e := range ctx.Elements {
+		switch c := e.Clause.(type) {
+		case *kingpin.FlagClause:
+			switch c.Model().Name {
+			case "config":
+				path = *e.Value
+			case "profile":
+				profile = *e.Value
+			}
+		case *kingpin.CmdClause:
+			cmds = append(cmds, c)
+		}
+	}
+	if len(cmds) > 0 && cmds[0] == configCommand {
+		// The config commands read the file themselves
+		return nil
+	}
+	explicit := path != ""
+	if !explicit {
+		path = config.DefaultPath()
+	}
+	f, err := config.Load(path)
+	if os.IsNotExist(err) && !explicit && profile == "" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read the config file %s: %s", path, err)
+	}
+	p, err := f.Profile(profile)
+	if err == config.ErrUnknownProfile {
+		return fmt.Errorf("the profile %s is not in the config file %s", profile, path)
+	}
+	if err != nil || p == nil {
+		return err
+	}
+	for key := range p {
+		flag := findFlag(a, cmds, key)
+		if flag == nil {
+			continue
+		}
+		values, err := p.Values(key)
+		if err != nil {
+			return fmt.Errorf("the setting %s of the profile is not valid", key)
+		}
+		flag.Default(values...)
+	}
+	return nil
+}
+
+// findFlag returns the flag with the given name of the most specific
+// command it's defined on, or of the app
+func findFlag(a *kingpin.Application, cmds []*kingpin.CmdClause, name string) *kingpin.FlagClause {
+	if name == "config" || name == "profile" {
+		return nil
+	}
+	for i := len(cmds) - 1; i >= 0; i-- {
+		if flag := cmds[i].GetFlag(name); flag != nil {
+			return flag
+		}
+	}
+	return a.GetFlag(name)
+}
+
+// knownFlags returns the names of the flags of all commands, which are the
+// settings a profile can have
+func knownFlags() map[string]bool {
+	known := map[string]bool{}
+	var walk func(cmds []*kingpin.CmdModel)
+	walk = func(cmds []*kingpin.CmdModel) {
+		for _, c := range cmds {
+			for _, f := range c.Flags {
+				known[f.Name] = true
+			}
+			walk(c.Commands)
+		}
+	}
+	model := app.Model()
+	for _, f := range model.Flags {
+		known[f.Name] = true
+	}
+	walk(model.Commands)
+	for _, name := range []string{"help", "config", "profile"} {
+		delete(known, name)
+	}
+	return known
+}
+
+func configFilePath() string {
+	if *configPath != "" {
+		return *configPath
+	}
+	return config.DefaultPath()
+}
+
+func getConfig(ctx context.Context) {
+	f, err := config.Load(configFilePath())
+	if err != nil {
+		logging.Fatal(err)
+		return
+	}
+	values, err := f.Get(*configProfile, *configGetKey)
+	if err != nil {
+		logging.Fatal(err)
+		return
+	}
+	if len(values) == 0 {
+		logging.Fatalf("The setting %s is not set in the profile", *configGetKey)
+		return
+	}
+	fmt.Println(strings.Join(values, "\n"))
+}
+
+func setConfig(ctx context.Context) {
+	if *configSetKey != config.DefaultProfileKey && !knownFlags()[*configSetKey] {
+		logging.Fatal(config.ErrUnknownKey)
+		return
+	}
+	path := configFilePath()
+	f, err := config.LoadOrEmpty(path)
+	if err != nil {
+		logging.Fatal(err)
+		return
+	}
+	if err = f.Set(*configProfile, *configSetKey, *configSetValue); err != nil {
+		if err == config.ErrNoProfile {
+			logging.Error("Specify the profile to change with --profile")
+		}
+		logging.Fatal(err)
+		return
+	}
+	if err = f.Save(path); err != nil {
+		logging.Debugf("Got error while writing config file: %s", err)
+		logging.Fatalf("Could not write the config file %s", path)
+		return
+	}
+	logging.Infof("Updated the config file %s", path)
+}
+
+func listConfig(ctx context.Context) {
+	path := configFilePath()
+	f, err := config.LoadOrEmpty(path)
+	if err != nil {
+		logging.Fatal(err)
+		return
+	}
+	output, err := config.FormatProfiles(f, path, *configListJSON)
+	if err != nil {
+		// Could not marshal profiles to JSON
+		logging.Debugf("Got error while formatting profiles: %s", err)
+		logging.Fatal(ErrGeneric)
+		return
+	}
+	fmt.Println(output)
+}
+
+func validateConfig(ctx context.Context) {
+	path := configFilePath()
+	f, err := config.Load(path)
+	if err != nil {
+		logging.Fatal(err)
+		return
+	}
+	problems := f.Validate(knownFlags())
+	if *configValidateJSON {
+		data, err := json.MarshalIndent(problems, "", "\t")
+		if err != nil {
+			logging.Debugf("Got error while formatting problems: %s", err)
+			logging.Fatal(ErrGeneric)
+			return
+		}
+		fmt.Println(string(data))
+	} else if len(problems) == 0 {
+		logging.Infof("The config file %s is valid", path)
+	} else {
+		for _, p := range problems {
+			logging.Error(p.String())
+		}
+	}
+	if len(problems) > 0 {
+		logging.Fatal(ErrInvalidProfiles)
+	}
+}
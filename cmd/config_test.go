@@ -0,0 +1,174 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const testConfig = `default-profile: prod
+profiles:
+  prod:
+    region: us-east-1
+    subnet-id: subnet-profile
+    concurrency: 8
+    filter: [tag:Env=prod]
+  dev:
+    region: eu-west-1
+`
+
+// testApp has flags declared like the ones of the app, as applying a profile
+// changes the defaults of the flags, which would leak between tests
+type testApp struct {
+	app         *kingpin.Application
+	region      *string
+	subnet      *string
+	concurrency *int
+}
+
+func newTestApp() *testApp {
+	a := &testApp{app: kingpin.New("metavisor", helpText)}
+	a.app.Flag("config", "").Envar(envConfig).String()
+	a.app.Flag("profile", "").Envar(envProfile).String()
+	awsCmd := a.app.Command("aws", "")
+	wrapAMI := awsCmd.Command("wrap-ami", "")
+	a.region = wrapAMI.Flag("region", "").Required().Envar(envAWSRegion).String()
+	a.subnet = wrapAMI.Flag("subnet-id", "").Envar(envAWSSubnet).String()
+	a.concurrency = wrapAMI.Flag("concurrency", "").Default("4").Int()
+	wrapAMI.Arg("ID", "").Required().String()
+	return a
+}
+
+// setTestEnv sets the env vars used by the test app, and returns a function
+// restoring them
+func setTestEnv(env map[string]string) func() {
+	saved := map[string]string{}
+	for _, name := range []string{envConfig, envProfile, envAWSRegion, envAWSSubnet, "XDG_CONFIG_HOME"} {
+		if v, ok := os.LookupEnv(name); ok {
+			saved[name] = v
+		}
+		os.Unsetenv(name)
+	}
+	for name, v := range env {
+		os.Setenv(name, v)
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+		for name, v := range saved {
+			os.Setenv(name, v)
+		}
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err = ioutil.WriteFile(path, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The default config file doesn't exist
+	noConfig := map[string]string{"XDG_CONFIG_HOME": dir + "/none"}
+
+	tests := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		region      string
+		subnet      string
+		concurrency int
+	}{
+		{"defaults", []string{"aws", "wrap-ami", "--region=us-west-2", "ami-1"}, noConfig, "us-west-2", "", 4},
+		{"profile", []string{"--config=" + path, "aws", "wrap-ami", "ami-1"}, nil, "us-east-1", "subnet-profile", 8},
+		{"profile from env", []string{"aws", "wrap-ami", "ami-1"}, map[string]string{envConfig: path, envProfile: "dev"}, "eu-west-1", "", 4},
+		{"profile flag", []string{"--config=" + path, "--profile=dev", "aws", "wrap-ami", "ami-1"}, map[string]string{envProfile: "prod"}, "eu-west-1", "", 4},
+		{"env", []string{"--config=" + path, "aws", "wrap-ami", "ami-1"}, map[string]string{envAWSRegion: "us-west-1"}, "us-west-1", "subnet-profile", 8},
+		{"flags", []string{"--config=" + path, "aws", "wrap-ami", "--region=ap-south-1", "--concurrency=2", "ami-1"}, map[string]string{envAWSRegion: "us-west-1", envAWSSubnet: "subnet-env"}, "ap-south-1", "subnet-env", 2},
+	}
+	for _, test := range tests {
+		restore := setTestEnv(test.env)
+		a := newTestApp()
+		if err := applyProfile(a.app, test.args); err != nil {
+			t.Errorf("%s: Got unexpected error when applying profile: %s", test.name, err)
+		} else if _, err := a.app.Parse(test.args); err != nil {
+			t.Errorf("%s: Got unexpected error when parsing: %s", test.name, err)
+		} else if *a.region != test.region || *a.subnet != test.subnet || *a.concurrency != test.concurrency {
+			t.Errorf("%s: Got region %q, subnet %q and concurrency %d, expected %q, %q and %d",
+				test.name, *a.region, *a.subnet, *a.concurrency, test.region, test.subnet, test.concurrency)
+		}
+		restore()
+	}
+}
+
+func TestApplyProfileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err = ioutil.WriteFile(path, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer setTestEnv(map[string]string{"XDG_CONFIG_HOME": dir + "/none"})()
+
+	// Without a profile, the required region has to be given
+	a := newTestApp()
+	args := []string{"aws", "wrap-ami", "ami-1"}
+	if err = applyProfile(a.app, args); err != nil {
+		t.Fatalf("Got unexpected error when applying profile: %s", err)
+	}
+	if _, err = a.app.Parse(args); err == nil {
+		t.Error("Expected error for missing required region")
+	}
+
+	for _, args := range [][]string{
+		{"--config=" + path, "--profile=staging", "aws", "wrap-ami", "ami-1"},
+		{"--config=" + filepath.Join(dir, "missing.yaml"), "aws", "wrap-ami", "ami-1"},
+		{"--profile=prod", "aws", "wrap-ami", "ami-1"},
+	} {
+		if err = applyProfile(newTestApp().app, args); err == nil {
+			t.Errorf("Expected error when applying profile with %v", args)
+		}
+	}
+}
+
+func TestFindFlag(t *testing.T) {
+	cmds := []*kingpin.CmdClause{awsCommand, awsWrapAMI}
+	if f := findFlag(app, cmds, "region"); f == nil || f != awsWrapAMI.GetFlag("region") {
+		t.Error("Expected the region flag of wrap-ami")
+	}
+	if f := findFlag(app, cmds, "iam"); f == nil || f != awsCommand.GetFlag("iam") {
+		t.Error("Expected the iam flag of the aws command")
+	}
+	if f := findFlag(app, cmds, "log-format"); f == nil || f != app.GetFlag("log-format") {
+		t.Error("Expected the log-format flag of the app")
+	}
+	for _, name := range []string{"config", "profile", "project"} {
+		if f := findFlag(app, cmds, name); f != nil {
+			t.Errorf("Expected no flag for %s, got --%s", name, f.Model().Name)
+		}
+	}
+}
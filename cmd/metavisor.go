@@ -18,14 +18,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/immutable/metavisor-cli/pkg/config"
+	"github.com/immutable/metavisor-cli/pkg/csp/gcp"
 	"github.com/immutable/metavisor-cli/pkg/logging"
 	"github.com/immutable/metavisor-cli/pkg/mv"
 	"github.com/immutable/metavisor-cli/pkg/mv/share"
 	"github.com/immutable/metavisor-cli/pkg/mv/wrap"
+	"github.com/immutable/metavisor-cli/pkg/output"
+	"github.com/immutable/metavisor-cli/pkg/token"
 
 	"gopkg.in/alecthomas/kingpin.v2"
 )
@@ -35,6 +42,8 @@ const (
 
 	// Env variable to always output things in JSON where applicable
 	envOutputJSON = "MV_OUTPUT_JSON"
+	// Env variable to set the format of the results of commands
+	envOutput = "MV_OUTPUT"
 	// Env variable to set default region to use for AWS commands
 	envAWSRegion = "MV_AWS_REGION"
 	// Env variable to set default subnet to use for launching instances
@@ -43,6 +52,18 @@ const (
 	envLaunchToken = "MV_LAUNCH_TOKEN"
 	// Env variable to set a custom service domain
 	envServiceDomain = "MV_SERVICE_DOMAIN"
+	// Env variable to set default project to use for GCP commands
+	envGCPProject = "MV_GCP_PROJECT"
+	// Env variable to set default zone to use for GCP commands
+	envGCPZone = "MV_GCP_ZONE"
+	// Env variable to set the path of the config file
+	envConfig = "MV_CONFIG"
+	// Env variable to set the profile to use from the config file
+	envProfile = "MV_PROFILE"
+	// Env variable to set the format of the logs
+	envLogFormat = "MV_LOG_FORMAT"
+	// Env variable to set where to write events
+	envEvents = "MV_EVENTS"
 
 	// DefaultShareLogsDir is where MV logs will be stored as default
 	DefaultShareLogsDir = "./"
@@ -60,34 +81,118 @@ var (
 	// AWS Wrap an instance
 	awsWrapInstance        = awsCommand.Command("wrap-instance", "Wrap a running instance with Metavisor")
 	awsWrapInstanceRegion  = awsWrapInstance.Flag("region", fmt.Sprintf("The AWS region to look for the instance in (overrides $%s)", envAWSRegion)).Envar(envAWSRegion).String()
-	awsWrapInstanceToken   = awsWrapInstance.Flag("token", fmt.Sprintf("Launch token used to identify the Metavisor (overrides $%s)", envLaunchToken)).Required().Envar(envLaunchToken).String() // TODO: Make non-required
+	awsWrapInstanceToken   = addTokenFlags(awsWrapInstance, "Launch token used to identify the Metavisor")
 	awsWrapInstanceVersion = awsWrapInstance.Flag("metavisor-version", "Which version of the MV to use").PlaceHolder("VERSION").String()
 	awsWrapInstanceAMI     = awsWrapInstance.Flag("metavisor-image", "AMI ID of MV to use, must be in correct region").Hidden().PlaceHolder("AMI-ID").String()
 	awsWrapInstanceDomain  = awsWrapInstance.Flag("service-domain", "Specify which Yeti to talk to").Hidden().PlaceHolder("DOMAIN").Envar(envServiceDomain).String()
-	awsWrapInstanceID      = awsWrapInstance.Arg("ID", "ID of the instance to wrap").Required().String()
+	awsWrapInstanceJournal = awsWrapInstance.Flag("journal", "Where to save the journal used to resume or roll back the operation").PlaceHolder("PATH").String()
+	awsWrapInstancePlan    = awsWrapInstance.Flag("plan", "Only show what would be done, without modifying anything").Bool()
+	awsWrapInstanceJSON    = awsWrapInstance.Flag("json", fmt.Sprintf("Output the plan or batch report as JSON (overrides $%s)", envOutputJSON)).Envar(envOutputJSON).Short('J').Bool()
+	awsWrapInstanceFilters = awsWrapInstance.Flag("filter", "Wrap all instances matching the filter, e.g. tag:Env=prod (can be repeated)").PlaceHolder("NAME=VALUE").Strings()
+	awsWrapInstanceFile    = awsWrapInstance.Flag("from-file", "File with IDs of instances to wrap, one per line").PlaceHolder("PATH").String()
+	awsWrapInstanceWorkers = awsWrapInstance.Flag("concurrency", "How many instances to wrap at the same time").Default(strconv.Itoa(wrap.DefaultConcurrency)).Int()
+	awsWrapInstanceOutput  = addOutputFlag(awsWrapInstance)
+	awsWrapInstanceIDs     = awsWrapInstance.Arg("ID", "IDs of the instances to wrap").Strings()
+
+	// AWS Unwrap an instance
+	awsUnwrapInstance             = awsCommand.Command("unwrap-instance", "Remove the Metavisor from a wrapped instance")
+	awsUnwrapInstanceRegion       = awsUnwrapInstance.Flag("region", fmt.Sprintf("The AWS region to look for the instance in (overrides $%s)", envAWSRegion)).Envar(envAWSRegion).String()
+	awsUnwrapInstanceUserdata     = awsUnwrapInstance.Flag("userdata-file", "File with userdata to restore on the instance (restores the userdata kept when wrapping if not specified)").PlaceHolder("PATH").String()
+	awsUnwrapInstanceDeleteVolume = awsUnwrapInstance.Flag("delete-metavisor-volume", "Delete the Metavisor volume after it has been detached").Bool()
+	awsUnwrapInstanceOutput       = addOutputFlag(awsUnwrapInstance)
+	awsUnwrapInstanceID           = awsUnwrapInstance.Arg("ID", "ID of the instance to unwrap").Required().String()
+
+	// AWS Upgrade the Metavisor of a wrapped instance
+	awsUpgradeInstance           = awsCommand.Command("upgrade-instance", "Upgrade the Metavisor of a wrapped instance to another version")
+	awsUpgradeInstanceRegion     = awsUpgradeInstance.Flag("region", fmt.Sprintf("The AWS region to look for the instance in (overrides $%s)", envAWSRegion)).Envar(envAWSRegion).String()
+	awsUpgradeInstanceVersion    = awsUpgradeInstance.Flag("metavisor-version", "Which version of the MV to upgrade to (latest if not specified)").PlaceHolder("VERSION").String()
+	awsUpgradeInstanceAMI        = awsUpgradeInstance.Flag("metavisor-image", "AMI ID of MV to use, must be in correct region").Hidden().PlaceHolder("AMI-ID").String()
+	awsUpgradeInstanceKeepVolume = awsUpgradeInstance.Flag("keep-metavisor-volume", "Keep the previous Metavisor volume after upgrading").Bool()
+	awsUpgradeInstanceOutput     = addOutputFlag(awsUpgradeInstance)
+	awsUpgradeInstanceID         = awsUpgradeInstance.Arg("ID", "ID of the instance to upgrade").Required().String()
+
+	// AWS Inspect an instance or image
+	awsInspect       = awsCommand.Command("inspect", "Show if an instance or AMI is wrapped with Metavisor, and with which version")
+	awsInspectRegion = awsInspect.Flag("region", fmt.Sprintf("The AWS region to look for the resource in, required for AMIs (overrides $%s)", envAWSRegion)).Envar(envAWSRegion).String()
+	awsInspectJSON   = awsInspect.Flag("json", fmt.Sprintf("Output the inspection as JSON (overrides $%s)", envOutputJSON)).Envar(envOutputJSON).Short('J').Bool()
+	awsInspectID     = awsInspect.Arg("ID", "ID of the instance or AMI to inspect").Required().String()
 
 	// AWS Wrap an image
 	awsWrapAMI        = awsCommand.Command("wrap-ami", "Wrap a regular AMI with Metavisor")
 	awsWrapAMIRegion  = awsWrapAMI.Flag("region", fmt.Sprintf("The AWS region to look for the AMI in (overrides $%s)", envAWSRegion)).Required().Envar(envAWSRegion).String()
-	awsWrapAMIToken   = awsWrapAMI.Flag("token", fmt.Sprintf("Launch token used to identify the Metavisor (overrides $%s)", envLaunchToken)).Required().Envar(envLaunchToken).String() // TODO: Make non-required
+	awsWrapAMIToken   = addTokenFlags(awsWrapAMI, "Launch token used to identify the Metavisor")
 	awsWrapAMIVersion = awsWrapAMI.Flag("metavisor-version", "Which version of the MV to use").PlaceHolder("VERSION").String()
 	awsWrapAMIAMI     = awsWrapAMI.Flag("metavisor-image", "AMI ID of MV to use, must be in correct region").Hidden().PlaceHolder("AMI-ID").String()
 	awsWrapAMIDomain  = awsWrapAMI.Flag("service-domain", "Specify which Yeti to talk to").Hidden().PlaceHolder("DOMAIN").Envar(envServiceDomain).String()
 	awsWrapAMISubnet  = awsWrapAMI.Flag("subnet-id", fmt.Sprintf("Use specified subnet when launching instances (overrides $%s)", envAWSSubnet)).PlaceHolder("ID").Envar(envAWSSubnet).String()
+	awsWrapAMIJournal = awsWrapAMI.Flag("journal", "Where to save the journal used to resume or roll back the operation").PlaceHolder("PATH").String()
+	awsWrapAMIPlan    = awsWrapAMI.Flag("plan", "Only show what would be done, without modifying anything").Bool()
+	awsWrapAMIJSON    = awsWrapAMI.Flag("json", fmt.Sprintf("Output the plan or the AMI ID of each region as JSON (overrides $%s)", envOutputJSON)).Envar(envOutputJSON).Short('J').Bool()
+	awsWrapAMICopyTo  = awsWrapAMI.Flag("copy-to-regions", "Copy the wrapped AMI to these regions (can be repeated or comma separated)").PlaceHolder("REGION").Strings()
+	awsWrapAMIShare   = awsWrapAMI.Flag("share-with-accounts", "Share the wrapped AMI and its copies with these account IDs, organization ARNs or OU ARNs (can be repeated or comma separated)").PlaceHolder("ACCOUNT").Strings()
+	awsWrapAMIName    = awsWrapAMI.Flag("name-template", "Go template for the name of the wrapped AMI, e.g. '{{.SourceName}}-mv-{{.MetavisorVersion}}'").PlaceHolder("TEMPLATE").String()
+	awsWrapAMIDesc    = awsWrapAMI.Flag("description-template", "Go template for the description of the wrapped AMI").PlaceHolder("TEMPLATE").String()
+	awsWrapAMITags    = awsWrapAMI.Flag("tag", "Extra tag to add to the wrapped AMI and its snapshots (can be repeated)").PlaceHolder("KEY=VALUE").StringMap()
+	awsWrapAMIOutput  = addOutputFlag(awsWrapAMI)
 	awsWrapAMIID      = awsWrapAMI.Arg("ID", "ID of the instance to wrap").Required().String()
 
+	// AWS Resume or roll back an interrupted wrap
+	awsResume        = awsCommand.Command("resume", "Resume an interrupted wrap-instance or wrap-ami operation")
+	awsResumeToken   = addTokenFlags(awsResume, "Launch token used to identify the Metavisor")
+	awsResumeOutput  = addOutputFlag(awsResume)
+	awsResumeJournal = awsResume.Arg("JOURNAL", "Path to the journal of the interrupted operation").Required().String()
+
+	awsRollback        = awsCommand.Command("rollback", "Undo an interrupted wrap-instance or wrap-ami operation")
+	awsRollbackOutput  = addOutputFlag(awsRollback)
+	awsRollbackJournal = awsRollback.Arg("JOURNAL", "Path to the journal of the interrupted operation").Required().String()
+
 	// AWS Share logs
 	awsShareLogs            = awsCommand.Command("share-logs", "Get the Metavisor logs from an instance or snapshot")
 	awsShareLogsRegion      = awsShareLogs.Flag("region", fmt.Sprintf("The AWS region to look for the resource in (overrides $%s)", envAWSRegion)).Required().Envar(envAWSRegion).String()
 	awsShareLogsOutPath     = awsShareLogs.Flag("output-path", "Path to store downloaded logs").Default(DefaultShareLogsDir).PlaceHolder("PATH").String()
 	awsShareLogsKeyName     = awsShareLogs.Flag("key-name", "Name of SSH key in AWS to use (attempts to create one if not specified)").PlaceHolder("NAME").String()
 	awsShareLogsKeyPath     = awsShareLogs.Flag("key-path", "Path to SSH private key to use (uses SSH agent if not specified)").PlaceHolder("PATH").String()
-	awsShareLogsBastionHost = awsShareLogs.Flag("bastion-host", "Host of bastion to tunnel through").PlaceHolder("HOST").Hidden().String() // TODO: Support bastion
-	awsShareLogsBastionUser = awsShareLogs.Flag("bastion-user", "Bastion username to tunnel through").PlaceHolder("NAME").Hidden().String()
-	awsShareLogsBastionKey  = awsShareLogs.Flag("bastion-key-path", "Key in bastion to use when tunneling").PlaceHolder("PATH").Hidden().String()
+	awsShareLogsBastionHost = awsShareLogs.Flag("bastion-host", "Bastion host to tunnel through as [user@]host[:port], repeat for multiple hops (launches without public IP)").PlaceHolder("HOST").Strings()
+	awsShareLogsBastionUser = awsShareLogs.Flag("bastion-user", "Username on bastion hosts that don't specify one").PlaceHolder("NAME").String()
+	awsShareLogsBastionKey  = awsShareLogs.Flag("bastion-key-path", "Path to SSH private key to use for bastion hosts (uses SSH agent if not specified)").PlaceHolder("PATH").String()
+	awsShareLogsTransport   = awsShareLogs.Flag("transport", "How to get the logs from the temporary instance, s3 and ssm need no key pair or public IP").Default(share.TransportSSH).Enum(share.TransportSSH, share.TransportS3, share.TransportSSM)
+	awsShareLogsBucket      = awsShareLogs.Flag("s3-bucket", "Bucket to upload logs to with the s3 transport, optional with ssm for faster downloads").PlaceHolder("NAME").String()
+	awsShareLogsProfile     = awsShareLogs.Flag("instance-profile", "Name or ARN of the IAM instance profile of the temporary instance, required with the ssm transport").PlaceHolder("NAME").String()
+	awsShareLogsNoRedact    = awsShareLogs.Flag("no-redact", "Keep tokens, private IPs and host names in the logs").Bool()
+	awsShareLogsRedact      = awsShareLogs.Flag("redact", "Regular expression of more secrets to redact from the logs (can be repeated)").PlaceHolder("REGEX").Strings()
 	awsShareLogsSubnet      = awsShareLogs.Flag("subnet-id", fmt.Sprintf("Use specified subnet when launching instances (overrides $%s)", envAWSSubnet)).PlaceHolder("ID").Envar(envAWSSubnet).String()
+	awsShareLogsOutput      = addOutputFlag(awsShareLogs)
 	awsShareLogsID          = awsShareLogs.Arg("ID", "ID of instance or snapshot to get logs from").Required().String()
 
+	// GCP commands
+	gcpCommand            = app.Command("gcp", "Perform operations related to GCP")
+	gcpCommandProject     = gcpCommand.Flag("project", fmt.Sprintf("The GCP project to perform operations in (overrides $%s)", envGCPProject)).Required().Envar(envGCPProject).String()
+	gcpCommandCredentials = gcpCommand.Flag("credentials", "Path to a service account key to use (overrides $GOOGLE_APPLICATION_CREDENTIALS)").PlaceHolder("PATH").String()
+
+	// GCP Wrap an instance
+	gcpWrapInstance        = gcpCommand.Command("wrap-instance", "Wrap a running instance with Metavisor")
+	gcpWrapInstanceZone    = gcpWrapInstance.Flag("zone", fmt.Sprintf("The GCP zone to look for the instance in (overrides $%s)", envGCPZone)).Required().Envar(envGCPZone).String()
+	gcpWrapInstanceToken   = addTokenFlags(gcpWrapInstance, "Launch token used to identify the Metavisor")
+	gcpWrapInstanceVersion = gcpWrapInstance.Flag("metavisor-version", "Which version of the MV the image contains, used for labels").PlaceHolder("VERSION").String()
+	gcpWrapInstanceImage   = gcpWrapInstance.Flag("metavisor-image", "Image of MV to use, e.g. projects/PROJECT/global/images/NAME").Required().PlaceHolder("IMAGE").String()
+	gcpWrapInstanceDomain  = gcpWrapInstance.Flag("service-domain", "Specify which Yeti to talk to").Hidden().PlaceHolder("DOMAIN").Envar(envServiceDomain).String()
+	gcpWrapInstanceOutput  = addOutputFlag(gcpWrapInstance)
+	gcpWrapInstanceID      = gcpWrapInstance.Arg("NAME", "Name of the instance to wrap").Required().String()
+
+	// GCP Wrap an image
+	gcpWrapImage           = gcpCommand.Command("wrap-image", "Wrap a regular image with Metavisor, creating a machine image")
+	gcpWrapImageZone       = gcpWrapImage.Flag("zone", fmt.Sprintf("The GCP zone to launch temporary instances in (overrides $%s)", envGCPZone)).Required().Envar(envGCPZone).String()
+	gcpWrapImageToken      = addTokenFlags(gcpWrapImage, "Launch token used to identify the Metavisor")
+	gcpWrapImageVersion    = gcpWrapImage.Flag("metavisor-version", "Which version of the MV the image contains, used for labels and names").PlaceHolder("VERSION").String()
+	gcpWrapImageImage      = gcpWrapImage.Flag("metavisor-image", "Image of MV to use, e.g. projects/PROJECT/global/images/NAME").Required().PlaceHolder("IMAGE").String()
+	gcpWrapImageDomain     = gcpWrapImage.Flag("service-domain", "Specify which Yeti to talk to").Hidden().PlaceHolder("DOMAIN").Envar(envServiceDomain).String()
+	gcpWrapImageSubnetwork = gcpWrapImage.Flag("subnetwork", "Use specified subnetwork when launching instances").PlaceHolder("SUBNETWORK").String()
+	gcpWrapImageName       = gcpWrapImage.Flag("name-template", "Go template for the name of the wrapped image, e.g. '{{.SourceName}}-mv-{{.MetavisorVersion}}'").PlaceHolder("TEMPLATE").String()
+	gcpWrapImageDesc       = gcpWrapImage.Flag("description-template", "Go template for the description of the wrapped image").PlaceHolder("TEMPLATE").String()
+	gcpWrapImageTags       = gcpWrapImage.Flag("tag", "Extra label to add to the wrapped image (can be repeated)").PlaceHolder("KEY=VALUE").StringMap()
+	gcpWrapImageOutput     = addOutputFlag(gcpWrapImage)
+	gcpWrapImageID         = gcpWrapImage.Arg("IMAGE", "Name or path of the image to wrap").Required().String()
+
 	// Generic commands
 	versionCommand  = app.Command("version", "Get version information about the CLI and the Metavisor")
 	versionWithJSON = versionCommand.Flag("json", fmt.Sprintf("Output information as JSON (overrides $%s)", envOutputJSON)).Envar(envOutputJSON).Short('J').Bool()
@@ -95,8 +200,60 @@ var (
 	listCommand  = app.Command("list", "List all available versions of the Metavisor")
 	listWithJSON = listCommand.Flag("json", fmt.Sprintf("Output information as JSON (overrides $%s)", envOutputJSON)).Envar(envOutputJSON).Short('J').Bool()
 
-	logVerbose = app.Flag("verbose", "Set logging level to Debug").Short('v').Bool()
-	logOutput  = app.Flag("log-output", "Set where to save log file").PlaceHolder("PATH").String()
+	logsCommand       = app.Command("logs", "Work with Metavisor logs downloaded with share-logs")
+	logsAnalyze       = logsCommand.Command("analyze", "Summarise boots, connectivity and token errors, and crash dumps in a log bundle")
+	logsAnalyzeJSON   = logsAnalyze.Flag("json", fmt.Sprintf("Output the findings as JSON (overrides $%s)", envOutputJSON)).Envar(envOutputJSON).Short('J').Bool()
+	logsAnalyzeBundle = logsAnalyze.Arg("BUNDLE", "Path to the log bundle").Default(share.DefaultLogArchiveName).String()
+
+	userdataCommand        = app.Command("userdata", "Generate and inspect the userdata of wrapped instances")
+	userdataGenerate       = userdataCommand.Command("generate", "Print the userdata wrapping sets, for launching wrapped images with other tools")
+	userdataGenerateToken  = addTokenFlags(userdataGenerate, "Launch token used to identify the Metavisor")
+	userdataGenerateDomain = userdataGenerate.Flag("service-domain", "Specify which Yeti to talk to").PlaceHolder("DOMAIN").Envar(envServiceDomain).String()
+	userdataGenerateGzip   = userdataGenerate.Flag("gzip", "Compress the userdata with gzip").Bool()
+	userdataGenerateBase64 = userdataGenerate.Flag("base64", "Encode the userdata with base64").Bool()
+	userdataInspect        = userdataCommand.Command("inspect", "Show the parts and Metavisor config of userdata, with the launch token masked")
+	userdataInspectRegion  = userdataInspect.Flag("region", fmt.Sprintf("The AWS region to look for the instance in (overrides $%s)", envAWSRegion)).Envar(envAWSRegion).String()
+	userdataInspectIAM     = userdataInspect.Flag("iam", "Role ARN to assume when getting the userdata of an instance").PlaceHolder("ARN").String()
+	userdataInspectJSON    = userdataInspect.Flag("json", fmt.Sprintf("Output the inspection as JSON (overrides $%s)", envOutputJSON)).Envar(envOutputJSON).Short('J').Bool()
+	userdataInspectSource  = userdataInspect.Arg("SOURCE", "Path to a userdata file, or ID of an instance").Required().String()
+
+	tokenCommand       = app.Command("token", "Work with launch tokens")
+	tokenInspect       = tokenCommand.Command("inspect", "Show the claims of a launch token, and check if it can be used")
+	tokenInspectToken  = addTokenFlags(tokenInspect, "Launch token to inspect")
+	tokenInspectDomain = tokenInspect.Flag("service-domain", "Check the issuer and audience of the token against this domain").PlaceHolder("DOMAIN").Envar(envServiceDomain).Default(wrap.ProdDomain).String()
+	tokenInspectJWKS   = tokenInspect.Flag("jwks", "Verify the signature of the token with the keys in this JWKS file").PlaceHolder("PATH").String()
+	tokenInspectJSON   = tokenInspect.Flag("json", fmt.Sprintf("Output the inspection as JSON (overrides $%s)", envOutputJSON)).Envar(envOutputJSON).Short('J').Bool()
+
+	configCommand      = app.Command("config", "Manage the profiles in the config file")
+	configGet          = configCommand.Command("get", "Print a setting of the selected or default profile")
+	configGetKey       = configGet.Arg("KEY", fmt.Sprintf("Name of the flag, or %s", config.DefaultProfileKey)).Required().String()
+	configSet          = configCommand.Command("set", "Change a setting of the selected or default profile, creating the profile if needed")
+	configSetKey       = configSet.Arg("KEY", fmt.Sprintf("Name of the flag, or %s", config.DefaultProfileKey)).Required().String()
+	configSetValue     = configSet.Arg("VALUE", "Value of the setting, an empty value removes it").Required().String()
+	configList         = configCommand.Command("list", "List the profiles and their settings, with launch tokens masked")
+	configListJSON     = configList.Flag("json", fmt.Sprintf("Output the profiles as JSON (overrides $%s)", envOutputJSON)).Envar(envOutputJSON).Short('J').Bool()
+	configValidate     = configCommand.Command("validate", "Check the config file for unknown settings and invalid values")
+	configValidateJSON = configValidate.Flag("json", fmt.Sprintf("Output the problems as JSON (overrides $%s)", envOutputJSON)).Envar(envOutputJSON).Short('J').Bool()
+
+	configPath    = app.Flag("config", fmt.Sprintf("Path to the config file, %s if not specified (overrides $%s)", config.DefaultPath(), envConfig)).PlaceHolder("PATH").Envar(envConfig).String()
+	configProfile = app.Flag("profile", fmt.Sprintf("Profile in the config file to use, its settings are used for flags and env vars that are not set (overrides $%s)", envProfile)).PlaceHolder("NAME").Envar(envProfile).String()
+	logVerbose    = app.Flag("verbose", "Set logging level to Debug").Short('v').Bool()
+	logOutput     = app.Flag("log-output", "Set where to save log file").PlaceHolder("PATH").String()
+	logFormat     = app.Flag("log-format", fmt.Sprintf("Format of the logs shown in console, text or json (overrides $%s)", envLogFormat)).Default(logging.FormatText).Envar(envLogFormat).Enum(logging.FormatText, logging.FormatJSON)
+	logEvents     = app.Flag("events", fmt.Sprintf("Write events as JSON lines to a file, or to an open file descriptor with fd:N (overrides $%s)", envEvents)).PlaceHolder("PATH").Envar(envEvents).String()
+
+	// ErrBatchFailed is returned if not all instances of a batch could be wrapped
+	ErrBatchFailed = errors.New("some of the instances could not be wrapped")
+
+	// ErrTokenSources is returned if the launch token is read from more than one source
+	ErrTokenSources = errors.New("only one of --token-file, --token-stdin, --token-secret, --token-ssm-parameter and --token-keyring can be specified")
+
+	// ErrNoToken is returned if a command needs a launch token, but none was specified
+	ErrNoToken = errors.New("a launch token must be specified with --token or one of the --token-* flags")
+
+	// ErrOutputNotSupported is returned if --output is used with a plan or a
+	// batch, which only support --json
+	ErrOutputNotSupported = errors.New("plans and batches can only be shown as JSON, with --json or --output=json")
 
 	// ErrGeneric is returned when we can't figure out what error happened, but we don't want to show the actual error
 	// to the user
@@ -108,6 +265,11 @@ func main() {
 	logging.LogLevel = logging.LevelInfo
 	logging.LogFileNamePrefix = "metavisor-cli-log"
 	logging.LogToFile = true
+	if err := applyProfile(app, os.Args[1:]); err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+		return
+	}
 	command, err := app.Parse(os.Args[1:])
 	if err != nil {
 		app.Usage(os.Args[1:])
@@ -121,6 +283,13 @@ func main() {
 	if *logOutput != "" {
 		logging.LogFilePath = *logOutput
 	}
+	logging.LogFormat = *logFormat
+	if *logEvents != "" {
+		if err = logging.OpenEvents(*logEvents); err != nil {
+			logging.Fatal(err)
+			return
+		}
+	}
 
 	ctx := context.Background()
 	switch command {
@@ -130,15 +299,60 @@ func main() {
 	case listCommand.FullCommand():
 		runWithInterrupt(ctx, listMetavisors)
 		break
+	case logsAnalyze.FullCommand():
+		runWithInterrupt(ctx, analyzeLogs)
+		break
+	case userdataGenerate.FullCommand():
+		runWithInterrupt(ctx, generateUserdata)
+		break
+	case userdataInspect.FullCommand():
+		runWithInterrupt(ctx, inspectUserdata)
+		break
+	case tokenInspect.FullCommand():
+		runWithInterrupt(ctx, inspectToken)
+		break
+	case configGet.FullCommand():
+		runWithInterrupt(ctx, getConfig)
+		break
+	case configSet.FullCommand():
+		runWithInterrupt(ctx, setConfig)
+		break
+	case configList.FullCommand():
+		runWithInterrupt(ctx, listConfig)
+		break
+	case configValidate.FullCommand():
+		runWithInterrupt(ctx, validateConfig)
+		break
 	case awsWrapInstance.FullCommand():
 		runWithInterrupt(ctx, wrapInstance)
 		break
+	case awsUnwrapInstance.FullCommand():
+		runWithInterrupt(ctx, unwrapInstance)
+		break
+	case awsUpgradeInstance.FullCommand():
+		runWithInterrupt(ctx, upgradeInstance)
+		break
+	case awsInspect.FullCommand():
+		runWithInterrupt(ctx, inspectResource)
+		break
 	case awsWrapAMI.FullCommand():
 		runWithInterrupt(ctx, wrapAMI)
 		break
+	case awsResume.FullCommand():
+		runWithInterrupt(ctx, resumeWrap)
+		break
+	case awsRollback.FullCommand():
+		runWithInterrupt(ctx, rollbackWrap)
+		break
 	case awsShareLogs.FullCommand():
 		runWithInterrupt(ctx, shareLogs)
 		break
+	case gcpWrapInstance.FullCommand():
+		runWithInterrupt(ctx, wrapGCPInstance)
+		break
+	case gcpWrapImage.FullCommand():
+		runWithInterrupt(ctx, wrapGCPImage)
+		break
 	}
 }
 
@@ -147,7 +361,7 @@ func showVersion(ctx context.Context) {
 	versionInfo, err := mv.GetInfo(ctx)
 	if err != nil {
 		// Could not fetch MV version. Log to debug and still show CLI version
-		logging.Debug("Error while getting version information: %s", err)
+		logging.Debugf("Error while getting version information: %s", err)
 		logging.Debug("Could not determine latest MV version, only showing CLI version")
 		exit = 1
 	}
@@ -180,17 +394,114 @@ func listMetavisors(ctx context.Context) {
 	fmt.Println(output)
 }
 
+func analyzeLogs(ctx context.Context) {
+	analysis, err := share.AnalyzeLogs(*logsAnalyzeBundle)
+	if err != nil {
+		// Could not read the bundle, show error
+		logging.Fatal(err)
+		return
+	}
+	output, err := share.FormatAnalysis(analysis, *logsAnalyzeJSON)
+	if err != nil {
+		// Could not marshal analysis to JSON
+		logging.Debugf("Got error while formatting log analysis: %s", err)
+		logging.Fatal(ErrGeneric)
+		return
+	}
+	fmt.Println(output)
+}
+
+func generateUserdata(ctx context.Context) {
+	launchToken, err := userdataGenerateToken.resolve(ctx)
+	if err != nil {
+		logging.Fatal(err)
+		return
+	}
+	data, err := wrap.GenerateUserdata(launchToken, *userdataGenerateDomain, *userdataGenerateGzip, *userdataGenerateBase64)
+	if err != nil {
+		// Could not generate userdata, show error
+		logging.Fatal(err)
+		return
+	}
+	// The userdata has the launch token, so it's not written to the log file
+	if *userdataGenerateBase64 {
+		data += "\n"
+	}
+	if _, err = os.Stdout.WriteString(data); err != nil {
+		logging.Debugf("Got error while writing userdata: %s", err)
+		logging.Fatal(ErrGeneric)
+	}
+}
+
+func inspectUserdata(ctx context.Context) {
+	conf := wrap.Config{
+		IAMRoleARN: *userdataInspectIAM,
+	}
+	inspection, err := wrap.InspectUserdata(ctx, *userdataInspectRegion, *userdataInspectSource, conf)
+	if err != nil {
+		// Could not inspect userdata, show error
+		logging.Fatal(err)
+		return
+	}
+	output, err := wrap.FormatUserdataInspection(inspection, *userdataInspectJSON)
+	if err != nil {
+		// Could not marshal inspection to JSON
+		logging.Debugf("Got error while formatting userdata inspection: %s", err)
+		logging.Fatal(ErrGeneric)
+		return
+	}
+	fmt.Println(output)
+}
+
+func inspectToken(ctx context.Context) {
+	opts := token.Options{
+		ServiceDomain: *tokenInspectDomain,
+	}
+	if *tokenInspectJWKS != "" {
+		ks, err := token.LoadKeySet(*tokenInspectJWKS)
+		if err != nil {
+			// Could not load key set, show error
+			logging.Fatal(err)
+			return
+		}
+		opts.KeySet = ks
+	}
+	launchToken, err := tokenInspectToken.resolve(ctx)
+	if err != nil {
+		logging.Fatal(err)
+		return
+	}
+	inspection, err := token.Inspect(launchToken, opts)
+	if inspection == nil {
+		// Token is not a JWT, show error
+		logging.Fatal(err)
+		return
+	}
+	output, ferr := token.FormatInspection(inspection, *tokenInspectJSON)
+	if ferr != nil {
+		// Could not marshal inspection to JSON
+		logging.Debugf("Got error while formatting token inspection: %s", ferr)
+		logging.Fatal(ErrGeneric)
+		return
+	}
+	fmt.Println(output)
+	if err != nil {
+		// The token can't be used, exit with an error
+		logging.Fatal(err)
+	}
+}
+
 func runWithInterrupt(ctx context.Context, f func(ctx context.Context)) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	interrupt := make(chan os.Signal)
+	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 	done := make(chan struct{})
 
 	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		f(ctx)
 		done <- struct{}{}
 	}()
@@ -212,43 +523,449 @@ func runWithInterrupt(ctx context.Context, f func(ctx context.Context)) {
 
 func wrapInstance(ctx context.Context) {
 	conf := wrap.Config{
-		Token:            *awsWrapInstanceToken,
 		MetavisorVersion: *awsWrapInstanceVersion,
 		MetavisorAMI:     *awsWrapInstanceAMI,
 		ServiceDomain:    *awsWrapInstanceDomain,
 		IAMRoleARN:       *awsCommandIAM,
 		IAMDeviceARN:     *awsCommandIAMMFA,
 		IAMCode:          *awsCommandIAMCode,
+		JournalPath:      *awsWrapInstanceJournal,
 	}
-	inst, err := wrap.Instance(ctx, *awsWrapInstanceRegion, *awsWrapInstanceID, conf)
+	if err := awsWrapInstanceToken.apply(&conf); err != nil {
+		logging.Fatal(err)
+		return
+	}
+	ids, err := instancesToWrap(ctx, conf)
+	if err != nil {
+		logging.Fatal(err)
+		return
+	}
+	batch := len(ids) > 1 || len(*awsWrapInstanceFilters) > 0 || *awsWrapInstanceFile != ""
+	if batch || *awsWrapInstancePlan {
+		withJSON, err := jsonOutput(*awsWrapInstanceJSON, *awsWrapInstanceOutput)
+		if err != nil {
+			logging.Fatal(err)
+			return
+		}
+		if batch {
+			wrapInstances(ctx, ids, conf, withJSON)
+			return
+		}
+		plan, err := wrap.PlanInstance(ctx, *awsWrapInstanceRegion, ids[0], conf)
+		showPlan(plan, err, withJSON)
+		return
+	}
+	inst, err := wrap.Instance(ctx, nil, *awsWrapInstanceRegion, ids[0], conf)
 	if err != nil {
 		// Could not wrap instance, show error
 		logging.Fatal(err)
 		return
 	}
+	if *awsWrapInstanceOutput != "" {
+		showResult(inst, *awsWrapInstanceOutput)
+		return
+	}
 	logging.Info("Successfully wrapped instance:")
-	logging.Output(inst)
+	logging.Output(inst.InstanceID)
+}
+
+func wrapInstances(ctx context.Context, ids []string, conf wrap.Config, withJSON bool) {
+	if *awsWrapInstancePlan {
+		logging.Fatal("A plan can only be shown for a single instance")
+		return
+	}
+	results := wrap.Instances(ctx, *awsWrapInstanceRegion, ids, conf, *awsWrapInstanceWorkers)
+	output, err := wrap.FormatBatchResults(results, withJSON)
+	if err != nil {
+		// Could not marshal results to JSON
+		logging.Debugf("Got error while formatting batch results: %s", err)
+		logging.Fatal(ErrGeneric)
+		return
+	}
+	fmt.Println(output)
+	if !wrap.BatchSucceeded(results) {
+		logging.Fatal(ErrBatchFailed)
+	}
+}
+
+// Collect the instances to wrap from the arguments, the ID file and the filters,
+// skipping any duplicates
+func instancesToWrap(ctx context.Context, conf wrap.Config) ([]string, error) {
+	ids := append([]string{}, *awsWrapInstanceIDs...)
+	if *awsWrapInstanceFile != "" {
+		data, err := ioutil.ReadFile(*awsWrapInstanceFile)
+		if err != nil {
+			logging.Debugf("Got error while reading instance file: %s", err)
+			logging.Error("Could not read the specified instance file")
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			ids = append(ids, line)
+		}
+	}
+	if len(*awsWrapInstanceFilters) > 0 {
+		found, err := wrap.FindInstances(ctx, *awsWrapInstanceRegion, *awsWrapInstanceFilters, conf)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, found...)
+	}
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, wrap.ErrNoInstances
+	}
+	return unique, nil
+}
+
+func unwrapInstance(ctx context.Context) {
+	conf := wrap.UnwrapConfig{
+		DeleteMetavisorVolume: *awsUnwrapInstanceDeleteVolume,
+		IAMRoleARN:            *awsCommandIAM,
+		IAMDeviceARN:          *awsCommandIAMMFA,
+		IAMCode:               *awsCommandIAMCode,
+	}
+	if *awsUnwrapInstanceUserdata != "" {
+		data, err := ioutil.ReadFile(*awsUnwrapInstanceUserdata)
+		if err != nil {
+			logging.Debugf("Got error while reading userdata file: %s", err)
+			logging.Fatal("Could not read the specified userdata file")
+			return
+		}
+		conf.Userdata = string(data)
+	}
+	res, err := wrap.Unwrap(ctx, *awsUnwrapInstanceRegion, *awsUnwrapInstanceID, conf)
+	if err != nil {
+		// Could not unwrap instance, show error
+		logging.Fatal(err)
+		return
+	}
+	if *awsUnwrapInstanceOutput != "" {
+		showResult(res, *awsUnwrapInstanceOutput)
+		return
+	}
+	logging.Info("Successfully unwrapped instance:")
+	logging.Output(res.InstanceID)
+}
+
+func upgradeInstance(ctx context.Context) {
+	conf := wrap.UpgradeConfig{
+		MetavisorVersion:    *awsUpgradeInstanceVersion,
+		MetavisorAMI:        *awsUpgradeInstanceAMI,
+		KeepMetavisorVolume: *awsUpgradeInstanceKeepVolume,
+		IAMRoleARN:          *awsCommandIAM,
+		IAMDeviceARN:        *awsCommandIAMMFA,
+		IAMCode:             *awsCommandIAMCode,
+	}
+	res, err := wrap.Upgrade(ctx, nil, *awsUpgradeInstanceRegion, *awsUpgradeInstanceID, conf)
+	if err != nil {
+		// Could not upgrade instance, show error
+		logging.Fatal(err)
+		return
+	}
+	if *awsUpgradeInstanceOutput != "" {
+		showResult(res, *awsUpgradeInstanceOutput)
+		return
+	}
+	logging.Info("Successfully upgraded instance:")
+	logging.Output(res.InstanceID)
+}
+
+func inspectResource(ctx context.Context) {
+	conf := wrap.Config{
+		IAMRoleARN:   *awsCommandIAM,
+		IAMDeviceARN: *awsCommandIAMMFA,
+		IAMCode:      *awsCommandIAMCode,
+	}
+	inspection, err := wrap.Inspect(ctx, *awsInspectRegion, *awsInspectID, conf)
+	if err != nil {
+		// Could not inspect resource, show error
+		logging.Fatal(err)
+		return
+	}
+	output, err := wrap.FormatInspection(inspection, *awsInspectJSON)
+	if err != nil {
+		// Could not marshal inspection to JSON
+		logging.Debugf("Got error while formatting inspection: %s", err)
+		logging.Fatal(ErrGeneric)
+		return
+	}
+	fmt.Println(output)
 }
 
 func wrapAMI(ctx context.Context) {
 	conf := wrap.Config{
-		Token:            *awsWrapAMIToken,
-		MetavisorVersion: *awsWrapAMIVersion,
-		MetavisorAMI:     *awsWrapAMIAMI,
-		ServiceDomain:    *awsWrapAMIDomain,
-		SubnetID:         *awsWrapAMISubnet,
-		IAMRoleARN:       *awsCommandIAM,
-		IAMDeviceARN:     *awsCommandIAMMFA,
-		IAMCode:          *awsCommandIAMCode,
+		MetavisorVersion:    *awsWrapAMIVersion,
+		MetavisorAMI:        *awsWrapAMIAMI,
+		ServiceDomain:       *awsWrapAMIDomain,
+		SubnetID:            *awsWrapAMISubnet,
+		NameTemplate:        *awsWrapAMIName,
+		DescriptionTemplate: *awsWrapAMIDesc,
+		Tags:                *awsWrapAMITags,
+		IAMRoleARN:          *awsCommandIAM,
+		IAMDeviceARN:        *awsCommandIAMMFA,
+		IAMCode:             *awsCommandIAMCode,
+		JournalPath:         *awsWrapAMIJournal,
 	}
-	ami, err := wrap.Image(ctx, *awsWrapAMIRegion, *awsWrapAMIID, conf)
+	if err := awsWrapAMIToken.apply(&conf); err != nil {
+		logging.Fatal(err)
+		return
+	}
+	distConf := wrap.DistributeConfig{
+		CopyToRegions: splitList(*awsWrapAMICopyTo),
+		ShareWith:     splitList(*awsWrapAMIShare),
+		IAMRoleARN:    *awsCommandIAM,
+		IAMDeviceARN:  *awsCommandIAMMFA,
+		IAMCode:       *awsCommandIAMCode,
+	}
+	if err := wrap.VerifyDistribution(distConf); err != nil {
+		logging.Fatal(err)
+		return
+	}
+	if *awsWrapAMIPlan {
+		withJSON, err := jsonOutput(*awsWrapAMIJSON, *awsWrapAMIOutput)
+		if err != nil {
+			logging.Fatal(err)
+			return
+		}
+		plan, err := wrap.PlanImage(ctx, *awsWrapAMIRegion, *awsWrapAMIID, conf, distConf)
+		showPlan(plan, err, withJSON)
+		return
+	}
+	res, err := wrap.Image(ctx, nil, *awsWrapAMIRegion, *awsWrapAMIID, conf)
 	if err != nil {
 		// Could not wrap image, show error
 		logging.Fatal(err)
 		return
 	}
+	ami := res.ImageID
+	if distConf.Empty() && *awsWrapAMIOutput == "" && !*awsWrapAMIJSON {
+		logging.Info("Successfully wrapped image:")
+		logging.Output(ami)
+		return
+	}
+	images := map[string]string{*awsWrapAMIRegion: ami}
+	var distErr error
+	if !distConf.Empty() {
+		images, distErr = wrap.Distribute(ctx, *awsWrapAMIRegion, ami, distConf)
+		if images == nil {
+			logging.Errorf("Successfully wrapped image %s, but could not copy or share it", ami)
+			logging.Fatal(distErr)
+			return
+		}
+	}
+	if *awsWrapAMIOutput != "" {
+		for region, id := range images {
+			if region != res.Region {
+				if res.Copies == nil {
+					res.Copies = map[string]string{}
+				}
+				res.Copies[region] = id
+			}
+		}
+		showResult(res, *awsWrapAMIOutput)
+		if distErr != nil {
+			logging.Fatal(distErr)
+		}
+		return
+	}
+	output, err := wrap.FormatImages(images, *awsWrapAMIJSON)
+	if err != nil {
+		// Could not marshal images to JSON
+		logging.Debugf("Got error while formatting images: %s", err)
+		logging.Fatal(ErrGeneric)
+		return
+	}
 	logging.Info("Successfully wrapped image:")
-	logging.Output(ami)
+	fmt.Println(output)
+	if distErr != nil {
+		logging.Fatal(distErr)
+	}
+}
+
+// splitList splits all comma separated values, so that flags can be given
+// either repeated or as comma separated lists
+func splitList(values []string) []string {
+	res := []string{}
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				res = append(res, part)
+			}
+		}
+	}
+	return res
+}
+
+// tokenFlags are the flags for where to get the launch token from
+type tokenFlags struct {
+	token     *string
+	file      *string
+	stdin     *bool
+	secret    *string
+	parameter *string
+	keyring   *string
+}
+
+func addTokenFlags(cmd *kingpin.CmdClause, help string) *tokenFlags {
+	return &tokenFlags{
+		token:     cmd.Flag("token", fmt.Sprintf("%s (overrides $%s)", help, envLaunchToken)).Envar(envLaunchToken).String(),
+		file:      cmd.Flag("token-file", "Read the launch token from a file").PlaceHolder("PATH").String(),
+		stdin:     cmd.Flag("token-stdin", "Read the launch token from stdin").Bool(),
+		secret:    cmd.Flag("token-secret", "Get the launch token from a secret in AWS Secrets Manager").PlaceHolder("ARN").String(),
+		parameter: cmd.Flag("token-ssm-parameter", "Get the launch token from a parameter in the SSM Parameter Store").PlaceHolder("NAME").String(),
+		keyring:   cmd.Flag("token-keyring", fmt.Sprintf("Get the launch token with this name from the OS keyring, stored under the service %s", wrap.KeyringService)).PlaceHolder("NAME").String(),
+	}
+}
+
+// apply sets the token source of the config if one of the --token-* flags
+// is specified, they take precedence over --token and $MV_LAUNCH_TOKEN
+func (f *tokenFlags) apply(conf *wrap.Config) error {
+	sources := []wrap.TokenSource{}
+	if *f.file != "" {
+		sources = append(sources, wrap.TokenFile(*f.file))
+	}
+	if *f.stdin {
+		sources = append(sources, wrap.TokenReader("stdin", os.Stdin))
+	}
+	if *f.secret != "" {
+		sources = append(sources, wrap.TokenSecret(*f.secret))
+	}
+	if *f.parameter != "" {
+		sources = append(sources, wrap.TokenParameter(*f.parameter))
+	}
+	if *f.keyring != "" {
+		sources = append(sources, wrap.TokenKeyring(*f.keyring))
+	}
+	switch len(sources) {
+	case 0:
+		conf.Token = *f.token
+	case 1:
+		conf.TokenSource = sources[0]
+	default:
+		return ErrTokenSources
+	}
+	return nil
+}
+
+// resolve returns the launch token for commands that don't wrap, which
+// must have one
+func (f *tokenFlags) resolve(ctx context.Context) (string, error) {
+	conf := wrap.Config{}
+	if err := f.apply(&conf); err != nil {
+		return "", err
+	}
+	t, err := wrap.ResolveToken(ctx, "", conf)
+	if err != nil {
+		return "", err
+	}
+	if t == "" {
+		return "", ErrNoToken
+	}
+	return t, nil
+}
+
+func showPlan(plan *wrap.Plan, err error, withJSON bool) {
+	if err != nil {
+		// Could not create plan, show error
+		logging.Fatal(err)
+		return
+	}
+	output, err := wrap.FormatPlan(plan, withJSON)
+	if err != nil {
+		// Could not marshal plan to JSON
+		logging.Debugf("Got error while formatting plan: %s", err)
+		logging.Fatal(ErrGeneric)
+		return
+	}
+	fmt.Println(output)
+	if !plan.Permitted() {
+		logging.Fatal(wrap.ErrPlanNotPermitted)
+	}
+}
+
+// addOutputFlag adds the --output flag, which shows the typed result of a
+// command instead of only the ID of the created resource
+func addOutputFlag(cmd *kingpin.CmdClause) *string {
+	return cmd.Flag("output", fmt.Sprintf("Output the whole result as json, yaml or table, instead of only the ID or path. Plans and batches only support json (overrides $%s)", envOutput)).PlaceHolder("FORMAT").Envar(envOutput).Enum(output.FormatJSON, output.FormatYAML, output.FormatTable)
+}
+
+// jsonOutput returns if plans and batches should be shown as JSON, which is
+// the only format other than text they support. Table and YAML are rejected
+// alike, instead of falling back to text.
+func jsonOutput(withJSON bool, format string) (bool, error) {
+	switch format {
+	case "":
+		return withJSON, nil
+	case output.FormatJSON:
+		return true, nil
+	}
+	return false, ErrOutputNotSupported
+}
+
+func showResult(r output.Result, format string) {
+	out, err := output.Format(r, format)
+	if err != nil {
+		// Could not marshal result
+		logging.Debugf("Got error while formatting result: %s", err)
+		logging.Fatal(ErrGeneric)
+		return
+	}
+	logging.Output(out)
+}
+
+func resumeWrap(ctx context.Context) {
+	conf := wrap.Config{
+		IAMRoleARN:   *awsCommandIAM,
+		IAMDeviceARN: *awsCommandIAMMFA,
+		IAMCode:      *awsCommandIAMCode,
+	}
+	if err := awsResumeToken.apply(&conf); err != nil {
+		logging.Fatal(err)
+		return
+	}
+	res, err := wrap.Resume(ctx, *awsResumeJournal, conf)
+	if err != nil {
+		// Could not resume operation, show error
+		logging.Fatal(err)
+		return
+	}
+	if *awsResumeOutput != "" {
+		showResult(res, *awsResumeOutput)
+		return
+	}
+	logging.Info("Successfully resumed operation:")
+	logging.Output(res.ID())
+}
+
+func rollbackWrap(ctx context.Context) {
+	conf := wrap.Config{
+		IAMRoleARN:   *awsCommandIAM,
+		IAMDeviceARN: *awsCommandIAMMFA,
+		IAMCode:      *awsCommandIAMCode,
+	}
+	res, err := wrap.Rollback(ctx, *awsRollbackJournal, conf)
+	if err != nil {
+		// Could not roll back operation, show error
+		logging.Fatal(err)
+		return
+	}
+	if *awsRollbackOutput != "" {
+		showResult(res, *awsRollbackOutput)
+		return
+	}
+	logging.Info("Successfully rolled back operation:")
+	logging.Output(res.ResourceID)
 }
 
 func shareLogs(ctx context.Context) {
@@ -256,20 +973,91 @@ func shareLogs(ctx context.Context) {
 		LogsPath:              *awsShareLogsOutPath,
 		AWSKeyName:            *awsShareLogsKeyName,
 		PrivateKeyPath:        *awsShareLogsKeyPath,
-		BastionHost:           *awsShareLogsBastionHost,
+		BastionHosts:          *awsShareLogsBastionHost,
 		BastionUsername:       *awsShareLogsBastionUser,
 		BastionPrivateKeyPath: *awsShareLogsBastionKey,
 		SubnetID:              *awsShareLogsSubnet,
+		Transport:             *awsShareLogsTransport,
+		S3Bucket:              *awsShareLogsBucket,
+		InstanceProfile:       *awsShareLogsProfile,
+		NoRedact:              *awsShareLogsNoRedact,
+		RedactPatterns:        *awsShareLogsRedact,
 		IAMRoleARN:            *awsCommandIAM,
 		IAMDeviceARN:          *awsCommandIAMMFA,
 		IAMCode:               *awsCommandIAMCode,
 	}
-	logs, err := share.LogsAWS(ctx, *awsShareLogsRegion, *awsShareLogsID, conf)
+	logs, err := share.LogsAWS(ctx, nil, *awsShareLogsRegion, *awsShareLogsID, conf)
 	if err != nil {
 		// Could not get logs, show error
 		logging.Fatal(err)
 		return
 	}
+	if *awsShareLogsOutput != "" {
+		showResult(logs, *awsShareLogsOutput)
+		return
+	}
 	logging.Info("Logs saved to:")
-	logging.Output(logs)
+	logging.Output(logs.Path)
+}
+
+func wrapGCPInstance(ctx context.Context) {
+	gcpConf := gcp.Config{
+		Project:         *gcpCommandProject,
+		Zone:            *gcpWrapInstanceZone,
+		CredentialsFile: *gcpCommandCredentials,
+	}
+	conf := wrap.Config{
+		MetavisorVersion: *gcpWrapInstanceVersion,
+		MetavisorAMI:     *gcpWrapInstanceImage,
+		ServiceDomain:    *gcpWrapInstanceDomain,
+	}
+	if err := gcpWrapInstanceToken.apply(&conf); err != nil {
+		logging.Fatal(err)
+		return
+	}
+	inst, err := wrap.GCPInstance(ctx, nil, gcpConf, *gcpWrapInstanceID, conf)
+	if err != nil {
+		// Could not wrap instance, show error
+		logging.Fatal(err)
+		return
+	}
+	if *gcpWrapInstanceOutput != "" {
+		showResult(inst, *gcpWrapInstanceOutput)
+		return
+	}
+	logging.Info("Successfully wrapped instance:")
+	logging.Output(inst.InstanceID)
+}
+
+func wrapGCPImage(ctx context.Context) {
+	gcpConf := gcp.Config{
+		Project:         *gcpCommandProject,
+		Zone:            *gcpWrapImageZone,
+		CredentialsFile: *gcpCommandCredentials,
+	}
+	conf := wrap.Config{
+		MetavisorVersion:    *gcpWrapImageVersion,
+		MetavisorAMI:        *gcpWrapImageImage,
+		ServiceDomain:       *gcpWrapImageDomain,
+		SubnetID:            *gcpWrapImageSubnetwork,
+		NameTemplate:        *gcpWrapImageName,
+		DescriptionTemplate: *gcpWrapImageDesc,
+		Tags:                *gcpWrapImageTags,
+	}
+	if err := gcpWrapImageToken.apply(&conf); err != nil {
+		logging.Fatal(err)
+		return
+	}
+	img, err := wrap.GCPImage(ctx, nil, gcpConf, *gcpWrapImageID, conf)
+	if err != nil {
+		// Could not wrap image, show error
+		logging.Fatal(err)
+		return
+	}
+	if *gcpWrapImageOutput != "" {
+		showResult(img, *gcpWrapImageOutput)
+		return
+	}
+	logging.Info("Successfully wrapped image:")
+	logging.Output(img.ImageID)
 }
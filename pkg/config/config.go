@@ -0,0 +1,396 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package config reads and writes the CLI config file, which has named
+// profiles of flag values
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/token"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultProfileKey is the key of the profile used when none is selected
+	DefaultProfileKey = "default-profile"
+
+	configDirName  = ".config/metavisor"
+	configFileName = "config.yaml"
+)
+
+var (
+	// ErrInvalidConfig is returned if the config file is not valid YAML, or
+	// not structured like a config file
+	ErrInvalidConfig = errors.New("the config file is not valid")
+	// ErrUnknownProfile is returned if a profile is not in the config file
+	ErrUnknownProfile = errors.New("the profile is not in the config file")
+	// ErrNoProfile is returned if a setting is read or written without a
+	// profile, and the config file has no default profile
+	ErrNoProfile = errors.New("no profile was specified, and the config file has no default profile")
+	// ErrUnknownKey is returned if a setting is not a flag of any command
+	ErrUnknownKey = errors.New("the key is not a flag of any command")
+)
+
+// sensitiveKeys are masked when listing profiles
+var sensitiveKeys = []string{"token"}
+
+// File is the config file. Profiles map the name of a flag, without the
+// leading dashes, to the value of the flag. The value can be a list or a
+// map for flags that can be repeated, e.g. tags.
+type File struct {
+	DefaultProfile string             `yaml:"default-profile,omitempty" json:"default_profile,omitempty"`
+	Profiles       map[string]Profile `yaml:"profiles,omitempty" json:"profiles"`
+}
+
+// Profile is a named set of flag values
+type Profile map[string]interface{}
+
+// DefaultPath is where the config file is read from if no other path is
+// specified
+func DefaultPath() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "metavisor", configFileName)
+	}
+	home := os.Getenv("HOME")
+	if runtime.GOOS == "windows" {
+		home = os.Getenv("USERPROFILE")
+	}
+	return filepath.Join(home, filepath.FromSlash(configDirName), configFileName)
+}
+
+// Load reads the config file at the given path
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{}
+	if err = yaml.UnmarshalStrict(data, f); err != nil {
+		logging.Debugf("Config file could not be unmarshaled: %s", err)
+		return nil, ErrInvalidConfig
+	}
+	if f.Profiles == nil {
+		f.Profiles = map[string]Profile{}
+	}
+	for name, p := range f.Profiles {
+		if p == nil {
+			f.Profiles[name] = Profile{}
+		}
+	}
+	return f, nil
+}
+
+// LoadOrEmpty reads the config file at the given path, or returns an empty
+// config if the file doesn't exist
+func LoadOrEmpty(path string) (*File, error) {
+	f, err := Load(path)
+	if os.IsNotExist(err) {
+		return &File{Profiles: map[string]Profile{}}, nil
+	}
+	return f, err
+}
+
+// Save writes the config file to the given path, only readable by the user
+func (f *File) Save(path string) error {
+	data, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Profile returns the profile with the given name, or the default profile
+// if the name is empty. If there is no default profile either, nil is
+// returned.
+func (f *File) Profile(name string) (Profile, error) {
+	if name == "" {
+		name = f.DefaultProfile
+	}
+	if name == "" {
+		return nil, nil
+	}
+	p, ok := f.Profiles[name]
+	if !ok {
+		return nil, ErrUnknownProfile
+	}
+	return p, nil
+}
+
+// Get returns the values of a setting in the profile with the given name,
+// or of the default profile. The default profile itself is read with
+// DefaultProfileKey.
+func (f *File) Get(profile, key string) ([]string, error) {
+	if key == DefaultProfileKey {
+		return []string{f.DefaultProfile}, nil
+	}
+	p, err := f.Profile(profile)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, ErrNoProfile
+	}
+	return p.Values(key)
+}
+
+// Set sets a setting in the profile with the given name, or in the default
+// profile. The profile is created if it doesn't exist. An empty value
+// removes the setting.
+func (f *File) Set(profile, key, value string) error {
+	if key == DefaultProfileKey {
+		if _, ok := f.Profiles[value]; !ok && value != "" {
+			return ErrUnknownProfile
+		}
+		f.DefaultProfile = value
+		return nil
+	}
+	if profile == "" {
+		profile = f.DefaultProfile
+	}
+	if profile == "" {
+		return ErrNoProfile
+	}
+	if f.Profiles == nil {
+		f.Profiles = map[string]Profile{}
+	}
+	p, ok := f.Profiles[profile]
+	if !ok {
+		p = Profile{}
+		f.Profiles[profile] = p
+	}
+	if value == "" {
+		delete(p, key)
+	} else {
+		p[key] = value
+	}
+	return nil
+}
+
+// Values returns the values of a setting as strings. Lists have a value per
+// item, and maps have a KEY=VALUE value per key, sorted by key.
+func (p Profile) Values(key string) ([]string, error) {
+	v, ok := p[key]
+	if !ok {
+		return nil, nil
+	}
+	switch value := v.(type) {
+	case []interface{}:
+		values := []string{}
+		for _, item := range value {
+			s, err := scalar(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	case map[interface{}]interface{}:
+		values := []string{}
+		for k, item := range value {
+			s, err := scalar(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, fmt.Sprintf("%v=%s", k, s))
+		}
+		sort.Strings(values)
+		return values, nil
+	}
+	s, err := scalar(v)
+	if err != nil {
+		return nil, err
+	}
+	return []string{s}, nil
+}
+
+func scalar(v interface{}) (string, error) {
+	switch v.(type) {
+	case []interface{}, map[interface{}]interface{}:
+		return "", ErrInvalidConfig
+	case nil:
+		return "", nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// Problem is something wrong with a config file
+type Problem struct {
+	Profile string `json:"profile,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.Key != "":
+		return fmt.Sprintf("%s: %s: %s", p.Profile, p.Key, p.Message)
+	case p.Profile != "":
+		return fmt.Sprintf("%s: %s", p.Profile, p.Message)
+	}
+	return p.Message
+}
+
+// Validate checks that the default profile exists, and that all settings
+// are known flags with valid values. The known flags are the names of the
+// flags of all commands.
+func (f *File) Validate(known map[string]bool) []Problem {
+	problems := []Problem{}
+	if f.DefaultProfile != "" {
+		if _, ok := f.Profiles[f.DefaultProfile]; !ok {
+			problems = append(problems, Problem{Message: fmt.Sprintf("the default profile %s doesn't exist", f.DefaultProfile)})
+		}
+	}
+	for _, name := range f.profileNames() {
+		p := f.Profiles[name]
+		for _, key := range p.keys() {
+			if !known[key] {
+				problems = append(problems, Problem{Profile: name, Key: key, Message: ErrUnknownKey.Error()})
+				continue
+			}
+			values, err := p.Values(key)
+			if err != nil {
+				problems = append(problems, Problem{Profile: name, Key: key, Message: "nested lists and maps are not supported"})
+				continue
+			}
+			for _, v := range values {
+				if msg := checkValue(key, v); msg != "" {
+					problems = append(problems, Problem{Profile: name, Key: key, Message: msg})
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// checkValue checks the values of the settings that can be checked without
+// calling any APIs
+func checkValue(key, value string) string {
+	switch key {
+	case "token":
+		return "launch tokens should not be kept in config files, use token-file, token-secret, token-ssm-parameter or token-keyring"
+	case "region":
+		if !aws.IsValidRegion(value) {
+			return fmt.Sprintf("%s is not an AWS region", value)
+		}
+	case "subnet-id":
+		if !aws.IsSubnetID(value) {
+			return fmt.Sprintf("%s is not a subnet ID", value)
+		}
+	case "iam", "iam-mfa", "token-secret":
+		if !strings.HasPrefix(value, "arn:") {
+			return fmt.Sprintf("%s is not an ARN", value)
+		}
+	}
+	return ""
+}
+
+func (f *File) profileNames() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p Profile) keys() []string {
+	keys := make([]string, 0, len(p))
+	for key := range p {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// masked returns the values of the profile as strings, with sensitive
+// settings masked
+func (p Profile) masked() map[string][]string {
+	res := map[string][]string{}
+	for _, key := range p.keys() {
+		values, err := p.Values(key)
+		if err != nil {
+			values = []string{"(invalid)"}
+		}
+		for _, s := range sensitiveKeys {
+			if key == s {
+				for i := range values {
+					values[i] = token.Mask(values[i])
+				}
+			}
+		}
+		res[key] = values
+	}
+	return res
+}
+
+// FormatProfiles will format the profiles of a config file for display,
+// with sensitive settings masked. If withJSON is true, the profiles will be
+// formatted as JSON.
+func FormatProfiles(f *File, path string, withJSON bool) (string, error) {
+	profiles := map[string]map[string][]string{}
+	for name, p := range f.Profiles {
+		profiles[name] = p.masked()
+	}
+	if withJSON {
+		data, err := json.MarshalIndent(struct {
+			Path           string                         `json:"path"`
+			DefaultProfile string                         `json:"default_profile,omitempty"`
+			Profiles       map[string]map[string][]string `json:"profiles"`
+		}{path, f.DefaultProfile, profiles}, "", "\t")
+		if err != nil {
+			logging.Errorf("Failed to marshal profiles to JSON: %s", err)
+		}
+		return string(data), err
+	}
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "Config file:\t%s\n", path)
+	if f.DefaultProfile != "" {
+		fmt.Fprintf(w, "Default profile:\t%s\n", f.DefaultProfile)
+	}
+	w.Flush()
+	for _, name := range f.profileNames() {
+		fmt.Fprintf(&b, "\n[%s]\n", name)
+		w = tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+		p := profiles[name]
+		keys := make([]string, 0, len(p))
+		for key := range p {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s:\t%s\n", key, strings.Join(p[key], ", "))
+		}
+		w.Flush()
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
@@ -0,0 +1,185 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `default-profile: prod-us
+profiles:
+  prod-us:
+    region: us-west-2
+    subnet-id: subnet-0123456789
+    iam: arn:aws:iam::123456789012:role/metavisor
+    tag:
+      Team: platform
+      Env: prod
+    copy-to-regions: [us-east-1, eu-west-1]
+  staging-eu:
+    region: eu-west-1
+    token: eyJhbGciOiJFUzM4NCJ9.eyJ9.c2ln
+    subnet: subnet-0123456789
+    concurrency: 5
+`
+
+func writeConfig(t *testing.T, data string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err = ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoad(t *testing.T) {
+	path, cleanup := writeConfig(t, testConfig)
+	defer cleanup()
+	f, err := Load(path)
+	if err != nil {
+		t.Fatalf("Got unexpected error when loading config: %s", err)
+	}
+	p, err := f.Profile("")
+	if err != nil || p == nil {
+		t.Fatalf("Expected default profile, got %v", err)
+	}
+	tests := map[string][]string{
+		"region":          {"us-west-2"},
+		"tag":             {"Env=prod", "Team=platform"},
+		"copy-to-regions": {"us-east-1", "eu-west-1"},
+		"missing":         nil,
+	}
+	for key, expected := range tests {
+		if values, err := p.Values(key); err != nil || !reflect.DeepEqual(values, expected) {
+			t.Errorf("Expected %v for %s, got %v (%v)", expected, key, values, err)
+		}
+	}
+	if values, _ := f.Get("staging-eu", "concurrency"); !reflect.DeepEqual(values, []string{"5"}) {
+		t.Errorf("Expected numbers as strings, got %v", values)
+	}
+	if _, err = f.Profile("dev"); err != ErrUnknownProfile {
+		t.Errorf("Expected ErrUnknownProfile, got %v", err)
+	}
+
+	invalid, cleanup := writeConfig(t, "profile:\n  prod: {}\n")
+	defer cleanup()
+	if _, err = Load(invalid); err != ErrInvalidConfig {
+		t.Errorf("Expected ErrInvalidConfig for unknown top-level keys, got %v", err)
+	}
+	if _, err = Load(filepath.Join(filepath.Dir(path), "missing.yaml")); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+	if f, err = LoadOrEmpty(filepath.Join(filepath.Dir(path), "missing.yaml")); err != nil || len(f.Profiles) != 0 {
+		t.Errorf("Expected empty config, got %v", err)
+	}
+}
+
+func TestSetAndSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metavisor", "config.yaml")
+	f, err := LoadOrEmpty(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Set("", "region", "us-west-2"); err != ErrNoProfile {
+		t.Errorf("Expected ErrNoProfile, got %v", err)
+	}
+	if err = f.Set("", DefaultProfileKey, "dev"); err != ErrUnknownProfile {
+		t.Errorf("Expected ErrUnknownProfile, got %v", err)
+	}
+	for _, s := range [][]string{
+		{"dev", "region", "us-west-2"},
+		{"dev", "subnet-id", "subnet-1"},
+		{"", DefaultProfileKey, "dev"},
+		{"", "subnet-id", ""},
+	} {
+		if err = f.Set(s[0], s[1], s[2]); err != nil {
+			t.Fatalf("Got unexpected error when setting %v: %s", s, err)
+		}
+	}
+	if err = f.Save(path); err != nil {
+		t.Fatalf("Got unexpected error when saving config: %s", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected config file to only be readable by the user, got %v", info.Mode())
+	}
+	saved, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.DefaultProfile != "dev" || !reflect.DeepEqual(saved.Profiles["dev"], Profile{"region": "us-west-2"}) {
+		t.Errorf("Got unexpected saved config: %+v", saved)
+	}
+	if values, err := saved.Get("", DefaultProfileKey); err != nil || values[0] != "dev" {
+		t.Errorf("Got unexpected default profile %v (%v)", values, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	path, cleanup := writeConfig(t, testConfig)
+	defer cleanup()
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := map[string]bool{"region": true, "subnet-id": true, "iam": true, "tag": true, "copy-to-regions": true, "token": true, "concurrency": true}
+	problems := f.Validate(known)
+	expected := []Problem{
+		{Profile: "staging-eu", Key: "subnet", Message: ErrUnknownKey.Error()},
+		{Profile: "staging-eu", Key: "token", Message: "launch tokens should not be kept in config files, use token-file, token-secret, token-ssm-parameter or token-keyring"},
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Got unexpected problems: %v", problems)
+	}
+	f.DefaultProfile = "dev"
+	f.Profiles["prod-us"]["region"] = "us-west-9"
+	problems = f.Validate(known)
+	if len(problems) != 4 || problems[0].String() != "the default profile dev doesn't exist" || problems[1].String() != "prod-us: region: us-west-9 is not an AWS region" {
+		t.Errorf("Got unexpected problems: %v", problems)
+	}
+}
+
+func TestFormatProfiles(t *testing.T) {
+	path, cleanup := writeConfig(t, testConfig)
+	defer cleanup()
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, withJSON := range []bool{false, true} {
+		out, err := FormatProfiles(f, path, withJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(out, "eyJ9.c2ln") || !strings.Contains(out, "eyJhbGci...") {
+			t.Errorf("Expected token to be masked:\n%s", out)
+		}
+		if !strings.Contains(out, "prod-us") || !strings.Contains(out, "Env=prod") {
+			t.Errorf("Expected profiles in output:\n%s", out)
+		}
+	}
+}
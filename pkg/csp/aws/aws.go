@@ -22,6 +22,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/immutable/metavisor-cli/pkg/csp"
 	"github.com/immutable/metavisor-cli/pkg/logging"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -34,14 +35,15 @@ import (
 )
 
 const (
-	accessDeniedErrorCode   = "AccessDenied"
-	keyNotFoundErrorCode    = "InvalidKeyPair.NotFound"
-	instanceIDErrorCode     = "InvalidInstanceID"
-	amiIDErrorCode          = "InvalidAMIID"
-	volumeNotFound          = "InvalidVolumeID"
-	snapshotNotFound        = "InvalidSnapshot.NotFound"
-	vpcNotFoundErrorCode    = "VPCResourceNotSpecified"
-	subnetNotFoundErrorCode = "InvalidSubnetID.NotFound"
+	accessDeniedErrorCode     = "AccessDenied"
+	keyNotFoundErrorCode      = "InvalidKeyPair.NotFound"
+	instanceIDErrorCode       = "InvalidInstanceID"
+	amiIDErrorCode            = "InvalidAMIID"
+	volumeNotFound            = "InvalidVolumeID"
+	snapshotNotFound          = "InvalidSnapshot.NotFound"
+	vpcNotFoundErrorCode      = "VPCResourceNotSpecified"
+	subnetNotFoundErrorCode   = "InvalidSubnetID.NotFound"
+	invalidParameterErrorCode = "InvalidParameterValue"
 
 	genericVolumeType = "gp2"
 
@@ -64,8 +66,9 @@ var (
 	// either from environment variables or ~/.aws/config
 	ErrNoAWSCreds = errors.New("no valid AWS credentials present")
 	// ErrNotAllowed is returned if the current user does not have enough
-	// IAM permissions to perform a certain action
-	ErrNotAllowed = errors.New("insufficient IAM permissions")
+	// IAM permissions to perform a certain action. It's the same error as
+	// csp.ErrNotAllowed, so provider neutral code can check for it.
+	ErrNotAllowed = csp.ErrNotAllowed
 	// ErrNonExistingRegion is returned if a specified region does not exist
 	ErrNonExistingRegion = errors.New("the specified region does not exist")
 	// ErrInvalidName is returned if trying to specify an invalid name
@@ -76,6 +79,8 @@ var (
 	ErrSnapshotNonExisting = errors.New("snapshot doesn't exist")
 	// ErrImageNonExisting is returned if specified AMI doesn't exist
 	ErrImageNonExisting = errors.New("image doesn't exist")
+	// ErrVolumeNonExisting is returned if specified volume doesn't exist
+	ErrVolumeNonExisting = errors.New("volume doesn't exist")
 	// ErrKeyNonExisting is returned if a key definetly doesn't exist
 	ErrKeyNonExisting = errors.New("key pair doesn't exist")
 	// ErrNoAMIInRegion is returned if trying to launch instance in region where
@@ -99,10 +104,19 @@ var (
 	ErrInvalidSubnetID = errors.New("the specified subnet is not valid")
 	// ErrAmbigiousInstanceRegion is returned if an instance ID was found in multiple regions
 	ErrAmbigiousInstanceRegion = errors.New("could not automatically determine instance region, please specify one explicitly")
+	// ErrInvalidFilter is returned if AWS doesn't accept a filter used to find resources
+	ErrInvalidFilter = errors.New("the specified filter is not valid")
 )
 
 var validVolumeTypes = []string{"gp2", "io1", "st1", "sc1", "standard"}
 
+var (
+	// assumedRoles are the credentials of the roles assumed so far, so that
+	// MFA codes are only asked for once when creating several clients
+	assumedRoles      = make(map[IAMConfig]*credentials.Credentials)
+	assumedRolesMutex sync.Mutex
+)
+
 // Service is a helper for doing common operations in AWS
 type Service interface {
 	// KeyPairExist will determine if a specified key pair exist in AWS or not
@@ -119,12 +133,23 @@ type Service interface {
 	DeleteSnapshot(ctx context.Context, snapshotID string) error
 	// TagResources will attach the given tags to the given resources
 	TagResources(ctx context.Context, tags map[string]string, resourceID ...string) error
+	// UntagResources will remove the tags with the given keys from the given resources
+	UntagResources(ctx context.Context, keys []string, resourceID ...string) error
 	// GetSnapshot returns the snapshot with the given ID
 	GetSnapshot(ctx context.Context, snapshotID string) (Snapshot, error)
 	// GetInstance returns an instance representation of the instance with the given ID
 	GetInstance(ctx context.Context, instanceID string) (Instance, error)
+	// FindInstances returns the IDs of all instances matching the given filters,
+	// which are mappings from filter name to accepted values, e.g. "tag:Env" to "prod"
+	FindInstances(ctx context.Context, filters map[string][]string) ([]string, error)
+	// GetInstanceUserdata returns the decoded userdata of the instance with the given ID
+	GetInstanceUserdata(ctx context.Context, instanceID string) (string, error)
 	// LaunchInstance will use a new instance with the specified attributes
-	LaunchInstance(ctx context.Context, image, instanceType, userData, keyName, subnetID string, tags map[string]string, extraDevices ...NewDevice) (Instance, error)
+	LaunchInstance(ctx context.Context, image, instanceType, userData, keyName, subnetID string, opts LaunchOptions, tags map[string]string, extraDevices ...NewDevice) (Instance, error)
+	// GetLaunchZone returns the availability zone instances are launched in,
+	// which is the zone of the subnet if one is given, otherwise the first
+	// available zone of the region
+	GetLaunchZone(ctx context.Context, subnetID string) (string, error)
 	// TerminateInstance will terminate the instance with the given ID
 	TerminateInstance(ctx context.Context, instanceID string) error
 	// StopInstance will stop the instance with the given ID
@@ -132,7 +157,7 @@ type Service interface {
 	// StartInstance will start the instance with the given ID
 	StartInstance(ctx context.Context, instanceID string) error
 	// ModifyInstanceAttribute changes the specified attribute of an instance
-	ModifyInstanceAttribute(ctx context.Context, instanceID string, attr instanceAttribute, value interface{}) error
+	ModifyInstanceAttribute(ctx context.Context, instanceID string, attr InstanceAttribute, value interface{}) error
 	// AwaitInstanceOK will block until the instance status is OK
 	AwaitInstanceOK(ctx context.Context, instanceID string) error
 	// AwaitInstanceRunning will block until instance is running
@@ -143,10 +168,23 @@ type Service interface {
 	CreateImage(ctx context.Context, instanceID, name, desc string) (string, error)
 	// GetImage returns the AMI with the given ID
 	GetImage(ctx context.Context, imageID string) (Image, error)
+	// GetImageBySnapshot returns an AMI which has the given snapshot in its block device mapping
+	GetImageBySnapshot(ctx context.Context, snapshotID string) (Image, error)
+	// DeregisterImage will deregister the AMI with the given ID
+	DeregisterImage(ctx context.Context, imageID string) error
 	// AwaitImageAvailable will block until image is available
 	AwaitImageAvailable(ctx context.Context, imageID string) error
+	// CopyImage will copy an AMI from the source region to the region of the
+	// service, returning the ID of the new AMI
+	CopyImage(ctx context.Context, sourceRegion, sourceImageID, name, desc string) (string, error)
+	// ShareImage will give the given accounts, organizations and OUs permission to launch the AMI
+	ShareImage(ctx context.Context, imageID string, perms LaunchPermissions) error
+	// ShareSnapshot will give the given accounts permission to create volumes from the snapshot
+	ShareSnapshot(ctx context.Context, snapshotID string, accountIDs ...string) error
 	// CreateVolume will create a new volume in AWS
 	CreateVolume(ctx context.Context, sourceSnapshotID, volumeType, zone string, size int64) (Volume, error)
+	// GetVolume returns the volume with the given ID
+	GetVolume(ctx context.Context, volumeID string) (Volume, error)
 	// DeleteVolume will delete the specified volume
 	DeleteVolume(ctx context.Context, volumeID string) error
 	// DetachVolume will detach a specified volume in AWS
@@ -159,6 +197,9 @@ type Service interface {
 	AwaitVolumeInUse(ctx context.Context, volumeID string) error
 	// DeleteInstanceDevicesOnTermination makes sure devices are deleted when instance is terminated
 	DeleteInstanceDevicesOnTermination(ctx context.Context, instanceID string) error
+	// DryRun checks if an action would be allowed, without performing it. If
+	// the IAM permissions are missing, ErrNotAllowed is returned
+	DryRun(ctx context.Context, action DryRunAction, params DryRunParams) error
 }
 
 // NewDevice is can be passed when launching new instance to add extra
@@ -170,19 +211,17 @@ type NewDevice struct {
 
 // Resource is a generic AWS resource
 type Resource interface {
-	ID() string
+	csp.Resource
 }
 
 // Snapshot is a snapshot in AWS
 type Snapshot interface {
-	Resource
-	// SizeGB is the size of the snapshot in GiB
-	SizeGB() int64
+	csp.Snapshot
 }
 
 // Image is an AMI in AWS
 type Image interface {
-	Resource
+	csp.Image
 	// RootDeviceName is the name of the root device
 	RootDeviceName() string
 	// DeviceMapping is a mapping from device name to AWS snapshot ID
@@ -191,49 +230,49 @@ type Image interface {
 	ENASupport() bool
 	// State is the current state of the AMI
 	State() string
-	// Name is the name of the AMI
-	Name() string
-	// Description is the description of the AMI
-	Description() string
 }
 
 // Volume is a volume in AWS
 type Volume interface {
-	Resource
+	csp.Disk
+	// SnapshotID is the ID of the snapshot the volume was created from, if any
+	SnapshotID() string
 }
 
-// Instance represents an instance in AWS
+// Instance represents an instance in AWS, its DeviceMapping is a mapping
+// from device name to AWS volume ID
 type Instance interface {
-	Resource
-	// InstanceType is the type of the instance, e.g. m4.large
-	InstanceType() string
-	// RootDeviceName is the name of the root device
-	RootDeviceName() string
-	// DeviceMapping is a mapping from device name to AWS volume ID
-	DeviceMapping() map[string]string
-	// PublicIP is the public IP, if it exists, otherwise empty
-	PublicIP() string
-	// PrivateIP is the private IP, if it exists, otherwise empty
-	PrivateIP() string
-	// AvailabilityZone is the availability zone of the instance
-	AvailabilityZone() string
+	csp.Instance
 	// SriovNetSupport specifies if enhanced networking is supported, "simple" == supported
 	SriovNetSupport() string
 	// ENASupport is if the instance supports ENA or not
 	ENASupport() bool
 }
 
-type instanceAttribute int
+// InstanceAttribute is an attribute of an instance that can be changed with
+// ModifyInstanceAttribute
+type InstanceAttribute int
 
 const (
 	// AttrSriovNetSupport is for changing instances' SriovNetSupport attribute
-	AttrSriovNetSupport instanceAttribute = iota
+	AttrSriovNetSupport InstanceAttribute = iota
 	// AttrENASupport is for changing instances' ENA support attribute
 	AttrENASupport
 	// AttrUserData is for changing the user data of an instance
 	AttrUserData
 )
 
+// LaunchOptions are the less common options when launching an instance
+type LaunchOptions struct {
+	// NoPublicIP launches the instance with only a private IP
+	NoPublicIP bool
+	// InstanceProfile is the name or ARN of the IAM instance profile
+	InstanceProfile string
+	// Zone is the availability zone to launch in, it's ignored if a subnet
+	// is given since the subnet decides the zone
+	Zone string
+}
+
 type resource struct {
 	id string
 }
@@ -251,38 +290,49 @@ type IAMConfig struct {
 // New will initialize and return a new AWS Service that can be used to perform
 // common operations in AWS.
 func New(region string, iamConf *IAMConfig) (Service, error) {
+	sess, conf, err := newSession(region, iamConf)
+	if err != nil {
+		return nil, err
+	}
+	service := new(awsService)
+	service.region = region
+	service.client = ec2.New(sess, conf)
+	return service, nil
+}
+
+// newSession creates a session in the region, and the config to create
+// clients with, which has the credentials of the role if one is specified
+func newSession(region string, iamConf *IAMConfig) (*session.Session, *aws.Config, error) {
 	if valid := IsValidRegion(region); !valid {
-		return nil, ErrNonExistingRegion
+		return nil, nil, ErrNonExistingRegion
 	}
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(region),
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if _, err := sess.Config.Credentials.Get(); err != nil {
 		logging.Debugf("Invalid AWS credentials: %v", err)
 		logging.Error("Could not load any valid AWS credentials from environment or AWS config file")
-		return nil, ErrNoAWSCreds
+		return nil, nil, ErrNoAWSCreds
 	}
-	var creds *credentials.Credentials
+	conf := &aws.Config{}
 	if iamConf != nil && strings.TrimSpace(iamConf.RoleARN) != "" {
-		creds, err = assumeIAMRole(sess, *iamConf)
-		if err != nil {
-			logging.Debug("Failed to assume IAM role")
-			return nil, err
+		assumedRolesMutex.Lock()
+		defer assumedRolesMutex.Unlock()
+		creds, assumed := assumedRoles[*iamConf]
+		if !assumed {
+			creds, err = assumeIAMRole(sess, *iamConf)
+			if err != nil {
+				logging.Debug("Failed to assume IAM role")
+				return nil, nil, err
+			}
+			assumedRoles[*iamConf] = creds
 		}
+		conf.Credentials = creds
 	}
-	service := new(awsService)
-	service.region = region
-	if creds != nil {
-		service.client = ec2.New(sess, &aws.Config{
-			Credentials: creds,
-		})
-	} else {
-		service.client = ec2.New(sess)
-	}
-	return service, nil
+	return sess, conf, nil
 }
 
 // FindInstanceRegion will look through all regions in an attempt to find a speciifed
@@ -460,6 +510,41 @@ func (a *awsService) DeleteInstanceDevicesOnTermination(ctx context.Context, ins
 	return nil
 }
 
+func (a *awsService) UntagResources(ctx context.Context, keys []string, resourceID ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	tags := []*ec2.Tag{}
+	for _, key := range keys {
+		tags = append(tags, &ec2.Tag{
+			Key: aws.String(key),
+		})
+	}
+	input := &ec2.DeleteTagsInput{
+		Resources: aws.StringSlice(resourceID),
+		Tags:      tags,
+	}
+	_, err := a.client.DeleteTagsWithContext(ctx, input)
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if ok && (aerr.Code() == accessDeniedErrorCode || aerr.Code() == unauthorizedErrorCode) {
+			return ErrNotAllowed
+		}
+		return err
+	}
+	return nil
+}
+
+func ec2TagsToMap(tags []*ec2.Tag) map[string]string {
+	res := make(map[string]string)
+	for _, t := range tags {
+		if t.Key != nil && t.Value != nil {
+			res[*t.Key] = *t.Value
+		}
+	}
+	return res
+}
+
 func mapToEC2Tags(tags map[string]string) []*ec2.Tag {
 	res := []*ec2.Tag{}
 	for key, value := range tags {
@@ -0,0 +1,214 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	dryRunSuccessCode     = "DryRunOperation"
+	unauthorizedErrorCode = "UnauthorizedOperation"
+)
+
+// ErrInvalidDryRunAction is returned if trying to dry run an unknown action
+var ErrInvalidDryRunAction = errors.New("specified action can't be dry run")
+
+// DryRunAction is an action that can be checked with Service.DryRun
+type DryRunAction int
+
+const (
+	// DryRunStopInstances checks if an instance can be stopped
+	DryRunStopInstances DryRunAction = iota
+	// DryRunStartInstances checks if an instance can be started
+	DryRunStartInstances
+	// DryRunTerminateInstances checks if an instance can be terminated
+	DryRunTerminateInstances
+	// DryRunRunInstances checks if an instance can be launched from an image
+	DryRunRunInstances
+	// DryRunModifyInstanceAttribute checks if the attributes of an instance can be changed
+	DryRunModifyInstanceAttribute
+	// DryRunCreateVolume checks if a volume can be created from a snapshot
+	DryRunCreateVolume
+	// DryRunAttachVolume checks if a volume can be attached to an instance
+	DryRunAttachVolume
+	// DryRunDetachVolume checks if a volume can be detached from an instance
+	DryRunDetachVolume
+	// DryRunCopyImage checks if an image can be copied from the source
+	// region to the region of the service
+	DryRunCopyImage
+	// DryRunModifyImageAttribute checks if an image can be shared
+	DryRunModifyImageAttribute
+	// DryRunModifySnapshotAttribute checks if a snapshot can be shared with
+	// accounts
+	DryRunModifySnapshotAttribute
+)
+
+// DryRunParams are the parameters of the action to dry run. Only the
+// parameters needed for the specific action must be set.
+type DryRunParams struct {
+	InstanceID   string
+	InstanceType string
+	ImageID      string
+	SubnetID     string
+	VolumeID     string
+	VolumeType   string
+	SnapshotID   string
+	DeviceName   string
+	Zone         string
+	SizeGB       int64
+	SourceRegion string
+	// Permissions are who images and snapshots are shared with, only the
+	// account IDs are used for snapshots
+	Permissions LaunchPermissions
+}
+
+// DryRunActionName returns the IAM action name of a dry run action, e.g.
+// "ec2:StopInstances"
+func DryRunActionName(action DryRunAction) string {
+	switch action {
+	case DryRunStopInstances:
+		return "ec2:StopInstances"
+	case DryRunStartInstances:
+		return "ec2:StartInstances"
+	case DryRunTerminateInstances:
+		return "ec2:TerminateInstances"
+	case DryRunRunInstances:
+		return "ec2:RunInstances"
+	case DryRunModifyInstanceAttribute:
+		return "ec2:ModifyInstanceAttribute"
+	case DryRunCreateVolume:
+		return "ec2:CreateVolume"
+	case DryRunAttachVolume:
+		return "ec2:AttachVolume"
+	case DryRunDetachVolume:
+		return "ec2:DetachVolume"
+	case DryRunCopyImage:
+		return "ec2:CopyImage"
+	case DryRunModifyImageAttribute:
+		return "ec2:ModifyImageAttribute"
+	case DryRunModifySnapshotAttribute:
+		return "ec2:ModifySnapshotAttribute"
+	}
+	return "unknown"
+}
+
+func (a *awsService) DryRun(ctx context.Context, action DryRunAction, p DryRunParams) error {
+	var err error
+	switch action {
+	case DryRunStopInstances:
+		_, err = a.client.StopInstancesWithContext(ctx, &ec2.StopInstancesInput{
+			DryRun:      aws.Bool(true),
+			InstanceIds: aws.StringSlice([]string{p.InstanceID}),
+		})
+	case DryRunStartInstances:
+		_, err = a.client.StartInstancesWithContext(ctx, &ec2.StartInstancesInput{
+			DryRun:      aws.Bool(true),
+			InstanceIds: aws.StringSlice([]string{p.InstanceID}),
+		})
+	case DryRunTerminateInstances:
+		_, err = a.client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+			DryRun:      aws.Bool(true),
+			InstanceIds: aws.StringSlice([]string{p.InstanceID}),
+		})
+	case DryRunRunInstances:
+		input := &ec2.RunInstancesInput{
+			DryRun:       aws.Bool(true),
+			ImageId:      aws.String(p.ImageID),
+			InstanceType: aws.String(p.InstanceType),
+			MinCount:     aws.Int64(1),
+			MaxCount:     aws.Int64(1),
+		}
+		if strings.TrimSpace(p.SubnetID) != "" {
+			input.SubnetId = aws.String(p.SubnetID)
+		}
+		_, err = a.client.RunInstancesWithContext(ctx, input)
+	case DryRunModifyInstanceAttribute:
+		_, err = a.client.ModifyInstanceAttributeWithContext(ctx, &ec2.ModifyInstanceAttributeInput{
+			DryRun:     aws.Bool(true),
+			InstanceId: aws.String(p.InstanceID),
+			SriovNetSupport: &ec2.AttributeValue{
+				Value: aws.String(SriovNetIsSupported),
+			},
+		})
+	case DryRunCreateVolume:
+		_, err = a.client.CreateVolumeWithContext(ctx, &ec2.CreateVolumeInput{
+			DryRun:           aws.Bool(true),
+			SnapshotId:       aws.String(p.SnapshotID),
+			VolumeType:       aws.String(p.VolumeType),
+			Size:             aws.Int64(p.SizeGB),
+			AvailabilityZone: aws.String(p.Zone),
+		})
+	case DryRunAttachVolume:
+		_, err = a.client.AttachVolumeWithContext(ctx, &ec2.AttachVolumeInput{
+			DryRun:     aws.Bool(true),
+			Device:     aws.String(p.DeviceName),
+			InstanceId: aws.String(p.InstanceID),
+			VolumeId:   aws.String(p.VolumeID),
+		})
+	case DryRunDetachVolume:
+		_, err = a.client.DetachVolumeWithContext(ctx, &ec2.DetachVolumeInput{
+			DryRun:     aws.Bool(true),
+			Device:     aws.String(p.DeviceName),
+			InstanceId: aws.String(p.InstanceID),
+			VolumeId:   aws.String(p.VolumeID),
+		})
+	case DryRunCopyImage:
+		_, err = a.client.CopyImageWithContext(ctx, &ec2.CopyImageInput{
+			DryRun:        aws.Bool(true),
+			SourceRegion:  aws.String(p.SourceRegion),
+			SourceImageId: aws.String(p.ImageID),
+			// The name is required, but the copy is never created
+			Name: aws.String(p.ImageID),
+		})
+	case DryRunModifyImageAttribute:
+		err = a.modifyImageAttribute(ctx, &modifyImageAttributeInput{
+			DryRun:  aws.Bool(true),
+			ImageId: aws.String(p.ImageID),
+			LaunchPermission: &launchPermissionModifications{
+				Add: launchPermissionsToEC2(p.Permissions),
+			},
+		})
+	case DryRunModifySnapshotAttribute:
+		_, err = a.client.ModifySnapshotAttributeWithContext(ctx, &ec2.ModifySnapshotAttributeInput{
+			DryRun:        aws.Bool(true),
+			SnapshotId:    aws.String(p.SnapshotID),
+			Attribute:     aws.String(attrCreateVolumePerm),
+			OperationType: aws.String(operationTypeAdd),
+			UserIds:       aws.StringSlice(p.Permissions.AccountIDs),
+		})
+	default:
+		return ErrInvalidDryRunAction
+	}
+	if err == nil {
+		// A dry run should always return an error, but if it doesn't the
+		// request was evidently allowed
+		return nil
+	}
+	aerr, ok := err.(awserr.Error)
+	if ok && aerr.Code() == dryRunSuccessCode {
+		return nil
+	}
+	if ok && (aerr.Code() == unauthorizedErrorCode || aerr.Code() == accessDeniedErrorCode) {
+		return ErrNotAllowed
+	}
+	return err
+}
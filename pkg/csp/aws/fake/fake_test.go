@@ -0,0 +1,233 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const testRegion = "us-west-2"
+
+func TestInstanceTransitions(t *testing.T) {
+	ctx := context.Background()
+	e := New(testRegion)
+	e.Latencies.InstanceStop = 20 * time.Millisecond
+	id := e.AddInstance(e.AddImage("guest", 8, nil), nil)
+
+	if err := e.StopInstance(ctx, id); err != nil {
+		t.Fatalf("Got unexpected error when stopping: %s", err)
+	}
+	if s := e.Instance(id).State; s != StateStopping {
+		t.Errorf("Expected instance to be stopping, was %s", s)
+	}
+	if err := e.StartInstance(ctx, id); err == nil {
+		t.Error("Expected error when starting a stopping instance")
+	}
+	if err := e.AwaitInstanceStopped(ctx, id); err != nil {
+		t.Fatalf("Got unexpected error when waiting for stop: %s", err)
+	}
+	inst := e.Instance(id)
+	if inst.State != StateStopped || inst.PublicIP != "" {
+		t.Errorf("Expected stopped instance without public IP, got %s %q", inst.State, inst.PublicIP)
+	}
+	if err := e.StartInstance(ctx, id); err != nil {
+		t.Fatalf("Got unexpected error when starting: %s", err)
+	}
+	if err := e.AwaitInstanceRunning(ctx, id); err != nil {
+		t.Fatalf("Got unexpected error when waiting for start: %s", err)
+	}
+	if e.Instance(id).PublicIP == "" {
+		t.Error("Expected running instance to have a public IP")
+	}
+	if err := e.TerminateInstance(ctx, id); err != nil {
+		t.Fatalf("Got unexpected error when terminating: %s", err)
+	}
+	if err := e.AwaitInstanceRunning(ctx, id); err == nil {
+		t.Error("Expected error when waiting for a terminated instance to run")
+	}
+	if res := e.Resources(); len(res.Instances) != 0 || len(res.Volumes) != 0 {
+		t.Errorf("Expected instance and volumes to be gone, got %v", res)
+	}
+}
+
+func TestVolumeMoves(t *testing.T) {
+	ctx := context.Background()
+	e := New(testRegion)
+	e.Latencies.VolumeAttach = 10 * time.Millisecond
+	e.Latencies.VolumeDetach = 10 * time.Millisecond
+	id := e.AddInstance(e.AddImage("guest", 8, nil), nil)
+	rootVolID := e.Instance(id).Devices[RootDeviceName]
+
+	if err := e.DetachVolume(ctx, rootVolID, id, RootDeviceName); err == nil {
+		t.Error("Expected error when detaching root volume of running instance")
+	}
+	e.StopInstance(ctx, id)
+	e.AwaitInstanceStopped(ctx, id)
+	if err := e.DetachVolume(ctx, rootVolID, id, RootDeviceName); err != nil {
+		t.Fatalf("Got unexpected error when detaching: %s", err)
+	}
+	if _, attached := e.Instance(id).Devices[RootDeviceName]; attached {
+		t.Error("Expected root device to be free after detaching")
+	}
+	if err := e.StartInstance(ctx, id); err == nil {
+		t.Error("Expected error when starting instance without root volume")
+	}
+	if err := e.AttachVolume(ctx, rootVolID, id, "/dev/sdf"); err != nil {
+		t.Fatalf("Got unexpected error when attaching: %s", err)
+	}
+	vol := e.Volume(rootVolID)
+	if vol.State != StateInUse || vol.AttachState != StateAttached || vol.Device != "/dev/sdf" {
+		t.Errorf("Got unexpected volume state: %s %s %s", vol.State, vol.AttachState, vol.Device)
+	}
+	if err := e.DeleteVolume(ctx, rootVolID); err == nil {
+		t.Error("Expected error when deleting attached volume")
+	}
+}
+
+func TestSnapshotProgress(t *testing.T) {
+	ctx := context.Background()
+	e := New(testRegion)
+	e.Latencies.Snapshot = 50 * time.Millisecond
+	id := e.AddInstance(e.AddImage("guest", 8, nil), nil)
+	volID := e.Instance(id).Devices[RootDeviceName]
+
+	start := time.Now()
+	snap, err := e.CreateSnapshot(ctx, "snap", volID)
+	if err != nil {
+		t.Fatalf("Got unexpected error when creating snapshot: %s", err)
+	}
+	if time.Since(start) < e.Latencies.Snapshot {
+		t.Error("Expected CreateSnapshot to wait for the snapshot to complete")
+	}
+	s := e.Snapshot(snap.ID())
+	if s.State != StateCompleted || s.Progress != 100 || s.SizeGB != 8 {
+		t.Errorf("Got unexpected snapshot: %s %d%% %d GiB", s.State, s.Progress, s.SizeGB)
+	}
+	if snap.Tags()["Name"] != "snap" {
+		t.Errorf("Expected snapshot to be tagged with its name, got %v", snap.Tags())
+	}
+
+	e.Deny("CreateTags")
+	snap, err = e.CreateSnapshot(ctx, "untagged", volID)
+	if err != nil {
+		t.Fatalf("Got unexpected error when not allowed to tag: %s", err)
+	}
+	if _, tagged := snap.Tags()["Name"]; tagged {
+		t.Error("Expected snapshot not to be tagged when denied")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	ctx := context.Background()
+	e := New(testRegion)
+	id := e.AddInstance(e.AddImage("guest", 8, nil), nil)
+
+	e.Throttle("DescribeInstances", e.MaxRetries)
+	if _, err := e.GetInstance(ctx, id); err != nil {
+		t.Errorf("Expected throttling to be retried, got: %s", err)
+	}
+	if n := e.Calls("DescribeInstances"); n != e.MaxRetries+1 {
+		t.Errorf("Expected %d calls, got %d", e.MaxRetries+1, n)
+	}
+
+	e.Throttle("DescribeInstances", e.MaxRetries+1)
+	_, err := e.GetInstance(ctx, id)
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != codeThrottled {
+		t.Errorf("Expected throttling error, got: %v", err)
+	}
+}
+
+func TestDenyAndFaults(t *testing.T) {
+	ctx := context.Background()
+	e := New(testRegion)
+
+	e.Deny("CreateKeyPair")
+	if _, err := e.CreateKeyPair(ctx, "key"); err != aws.ErrNotAllowed {
+		t.Errorf("Expected ErrNotAllowed, got: %v", err)
+	}
+	if err := e.DryRun(ctx, aws.DryRunStopInstances, aws.DryRunParams{}); err != nil {
+		t.Errorf("Got unexpected error when dry running allowed action: %s", err)
+	}
+	e.Deny("StopInstances")
+	if err := e.DryRun(ctx, aws.DryRunStopInstances, aws.DryRunParams{}); err != aws.ErrNotAllowed {
+		t.Errorf("Expected ErrNotAllowed from dry run, got: %v", err)
+	}
+	e.Allow("CreateKeyPair")
+
+	errFirst := errors.New("first")
+	errThird := errors.New("third")
+	e.FailNext("CreateKeyPair", errFirst)
+	e.FailCall("CreateKeyPair", 3, errThird)
+	names := []string{"a", "b", "c", "d"}
+	expected := []error{errFirst, nil, errThird, nil}
+	for i, name := range names {
+		if _, err := e.CreateKeyPair(ctx, name); err != expected[i] {
+			t.Errorf("Call %d: expected error %v, got %v", i+1, expected[i], err)
+		}
+	}
+	if keys := e.Resources().KeyPairs; len(keys) != 2 {
+		t.Errorf("Expected failed calls not to change state, got keys %v", keys)
+	}
+}
+
+func TestImages(t *testing.T) {
+	ctx := context.Background()
+	e := New(testRegion)
+	e.Latencies.Image = 10 * time.Millisecond
+	id := e.AddInstance(e.AddImage("guest", 8, nil), nil)
+
+	ami, err := e.CreateImage(ctx, id, "wrapped", "desc")
+	if err != nil {
+		t.Fatalf("Got unexpected error when creating image: %s", err)
+	}
+	if _, err = e.CreateImage(ctx, id, "wrapped", "desc"); err == nil {
+		t.Error("Expected error when creating image with a taken name")
+	}
+	if s := e.Image(ami).State; s != StatePending {
+		t.Errorf("Expected new image to be pending, was %s", s)
+	}
+	if err = e.AwaitImageAvailable(ctx, ami); err != nil {
+		t.Fatalf("Got unexpected error when waiting for image: %s", err)
+	}
+	snapID := e.Image(ami).Devices[RootDeviceName]
+	if err = e.DeleteSnapshot(ctx, snapID); err == nil {
+		t.Error("Expected error when deleting snapshot of registered image")
+	}
+
+	other := New("eu-west-1")
+	other.Peer(e)
+	copied, err := other.CopyImage(ctx, testRegion, ami, "copy", "")
+	if err != nil {
+		t.Fatalf("Got unexpected error when copying image: %s", err)
+	}
+	if err = other.AwaitImageAvailable(ctx, copied); err != nil {
+		t.Fatalf("Got unexpected error when waiting for copy: %s", err)
+	}
+	if size := other.Snapshot(other.Image(copied).Devices[RootDeviceName]).SizeGB; size != 8 {
+		t.Errorf("Expected copied snapshot to be 8 GiB, was %d", size)
+	}
+
+	e.SetInstance(id, func(inst *Instance) { inst.State = StateStopping })
+	if _, err = e.CreateImage(ctx, id, "stopping", ""); err == nil {
+		t.Error("Expected error when creating image of stopping instance")
+	}
+}
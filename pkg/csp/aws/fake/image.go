@@ -0,0 +1,243 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const stateFailed = "failed"
+
+type image struct {
+	s Image
+}
+
+func (i *image) ID() string                       { return i.s.ID }
+func (i *image) Name() string                     { return i.s.Name }
+func (i *image) Description() string              { return i.s.Description }
+func (i *image) Tags() map[string]string          { return i.s.Tags }
+func (i *image) RootDeviceName() string           { return i.s.RootDeviceName }
+func (i *image) DeviceMapping() map[string]string { return i.s.Devices }
+func (i *image) ENASupport() bool                 { return i.s.ENASupport }
+func (i *image) State() string                    { return i.s.State }
+
+// newImage registers a pending image with new snapshots of the given sizes,
+// which becomes available when the snapshots are completed. It must be
+// called with the lock held.
+func (e *EC2) newImage(name, desc, rootDeviceName string, enaSupport bool, sizes map[string]int64) *Image {
+	img := &Image{
+		ID:             e.newID("ami"),
+		Name:           name,
+		Description:    desc,
+		State:          StatePending,
+		RootDeviceName: rootDeviceName,
+		ENASupport:     enaSupport,
+		Devices:        make(map[string]string),
+		Tags:           make(map[string]string),
+	}
+	for device, size := range sizes {
+		snapDesc := fmt.Sprintf("Created by CreateImage for %s", img.ID)
+		img.Devices[device] = e.newSnapshot("", snapDesc, size).ID
+	}
+	latency := e.Latencies.Image
+	if e.Latencies.Snapshot > latency {
+		latency = e.Latencies.Snapshot
+	}
+	img.next = StateAvailable
+	img.at = time.Now().Add(latency)
+	e.images[img.ID] = img
+	return img
+}
+
+func (e *EC2) nameTaken(name string) bool {
+	for _, img := range e.images {
+		if img.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func duplicateName(name string) error {
+	return awserr.New("InvalidAMIName.Duplicate", fmt.Sprintf("AMI name %s is already in use by an AMI", name), nil)
+}
+
+// CreateImage fails with the same error as EC2 if the instance is neither
+// running nor stopped, which happens when the Metavisor shuts it down
+func (e *EC2) CreateImage(ctx context.Context, instanceID, name, desc string) (string, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return "", aws.ErrInstanceNonExisting
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("CreateImage"); err != nil {
+		return "", err
+	}
+	inst, exists := e.instances[instanceID]
+	if !exists {
+		return "", aws.ErrInstanceNonExisting
+	}
+	if inst.State != StateRunning && inst.State != StateStopped {
+		return "", incorrectState("Instance '%s' is not in state 'running' or 'stopped'", instanceID)
+	}
+	if e.nameTaken(name) {
+		return "", duplicateName(name)
+	}
+	sizes := make(map[string]int64)
+	for device, volID := range inst.Devices {
+		sizes[device] = e.volumes[volID].SizeGB
+	}
+	img := e.newImage(name, desc, inst.RootDeviceName, inst.ENASupport, sizes)
+	img.SourceInstance = instanceID
+	return img.ID, nil
+}
+
+func (e *EC2) GetImage(ctx context.Context, imageID string) (aws.Image, error) {
+	if strings.TrimSpace(imageID) == "" {
+		return nil, aws.ErrImageNonExisting
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DescribeImages"); err != nil {
+		return nil, err
+	}
+	img, exists := e.images[imageID]
+	if !exists {
+		return nil, aws.ErrImageNonExisting
+	}
+	return &image{img.clone()}, nil
+}
+
+func (e *EC2) GetImageBySnapshot(ctx context.Context, snapshotID string) (aws.Image, error) {
+	if strings.TrimSpace(snapshotID) == "" {
+		return nil, aws.ErrImageNonExisting
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DescribeImages"); err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for id := range e.images {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		img := e.images[id]
+		for _, snapID := range img.Devices {
+			if snapID == snapshotID {
+				return &image{img.clone()}, nil
+			}
+		}
+	}
+	return nil, aws.ErrImageNonExisting
+}
+
+// DeregisterImage removes the image, but not its snapshots, like in EC2
+func (e *EC2) DeregisterImage(ctx context.Context, imageID string) error {
+	if strings.TrimSpace(imageID) == "" {
+		return aws.ErrImageNonExisting
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DeregisterImage"); err != nil {
+		return err
+	}
+	if _, exists := e.images[imageID]; !exists {
+		return aws.ErrImageNonExisting
+	}
+	delete(e.images, imageID)
+	return nil
+}
+
+func (e *EC2) AwaitImageAvailable(ctx context.Context, imageID string) error {
+	if strings.TrimSpace(imageID) == "" {
+		return aws.ErrImageNonExisting
+	}
+	return e.await(ctx, "DescribeImages", func() (bool, error) {
+		img, exists := e.images[imageID]
+		if !exists {
+			return false, errWaiter(imageID, StateDeregistered)
+		}
+		if img.State == stateFailed {
+			return false, errWaiter(imageID, img.State)
+		}
+		return img.State == StateAvailable, nil
+	})
+}
+
+// CopyImage copies an image of this region or of a peer, see Peer
+func (e *EC2) CopyImage(ctx context.Context, sourceRegion, sourceImageID, name, desc string) (string, error) {
+	if strings.TrimSpace(sourceImageID) == "" {
+		return "", aws.ErrImageNonExisting
+	}
+	// Look up the source and its snapshot sizes first, as the source
+	// simulator must be locked to read them
+	src := e
+	if sourceRegion != e.region {
+		e.mutex.Lock()
+		src = e.peers[sourceRegion]
+		e.mutex.Unlock()
+	}
+	var source *Image
+	sizes := make(map[string]int64)
+	if src != nil {
+		source = src.Image(sourceImageID)
+	}
+	if source != nil {
+		for device, snapID := range source.Devices {
+			if snap := src.Snapshot(snapID); snap != nil {
+				sizes[device] = snap.SizeGB
+			}
+		}
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("CopyImage"); err != nil {
+		return "", err
+	}
+	if source == nil {
+		return "", aws.ErrImageNonExisting
+	}
+	if e.nameTaken(name) {
+		return "", duplicateName(name)
+	}
+	img := e.newImage(name, desc, source.RootDeviceName, source.ENASupport, sizes)
+	return img.ID, nil
+}
+
+func (e *EC2) ShareImage(ctx context.Context, imageID string, perms aws.LaunchPermissions) error {
+	if strings.TrimSpace(imageID) == "" {
+		return aws.ErrImageNonExisting
+	}
+	if perms.Empty() {
+		return nil
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("ModifyImageAttribute"); err != nil {
+		return err
+	}
+	img, exists := e.images[imageID]
+	if !exists {
+		return aws.ErrImageNonExisting
+	}
+	img.LaunchPermissions = append(img.LaunchPermissions, perms.AccountIDs...)
+	img.LaunchPermissions = append(img.LaunchPermissions, perms.OrganizationARNs...)
+	img.LaunchPermissions = append(img.LaunchPermissions, perms.OrganizationalUnitARNs...)
+	return nil
+}
@@ -0,0 +1,471 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	cliResourceTagKey   = "metavisor-cli"
+	cliResourceTagValue = "true"
+)
+
+// instance is what the service returns, a copy of the simulated state so
+// that it doesn't change after being returned
+type instance struct {
+	s Instance
+}
+
+func (i *instance) ID() string                       { return i.s.ID }
+func (i *instance) InstanceType() string             { return i.s.InstanceType }
+func (i *instance) RootDeviceName() string           { return i.s.RootDeviceName }
+func (i *instance) DeviceMapping() map[string]string { return i.s.Devices }
+func (i *instance) PublicIP() string                 { return i.s.PublicIP }
+func (i *instance) PrivateIP() string                { return i.s.PrivateIP }
+func (i *instance) AvailabilityZone() string         { return i.s.Zone }
+func (i *instance) SriovNetSupport() string          { return i.s.SriovNetSupport }
+func (i *instance) ENASupport() bool                 { return i.s.ENASupport }
+func (i *instance) Tags() map[string]string          { return i.s.Tags }
+
+func instanceNotFound(id string) error {
+	return awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", id), nil)
+}
+
+// SetInstance changes the state of an instance using the given function,
+// e.g. to mark it as impaired. It panics if the instance doesn't exist.
+func (e *EC2) SetInstance(instanceID string, f func(inst *Instance)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	inst, exists := e.instances[instanceID]
+	if !exists {
+		panic(fmt.Sprintf("fake: instance %s doesn't exist", instanceID))
+	}
+	f(inst)
+}
+
+// newInstance creates a pending instance with volumes created from the
+// snapshots of the image and the extra devices. It must be called with the
+// lock held.
+func (e *EC2) newInstance(img *Image, instanceType, userdata, keyName, subnetID string, tags map[string]string, extraDevices []aws.NewDevice) *Instance {
+	inst := &Instance{
+		ID:                  e.newID("i"),
+		ImageID:             img.ID,
+		InstanceType:        instanceType,
+		State:               StatePending,
+		RootDeviceName:      img.RootDeviceName,
+		Zone:                e.Zone(),
+		SubnetID:            subnetID,
+		KeyName:             keyName,
+		PrivateIP:           e.privateIP(),
+		Userdata:            userdata,
+		ENASupport:          img.ENASupport,
+		Devices:             make(map[string]string),
+		DeleteOnTermination: make(map[string]bool),
+		Tags:                copyTags(tags),
+	}
+	inst.next = StateRunning
+	inst.at = time.Now().Add(e.Latencies.InstanceStart)
+	devices := copyTags(img.Devices)
+	for _, d := range extraDevices {
+		devices[d.DeviceName] = d.SnapshotID
+	}
+	for device, snapID := range devices {
+		var size int64
+		if snap, exists := e.snapshots[snapID]; exists {
+			size = snap.SizeGB
+		}
+		vol := &Volume{
+			ID:          e.newID("vol"),
+			SnapshotID:  snapID,
+			VolumeType:  "gp2",
+			Zone:        inst.Zone,
+			SizeGB:      size,
+			State:       StateInUse,
+			InstanceID:  inst.ID,
+			Device:      device,
+			AttachState: StateAttached,
+			Tags:        copyTags(tags),
+		}
+		e.volumes[vol.ID] = vol
+		inst.Devices[device] = vol.ID
+		inst.DeleteOnTermination[device] = true
+	}
+	e.instances[inst.ID] = inst
+	return inst
+}
+
+func (e *EC2) GetInstance(ctx context.Context, instanceID string) (aws.Instance, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return nil, aws.ErrInstanceNonExisting
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	inst, exists := e.instances[instanceID]
+	if !exists {
+		return nil, aws.ErrInstanceNonExisting
+	}
+	return &instance{inst.clone()}, nil
+}
+
+// FindInstances supports filtering on instance-id, instance-state-name,
+// instance-type, image-id, subnet-id, availability-zone, tag-key and tag:KEY
+func (e *EC2) FindInstances(ctx context.Context, filters map[string][]string) ([]string, error) {
+	defer e.mutex.Unlock()
+	if err := e.begin("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for id, inst := range e.instances {
+		matches := true
+		for name, values := range filters {
+			var actual []string
+			switch {
+			case name == "instance-id":
+				actual = []string{inst.ID}
+			case name == "instance-state-name":
+				actual = []string{inst.State}
+			case name == "instance-type":
+				actual = []string{inst.InstanceType}
+			case name == "image-id":
+				actual = []string{inst.ImageID}
+			case name == "subnet-id":
+				actual = []string{inst.SubnetID}
+			case name == "availability-zone":
+				actual = []string{inst.Zone}
+			case name == "tag-key":
+				for k := range inst.Tags {
+					actual = append(actual, k)
+				}
+			case strings.HasPrefix(name, "tag:"):
+				if v, tagged := inst.Tags[strings.TrimPrefix(name, "tag:")]; tagged {
+					actual = []string{v}
+				}
+			default:
+				return nil, aws.ErrInvalidFilter
+			}
+			matches = matches && anyEqual(actual, values)
+		}
+		if matches {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func anyEqual(actual, accepted []string) bool {
+	for _, a := range actual {
+		for _, v := range accepted {
+			if a == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *EC2) GetInstanceUserdata(ctx context.Context, instanceID string) (string, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return "", aws.ErrInstanceNonExisting
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DescribeInstanceAttribute"); err != nil {
+		return "", err
+	}
+	inst, exists := e.instances[instanceID]
+	if !exists {
+		return "", aws.ErrInstanceNonExisting
+	}
+	return inst.Userdata, nil
+}
+
+func (e *EC2) LaunchInstance(ctx context.Context, imageID, instanceType, userData, keyName, subnetID string, opts aws.LaunchOptions, tags map[string]string, extraDevices ...aws.NewDevice) (aws.Instance, error) {
+	if !aws.IsAMIID(imageID) {
+		return nil, aws.ErrInvalidAMIID
+	}
+	if strings.TrimSpace(keyName) != "" {
+		if keyExist, err := e.KeyPairExist(ctx, keyName); (err != nil && err != aws.ErrNotAllowed) || (!keyExist && err == nil) {
+			// Like the real service, assume it exists if not allowed to check
+			if err == nil {
+				err = aws.ErrKeyNonExisting
+			}
+			return nil, err
+		}
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("RunInstances"); err != nil {
+		return nil, err
+	}
+	img, exists := e.images[imageID]
+	if !exists {
+		return nil, awserr.New("InvalidAMIID.NotFound", fmt.Sprintf("The image id '[%s]' does not exist", imageID), nil)
+	}
+	if img.State != StateAvailable {
+		return nil, awserr.New("InvalidAMIID.Unavailable", fmt.Sprintf("The image id '[%s]' is %s", imageID, img.State), nil)
+	}
+	if strings.TrimSpace(subnetID) == "" && e.RequireSubnet {
+		return nil, aws.ErrRequiresSubnet
+	}
+	if strings.TrimSpace(subnetID) != "" && !e.subnets[subnetID] {
+		return nil, aws.ErrInvalidSubnetID
+	}
+	if strings.TrimSpace(subnetID) == "" && opts.Zone != "" && opts.Zone != e.Zone() {
+		return nil, awserr.New("InvalidParameterValue", fmt.Sprintf("Invalid availability zone: [%s]", opts.Zone), nil)
+	}
+	for _, d := range extraDevices {
+		if _, exists := e.snapshots[d.SnapshotID]; !exists {
+			return nil, snapshotNotFound(d.SnapshotID)
+		}
+	}
+	if tags != nil {
+		if _, exist := tags[cliResourceTagKey]; !exist {
+			tags[cliResourceTagKey] = cliResourceTagValue
+		}
+	}
+	inst := e.newInstance(img, instanceType, userData, keyName, subnetID, tags, extraDevices)
+	inst.NoPublicIP = opts.NoPublicIP
+	inst.InstanceProfile = opts.InstanceProfile
+	// Tags are not part of the response in the real service
+	res := inst.clone()
+	res.Tags = make(map[string]string)
+	return &instance{res}, nil
+}
+
+func (e *EC2) GetLaunchZone(ctx context.Context, subnetID string) (string, error) {
+	defer e.mutex.Unlock()
+	if strings.TrimSpace(subnetID) == "" {
+		if err := e.begin("DescribeAvailabilityZones"); err != nil {
+			return "", err
+		}
+		return e.Zone(), nil
+	}
+	if err := e.begin("DescribeSubnets"); err != nil {
+		return "", err
+	}
+	if !e.subnets[subnetID] {
+		return "", aws.ErrInvalidSubnetID
+	}
+	// All instances are in the same zone
+	return e.Zone(), nil
+}
+
+func (e *EC2) TerminateInstance(ctx context.Context, instanceID string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return aws.ErrInvalidName
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("TerminateInstances"); err != nil {
+		return err
+	}
+	inst, exists := e.instances[instanceID]
+	if !exists {
+		return nil
+	}
+	switch inst.State {
+	case StateShuttingDown, StateTerminated:
+		return nil
+	}
+	inst.State = StateShuttingDown
+	inst.next = StateTerminated
+	inst.at = time.Now().Add(e.Latencies.InstanceTerminate)
+	return nil
+}
+
+func (e *EC2) StopInstance(ctx context.Context, instanceID string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return aws.ErrInvalidName
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("StopInstances"); err != nil {
+		return err
+	}
+	inst, exists := e.instances[instanceID]
+	if !exists {
+		return aws.ErrInstanceNonExisting
+	}
+	switch inst.State {
+	case StateStopping, StateStopped:
+		return nil
+	case StateRunning:
+		inst.State = StateStopping
+		inst.next = StateStopped
+		inst.at = time.Now().Add(e.Latencies.InstanceStop)
+		return nil
+	}
+	return incorrectState("The instance '%s' is not in a state from which it can be stopped.", instanceID)
+}
+
+func (e *EC2) StartInstance(ctx context.Context, instanceID string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return aws.ErrInvalidName
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("StartInstances"); err != nil {
+		return err
+	}
+	inst, exists := e.instances[instanceID]
+	if !exists {
+		return aws.ErrInstanceNonExisting
+	}
+	switch inst.State {
+	case StatePending, StateRunning:
+		return nil
+	case StateStopped:
+		break
+	default:
+		return incorrectState("The instance '%s' is not in a state from which it can be started.", instanceID)
+	}
+	rootVolID, hasRoot := inst.Devices[inst.RootDeviceName]
+	if !hasRoot || e.volumes[rootVolID].AttachState != StateAttached {
+		return awserr.New(codeInvalidParam, fmt.Sprintf("Invalid value '%s' for instanceId. Instance does not have a volume attached at root (%s)", instanceID, inst.RootDeviceName), nil)
+	}
+	inst.State = StatePending
+	inst.next = StateRunning
+	inst.at = time.Now().Add(e.Latencies.InstanceStart)
+	return nil
+}
+
+func (e *EC2) ModifyInstanceAttribute(ctx context.Context, instanceID string, attr aws.InstanceAttribute, value interface{}) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return aws.ErrInvalidInstanceID
+	}
+	var str string
+	var enabled bool
+	switch attr {
+	case aws.AttrSriovNetSupport, aws.AttrUserData:
+		v, ok := value.(string)
+		if !ok && attr == aws.AttrSriovNetSupport {
+			return aws.ErrInvalidInstanceAttrValue
+		}
+		str = v
+	case aws.AttrENASupport:
+		v, ok := value.(bool)
+		if !ok {
+			return aws.ErrInvalidInstanceAttrValue
+		}
+		enabled = v
+	default:
+		return aws.ErrInvalidInstanceAttr
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("ModifyInstanceAttribute"); err != nil {
+		return err
+	}
+	inst, exists := e.instances[instanceID]
+	if !exists {
+		return instanceNotFound(instanceID)
+	}
+	if inst.State != StateStopped {
+		return incorrectState("The instance '%s' is not in the 'stopped' state.", instanceID)
+	}
+	switch attr {
+	case aws.AttrSriovNetSupport:
+		inst.SriovNetSupport = str
+	case aws.AttrENASupport:
+		inst.ENASupport = enabled
+	case aws.AttrUserData:
+		inst.Userdata = str
+	}
+	return nil
+}
+
+func (e *EC2) DeleteInstanceDevicesOnTermination(ctx context.Context, instanceID string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return aws.ErrInvalidID
+	}
+	if _, err := e.GetInstance(ctx, instanceID); err != nil {
+		return err
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("ModifyInstanceAttribute"); err != nil {
+		return err
+	}
+	inst, exists := e.instances[instanceID]
+	if !exists {
+		return instanceNotFound(instanceID)
+	}
+	for device := range inst.Devices {
+		inst.DeleteOnTermination[device] = true
+	}
+	return nil
+}
+
+// AwaitInstanceOK waits for the status checks to pass. Like in EC2, only
+// running instances have a status, so it returns directly for instances in
+// any other state.
+func (e *EC2) AwaitInstanceOK(ctx context.Context, instanceID string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return aws.ErrInstanceNonExisting
+	}
+	return e.await(ctx, "DescribeInstanceStatus", func() (bool, error) {
+		inst, exists := e.instances[instanceID]
+		if !exists || inst.State != StateRunning {
+			return true, nil
+		}
+		if inst.Impaired {
+			return false, aws.ErrInstanceImpaired
+		}
+		return !time.Now().Before(inst.statusOK), nil
+	})
+}
+
+func (e *EC2) AwaitInstanceRunning(ctx context.Context, instanceID string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return aws.ErrInvalidName
+	}
+	return e.await(ctx, "DescribeInstances", func() (bool, error) {
+		inst, exists := e.instances[instanceID]
+		if !exists {
+			return false, nil
+		}
+		switch inst.State {
+		case StateRunning:
+			return true, nil
+		case StateShuttingDown, StateTerminated, StateStopping:
+			return false, errWaiter(instanceID, inst.State)
+		}
+		return false, nil
+	})
+}
+
+func (e *EC2) AwaitInstanceStopped(ctx context.Context, instanceID string) error {
+	if strings.TrimSpace(instanceID) == "" {
+		return aws.ErrInvalidName
+	}
+	return e.await(ctx, "DescribeInstances", func() (bool, error) {
+		inst, exists := e.instances[instanceID]
+		if !exists {
+			return false, nil
+		}
+		switch inst.State {
+		case StateStopped:
+			return true, nil
+		case StatePending, StateTerminated:
+			return false, errWaiter(instanceID, inst.State)
+		}
+		return false, nil
+	})
+}
@@ -0,0 +1,62 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"strings"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+)
+
+func (e *EC2) KeyPairExist(ctx context.Context, key string) (bool, error) {
+	if strings.TrimSpace(key) == "" {
+		return false, nil
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DescribeKeyPairs"); err != nil {
+		return false, err
+	}
+	_, exists := e.keyPairs[key]
+	return exists, nil
+}
+
+func (e *EC2) CreateKeyPair(ctx context.Context, name string) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", aws.ErrInvalidName
+	}
+	if exist, _ := e.KeyPairExist(ctx, name); exist {
+		return "", aws.ErrInvalidName
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("CreateKeyPair"); err != nil {
+		return "", err
+	}
+	e.keyPairs[name] = privateKeyMaterial(name)
+	return e.keyPairs[name], nil
+}
+
+// RemoveKeyPair succeeds even if the key pair doesn't exist, like in EC2
+func (e *EC2) RemoveKeyPair(ctx context.Context, name string) error {
+	if strings.TrimSpace(name) == "" {
+		return aws.ErrInvalidName
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DeleteKeyPair"); err != nil {
+		return err
+	}
+	delete(e.keyPairs, name)
+	return nil
+}
@@ -0,0 +1,127 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+)
+
+// Bucket simulates an S3 bucket implementing aws.Bucket. Presigned URLs
+// point to a local HTTP server, so anything can upload to them with a plain
+// HTTP PUT, like to the URLs of the real service.
+type Bucket struct {
+	name    string
+	server  *httptest.Server
+	mutex   sync.Mutex
+	objects map[string][]byte
+	// presigned is when the presigned URL of each key expires
+	presigned map[string]time.Time
+}
+
+// NewBucket starts a simulated bucket, which must be closed when done
+func NewBucket(name string) *Bucket {
+	b := &Bucket{
+		name:      name,
+		objects:   make(map[string][]byte),
+		presigned: make(map[string]time.Time),
+	}
+	b.server = httptest.NewServer(http.HandlerFunc(b.serveHTTP))
+	return b
+}
+
+// Close stops the HTTP server of the presigned URLs
+func (b *Bucket) Close() {
+	b.server.Close()
+}
+
+// Object returns the content of the object, and whether it exists
+func (b *Bucket) Object(key string) ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	data, exists := b.objects[key]
+	return data, exists
+}
+
+// Keys returns the keys of all objects in the bucket
+func (b *Bucket) Keys() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	keys := []string{}
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (b *Bucket) Name() string { return b.name }
+
+func (b *Bucket) PresignPut(key string, expires time.Duration) (string, error) {
+	if strings.TrimSpace(key) == "" {
+		return "", aws.ErrInvalidName
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.presigned[key] = time.Now().Add(expires)
+	u := fmt.Sprintf("%s/%s/%s", b.server.URL, b.name, key)
+	return u + "?" + url.Values{"X-Amz-Expires": {fmt.Sprint(int(expires / time.Second))}}.Encode(), nil
+}
+
+func (b *Bucket) Download(ctx context.Context, key, path string) error {
+	data, exists := b.Object(key)
+	if !exists {
+		return aws.ErrObjectNonExisting
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func (b *Bucket) Delete(ctx context.Context, key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.objects, key)
+	return nil
+}
+
+// serveHTTP accepts uploads to presigned URLs that haven't expired
+func (b *Bucket) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/"+b.name+"/")
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	expires, signed := b.presigned[key]
+	if !signed || time.Now().After(expires) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<Error><Code>AccessDenied</Code></Error>")
+		return
+	}
+	b.objects[key] = data
+}
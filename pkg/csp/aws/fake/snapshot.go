@@ -0,0 +1,159 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+type snapshot struct {
+	s Snapshot
+}
+
+func (s *snapshot) ID() string              { return s.s.ID }
+func (s *snapshot) SizeGB() int64           { return s.s.SizeGB }
+func (s *snapshot) Tags() map[string]string { return s.s.Tags }
+
+func snapshotNotFound(id string) error {
+	return awserr.New("InvalidSnapshot.NotFound", fmt.Sprintf("The snapshot '%s' does not exist.", id), nil)
+}
+
+// newSnapshot creates a pending snapshot, which is completed after the
+// snapshot latency. It must be called with the lock held.
+func (e *EC2) newSnapshot(volumeID, desc string, sizeGB int64) *Snapshot {
+	now := time.Now()
+	snap := &Snapshot{
+		ID:          e.newID("snap"),
+		VolumeID:    volumeID,
+		Description: desc,
+		SizeGB:      sizeGB,
+		State:       StatePending,
+		Tags:        make(map[string]string),
+		started:     now,
+		done:        now.Add(e.Latencies.Snapshot),
+	}
+	e.snapshots[snap.ID] = snap
+	return snap
+}
+
+func (e *EC2) GetSnapshot(ctx context.Context, snapshotID string) (aws.Snapshot, error) {
+	if strings.TrimSpace(snapshotID) == "" {
+		return nil, aws.ErrSnapshotNonExisting
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DescribeSnapshots"); err != nil {
+		return nil, err
+	}
+	snap, exists := e.snapshots[snapshotID]
+	if !exists {
+		return nil, aws.ErrSnapshotNonExisting
+	}
+	return &snapshot{snap.clone()}, nil
+}
+
+// CreateSnapshot waits for the snapshot to complete and then tags it with
+// its name, like the real service
+func (e *EC2) CreateSnapshot(ctx context.Context, name, sourceVolumeID string) (aws.Snapshot, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, aws.ErrInvalidName
+	}
+	snapID, err := e.createSnapshot(sourceVolumeID)
+	if err != nil {
+		return nil, err
+	}
+	err = e.await(ctx, "DescribeSnapshots", func() (bool, error) {
+		snap, exists := e.snapshots[snapID]
+		if !exists {
+			return false, snapshotNotFound(snapID)
+		}
+		return snap.State == StateCompleted, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	nameTags := map[string]string{
+		"Name":            name,
+		cliResourceTagKey: cliResourceTagValue,
+	}
+	err = e.TagResources(ctx, nameTags, snapID)
+	if err != nil && err != aws.ErrNotAllowed {
+		return nil, err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return &snapshot{e.snapshots[snapID].clone()}, nil
+}
+
+func (e *EC2) createSnapshot(volumeID string) (string, error) {
+	defer e.mutex.Unlock()
+	if err := e.begin("CreateSnapshot"); err != nil {
+		return "", err
+	}
+	vol, exists := e.volumes[volumeID]
+	if !exists {
+		return "", volumeNotFound(volumeID)
+	}
+	desc := fmt.Sprintf("Created by metavisor-cli, based on volume %s", volumeID)
+	return e.newSnapshot(vol.ID, desc, vol.SizeGB).ID, nil
+}
+
+// DeleteSnapshot fails if the snapshot is used by an image, like in EC2
+func (e *EC2) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	if strings.TrimSpace(snapshotID) == "" {
+		return aws.ErrInvalidSnapshotID
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DeleteSnapshot"); err != nil {
+		return err
+	}
+	if _, exists := e.snapshots[snapshotID]; !exists {
+		return nil
+	}
+	for _, img := range e.images {
+		for _, id := range img.Devices {
+			if id == snapshotID {
+				return awserr.New(codeSnapshotInUse, fmt.Sprintf("The snapshot %s is currently in use by %s", snapshotID, img.ID), nil)
+			}
+		}
+	}
+	delete(e.snapshots, snapshotID)
+	return nil
+}
+
+func (e *EC2) ShareSnapshot(ctx context.Context, snapshotID string, accountIDs ...string) error {
+	if strings.TrimSpace(snapshotID) == "" {
+		return aws.ErrInvalidSnapshotID
+	}
+	if len(accountIDs) == 0 {
+		return nil
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("ModifySnapshotAttribute"); err != nil {
+		return err
+	}
+	snap, exists := e.snapshots[snapshotID]
+	if !exists {
+		return aws.ErrSnapshotNonExisting
+	}
+	snap.SharedWith = append(snap.SharedWith, accountIDs...)
+	return nil
+}
@@ -0,0 +1,73 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"sync"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+)
+
+// CommandRunner simulates SSM Run Command on the instances of a simulated
+// EC2, implementing aws.CommandRunner. Like in SSM, only running instances
+// with an instance profile are managed.
+type CommandRunner struct {
+	// Run returns the output of the commands on the instance, there is no
+	// output if nil
+	Run func(inst Instance, commands []string) (string, error)
+
+	ec2      *EC2
+	mutex    sync.Mutex
+	commands [][]string
+}
+
+// NewCommandRunner returns a CommandRunner for the instances of the EC2
+func NewCommandRunner(ec2 *EC2) *CommandRunner {
+	return &CommandRunner{ec2: ec2}
+}
+
+// Commands returns the commands of all runs so far
+func (c *CommandRunner) Commands() [][]string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([][]string{}, c.commands...)
+}
+
+func (c *CommandRunner) AwaitManaged(ctx context.Context, instanceID string) error {
+	inst := c.ec2.Instance(instanceID)
+	if inst == nil || inst.InstanceProfile == "" {
+		return aws.ErrNotManaged
+	}
+	return c.ec2.AwaitInstanceRunning(ctx, instanceID)
+}
+
+func (c *CommandRunner) RunShellScript(ctx context.Context, instanceID string, commands []string) (string, error) {
+	inst := c.ec2.Instance(instanceID)
+	if inst == nil || inst.InstanceProfile == "" || inst.State != StateRunning {
+		return "", aws.ErrNotManaged
+	}
+	c.mutex.Lock()
+	c.commands = append(c.commands, commands)
+	c.mutex.Unlock()
+	if c.Run == nil {
+		return "", nil
+	}
+	out, err := c.Run(*inst, commands)
+	if len(out) > aws.MaxCommandOutput {
+		out = out[:aws.MaxCommandOutput]
+	}
+	return out, err
+}
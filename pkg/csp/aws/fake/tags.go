@@ -0,0 +1,108 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// resourceTags returns the tags of the resource with the given ID, so they
+// can be changed. It must be called with the lock held.
+func (e *EC2) resourceTags(id string) (map[string]string, error) {
+	if inst, exists := e.instances[id]; exists {
+		return inst.Tags, nil
+	}
+	if vol, exists := e.volumes[id]; exists {
+		return vol.Tags, nil
+	}
+	if snap, exists := e.snapshots[id]; exists {
+		return snap.Tags, nil
+	}
+	if img, exists := e.images[id]; exists {
+		return img.Tags, nil
+	}
+	return nil, awserr.New(codeInvalidID, fmt.Sprintf("The ID '%s' is not valid", id), nil)
+}
+
+// TagResources tags all resources, or none of them if any doesn't exist
+func (e *EC2) TagResources(ctx context.Context, tags map[string]string, resourceID ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("CreateTags"); err != nil {
+		return err
+	}
+	resources := []map[string]string{}
+	for _, id := range resourceID {
+		res, err := e.resourceTags(id)
+		if err != nil {
+			return err
+		}
+		resources = append(resources, res)
+	}
+	for _, res := range resources {
+		for k, v := range tags {
+			res[k] = v
+		}
+	}
+	return nil
+}
+
+// UntagResources untags all resources, or none of them if any doesn't exist
+func (e *EC2) UntagResources(ctx context.Context, keys []string, resourceID ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DeleteTags"); err != nil {
+		return err
+	}
+	resources := []map[string]string{}
+	for _, id := range resourceID {
+		res, err := e.resourceTags(id)
+		if err != nil {
+			return err
+		}
+		resources = append(resources, res)
+	}
+	for _, res := range resources {
+		for _, k := range keys {
+			delete(res, k)
+		}
+	}
+	return nil
+}
+
+// DryRun only checks if the action is denied. Dry runs are not counted as
+// calls, so they don't use up faults scheduled for the real call.
+func (e *EC2) DryRun(ctx context.Context, action aws.DryRunAction, params aws.DryRunParams) error {
+	name := aws.DryRunActionName(action)
+	if name == "unknown" {
+		return aws.ErrInvalidDryRunAction
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.denied[strings.TrimPrefix(name, "ec2:")] {
+		return aws.ErrNotAllowed
+	}
+	return nil
+}
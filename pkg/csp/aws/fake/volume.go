@@ -0,0 +1,234 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+var validVolumeTypes = []string{"gp2", "io1", "st1", "sc1", "standard"}
+
+type volume struct {
+	s Volume
+}
+
+func (v *volume) ID() string              { return v.s.ID }
+func (v *volume) SnapshotID() string      { return v.s.SnapshotID }
+func (v *volume) Tags() map[string]string { return v.s.Tags }
+
+func volumeNotFound(id string) error {
+	return awserr.New("InvalidVolume.NotFound", fmt.Sprintf("The volume '%s' does not exist.", id), nil)
+}
+
+func (e *EC2) CreateVolume(ctx context.Context, sourceSnapshotID, volumeType, zone string, size int64) (aws.Volume, error) {
+	if strings.TrimSpace(sourceSnapshotID) == "" {
+		return nil, aws.ErrInvalidSnapshotID
+	}
+	if !anyEqual([]string{volumeType}, validVolumeTypes) {
+		return nil, aws.ErrInvalidVolumeType
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("CreateVolume"); err != nil {
+		return nil, err
+	}
+	snap, exists := e.snapshots[sourceSnapshotID]
+	if !exists {
+		return nil, snapshotNotFound(sourceSnapshotID)
+	}
+	if snap.State != StateCompleted {
+		return nil, awserr.New("IncorrectState", fmt.Sprintf("Snapshot '%s' is not 'completed'.", snap.ID), nil)
+	}
+	if !strings.HasPrefix(zone, e.region) {
+		return nil, awserr.New(codeInvalidParam, fmt.Sprintf("Invalid availability zone: [%s]", zone), nil)
+	}
+	if size < snap.SizeGB {
+		return nil, awserr.New(codeInvalidParam, fmt.Sprintf("Volume of %d GiB is smaller than snapshot '%s'", size, snap.ID), nil)
+	}
+	vol := &Volume{
+		ID:         e.newID("vol"),
+		SnapshotID: snap.ID,
+		VolumeType: volumeType,
+		Zone:       zone,
+		SizeGB:     size,
+		State:      StateCreating,
+		Tags: map[string]string{
+			cliResourceTagKey: cliResourceTagValue,
+		},
+	}
+	vol.next = StateAvailable
+	vol.at = time.Now().Add(e.Latencies.VolumeCreate)
+	e.volumes[vol.ID] = vol
+	return &volume{vol.clone()}, nil
+}
+
+func (e *EC2) GetVolume(ctx context.Context, volumeID string) (aws.Volume, error) {
+	if strings.TrimSpace(volumeID) == "" {
+		return nil, aws.ErrInvalidVolumeID
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DescribeVolumes"); err != nil {
+		return nil, err
+	}
+	vol, exists := e.volumes[volumeID]
+	if !exists {
+		return nil, aws.ErrVolumeNonExisting
+	}
+	return &volume{vol.clone()}, nil
+}
+
+func (e *EC2) DeleteVolume(ctx context.Context, volumeID string) error {
+	if strings.TrimSpace(volumeID) == "" {
+		return aws.ErrInvalidVolumeID
+	}
+	defer e.mutex.Unlock()
+	if err := e.begin("DeleteVolume"); err != nil {
+		return err
+	}
+	vol, exists := e.volumes[volumeID]
+	if !exists {
+		return nil
+	}
+	if vol.State != StateAvailable {
+		return awserr.New(codeVolumeInUse, fmt.Sprintf("Volume %s is currently %s", volumeID, vol.State), nil)
+	}
+	delete(e.volumes, volumeID)
+	return nil
+}
+
+// DetachVolume starts detaching the volume and then waits for it to be
+// available, like the real service
+func (e *EC2) DetachVolume(ctx context.Context, volumeID, instanceID, deviceName string) error {
+	if strings.TrimSpace(volumeID) == "" {
+		return aws.ErrInvalidVolumeID
+	}
+	if strings.TrimSpace(instanceID) == "" {
+		return aws.ErrInvalidInstanceID
+	}
+	if err := e.detachVolume(volumeID, instanceID, deviceName); err != nil {
+		return err
+	}
+	return e.AwaitVolumeAvailable(ctx, volumeID)
+}
+
+func (e *EC2) detachVolume(volumeID, instanceID, deviceName string) error {
+	defer e.mutex.Unlock()
+	if err := e.begin("DetachVolume"); err != nil {
+		return err
+	}
+	vol, exists := e.volumes[volumeID]
+	if !exists {
+		return volumeNotFound(volumeID)
+	}
+	if vol.InstanceID != instanceID || vol.Device != deviceName || vol.AttachState != StateAttached {
+		return awserr.New("IncorrectState", fmt.Sprintf("Volume '%s' is not attached to '%s' on %s", volumeID, instanceID, deviceName), nil)
+	}
+	inst := e.instances[instanceID]
+	if deviceName == inst.RootDeviceName && inst.State != StateStopped {
+		return incorrectState("Unable to detach root volume '%s' from instance '%s' unless it is stopped", volumeID, instanceID)
+	}
+	vol.AttachState = StateDetaching
+	vol.next = StateAvailable
+	vol.at = time.Now().Add(e.Latencies.VolumeDetach)
+	return nil
+}
+
+// AttachVolume starts attaching the volume and then waits for it to be in
+// use, like the real service. The volume shows up in the device mapping of
+// the instance directly.
+func (e *EC2) AttachVolume(ctx context.Context, volumeID, instanceID, deviceName string) error {
+	if strings.TrimSpace(volumeID) == "" {
+		return aws.ErrInvalidVolumeID
+	}
+	if strings.TrimSpace(instanceID) == "" {
+		return aws.ErrInvalidInstanceID
+	}
+	if err := e.attachVolume(volumeID, instanceID, deviceName); err != nil {
+		return err
+	}
+	return e.AwaitVolumeInUse(ctx, volumeID)
+}
+
+func (e *EC2) attachVolume(volumeID, instanceID, deviceName string) error {
+	defer e.mutex.Unlock()
+	if err := e.begin("AttachVolume"); err != nil {
+		return err
+	}
+	vol, exists := e.volumes[volumeID]
+	if !exists {
+		return volumeNotFound(volumeID)
+	}
+	inst, exists := e.instances[instanceID]
+	if !exists {
+		return instanceNotFound(instanceID)
+	}
+	if vol.State != StateAvailable {
+		return awserr.New(codeVolumeInUse, fmt.Sprintf("%s is already attached to an instance", volumeID), nil)
+	}
+	if vol.Zone != inst.Zone {
+		return awserr.New("InvalidVolume.ZoneMismatch", fmt.Sprintf("The volume '%s' is not in the same availability zone as instance '%s'", volumeID, instanceID), nil)
+	}
+	if _, occupied := inst.Devices[deviceName]; occupied {
+		return awserr.New(codeInvalidParam, fmt.Sprintf("Invalid value '%s' for unixDevice. Attachment point %s is already in use", deviceName, deviceName), nil)
+	}
+	switch {
+	case inst.State != StateRunning && inst.State != StateStopped:
+		return incorrectState("Instance '%s' is not 'running' or 'stopped'.", instanceID)
+	case deviceName == inst.RootDeviceName && inst.State != StateStopped:
+		return incorrectState("Unable to attach volume '%s' as root device of instance '%s' unless it is stopped", volumeID, instanceID)
+	}
+	vol.State = StateInUse
+	vol.InstanceID = instanceID
+	vol.Device = deviceName
+	vol.AttachState = StateAttaching
+	vol.next = StateAttached
+	vol.at = time.Now().Add(e.Latencies.VolumeAttach)
+	inst.Devices[deviceName] = volumeID
+	inst.DeleteOnTermination[deviceName] = false
+	return nil
+}
+
+func (e *EC2) AwaitVolumeAvailable(ctx context.Context, volumeID string) error {
+	if strings.TrimSpace(volumeID) == "" {
+		return aws.ErrInvalidVolumeID
+	}
+	return e.await(ctx, "DescribeVolumes", func() (bool, error) {
+		vol, exists := e.volumes[volumeID]
+		if !exists {
+			return false, errWaiter(volumeID, StateDeleted)
+		}
+		return vol.State == StateAvailable, nil
+	})
+}
+
+// AwaitVolumeInUse waits until the volume is attached to an instance
+func (e *EC2) AwaitVolumeInUse(ctx context.Context, volumeID string) error {
+	if strings.TrimSpace(volumeID) == "" {
+		return aws.ErrInvalidVolumeID
+	}
+	return e.await(ctx, "DescribeVolumes", func() (bool, error) {
+		vol, exists := e.volumes[volumeID]
+		if !exists {
+			return false, errWaiter(volumeID, StateDeleted)
+		}
+		return vol.State == StateInUse && vol.AttachState == StateAttached, nil
+	})
+}
@@ -16,6 +16,7 @@ package aws
 
 import (
 	"errors"
+	"regexp"
 	"strings"
 
 	"github.com/immutable/metavisor-cli/pkg/logging"
@@ -30,6 +31,12 @@ const (
 	subnetPrefix = "subnet-"
 )
 
+var (
+	accountIDPattern = regexp.MustCompile(`^\d{12}$`)
+	orgARNPattern    = regexp.MustCompile(`^arn:aws[a-z-]*:organizations::\d{12}:organization/o-[a-z0-9]+$`)
+	ouARNPattern     = regexp.MustCompile(`^arn:aws[a-z-]*:organizations::\d{12}:ou/o-[a-z0-9]+/ou-[a-z0-9]+-[a-z0-9]+$`)
+)
+
 // Amazon Linux AMIs (HVM EBS) collected on Feb 14 2018, from:
 // https://aws.amazon.com/amazon-linux-ami/
 // Regions can be found translated to IDs here:
@@ -95,6 +102,22 @@ func IsSubnetID(id string) bool {
 	return strings.HasPrefix(id, subnetPrefix)
 }
 
+// IsAccountID determines if the specified ID is an AWS account ID or not
+func IsAccountID(id string) bool {
+	return accountIDPattern.MatchString(id)
+}
+
+// IsOrganizationARN determines if the specified ARN belong to an organization or not
+func IsOrganizationARN(arn string) bool {
+	return orgARNPattern.MatchString(arn)
+}
+
+// IsOrganizationalUnitARN determines if the specified ARN belong to an
+// organizational unit or not
+func IsOrganizationalUnitARN(arn string) bool {
+	return ouARNPattern.MatchString(arn)
+}
+
 // IsValidRegion will validate a specified region to make sure it exist in AWS
 func IsValidRegion(region string) bool {
 	if strings.TrimSpace(region) == "" {
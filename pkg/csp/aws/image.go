@@ -31,6 +31,7 @@ type image struct {
 	state          string
 	name           string
 	description    string
+	tags           map[string]string
 }
 
 func (i *image) RootDeviceName() string           { return i.rootDeviceName }
@@ -39,6 +40,7 @@ func (i *image) ENASupport() bool                 { return i.enaSupport }
 func (i *image) State() string                    { return i.state }
 func (i *image) Name() string                     { return i.name }
 func (i *image) Description() string              { return i.description }
+func (i *image) Tags() map[string]string          { return i.tags }
 
 func (a *awsService) CreateImage(ctx context.Context, instanceID, name, desc string) (string, error) {
 	if strings.TrimSpace(instanceID) == "" {
@@ -82,39 +84,91 @@ func (a *awsService) GetImage(ctx context.Context, imageID string) (Image, error
 		return nil, err
 	}
 	for _, img := range out.Images {
-		var enaSupport bool
-		if img.EnaSupport != nil {
-			enaSupport = *img.EnaSupport
-		}
-		var state string
-		if img.State != nil {
-			state = *img.State
-		}
-		var name string
-		if img.Name != nil {
-			name = *img.Name
-		}
-		var desc string
-		if img.Description != nil {
-			desc = *img.Description
-		}
-		res := &image{
-			resource: resource{
-				id: *img.ImageId,
+		return imageFromEC2(img), nil
+	}
+	// If we got this far, the AMI doesn't exist
+	return nil, ErrImageNonExisting
+}
+
+func (a *awsService) GetImageBySnapshot(ctx context.Context, snapshotID string) (Image, error) {
+	if strings.TrimSpace(snapshotID) == "" {
+		return nil, ErrImageNonExisting
+	}
+	input := &ec2.DescribeImagesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("block-device-mapping.snapshot-id"),
+				Values: aws.StringSlice([]string{snapshotID}),
 			},
-			rootDeviceName: *img.RootDeviceName,
-			deviceMapping:  imageBlockToMap(img.BlockDeviceMappings),
-			enaSupport:     enaSupport,
-			state:          state,
-			name:           name,
-			description:    desc,
+		},
+	}
+	out, err := a.client.DescribeImagesWithContext(ctx, input)
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if ok && aerr.Code() == accessDeniedErrorCode {
+			return nil, ErrNotAllowed
 		}
-		return res, nil
+		return nil, err
+	}
+	for _, img := range out.Images {
+		return imageFromEC2(img), nil
 	}
-	// If we got this far, the AMI doesn't exist
 	return nil, ErrImageNonExisting
 }
 
+func imageFromEC2(img *ec2.Image) *image {
+	var enaSupport bool
+	if img.EnaSupport != nil {
+		enaSupport = *img.EnaSupport
+	}
+	var state string
+	if img.State != nil {
+		state = *img.State
+	}
+	var name string
+	if img.Name != nil {
+		name = *img.Name
+	}
+	var desc string
+	if img.Description != nil {
+		desc = *img.Description
+	}
+	res := &image{
+		resource: resource{
+			id: *img.ImageId,
+		},
+		rootDeviceName: *img.RootDeviceName,
+		deviceMapping:  imageBlockToMap(img.BlockDeviceMappings),
+		enaSupport:     enaSupport,
+		state:          state,
+		name:           name,
+		description:    desc,
+		tags:           ec2TagsToMap(img.Tags),
+	}
+	return res
+}
+
+func (a *awsService) DeregisterImage(ctx context.Context, imageID string) error {
+	if strings.TrimSpace(imageID) == "" {
+		return ErrImageNonExisting
+	}
+	input := &ec2.DeregisterImageInput{
+		ImageId: aws.String(imageID),
+	}
+	_, err := a.client.DeregisterImageWithContext(ctx, input)
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if ok && aerr.Code() == accessDeniedErrorCode {
+			return ErrNotAllowed
+		}
+		if ok && strings.Contains(aerr.Code(), amiIDErrorCode) {
+			return ErrImageNonExisting
+		}
+		return err
+	}
+	return nil
+}
+
 func (a *awsService) AwaitImageAvailable(ctx context.Context, imageID string) error {
 	if strings.TrimSpace(imageID) == "" {
 		return ErrImageNonExisting
@@ -17,6 +17,7 @@ package aws
 import (
 	"context"
 	"encoding/base64"
+	"sort"
 	"strings"
 	"time"
 
@@ -40,6 +41,7 @@ type instance struct {
 	zone            string
 	sriovNetSupport string
 	enaSupport      bool
+	tags            map[string]string
 }
 
 func (i *instance) InstanceType() string             { return i.instanceType }
@@ -50,6 +52,7 @@ func (i *instance) PrivateIP() string                { return i.privIP }
 func (i *instance) AvailabilityZone() string         { return i.zone }
 func (i *instance) SriovNetSupport() string          { return i.sriovNetSupport }
 func (i *instance) ENASupport() bool                 { return i.enaSupport }
+func (i *instance) Tags() map[string]string          { return i.tags }
 
 func (a *awsService) GetInstance(ctx context.Context, instanceID string) (Instance, error) {
 	if strings.TrimSpace(instanceID) == "" {
@@ -102,6 +105,7 @@ func (a *awsService) GetInstance(ctx context.Context, instanceID string) (Instan
 				zone:            zone,
 				sriovNetSupport: sriovSupport,
 				enaSupport:      enaSupport,
+				tags:            ec2TagsToMap(inst.Tags),
 			}
 			return res, nil
 		}
@@ -110,7 +114,7 @@ func (a *awsService) GetInstance(ctx context.Context, instanceID string) (Instan
 	return nil, ErrInstanceNonExisting
 }
 
-func (a *awsService) LaunchInstance(ctx context.Context, imageID, instanceType, userData, keyName, subnetID string, tags map[string]string, extraDevices ...NewDevice) (Instance, error) {
+func (a *awsService) LaunchInstance(ctx context.Context, imageID, instanceType, userData, keyName, subnetID string, opts LaunchOptions, tags map[string]string, extraDevices ...NewDevice) (Instance, error) {
 	if !IsAMIID(imageID) {
 		return nil, ErrInvalidAMIID
 	}
@@ -143,9 +147,28 @@ func (a *awsService) LaunchInstance(ctx context.Context, imageID, instanceType,
 		MinCount:     aws.Int64(1),
 		MaxCount:     aws.Int64(1),
 	}
-	if strings.TrimSpace(subnetID) != "" {
+	if opts.NoPublicIP {
+		// Public IPs can only be turned off on the network interface, which
+		// then must have the subnet instead of the instance
+		netInterface := &ec2.InstanceNetworkInterfaceSpecification{
+			AssociatePublicIpAddress: aws.Bool(false),
+			DeviceIndex:              aws.Int64(0),
+		}
+		if strings.TrimSpace(subnetID) != "" {
+			netInterface.SubnetId = aws.String(subnetID)
+		}
+		input.NetworkInterfaces = []*ec2.InstanceNetworkInterfaceSpecification{netInterface}
+	} else if strings.TrimSpace(subnetID) != "" {
 		input.SubnetId = aws.String(subnetID)
 	}
+	if strings.TrimSpace(subnetID) == "" && opts.Zone != "" {
+		input.Placement = &ec2.Placement{AvailabilityZone: aws.String(opts.Zone)}
+	}
+	if strings.HasPrefix(opts.InstanceProfile, "arn:") {
+		input.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Arn: aws.String(opts.InstanceProfile)}
+	} else if opts.InstanceProfile != "" {
+		input.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Name: aws.String(opts.InstanceProfile)}
+	}
 	if strings.TrimSpace(userData) != "" {
 		input.UserData = aws.String(base64.StdEncoding.EncodeToString([]byte(userData)))
 	}
@@ -235,6 +258,112 @@ func (a *awsService) LaunchInstance(ctx context.Context, imageID, instanceType,
 	return nil, ErrFailedLaunchingInstance
 }
 
+func (a *awsService) GetLaunchZone(ctx context.Context, subnetID string) (string, error) {
+	if strings.TrimSpace(subnetID) != "" {
+		out, err := a.client.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{
+			SubnetIds: []*string{aws.String(subnetID)},
+		})
+		if err != nil {
+			aerr, ok := err.(awserr.Error)
+			if ok && aerr.Code() == accessDeniedErrorCode {
+				return "", ErrNotAllowed
+			} else if ok && aerr.Code() == subnetNotFoundErrorCode {
+				return "", ErrInvalidSubnetID
+			}
+			return "", err
+		}
+		if len(out.Subnets) == 0 || out.Subnets[0].AvailabilityZone == nil {
+			return "", ErrInvalidSubnetID
+		}
+		return *out.Subnets[0].AvailabilityZone, nil
+	}
+	out, err := a.client.DescribeAvailabilityZonesWithContext(ctx, &ec2.DescribeAvailabilityZonesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("state"),
+			Values: []*string{aws.String("available")},
+		}},
+	})
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if ok && aerr.Code() == accessDeniedErrorCode {
+			return "", ErrNotAllowed
+		}
+		return "", err
+	}
+	zones := []string{}
+	for _, z := range out.AvailabilityZones {
+		if z.ZoneName != nil {
+			zones = append(zones, *z.ZoneName)
+		}
+	}
+	if len(zones) == 0 {
+		return "", ErrRequiresSubnet
+	}
+	// Always use the same zone, the order of the response isn't defined
+	sort.Strings(zones)
+	return zones[0], nil
+}
+
+func (a *awsService) GetInstanceUserdata(ctx context.Context, instanceID string) (string, error) {
+	if strings.TrimSpace(instanceID) == "" {
+		return "", ErrInstanceNonExisting
+	}
+	input := &ec2.DescribeInstanceAttributeInput{
+		Attribute:  aws.String(ec2.InstanceAttributeNameUserData),
+		InstanceId: aws.String(instanceID),
+	}
+	out, err := a.client.DescribeInstanceAttributeWithContext(ctx, input)
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if ok && (aerr.Code() == accessDeniedErrorCode || aerr.Code() == unauthorizedErrorCode) {
+			return "", ErrNotAllowed
+		}
+		if ok && strings.Contains(aerr.Code(), instanceIDErrorCode) {
+			return "", ErrInstanceNonExisting
+		}
+		return "", err
+	}
+	if out.UserData == nil || out.UserData.Value == nil {
+		return "", nil
+	}
+	data, err := base64.StdEncoding.DecodeString(*out.UserData.Value)
+	if err != nil {
+		logging.Debugf("Could not decode instance userdata: %s", err)
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (a *awsService) FindInstances(ctx context.Context, filters map[string][]string) ([]string, error) {
+	input := &ec2.DescribeInstancesInput{}
+	for name, values := range filters {
+		input.Filters = append(input.Filters, &ec2.Filter{
+			Name:   aws.String(name),
+			Values: aws.StringSlice(values),
+		})
+	}
+	ids := []string{}
+	err := a.client.DescribeInstancesPagesWithContext(ctx, input, func(out *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range out.Reservations {
+			for _, inst := range reservation.Instances {
+				ids = append(ids, *inst.InstanceId)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if ok && (aerr.Code() == accessDeniedErrorCode || aerr.Code() == unauthorizedErrorCode) {
+			return nil, ErrNotAllowed
+		} else if ok && aerr.Code() == invalidParameterErrorCode {
+			logging.Debug(aerr.Message())
+			return nil, ErrInvalidFilter
+		}
+		return nil, err
+	}
+	return ids, nil
+}
+
 func (a *awsService) StopInstance(ctx context.Context, instanceID string) error {
 	if strings.TrimSpace(instanceID) == "" {
 		return ErrInvalidName
@@ -298,7 +427,7 @@ func (a *awsService) TerminateInstance(ctx context.Context, instanceID string) e
 	return nil
 }
 
-func (a *awsService) ModifyInstanceAttribute(ctx context.Context, instanceID string, attr instanceAttribute, value interface{}) error {
+func (a *awsService) ModifyInstanceAttribute(ctx context.Context, instanceID string, attr InstanceAttribute, value interface{}) error {
 	if strings.TrimSpace(instanceID) == "" {
 		return ErrInvalidInstanceID
 	}
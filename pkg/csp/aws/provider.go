@@ -0,0 +1,221 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package aws
+
+import (
+	"context"
+
+	"github.com/immutable/metavisor-cli/pkg/csp"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+// GuestDeviceName is where the Metavisor expects the guest root volume
+const GuestDeviceName = "/dev/sdf"
+
+// NewProvider returns the given AWS Service as a generic csp.Provider, for
+// use in workflows that are not specific to AWS. The provider also
+// implements csp.HealthChecker, csp.NetworkEnabler, csp.SnapshotTagger and
+// csp.GzipUserdata.
+func NewProvider(service Service, region string) csp.Provider {
+	return &provider{service, region}
+}
+
+type provider struct {
+	svc    Service
+	region string
+}
+
+func (p *provider) Name() string            { return "aws" }
+func (p *provider) Region() string          { return p.region }
+func (p *provider) GuestDeviceName() string { return GuestDeviceName }
+
+func (p *provider) GetInstance(ctx context.Context, instanceID string) (csp.Instance, error) {
+	return p.svc.GetInstance(ctx, instanceID)
+}
+
+func (p *provider) LaunchInstance(ctx context.Context, conf csp.LaunchConfig) (csp.Instance, error) {
+	instanceType := conf.InstanceType
+	if instanceType == "" && conf.Larger {
+		instanceType = LargerInstanceType
+	} else if instanceType == "" {
+		instanceType = SmallInstanceType
+	}
+	opts := LaunchOptions{
+		NoPublicIP:      conf.NoPublicIP,
+		InstanceProfile: conf.InstanceProfile,
+		Zone:            conf.Zone,
+	}
+	var devices []NewDevice
+	for _, d := range conf.ExtraDisks {
+		devices = append(devices, NewDevice{
+			DeviceName: d.DeviceName,
+			SnapshotID: d.SnapshotID,
+		})
+	}
+	return p.svc.LaunchInstance(ctx, conf.Image, instanceType, conf.Userdata, conf.KeyName, conf.SubnetID, opts, conf.Tags, devices...)
+}
+
+func (p *provider) StartInstance(ctx context.Context, instanceID string) error {
+	return p.svc.StartInstance(ctx, instanceID)
+}
+
+func (p *provider) StopInstance(ctx context.Context, instanceID string) error {
+	return p.svc.StopInstance(ctx, instanceID)
+}
+
+func (p *provider) TerminateInstance(ctx context.Context, instanceID string) error {
+	return p.svc.TerminateInstance(ctx, instanceID)
+}
+
+func (p *provider) AwaitInstanceRunning(ctx context.Context, instanceID string) error {
+	return p.svc.AwaitInstanceRunning(ctx, instanceID)
+}
+
+func (p *provider) AwaitInstanceStopped(ctx context.Context, instanceID string) error {
+	return p.svc.AwaitInstanceStopped(ctx, instanceID)
+}
+
+func (p *provider) GetInstanceUserdata(ctx context.Context, instanceID string) (string, error) {
+	return p.svc.GetInstanceUserdata(ctx, instanceID)
+}
+
+func (p *provider) SetInstanceUserdata(ctx context.Context, instanceID, userdata string) error {
+	return p.svc.ModifyInstanceAttribute(ctx, instanceID, AttrUserData, userdata)
+}
+
+func (p *provider) TagInstance(ctx context.Context, instanceID string, tags map[string]string) error {
+	return p.svc.TagResources(ctx, tags, instanceID)
+}
+
+func (p *provider) DeleteDisksOnTermination(ctx context.Context, instanceID string) error {
+	return p.svc.DeleteInstanceDevicesOnTermination(ctx, instanceID)
+}
+
+// CreateDiskFromImage creates a gp2 volume from the root snapshot of the AMI
+func (p *provider) CreateDiskFromImage(ctx context.Context, imageID, zone string) (csp.Disk, error) {
+	img, err := p.svc.GetImage(ctx, imageID)
+	if err != nil {
+		return nil, err
+	}
+	snapID, ok := img.DeviceMapping()[img.RootDeviceName()]
+	if !ok {
+		return nil, ErrSnapshotNonExisting
+	}
+	snap, err := p.svc.GetSnapshot(ctx, snapID)
+	if err != nil {
+		return nil, err
+	}
+	return p.svc.CreateVolume(ctx, snap.ID(), genericVolumeType, zone, snap.SizeGB())
+}
+
+func (p *provider) GetDisk(ctx context.Context, diskID string) (csp.Disk, error) {
+	return p.svc.GetVolume(ctx, diskID)
+}
+
+func (p *provider) DeleteDisk(ctx context.Context, diskID string) error {
+	return p.svc.DeleteVolume(ctx, diskID)
+}
+
+func (p *provider) AwaitDiskAvailable(ctx context.Context, diskID string) error {
+	return p.svc.AwaitVolumeAvailable(ctx, diskID)
+}
+
+// AttachDisk attaches the volume, root has no meaning in AWS as the device
+// name decides if it's the root device or not
+func (p *provider) AttachDisk(ctx context.Context, diskID, instanceID, deviceName string, root bool) error {
+	return p.svc.AttachVolume(ctx, diskID, instanceID, deviceName)
+}
+
+func (p *provider) DetachDisk(ctx context.Context, diskID, instanceID, deviceName string) error {
+	return p.svc.DetachVolume(ctx, diskID, instanceID, deviceName)
+}
+
+func (p *provider) TagDisk(ctx context.Context, diskID string, tags map[string]string) error {
+	return p.svc.TagResources(ctx, tags, diskID)
+}
+
+func (p *provider) CreateSnapshot(ctx context.Context, name, diskID string) (csp.Snapshot, error) {
+	return p.svc.CreateSnapshot(ctx, name, diskID)
+}
+
+func (p *provider) GetSnapshot(ctx context.Context, snapshotID string) (csp.Snapshot, error) {
+	return p.svc.GetSnapshot(ctx, snapshotID)
+}
+
+func (p *provider) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	return p.svc.DeleteSnapshot(ctx, snapshotID)
+}
+
+func (p *provider) GetImage(ctx context.Context, imageID string) (csp.Image, error) {
+	return p.svc.GetImage(ctx, imageID)
+}
+
+func (p *provider) CreateImage(ctx context.Context, instanceID, name, desc string) (string, error) {
+	return p.svc.CreateImage(ctx, instanceID, name, desc)
+}
+
+func (p *provider) AwaitImageAvailable(ctx context.Context, imageID string) error {
+	return p.svc.AwaitImageAvailable(ctx, imageID)
+}
+
+func (p *provider) DeleteImage(ctx context.Context, imageID string) error {
+	return p.svc.DeregisterImage(ctx, imageID)
+}
+
+func (p *provider) TagImage(ctx context.Context, imageID string, tags map[string]string) error {
+	return p.svc.TagResources(ctx, tags, imageID)
+}
+
+func (p *provider) AwaitInstanceOK(ctx context.Context, instanceID string) error {
+	return p.svc.AwaitInstanceOK(ctx, instanceID)
+}
+
+// EnableNetworking enables sriovNetSupport on the instance, and ENA support
+// if the AMI has it. Failing to enable sriovNetSupport is only logged, as
+// the instance still boots without it.
+func (p *provider) EnableNetworking(ctx context.Context, instanceID, imageID string) error {
+	img, err := p.svc.GetImage(ctx, imageID)
+	if err != nil {
+		return err
+	}
+	inst, err := p.svc.GetInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	if inst.SriovNetSupport() != SriovNetIsSupported {
+		logging.Debug("Enabling sriovNetSupport on instance")
+		err = p.svc.ModifyInstanceAttribute(ctx, instanceID, AttrSriovNetSupport, SriovNetIsSupported)
+		if err != nil {
+			logging.Debugf("Failed to enable sriovNetSupport:\n%s", err)
+			logging.Warningf("Failed to enable sriovNetSupport for instance %s", instanceID)
+		}
+	}
+	logging.Debugf("ENA support: image=%t, instance=%t", img.ENASupport(), inst.ENASupport())
+	if img.ENASupport() && !inst.ENASupport() {
+		logging.Info("Enabling ENA support on instance")
+		err = p.svc.ModifyInstanceAttribute(ctx, instanceID, AttrENASupport, true)
+		if err != nil {
+			logging.Error("Failed to enable ENA support on the instance")
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *provider) TagSnapshot(ctx context.Context, snapshotID string, tags map[string]string) error {
+	return p.svc.TagResources(ctx, tags, snapshotID)
+}
+
+func (p *provider) AcceptsGzipUserdata() bool { return true }
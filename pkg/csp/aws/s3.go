@@ -0,0 +1,133 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	// ErrObjectNonExisting is returned if an object doesn't exist in the bucket
+	ErrObjectNonExisting = errors.New("object doesn't exist")
+	// ErrBucketNonExisting is returned if the bucket doesn't exist
+	ErrBucketNonExisting = errors.New("bucket doesn't exist")
+)
+
+// Bucket is a helper for the objects in an S3 bucket
+type Bucket interface {
+	// Name is the name of the bucket
+	Name() string
+	// PresignPut returns a URL that the object can be uploaded to with a
+	// plain HTTP PUT, without any credentials, until it expires
+	PresignPut(key string, expires time.Duration) (string, error)
+	// Download writes the object to the local path
+	Download(ctx context.Context, key, path string) error
+	// Delete removes the object from the bucket
+	Delete(ctx context.Context, key string) error
+}
+
+type s3Bucket struct {
+	client *s3.S3
+	name   string
+}
+
+// NewBucket returns a helper for the bucket with the given name. Presigned
+// URLs are for the region, so the bucket should be in the same region.
+func NewBucket(region, name string, iamConf *IAMConfig) (Bucket, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, ErrInvalidName
+	}
+	sess, conf, err := newSession(region, iamConf)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Bucket{
+		client: s3.New(sess, conf),
+		name:   name,
+	}, nil
+}
+
+func (b *s3Bucket) Name() string { return b.name }
+
+func (b *s3Bucket) PresignPut(key string, expires time.Duration) (string, error) {
+	req, _ := b.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	return req.Presign(expires)
+}
+
+func (b *s3Bucket) Download(ctx context.Context, key, path string) error {
+	out, err := b.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return s3Error(err)
+	}
+	defer out.Body.Close()
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, out.Body)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logging.Debugf("Failed to download s3://%s/%s: %s", b.name, key, err)
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func (b *s3Bucket) Delete(ctx context.Context, key string) error {
+	_, err := b.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return s3Error(err)
+	}
+	return nil
+}
+
+func s3Error(err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	switch aerr.Code() {
+	case accessDeniedErrorCode:
+		return ErrNotAllowed
+	case s3.ErrCodeNoSuchKey:
+		return ErrObjectNonExisting
+	case s3.ErrCodeNoSuchBucket:
+		return ErrBucketNonExisting
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+)
+
+const (
+	secretsServiceName  = "secretsmanager"
+	secretsAPIVersion   = "2017-10-17"
+	secretsTargetPrefix = "secretsmanager"
+
+	opGetSecretValue = "GetSecretValue"
+	opGetParameter   = "GetParameter"
+
+	secretNotFoundErrorCode    = "ResourceNotFoundException"
+	parameterNotFoundErrorCode = "ParameterNotFound"
+)
+
+var (
+	// ErrSecretNonExisting is returned if a secret or parameter doesn't exist
+	ErrSecretNonExisting = errors.New("secret doesn't exist")
+	// ErrNoSecretString is returned if a secret only has a binary value
+	ErrNoSecretString = errors.New("secret has no string value")
+	// ErrInvalidSecretARN is returned if an ARN of a secret or parameter is
+	// not formatted properly
+	ErrInvalidSecretARN = errors.New("the specified ARN is not formatted properly - expected arn:aws:SERVICE:REGION:ACCOUNT:RESOURCE")
+)
+
+type getSecretValueInput struct {
+	SecretId string
+}
+
+type getSecretValueOutput struct {
+	SecretString *string
+}
+
+type getParameterInput struct {
+	Name           string
+	WithDecryption bool
+}
+
+type getParameterOutput struct {
+	Parameter struct {
+		Value string
+	}
+}
+
+// GetSecretString returns the string value of a secret in Secrets Manager.
+// The secret is fetched from the region in its ARN.
+func GetSecretString(ctx context.Context, secretARN string, iamConf *IAMConfig) (string, error) {
+	region, err := regionFromARN(secretARN)
+	if err != nil {
+		return "", err
+	}
+	c, err := newSecretsClient(region, secretsServiceName, secretsAPIVersion, secretsTargetPrefix, iamConf)
+	if err != nil {
+		return "", err
+	}
+	return getSecretString(ctx, c, secretARN)
+}
+
+func getSecretString(ctx context.Context, c *client.Client, secretARN string) (string, error) {
+	out := &getSecretValueOutput{}
+	if err := sendJSON(ctx, c, opGetSecretValue, &getSecretValueInput{SecretId: secretARN}, out); err != nil {
+		return "", secretError(err, secretNotFoundErrorCode)
+	}
+	if out.SecretString == nil {
+		return "", ErrNoSecretString
+	}
+	return *out.SecretString, nil
+}
+
+// GetParameter returns the decrypted value of a parameter in the SSM
+// Parameter Store. If the name is an ARN, the parameter is fetched from the
+// region in the ARN rather than the given region.
+func GetParameter(ctx context.Context, region, name string, iamConf *IAMConfig) (string, error) {
+	if strings.HasPrefix(name, "arn:") {
+		reg, err := regionFromARN(name)
+		if err != nil {
+			return "", err
+		}
+		region = reg
+	}
+	c, err := newSecretsClient(region, ssmServiceName, ssmAPIVersion, ssmTargetPrefix, iamConf)
+	if err != nil {
+		return "", err
+	}
+	return getParameter(ctx, c, name)
+}
+
+func getParameter(ctx context.Context, c *client.Client, name string) (string, error) {
+	out := &getParameterOutput{}
+	if err := sendJSON(ctx, c, opGetParameter, &getParameterInput{Name: name, WithDecryption: true}, out); err != nil {
+		return "", secretError(err, parameterNotFoundErrorCode)
+	}
+	return out.Parameter.Value, nil
+}
+
+func newSecretsClient(region, serviceName, apiVersion, targetPrefix string, iamConf *IAMConfig) (*client.Client, error) {
+	sess, conf, err := newSession(region, iamConf)
+	if err != nil {
+		return nil, err
+	}
+	return newJSONClient(sess, serviceName, apiVersion, targetPrefix, conf), nil
+}
+
+// secretError maps the error codes of getting secrets, the error messages
+// are not logged as they can contain the names of secrets
+func secretError(err error, notFoundCode string) error {
+	if err == ErrNotAllowed {
+		return err
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		if aerr.Code() == notFoundCode {
+			return ErrSecretNonExisting
+		}
+		logging.Debugf("Got error code %s when getting secret", aerr.Code())
+	}
+	return err
+}
+
+// regionFromARN returns the region of an ARN, which is formatted like
+// arn:PARTITION:SERVICE:REGION:ACCOUNT:RESOURCE
+func regionFromARN(arn string) (string, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[3] == "" {
+		return "", ErrInvalidSecretARN
+	}
+	return parts[3], nil
+}
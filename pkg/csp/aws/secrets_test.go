@@ -0,0 +1,120 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const testSecretARN = "arn:aws:secretsmanager:us-west-2:123456789012:secret:launch-token-AbCdEf"
+
+// secretsServer answers like Secrets Manager and the Parameter Store
+type secretsServer struct {
+	secrets map[string]string
+}
+
+func (s *secretsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch r.Header.Get("X-Amz-Target") {
+	case secretsTargetPrefix + "." + opGetSecretValue:
+		var in getSecretValueInput
+		json.NewDecoder(r.Body).Decode(&in)
+		if in.SecretId == "arn:aws:secretsmanager:us-west-2:123456789012:secret:binary" {
+			w.Write([]byte(`{"SecretBinary":"AAEC"}`))
+			return
+		}
+		value, ok := s.secrets[in.SecretId]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Secrets Manager can't find the specified secret."}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": value})
+	case ssmTargetPrefix + "." + opGetParameter:
+		var in getParameterInput
+		json.NewDecoder(r.Body).Decode(&in)
+		value, ok := s.secrets[in.Name]
+		if !ok || !in.WithDecryption {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ParameterNotFound"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Parameter": map[string]string{"Value": value}})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"AccessDeniedException"}`))
+	}
+}
+
+func TestGetSecrets(t *testing.T) {
+	server := httptest.NewServer(&secretsServer{secrets: map[string]string{
+		testSecretARN:      "secret-token",
+		"/metavisor/token": "parameter-token",
+	}})
+	defer server.Close()
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	secrets := newJSONClient(sess, secretsServiceName, secretsAPIVersion, secretsTargetPrefix)
+	parameters := newJSONClient(sess, ssmServiceName, ssmAPIVersion, ssmTargetPrefix)
+
+	if value, err := getSecretString(ctx, secrets, testSecretARN); err != nil || value != "secret-token" {
+		t.Errorf("Got unexpected secret %q (%v)", value, err)
+	}
+	if _, err = getSecretString(ctx, secrets, testSecretARN+"-missing"); err != ErrSecretNonExisting {
+		t.Errorf("Expected ErrSecretNonExisting, got %v", err)
+	}
+	if _, err = getSecretString(ctx, secrets, "arn:aws:secretsmanager:us-west-2:123456789012:secret:binary"); err != ErrNoSecretString {
+		t.Errorf("Expected ErrNoSecretString, got %v", err)
+	}
+	if value, err := getParameter(ctx, parameters, "/metavisor/token"); err != nil || value != "parameter-token" {
+		t.Errorf("Got unexpected parameter %q (%v)", value, err)
+	}
+	if _, err = getParameter(ctx, parameters, "/metavisor/missing"); err != ErrSecretNonExisting {
+		t.Errorf("Expected ErrSecretNonExisting, got %v", err)
+	}
+	if err = sendJSON(ctx, parameters, "DeleteParameter", &struct{}{}, nil); err != ErrNotAllowed {
+		t.Errorf("Expected ErrNotAllowed, got %v", err)
+	}
+}
+
+func TestRegionFromARN(t *testing.T) {
+	tests := map[string]string{
+		testSecretARN: "us-west-2",
+		"arn:aws:ssm:eu-west-1:123456789012:parameter/metavisor/token": "eu-west-1",
+		"arn:aws:iam::123456789012:role/admin":                         "",
+		"launch-token":                                                 "",
+	}
+	for arn, expected := range tests {
+		region, err := regionFromARN(arn)
+		if region != expected || (expected == "") != (err == ErrInvalidSecretARN) {
+			t.Errorf("Got region %q (%v) for %s, expected %q", region, err, arn, expected)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package aws
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol"
+	"github.com/aws/aws-sdk-go/private/protocol/ec2query"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	opModifyImageAttribute = "ModifyImageAttribute"
+	attrCreateVolumePerm   = "createVolumePermission"
+	operationTypeAdd       = "add"
+)
+
+// LaunchPermissions are the principals an AMI can be shared with
+type LaunchPermissions struct {
+	AccountIDs             []string
+	OrganizationARNs       []string
+	OrganizationalUnitARNs []string
+}
+
+// Empty is true if the AMI wouldn't be shared with anyone
+func (p LaunchPermissions) Empty() bool {
+	return len(p.AccountIDs) == 0 && len(p.OrganizationARNs) == 0 && len(p.OrganizationalUnitARNs) == 0
+}
+
+// The vendored EC2 client predates sharing AMIs with organizations and OUs,
+// so ModifyImageAttribute is sent with these types instead, which serialize
+// the same way as the ones in the SDK but include the ARNs.
+type modifyImageAttributeInput struct {
+	_ struct{} `type:"structure"`
+
+	DryRun           *bool                          `locationName:"dryRun" type:"boolean"`
+	ImageId          *string                        `type:"string" required:"true"`
+	LaunchPermission *launchPermissionModifications `type:"structure"`
+}
+
+type launchPermissionModifications struct {
+	_ struct{} `type:"structure"`
+
+	Add []*launchPermission `locationNameList:"item" type:"list"`
+}
+
+type launchPermission struct {
+	_ struct{} `type:"structure"`
+
+	OrganizationArn       *string `type:"string"`
+	OrganizationalUnitArn *string `type:"string"`
+	UserId                *string `locationName:"userId" type:"string"`
+}
+
+func (a *awsService) CopyImage(ctx context.Context, sourceRegion, sourceImageID, name, desc string) (string, error) {
+	if strings.TrimSpace(sourceImageID) == "" {
+		return "", ErrImageNonExisting
+	}
+	input := &ec2.CopyImageInput{
+		SourceRegion:  aws.String(sourceRegion),
+		SourceImageId: aws.String(sourceImageID),
+		Name:          aws.String(name),
+		Description:   aws.String(desc),
+	}
+	out, err := a.client.CopyImageWithContext(ctx, input)
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if ok && (aerr.Code() == accessDeniedErrorCode || aerr.Code() == unauthorizedErrorCode) {
+			return "", ErrNotAllowed
+		}
+		if ok && strings.Contains(aerr.Code(), amiIDErrorCode) {
+			return "", ErrImageNonExisting
+		}
+		return "", err
+	}
+	return *out.ImageId, nil
+}
+
+func (a *awsService) ShareImage(ctx context.Context, imageID string, perms LaunchPermissions) error {
+	if strings.TrimSpace(imageID) == "" {
+		return ErrImageNonExisting
+	}
+	if perms.Empty() {
+		return nil
+	}
+	err := a.modifyImageAttribute(ctx, &modifyImageAttributeInput{
+		ImageId: aws.String(imageID),
+		LaunchPermission: &launchPermissionModifications{
+			Add: launchPermissionsToEC2(perms),
+		},
+	})
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if ok && (aerr.Code() == accessDeniedErrorCode || aerr.Code() == unauthorizedErrorCode) {
+			return ErrNotAllowed
+		}
+		if ok && strings.Contains(aerr.Code(), amiIDErrorCode) {
+			return ErrImageNonExisting
+		}
+		return err
+	}
+	return nil
+}
+
+// modifyImageAttribute sends ModifyImageAttribute with the extended input
+func (a *awsService) modifyImageAttribute(ctx context.Context, input *modifyImageAttributeInput) error {
+	op := &request.Operation{
+		Name:       opModifyImageAttribute,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	req := a.client.NewRequest(op, input, &ec2.ModifyImageAttributeOutput{})
+	req.Handlers.Unmarshal.Remove(ec2query.UnmarshalHandler)
+	req.Handlers.Unmarshal.PushBackNamed(protocol.UnmarshalDiscardBodyHandler)
+	req.SetContext(ctx)
+	return req.Send()
+}
+
+func (a *awsService) ShareSnapshot(ctx context.Context, snapshotID string, accountIDs ...string) error {
+	if strings.TrimSpace(snapshotID) == "" {
+		return ErrInvalidSnapshotID
+	}
+	if len(accountIDs) == 0 {
+		return nil
+	}
+	input := &ec2.ModifySnapshotAttributeInput{
+		SnapshotId:    aws.String(snapshotID),
+		Attribute:     aws.String(attrCreateVolumePerm),
+		OperationType: aws.String(operationTypeAdd),
+		UserIds:       aws.StringSlice(accountIDs),
+	}
+	_, err := a.client.ModifySnapshotAttributeWithContext(ctx, input)
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if ok && (aerr.Code() == accessDeniedErrorCode || aerr.Code() == unauthorizedErrorCode) {
+			return ErrNotAllowed
+		}
+		if ok && aerr.Code() == snapshotNotFound {
+			return ErrSnapshotNonExisting
+		}
+		return err
+	}
+	return nil
+}
+
+func launchPermissionsToEC2(perms LaunchPermissions) []*launchPermission {
+	res := []*launchPermission{}
+	for _, id := range perms.AccountIDs {
+		res = append(res, &launchPermission{UserId: aws.String(id)})
+	}
+	for _, arn := range perms.OrganizationARNs {
+		res = append(res, &launchPermission{OrganizationArn: aws.String(arn)})
+	}
+	for _, arn := range perms.OrganizationalUnitARNs {
+		res = append(res, &launchPermission{OrganizationalUnitArn: aws.String(arn)})
+	}
+	return res
+}
@@ -0,0 +1,83 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package aws
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/private/protocol/query/queryutil"
+)
+
+func TestModifyImageAttributeSerialization(t *testing.T) {
+	input := &modifyImageAttributeInput{
+		ImageId: aws.String("ami-12345678"),
+		LaunchPermission: &launchPermissionModifications{
+			Add: launchPermissionsToEC2(LaunchPermissions{
+				AccountIDs:             []string{"123456789012"},
+				OrganizationARNs:       []string{"arn:aws:organizations::123456789012:organization/o-abc123"},
+				OrganizationalUnitARNs: []string{"arn:aws:organizations::123456789012:ou/o-abc123/ou-ab12-cd34ef56"},
+			}),
+		},
+	}
+	v := url.Values{}
+	if err := queryutil.Parse(v, input, true); err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	expected := map[string]string{
+		"ImageId":                                      "ami-12345678",
+		"LaunchPermission.Add.1.UserId":                "123456789012",
+		"LaunchPermission.Add.2.OrganizationArn":       "arn:aws:organizations::123456789012:organization/o-abc123",
+		"LaunchPermission.Add.3.OrganizationalUnitArn": "arn:aws:organizations::123456789012:ou/o-abc123/ou-ab12-cd34ef56",
+	}
+	for key, value := range expected {
+		if v.Get(key) != value {
+			t.Errorf("Expected %s to be %s, got %q", key, value, v.Get(key))
+		}
+	}
+	if len(v) != len(expected) {
+		t.Errorf("Got unexpected parameters: %v", v)
+	}
+}
+
+func TestPrincipalFormats(t *testing.T) {
+	if !IsAccountID("123456789012") || IsAccountID("12345") || IsAccountID("arn:aws:iam::123456789012:root") {
+		t.Error("Account IDs were not detected correctly")
+	}
+	if !IsOrganizationARN("arn:aws:organizations::123456789012:organization/o-abc123") {
+		t.Error("Expected organization ARN to be valid")
+	}
+	if !IsOrganizationalUnitARN("arn:aws:organizations::123456789012:ou/o-abc123/ou-ab12-cd34ef56") {
+		t.Error("Expected OU ARN to be valid")
+	}
+	if IsOrganizationARN("arn:aws:organizations::123456789012:ou/o-abc123/ou-ab12-cd34ef56") {
+		t.Error("OU ARN should not be an organization ARN")
+	}
+}
+
+func TestModifyImageAttributeDryRunSerialization(t *testing.T) {
+	input := &modifyImageAttributeInput{
+		DryRun:  aws.Bool(true),
+		ImageId: aws.String("ami-12345678"),
+	}
+	v := url.Values{}
+	if err := queryutil.Parse(v, input, true); err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if v.Get("DryRun") != "true" || v.Get("ImageId") != "ami-12345678" {
+		t.Errorf("Got unexpected parameters: %v", v)
+	}
+}
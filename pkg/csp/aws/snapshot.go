@@ -28,9 +28,11 @@ import (
 type snapshot struct {
 	resource
 	sizeGB int64
+	tags   map[string]string
 }
 
-func (s *snapshot) SizeGB() int64 { return s.sizeGB }
+func (s *snapshot) SizeGB() int64           { return s.sizeGB }
+func (s *snapshot) Tags() map[string]string { return s.tags }
 
 func (a *awsService) GetSnapshot(ctx context.Context, snapshotID string) (Snapshot, error) {
 	if strings.TrimSpace(snapshotID) == "" {
@@ -56,6 +58,7 @@ func (a *awsService) GetSnapshot(ctx context.Context, snapshotID string) (Snapsh
 				id: *snap.SnapshotId,
 			},
 			sizeGB: *snap.VolumeSize,
+			tags:   ec2TagsToMap(snap.Tags),
 		}
 		return res, nil
 	}
@@ -82,10 +85,11 @@ func (a *awsService) CreateSnapshot(ctx context.Context, name, sourceVolumeID st
 	}
 
 	res := &snapshot{
-		resource{
-			*snap.SnapshotId,
+		resource: resource{
+			id: *snap.SnapshotId,
 		},
-		*snap.VolumeSize,
+		sizeGB: *snap.VolumeSize,
+		tags:   map[string]string{},
 	}
 	logging.Info("Waiting for snapshot to become ready...")
 	err = waitForSnapshot(ctx, a.client, res.ID())
@@ -98,6 +102,9 @@ func (a *awsService) CreateSnapshot(ctx context.Context, name, sourceVolumeID st
 		cliResourceTagKey: cliResourceTagValue,
 	}
 	err = a.TagResources(ctx, nameTags, res.ID())
+	if err == nil {
+		res.tags = nameTags
+	}
 	if err == ErrNotAllowed {
 		logging.Warning("Insufficient IAM permissions to tag resource, skipping Name")
 		return res, nil
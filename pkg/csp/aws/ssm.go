@@ -0,0 +1,285 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+const (
+	ssmServiceName  = "ssm"
+	ssmAPIVersion   = "2014-11-06"
+	ssmTargetPrefix = "AmazonSSM"
+
+	opDescribeInstanceInformation = "DescribeInstanceInformation"
+	opSendCommand                 = "SendCommand"
+	opGetCommandInvocation        = "GetCommandInvocation"
+
+	jsonAccessDeniedErrorCode   = "AccessDeniedException"
+	invocationNotFoundErrorCode = "InvocationDoesNotExist"
+
+	ssmPingOnline      = "Online"
+	ssmShellDocument   = "AWS-RunShellScript"
+	ssmCommandTimeout  = 30 * time.Minute
+	ssmManagedAttempts = 60
+
+	// MaxCommandOutput is the number of characters of the standard output
+	// that SSM returns, the rest is truncated
+	MaxCommandOutput = 24000
+)
+
+var (
+	// ErrNotManaged is returned if an instance never registers with SSM,
+	// e.g. because it has no instance profile or can't reach SSM
+	ErrNotManaged = errors.New("instance is not managed by SSM")
+	// ErrCommandFailed is returned if a command exits with an error on the
+	// instance, or times out
+	ErrCommandFailed = errors.New("command failed on instance")
+
+	// ssmPollInterval is how long to wait between checking instances and
+	// commands
+	ssmPollInterval = 5 * time.Second
+)
+
+// CommandRunner runs shell commands on instances with SSM Run Command. The
+// instances must run the SSM agent and have an instance profile that allows
+// the agent to register with SSM.
+type CommandRunner interface {
+	// AwaitManaged waits for the instance to register with SSM
+	AwaitManaged(ctx context.Context, instanceID string) error
+	// RunShellScript runs the commands on the instance and returns their
+	// standard output, which is truncated after MaxCommandOutput characters
+	RunShellScript(ctx context.Context, instanceID string, commands []string) (string, error)
+}
+
+// The vendored SDK doesn't include SSM, so the few operations needed are sent
+// with these types, in the JSON protocol that SSM uses. The same protocol is
+// used for Secrets Manager.
+type ssmRunner struct {
+	client *client.Client
+}
+
+type ssmFilter struct {
+	Key    string
+	Values []string
+}
+
+type describeInstanceInformationInput struct {
+	Filters []ssmFilter
+}
+
+type describeInstanceInformationOutput struct {
+	InstanceInformationList []struct {
+		InstanceId string
+		PingStatus string
+	}
+}
+
+type sendCommandInput struct {
+	DocumentName   string
+	InstanceIds    []string
+	Parameters     map[string][]string
+	TimeoutSeconds int64
+}
+
+type sendCommandOutput struct {
+	Command struct {
+		CommandId string
+	}
+}
+
+type getCommandInvocationInput struct {
+	CommandId  string
+	InstanceId string
+}
+
+type getCommandInvocationOutput struct {
+	Status                string
+	StandardOutputContent string
+	StandardErrorContent  string
+}
+
+// NewCommandRunner returns a CommandRunner for instances in the region
+func NewCommandRunner(region string, iamConf *IAMConfig) (CommandRunner, error) {
+	sess, conf, err := newSession(region, iamConf)
+	if err != nil {
+		return nil, err
+	}
+	return newSSMRunner(sess, conf), nil
+}
+
+func newSSMRunner(p client.ConfigProvider, cfgs ...*aws.Config) *ssmRunner {
+	return &ssmRunner{newJSONClient(p, ssmServiceName, ssmAPIVersion, ssmTargetPrefix, cfgs...)}
+}
+
+// newJSONClient returns a client for a service that uses the JSON protocol
+func newJSONClient(p client.ConfigProvider, serviceName, apiVersion, targetPrefix string, cfgs ...*aws.Config) *client.Client {
+	c := p.ClientConfig(serviceName, cfgs...)
+	jsonClient := client.New(*c.Config, metadata.ClientInfo{
+		ServiceName:   serviceName,
+		SigningName:   c.SigningName,
+		SigningRegion: c.SigningRegion,
+		Endpoint:      c.Endpoint,
+		APIVersion:    apiVersion,
+		JSONVersion:   "1.1",
+		TargetPrefix:  targetPrefix,
+	}, c.Handlers)
+	jsonClient.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	jsonClient.Handlers.Build.PushBackNamed(request.NamedHandler{Name: "metavisor.jsonBuild", Fn: jsonBuild})
+	jsonClient.Handlers.Unmarshal.PushBackNamed(request.NamedHandler{Name: "metavisor.jsonUnmarshal", Fn: jsonUnmarshal})
+	jsonClient.Handlers.UnmarshalError.PushBackNamed(request.NamedHandler{Name: "metavisor.jsonUnmarshalError", Fn: jsonUnmarshalError})
+	return jsonClient
+}
+
+func (r *ssmRunner) AwaitManaged(ctx context.Context, instanceID string) error {
+	input := &describeInstanceInformationInput{
+		Filters: []ssmFilter{{Key: "InstanceIds", Values: []string{instanceID}}},
+	}
+	for try := 1; try <= ssmManagedAttempts; try++ {
+		out := &describeInstanceInformationOutput{}
+		if err := r.send(ctx, opDescribeInstanceInformation, input, out); err != nil {
+			return err
+		}
+		for _, info := range out.InstanceInformationList {
+			if info.InstanceId == instanceID && info.PingStatus == ssmPingOnline {
+				return nil
+			}
+		}
+		logging.Debugf("Still waiting for %s to register with SSM...", instanceID)
+		if err := sleep(ctx, ssmPollInterval); err != nil {
+			return err
+		}
+	}
+	return ErrNotManaged
+}
+
+func (r *ssmRunner) RunShellScript(ctx context.Context, instanceID string, commands []string) (string, error) {
+	sent := &sendCommandOutput{}
+	err := r.send(ctx, opSendCommand, &sendCommandInput{
+		DocumentName:   ssmShellDocument,
+		InstanceIds:    []string{instanceID},
+		Parameters:     map[string][]string{"commands": commands},
+		TimeoutSeconds: int64(ssmCommandTimeout / time.Second),
+	}, sent)
+	if err != nil {
+		return "", err
+	}
+	input := &getCommandInvocationInput{
+		CommandId:  sent.Command.CommandId,
+		InstanceId: instanceID,
+	}
+	for {
+		if err = sleep(ctx, ssmPollInterval); err != nil {
+			return "", err
+		}
+		out := &getCommandInvocationOutput{}
+		err = r.send(ctx, opGetCommandInvocation, input, out)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == invocationNotFoundErrorCode {
+			// The invocation shows up a little while after sending the command
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		switch out.Status {
+		case "Success":
+			return out.StandardOutputContent, nil
+		case "Pending", "InProgress", "Delayed":
+			continue
+		}
+		logging.Debugf("Command %s is %s with error output:\n%s", input.CommandId, out.Status, out.StandardErrorContent)
+		return "", ErrCommandFailed
+	}
+}
+
+func (r *ssmRunner) send(ctx context.Context, name string, input, output interface{}) error {
+	return sendJSON(ctx, r.client, name, input, output)
+}
+
+// sendJSON sends an operation of a service that uses the JSON protocol
+func sendJSON(ctx context.Context, c *client.Client, name string, input, output interface{}) error {
+	op := &request.Operation{
+		Name:       name,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	req := c.NewRequest(op, input, output)
+	req.SetContext(ctx)
+	err := req.Send()
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == jsonAccessDeniedErrorCode {
+		return ErrNotAllowed
+	}
+	return err
+}
+
+func jsonBuild(r *request.Request) {
+	body, err := json.Marshal(r.Params)
+	if err != nil {
+		r.Error = awserr.New("SerializationError", "failed encoding JSON request", err)
+		return
+	}
+	r.SetBufferBody(body)
+	r.HTTPRequest.Header.Set("X-Amz-Target", r.ClientInfo.TargetPrefix+"."+r.Operation.Name)
+	r.HTTPRequest.Header.Set("Content-Type", "application/x-amz-json-"+r.ClientInfo.JSONVersion)
+}
+
+func jsonUnmarshal(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	if !r.DataFilled() {
+		return
+	}
+	err := json.NewDecoder(r.HTTPResponse.Body).Decode(r.Data)
+	if err != nil && err != io.EOF {
+		r.Error = awserr.New("SerializationError", "failed decoding JSON response", err)
+	}
+}
+
+func jsonUnmarshalError(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	var body struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.HTTPResponse.Body).Decode(&body); err != nil {
+		r.Error = awserr.NewRequestFailure(awserr.New("SerializationError", r.HTTPResponse.Status, err), r.HTTPResponse.StatusCode, r.RequestID)
+		return
+	}
+	// The type can be prefixed with the namespace, e.g. "com.amazon#Code"
+	code := body.Type[strings.LastIndex(body.Type, "#")+1:]
+	r.Error = awserr.NewRequestFailure(awserr.New(code, body.Message, nil), r.HTTPResponse.StatusCode, r.RequestID)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
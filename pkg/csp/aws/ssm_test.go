@@ -0,0 +1,125 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// ssmServer answers like SSM, the instance registers after a few checks
+// and commands finish after a few polls
+type ssmServer struct {
+	calls    map[string]int
+	commands []string
+	status   string
+}
+
+func (s *ssmServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.Header.Get("X-Amz-Target")
+	op := strings.TrimPrefix(target, ssmTargetPrefix+".")
+	s.calls[op]++
+	if !strings.Contains(r.Header.Get("Authorization"), "/us-west-2/ssm/aws4_request") {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"__type":"AccessDeniedException","message":"bad signature"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch op {
+	case opDescribeInstanceInformation:
+		var in describeInstanceInformationInput
+		json.NewDecoder(r.Body).Decode(&in)
+		status := "ConnectionLost"
+		if s.calls[op] > 2 {
+			status = ssmPingOnline
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"InstanceInformationList": []map[string]string{{"InstanceId": in.Filters[0].Values[0], "PingStatus": status}},
+		})
+	case opSendCommand:
+		var in sendCommandInput
+		json.NewDecoder(r.Body).Decode(&in)
+		s.commands = in.Parameters["commands"]
+		w.Write([]byte(`{"Command":{"CommandId":"cmd-1"}}`))
+	case opGetCommandInvocation:
+		if s.calls[op] == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.ssm#InvocationDoesNotExist"}`))
+			return
+		}
+		status := "InProgress"
+		if s.calls[op] > 2 {
+			status = s.status
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Status": status, "StandardOutputContent": "output\n"})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"UnknownOperationException"}`))
+	}
+}
+
+func newTestSSMRunner(t *testing.T, server *httptest.Server) *ssmRunner {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSSMRunner(sess)
+}
+
+func TestSSMRunner(t *testing.T) {
+	orig := ssmPollInterval
+	ssmPollInterval = 0
+	defer func() { ssmPollInterval = orig }()
+	handler := &ssmServer{calls: make(map[string]int), status: "Success"}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	runner := newTestSSMRunner(t, server)
+	ctx := context.Background()
+
+	if err := runner.AwaitManaged(ctx, "i-12345678"); err != nil {
+		t.Fatalf("Got unexpected error when waiting for instance: %s", err)
+	}
+	if n := handler.calls[opDescribeInstanceInformation]; n != 3 {
+		t.Errorf("Expected instance to be checked until online, got %d calls", n)
+	}
+	out, err := runner.RunShellScript(ctx, "i-12345678", []string{"echo output"})
+	if err != nil {
+		t.Fatalf("Got unexpected error when running command: %s", err)
+	}
+	if out != "output\n" || len(handler.commands) != 1 || handler.commands[0] != "echo output" {
+		t.Errorf("Got unexpected output %q for commands %v", out, handler.commands)
+	}
+
+	handler.calls = make(map[string]int)
+	handler.status = "Failed"
+	if _, err = runner.RunShellScript(ctx, "i-12345678", []string{"false"}); err != ErrCommandFailed {
+		t.Errorf("Expected ErrCommandFailed, got %v", err)
+	}
+	if err = runner.send(ctx, "DeleteEverything", &struct{}{}, nil); err == nil || !strings.Contains(err.Error(), "UnknownOperationException") {
+		t.Errorf("Expected error code to be parsed, got %v", err)
+	}
+}
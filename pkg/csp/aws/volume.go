@@ -26,8 +26,13 @@ import (
 
 type volume struct {
 	resource
+	snapshotID string
+	tags       map[string]string
 }
 
+func (v *volume) SnapshotID() string      { return v.snapshotID }
+func (v *volume) Tags() map[string]string { return v.tags }
+
 func (a *awsService) CreateVolume(ctx context.Context, sourceSnapshotID, volumeType, zone string, size int64) (Volume, error) {
 	if strings.TrimSpace(sourceSnapshotID) == "" {
 		return nil, ErrInvalidSnapshotID
@@ -49,6 +54,14 @@ func (a *awsService) CreateVolume(ctx context.Context, sourceSnapshotID, volumeT
 		VolumeType:       aws.String(volumeType),
 		Size:             aws.Int64(size),
 		AvailabilityZone: aws.String(zone),
+		TagSpecifications: []*ec2.TagSpecification{
+			&ec2.TagSpecification{
+				ResourceType: aws.String(tagSpecVolume),
+				Tags: mapToEC2Tags(map[string]string{
+					cliResourceTagKey: cliResourceTagValue,
+				}),
+			},
+		},
 	}
 	vol, err := a.client.CreateVolumeWithContext(ctx, input)
 	if err != nil {
@@ -62,10 +75,49 @@ func (a *awsService) CreateVolume(ctx context.Context, sourceSnapshotID, volumeT
 		resource: resource{
 			id: *vol.VolumeId,
 		},
+		snapshotID: sourceSnapshotID,
+		tags: map[string]string{
+			cliResourceTagKey: cliResourceTagValue,
+		},
 	}
 	return res, nil
 }
 
+func (a *awsService) GetVolume(ctx context.Context, volumeID string) (Volume, error) {
+	if strings.TrimSpace(volumeID) == "" {
+		return nil, ErrInvalidVolumeID
+	}
+	input := &ec2.DescribeVolumesInput{
+		VolumeIds: aws.StringSlice([]string{volumeID}),
+	}
+	out, err := a.client.DescribeVolumesWithContext(ctx, input)
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if ok && aerr.Code() == accessDeniedErrorCode {
+			return nil, ErrNotAllowed
+		} else if ok && strings.Contains(aerr.Code(), volumeNotFound) {
+			return nil, ErrVolumeNonExisting
+		}
+		return nil, err
+	}
+	for _, vol := range out.Volumes {
+		var snapshotID string
+		if vol.SnapshotId != nil {
+			snapshotID = *vol.SnapshotId
+		}
+		res := &volume{
+			resource: resource{
+				id: *vol.VolumeId,
+			},
+			snapshotID: snapshotID,
+			tags:       ec2TagsToMap(vol.Tags),
+		}
+		return res, nil
+	}
+	// If we got this far, the volume doesn't exist
+	return nil, ErrVolumeNonExisting
+}
+
 func (a *awsService) DeleteVolume(ctx context.Context, volumeID string) error {
 	if strings.TrimSpace(volumeID) == "" {
 		return ErrInvalidVolumeID
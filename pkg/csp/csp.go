@@ -0,0 +1,232 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package csp defines the generic operations of a cloud service provider,
+// which wrapping and getting Metavisor logs are implemented with. Each cloud
+// has its own package implementing Provider, e.g. pkg/csp/aws and
+// pkg/csp/gcp. Features that only some clouds have, such as health checks
+// and enhanced networking, are optional interfaces that a Provider may also
+// implement.
+package csp
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrNotAllowed is returned if the current user does not have enough
+	// permissions in the cloud to perform a certain action
+	ErrNotAllowed = errors.New("insufficient IAM permissions")
+)
+
+// Provider is a cloud service provider that instances can be wrapped in, and
+// that Metavisor logs can be retrieved from. All operations are performed in
+// the region (or zone) the provider was created for. IDs are whatever the
+// cloud uses to identify a resource within that region, e.g. i-XXXXXXX in AWS
+// and the resource name in GCP.
+type Provider interface {
+	// Name is the short name of the cloud, e.g. "aws" or "gcp"
+	Name() string
+	// Region is the region or zone the provider operates in
+	Region() string
+	// GuestDeviceName is the device the Metavisor expects the guest disk on
+	GuestDeviceName() string
+
+	// GetInstance returns the instance with the given ID
+	GetInstance(ctx context.Context, instanceID string) (Instance, error)
+	// LaunchInstance launches a new instance, see LaunchConfig
+	LaunchInstance(ctx context.Context, conf LaunchConfig) (Instance, error)
+	// StartInstance will start the instance with the given ID
+	StartInstance(ctx context.Context, instanceID string) error
+	// StopInstance will stop the instance with the given ID
+	StopInstance(ctx context.Context, instanceID string) error
+	// TerminateInstance will terminate the instance with the given ID
+	TerminateInstance(ctx context.Context, instanceID string) error
+	// AwaitInstanceRunning will block until the instance is running
+	AwaitInstanceRunning(ctx context.Context, instanceID string) error
+	// AwaitInstanceStopped will block until the instance is stopped
+	AwaitInstanceStopped(ctx context.Context, instanceID string) error
+	// GetInstanceUserdata returns the decoded userdata (or metadata used
+	// as userdata) of the instance
+	GetInstanceUserdata(ctx context.Context, instanceID string) (string, error)
+	// SetInstanceUserdata replaces the userdata of the (stopped) instance
+	SetInstanceUserdata(ctx context.Context, instanceID, userdata string) error
+	// TagInstance adds the given tags (labels in some clouds) to the instance
+	TagInstance(ctx context.Context, instanceID string, tags map[string]string) error
+	// DeleteDisksOnTermination makes sure all disks of the instance are
+	// deleted when the instance is terminated
+	DeleteDisksOnTermination(ctx context.Context, instanceID string) error
+
+	// CreateDiskFromImage creates a new boot disk from the root disk of the
+	// given image, in the given availability zone
+	CreateDiskFromImage(ctx context.Context, imageID, zone string) (Disk, error)
+	// GetDisk returns the disk with the given ID
+	GetDisk(ctx context.Context, diskID string) (Disk, error)
+	// DeleteDisk will delete the disk with the given ID
+	DeleteDisk(ctx context.Context, diskID string) error
+	// AwaitDiskAvailable will block until the disk can be attached
+	AwaitDiskAvailable(ctx context.Context, diskID string) error
+	// AttachDisk attaches the disk to the (stopped) instance as the given
+	// device. If root is true, the disk is attached as the boot disk.
+	AttachDisk(ctx context.Context, diskID, instanceID, deviceName string, root bool) error
+	// DetachDisk detaches the disk from the given device of the instance
+	DetachDisk(ctx context.Context, diskID, instanceID, deviceName string) error
+	// TagDisk adds the given tags (labels in some clouds) to the disk
+	TagDisk(ctx context.Context, diskID string, tags map[string]string) error
+
+	// CreateSnapshot creates a snapshot of the disk and waits for it to
+	// be ready
+	CreateSnapshot(ctx context.Context, name, diskID string) (Snapshot, error)
+	// GetSnapshot returns the snapshot with the given ID
+	GetSnapshot(ctx context.Context, snapshotID string) (Snapshot, error)
+	// DeleteSnapshot will delete the snapshot with the given ID
+	DeleteSnapshot(ctx context.Context, snapshotID string) error
+
+	// GetImage returns the image with the given ID
+	GetImage(ctx context.Context, imageID string) (Image, error)
+	// CreateImage creates an image of all disks of the instance, that new
+	// instances can be launched from, and returns its ID
+	CreateImage(ctx context.Context, instanceID, name, desc string) (string, error)
+	// AwaitImageAvailable will block until the image can be launched
+	AwaitImageAvailable(ctx context.Context, imageID string) error
+	// DeleteImage will delete (or deregister) the image with the given ID
+	DeleteImage(ctx context.Context, imageID string) error
+	// TagImage adds the given tags (labels in some clouds) to the image
+	TagImage(ctx context.Context, imageID string, tags map[string]string) error
+}
+
+// HealthChecker is implemented by providers where instances report their
+// health after booting
+type HealthChecker interface {
+	// AwaitInstanceOK will block until the instance passes its health checks
+	AwaitInstanceOK(ctx context.Context, instanceID string) error
+}
+
+// NetworkEnabler is implemented by providers where enhanced networking must
+// be enabled on an instance before booting an image that supports it
+type NetworkEnabler interface {
+	// EnableNetworking enables the networking features of the image on the
+	// (stopped) instance
+	EnableNetworking(ctx context.Context, instanceID, imageID string) error
+}
+
+// SnapshotTagger is implemented by providers where snapshots can be tagged
+type SnapshotTagger interface {
+	// TagSnapshot adds the given tags to the snapshot
+	TagSnapshot(ctx context.Context, snapshotID string, tags map[string]string) error
+}
+
+// GzipUserdata is implemented by providers where instances accept gzip
+// compressed userdata, which leaves more room for the guest's userdata
+type GzipUserdata interface {
+	// AcceptsGzipUserdata reports if userdata may be compressed
+	AcceptsGzipUserdata() bool
+}
+
+// LaunchConfig specifies the instance launched by Provider.LaunchInstance.
+// Everything except the image is optional.
+type LaunchConfig struct {
+	Image string
+	// InstanceType is the type (or machine type) of the instance, a small
+	// generic type is used if empty
+	InstanceType string
+	// Larger uses a larger generic type if InstanceType is empty, e.g. for
+	// instances running the Metavisor
+	Larger   bool
+	Userdata string
+	// KeyName is the SSH key pair to launch with, in clouds that have them
+	KeyName string
+	// SubnetID is the subnet (or subnetwork) to launch in
+	SubnetID string
+	// Zone is the zone to launch in when no subnet is given, in clouds where
+	// disks must be in the same zone as the instance they're attached to
+	Zone string
+	// NoPublicIP launches the instance with only a private IP, e.g. when it
+	// is reached through a bastion host
+	NoPublicIP bool
+	// InstanceProfile is the IAM instance profile (or service account) the
+	// instance runs as
+	InstanceProfile string
+	Tags            map[string]string
+	// ExtraDisks are created from snapshots and attached at launch
+	ExtraDisks []NewDisk
+}
+
+// NewDisk is a disk created from a snapshot when launching an instance
+type NewDisk struct {
+	DeviceName string
+	SnapshotID string
+}
+
+// Resource is a generic cloud resource
+type Resource interface {
+	ID() string
+}
+
+// Instance is a virtual machine
+type Instance interface {
+	Resource
+	// InstanceType is the type of the instance, e.g. m4.large
+	InstanceType() string
+	// RootDeviceName is the name of the device the instance boots from
+	RootDeviceName() string
+	// DeviceMapping is a mapping from device name to disk ID
+	DeviceMapping() map[string]string
+	// PublicIP is the public IP, if it exists, otherwise empty
+	PublicIP() string
+	// PrivateIP is the private IP, if it exists, otherwise empty
+	PrivateIP() string
+	// AvailabilityZone is the availability zone of the instance
+	AvailabilityZone() string
+	// Tags are the tags (or labels) of the instance
+	Tags() map[string]string
+}
+
+// Disk is a block storage device, a volume in AWS
+type Disk interface {
+	Resource
+	// Tags are the tags (or labels) of the disk
+	Tags() map[string]string
+}
+
+// Snapshot is a point in time copy of a disk
+type Snapshot interface {
+	Resource
+	// SizeGB is the size of the snapshot in GiB
+	SizeGB() int64
+	// Tags are the tags (or labels) of the snapshot
+	Tags() map[string]string
+}
+
+// Image is something instances can be launched from, an AMI in AWS
+type Image interface {
+	Resource
+	// Name is the name of the image
+	Name() string
+	// Description is the description of the image
+	Description() string
+	// Tags are the tags (or labels) of the image
+	Tags() map[string]string
+}
+
+// MappedImage is an image made of snapshots, one for each device, such as
+// an AMI in AWS
+type MappedImage interface {
+	Image
+	// RootDeviceName is the name of the device instances boot from
+	RootDeviceName() string
+	// DeviceMapping is a mapping from device name to snapshot ID
+	DeviceMapping() map[string]string
+}
@@ -0,0 +1,190 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+const (
+	credentialsEnv = "GOOGLE_APPLICATION_CREDENTIALS"
+	computeScope   = "https://www.googleapis.com/auth/compute"
+	jwtGrantType   = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	// Tokens are refreshed a while before they expire
+	tokenExpiryMargin = time.Minute
+	// Tokens printed by gcloud are valid for an hour
+	gcloudTokenLifetime = 45 * time.Minute
+)
+
+// ErrInvalidCredentials is returned if the credentials file can't be used
+var ErrInvalidCredentials = errors.New("the GCP credentials file is not a valid service account key")
+
+type tokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+func newTokenSource(conf Config) (tokenSource, error) {
+	if conf.AccessToken != "" {
+		return staticToken(conf.AccessToken), nil
+	}
+	path := conf.CredentialsFile
+	if path == "" {
+		path = os.Getenv(credentialsEnv)
+	}
+	if path != "" {
+		return newServiceAccountSource(path)
+	}
+	if _, err := exec.LookPath("gcloud"); err != nil {
+		logging.Error("Could not find any GCP credentials, specify a service account key or install gcloud")
+		return nil, ErrNoGCPCreds
+	}
+	return &cachedToken{fetch: gcloudToken}, nil
+}
+
+type staticToken string
+
+func (t staticToken) Token(ctx context.Context) (string, error) { return string(t), nil }
+
+// cachedToken fetches a new token when the current one is about to expire
+type cachedToken struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	fetch   func(ctx context.Context) (string, time.Time, error)
+}
+
+func (c *cachedToken) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Add(tokenExpiryMargin).Before(c.expires) {
+		return c.token, nil
+	}
+	token, expires, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token, c.expires = token, expires
+	return token, nil
+}
+
+func gcloudToken(ctx context.Context) (string, time.Time, error) {
+	out, err := exec.CommandContext(ctx, "gcloud", "auth", "print-access-token").Output()
+	if err != nil {
+		logging.Error("Could not get an access token from gcloud, try running: gcloud auth login")
+		logging.Debugf("Got error from gcloud: %s", err)
+		return "", time.Time{}, ErrNoGCPCreds
+	}
+	return strings.TrimSpace(string(out)), time.Now().Add(gcloudTokenLifetime), nil
+}
+
+type serviceAccountKey struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func newServiceAccountSource(path string) (tokenSource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logging.Errorf("Could not read GCP credentials file %s", path)
+		return nil, err
+	}
+	var key serviceAccountKey
+	if err = json.Unmarshal(data, &key); err != nil || key.Type != "service_account" {
+		return nil, ErrInvalidCredentials
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, ErrInvalidCredentials
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		logging.Debugf("Could not parse service account private key: %s", err)
+		return nil, ErrInvalidCredentials
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &cachedToken{fetch: func(ctx context.Context) (string, time.Time, error) {
+		return exchangeJWT(ctx, key, rsaKey)
+	}}, nil
+}
+
+// exchangeJWT signs a JWT with the service account key, and exchanges it for
+// an access token, see https://developers.google.com/identity/protocols/oauth2/service-account
+func exchangeJWT(ctx context.Context, key serviceAccountKey, rsaKey *rsa.PrivateKey) (string, time.Time, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": computeScope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	form := url.Values{
+		"grant_type": {jwtGrantType},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)},
+	}
+	req, err := http.NewRequest(http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		logging.Errorf("Could not authenticate as %s", key.ClientEmail)
+		return "", time.Time{}, ErrNoGCPCreds
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", time.Time{}, err
+	}
+	return res.AccessToken, now.Add(time.Duration(res.ExpiresIn) * time.Second), nil
+}
@@ -0,0 +1,188 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/immutable/metavisor-cli/pkg/csp"
+)
+
+type computeDisk struct {
+	Name           string            `json:"name"`
+	SizeGB         string            `json:"sizeGb,omitempty"`
+	SourceImage    string            `json:"sourceImage,omitempty"`
+	SourceSnapshot string            `json:"sourceSnapshot,omitempty"`
+	Status         string            `json:"status,omitempty"`
+	Users          []string          `json:"users,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+type disk struct {
+	name   string
+	labels map[string]string
+}
+
+func (d *disk) ID() string              { return d.name }
+func (d *disk) Tags() map[string]string { return d.labels }
+
+type computeSnapshot struct {
+	Name       string            `json:"name"`
+	DiskSizeGB string            `json:"diskSizeGb,omitempty"`
+	SourceDisk string            `json:"sourceDisk,omitempty"`
+	Status     string            `json:"status,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+type snapshot struct {
+	name   string
+	sizeGB int64
+	labels map[string]string
+}
+
+func (s *snapshot) ID() string              { return s.name }
+func (s *snapshot) SizeGB() int64           { return s.sizeGB }
+func (s *snapshot) Tags() map[string]string { return s.labels }
+
+// CreateDiskFromImage creates a new disk from the image, which must be a
+// regular image and not a machine image. Disks can only be created in the
+// zone of the provider.
+func (g *gcpService) CreateDiskFromImage(ctx context.Context, imageID, zone string) (csp.Disk, error) {
+	if zone != "" && zone != g.zone {
+		return nil, ErrInvalidZone
+	}
+	source := imagePath(g.project, imageID)
+	if isMachineImage(source) {
+		return nil, ErrImageNonExisting
+	}
+	d := &computeDisk{
+		Name:        resourceName("metavisor-root"),
+		SourceImage: source,
+		Labels:      map[string]string{cliResourceLabelKey: cliResourceLabelValue},
+	}
+	err := g.do(ctx, http.MethodPost, "projects/"+g.project+"/zones/"+g.zone+"/disks", nil, d)
+	if err == errNotFound {
+		return nil, ErrImageNonExisting
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g.GetDisk(ctx, d.Name)
+}
+
+func (g *gcpService) GetDisk(ctx context.Context, diskID string) (csp.Disk, error) {
+	if !IsValidName(diskID) {
+		return nil, ErrDiskNonExisting
+	}
+	res := new(computeDisk)
+	err := g.call(ctx, http.MethodGet, g.zonal("disks", diskID), nil, nil, res)
+	if err == errNotFound {
+		return nil, ErrDiskNonExisting
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &disk{name: res.Name, labels: res.Labels}
+	if d.labels == nil {
+		d.labels = make(map[string]string)
+	}
+	return d, nil
+}
+
+func (g *gcpService) DeleteDisk(ctx context.Context, diskID string) error {
+	if !IsValidName(diskID) {
+		return ErrDiskNonExisting
+	}
+	err := g.do(ctx, http.MethodDelete, g.zonal("disks", diskID), nil, nil)
+	if err == errNotFound {
+		return ErrDiskNonExisting
+	}
+	return err
+}
+
+// AwaitDiskAvailable waits until the disk is ready and not attached to any
+// instance
+func (g *gcpService) AwaitDiskAvailable(ctx context.Context, diskID string) error {
+	return g.await(ctx, g.zonal("disks", diskID), func(status string, users int) bool {
+		return status == statusReady && users == 0
+	})
+}
+
+func (g *gcpService) TagDisk(ctx context.Context, diskID string, tags map[string]string) error {
+	err := g.setLabels(ctx, g.zonal("disks", diskID), tags)
+	if err == errNotFound {
+		return ErrDiskNonExisting
+	}
+	return err
+}
+
+// CreateSnapshot creates a snapshot of the disk. Snapshot names must be
+// unique in GCP, so the given name is used as a prefix.
+func (g *gcpService) CreateSnapshot(ctx context.Context, name, diskID string) (csp.Snapshot, error) {
+	if !IsValidName(diskID) {
+		return nil, ErrDiskNonExisting
+	}
+	s := &computeSnapshot{
+		Name:   resourceName(name),
+		Labels: map[string]string{cliResourceLabelKey: cliResourceLabelValue},
+	}
+	err := g.do(ctx, http.MethodPost, g.zonal("disks", diskID)+"/createSnapshot", nil, s)
+	if err == errNotFound {
+		return nil, ErrDiskNonExisting
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = g.await(ctx, g.global("snapshots", s.Name), func(status string, _ int) bool {
+		return status == statusReady
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g.GetSnapshot(ctx, s.Name)
+}
+
+func (g *gcpService) GetSnapshot(ctx context.Context, snapshotID string) (csp.Snapshot, error) {
+	if !IsValidName(snapshotID) {
+		return nil, ErrSnapshotNonExisting
+	}
+	res := new(computeSnapshot)
+	err := g.call(ctx, http.MethodGet, g.global("snapshots", snapshotID), nil, nil, res)
+	if err == errNotFound {
+		return nil, ErrSnapshotNonExisting
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{name: res.Name, labels: res.Labels}
+	if s.labels == nil {
+		s.labels = make(map[string]string)
+	}
+	s.sizeGB, _ = strconv.ParseInt(res.DiskSizeGB, 10, 64)
+	return s, nil
+}
+
+func (g *gcpService) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	if !IsValidName(snapshotID) {
+		return ErrSnapshotNonExisting
+	}
+	err := g.do(ctx, http.MethodDelete, g.global("snapshots", snapshotID), nil, nil)
+	if err == errNotFound {
+		return ErrSnapshotNonExisting
+	}
+	return err
+}
@@ -0,0 +1,773 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package fake is an in-memory implementation of the parts of the Compute
+// Engine API used by pkg/csp/gcp. It's meant to be served with
+// net/http/httptest and used as the endpoint of the GCP provider in tests:
+//
+//	compute := fake.New()
+//	server := httptest.NewServer(compute)
+//	defer server.Close()
+//	provider, err := gcp.New(gcp.Config{Endpoint: server.URL, ...})
+//
+// Operations are reported as running when created and done the first time
+// they are polled, everything else happens immediately.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	statusRunning    = "RUNNING"
+	statusTerminated = "TERMINATED"
+	statusReady      = "READY"
+	statusDone       = "DONE"
+
+	// BootDeviceName is the device name of the boot disk of instances
+	// created with AddInstance
+	BootDeviceName = "persistent-disk-0"
+
+	defaultDiskSizeGB = "10"
+)
+
+// AttachedDisk is a disk attached to an instance
+type AttachedDisk struct {
+	DeviceName       string            `json:"deviceName,omitempty"`
+	Source           string            `json:"source,omitempty"`
+	Boot             bool              `json:"boot,omitempty"`
+	AutoDelete       bool              `json:"autoDelete,omitempty"`
+	InitializeParams *InitializeParams `json:"initializeParams,omitempty"`
+}
+
+// InitializeParams specifies how to create a disk when launching an instance
+type InitializeParams struct {
+	SourceImage    string `json:"sourceImage,omitempty"`
+	SourceSnapshot string `json:"sourceSnapshot,omitempty"`
+}
+
+// MetadataItem is a key/value pair of instance metadata
+type MetadataItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Metadata is the metadata of an instance
+type Metadata struct {
+	Fingerprint string         `json:"fingerprint,omitempty"`
+	Items       []MetadataItem `json:"items"`
+}
+
+// NetworkInterface is a network interface of an instance
+type NetworkInterface struct {
+	Network       string         `json:"network,omitempty"`
+	Subnetwork    string         `json:"subnetwork,omitempty"`
+	NetworkIP     string         `json:"networkIP,omitempty"`
+	AccessConfigs []AccessConfig `json:"accessConfigs,omitempty"`
+}
+
+// AccessConfig gives an instance a public IP
+type AccessConfig struct {
+	Type  string `json:"type,omitempty"`
+	NatIP string `json:"natIP,omitempty"`
+}
+
+// Instance is a Compute Engine instance
+type Instance struct {
+	Name               string             `json:"name"`
+	MachineType        string             `json:"machineType,omitempty"`
+	Status             string             `json:"status,omitempty"`
+	Zone               string             `json:"zone,omitempty"`
+	Disks              []AttachedDisk     `json:"disks,omitempty"`
+	NetworkInterfaces  []NetworkInterface `json:"networkInterfaces,omitempty"`
+	Metadata           *Metadata          `json:"metadata,omitempty"`
+	Labels             map[string]string  `json:"labels,omitempty"`
+	LabelFingerprint   string             `json:"labelFingerprint,omitempty"`
+	SourceMachineImage string             `json:"sourceMachineImage,omitempty"`
+}
+
+// Disk is a persistent disk
+type Disk struct {
+	Name             string            `json:"name"`
+	SizeGB           string            `json:"sizeGb,omitempty"`
+	SourceImage      string            `json:"sourceImage,omitempty"`
+	SourceSnapshot   string            `json:"sourceSnapshot,omitempty"`
+	Status           string            `json:"status,omitempty"`
+	Users            []string          `json:"users,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	LabelFingerprint string            `json:"labelFingerprint,omitempty"`
+}
+
+// Snapshot is a snapshot of a disk
+type Snapshot struct {
+	Name             string            `json:"name"`
+	DiskSizeGB       string            `json:"diskSizeGb,omitempty"`
+	SourceDisk       string            `json:"sourceDisk,omitempty"`
+	Status           string            `json:"status,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	LabelFingerprint string            `json:"labelFingerprint,omitempty"`
+}
+
+// Image is either an image or a machine image
+type Image struct {
+	Name             string            `json:"name"`
+	Description      string            `json:"description,omitempty"`
+	Status           string            `json:"status,omitempty"`
+	DiskSizeGB       string            `json:"diskSizeGb,omitempty"`
+	SourceInstance   string            `json:"sourceInstance,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	LabelFingerprint string            `json:"labelFingerprint,omitempty"`
+	// SavedDisks are the disks of the instance a machine image was
+	// created from, new instances get disks on the same devices
+	SavedDisks []AttachedDisk `json:"-"`
+}
+
+type operation struct {
+	Name   string `json:"name"`
+	Zone   string `json:"zone,omitempty"`
+	Status string `json:"status"`
+}
+
+type failure struct {
+	method, suffix string
+	code           int
+}
+
+// Compute is an in-memory Compute Engine API. All resources are stored by
+// their path, e.g. projects/p/zones/z/instances/name.
+type Compute struct {
+	mu            sync.Mutex
+	instances     map[string]*Instance
+	disks         map[string]*Disk
+	snapshots     map[string]*Snapshot
+	images        map[string]*Image
+	machineImages map[string]*Image
+	operations    map[string]*operation
+	failures      []failure
+	counter       int
+}
+
+// New returns an empty compute API
+func New() *Compute {
+	return &Compute{
+		instances:     make(map[string]*Instance),
+		disks:         make(map[string]*Disk),
+		snapshots:     make(map[string]*Snapshot),
+		images:        make(map[string]*Image),
+		machineImages: make(map[string]*Image),
+		operations:    make(map[string]*operation),
+	}
+}
+
+// AddImage adds an image which instances and disks can be created from
+func (c *Compute) AddImage(project, name string, labels map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.images[globalPath(project, "images", name)] = &Image{
+		Name:             name,
+		Status:           statusReady,
+		DiskSizeGB:       defaultDiskSizeGB,
+		Labels:           labels,
+		LabelFingerprint: c.fingerprint(),
+	}
+}
+
+// AddInstance adds a running instance booted from a disk with the same
+// name as the instance, attached as BootDeviceName
+func (c *Compute) AddInstance(project, zone, name string, labels map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	instPath := zonalPath(project, zone, "instances", name)
+	diskPath := zonalPath(project, zone, "disks", name)
+	c.disks[diskPath] = &Disk{
+		Name:             name,
+		SizeGB:           defaultDiskSizeGB,
+		Status:           statusReady,
+		Users:            []string{instPath},
+		LabelFingerprint: c.fingerprint(),
+	}
+	c.instances[instPath] = c.newInstance(project, zone, name, labels)
+	c.instances[instPath].Disks = []AttachedDisk{{
+		DeviceName: BootDeviceName,
+		Source:     diskPath,
+		Boot:       true,
+		AutoDelete: true,
+	}}
+}
+
+// FailNext makes the next request with the given method, whose path ends
+// with the suffix, fail with the given HTTP status code
+func (c *Compute) FailNext(method, suffix string, code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = append(c.failures, failure{method, suffix, code})
+}
+
+// Instance returns a copy of the instance, or nil if it doesn't exist
+func (c *Compute) Instance(project, zone, name string) *Instance {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inst, exist := c.instances[zonalPath(project, zone, "instances", name)]
+	if !exist {
+		return nil
+	}
+	cp := *inst
+	cp.Disks = append([]AttachedDisk(nil), inst.Disks...)
+	return &cp
+}
+
+// Disk returns a copy of the disk, or nil if it doesn't exist
+func (c *Compute) Disk(project, zone, name string) *Disk {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, exist := c.disks[zonalPath(project, zone, "disks", name)]
+	if !exist {
+		return nil
+	}
+	cp := *d
+	return &cp
+}
+
+// MachineImage returns a copy of the machine image, or nil if it doesn't exist
+func (c *Compute) MachineImage(project, name string) *Image {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	img, exist := c.machineImages[globalPath(project, "machineImages", name)]
+	if !exist {
+		return nil
+	}
+	cp := *img
+	return &cp
+}
+
+// Count returns the number of instances, disks and snapshots that exist
+func (c *Compute) Count() (instances, disks, snapshots int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.instances), len(c.disks), len(c.snapshots)
+}
+
+func zonalPath(project, zone, collection, name string) string {
+	return fmt.Sprintf("projects/%s/zones/%s/%s/%s", project, zone, collection, name)
+}
+
+func globalPath(project, collection, name string) string {
+	return fmt.Sprintf("projects/%s/global/%s/%s", project, collection, name)
+}
+
+// resourcePath turns a URL or partial path into a full resource path
+func resourcePath(project, s string) string {
+	if i := strings.Index(s, "projects/"); i >= 0 {
+		return s[i:]
+	}
+	return "projects/" + project + "/" + s
+}
+
+func (c *Compute) newInstance(project, zone, name string, labels map[string]string) *Instance {
+	c.counter++
+	return &Instance{
+		Name:        name,
+		MachineType: zonalPath(project, zone, "machineTypes", "e2-small"),
+		Status:      statusRunning,
+		Zone:        "projects/" + project + "/zones/" + zone,
+		NetworkInterfaces: []NetworkInterface{{
+			NetworkIP:     fmt.Sprintf("10.0.0.%d", c.counter%250+2),
+			AccessConfigs: []AccessConfig{{Type: "ONE_TO_ONE_NAT", NatIP: fmt.Sprintf("203.0.113.%d", c.counter%250+2)}},
+		}},
+		Metadata:         &Metadata{Fingerprint: c.fingerprint()},
+		Labels:           labels,
+		LabelFingerprint: c.fingerprint(),
+	}
+}
+
+func (c *Compute) fingerprint() string {
+	c.counter++
+	return "fp-" + strconv.Itoa(c.counter)
+}
+
+type apiError struct {
+	code    int
+	message string
+}
+
+func errorf(code int, format string, args ...interface{}) *apiError {
+	return &apiError{code, fmt.Sprintf(format, args...)}
+}
+
+// ServeHTTP implements the Compute Engine REST API
+func (c *Compute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, apiErr := c.serve(r)
+	w.Header().Set("Content-Type", "application/json")
+	if apiErr != nil {
+		w.WriteHeader(apiErr.code)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{"code": apiErr.code, "message": apiErr.message},
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (c *Compute) serve(r *http.Request) (interface{}, *apiError) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return nil, errorf(http.StatusUnauthorized, "missing credentials")
+	}
+	for i, f := range c.failures {
+		if f.method == r.Method && strings.HasSuffix(r.URL.Path, f.suffix) {
+			c.failures = append(c.failures[:i], c.failures[i+1:]...)
+			return nil, errorf(f.code, "injected failure")
+		}
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "projects" {
+		return nil, errorf(http.StatusNotFound, "unknown path %s", r.URL.Path)
+	}
+	project := parts[1]
+	var zone, collection, name, action string
+	if parts[2] == "zones" && len(parts) >= 5 {
+		zone, collection = parts[3], parts[4]
+		parts = parts[5:]
+	} else if parts[2] == "global" {
+		collection = parts[3]
+		parts = parts[4:]
+	} else {
+		return nil, errorf(http.StatusNotFound, "unknown path %s", r.URL.Path)
+	}
+	if len(parts) > 0 {
+		name = parts[0]
+	}
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	var body map[string]json.RawMessage
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			return nil, errorf(http.StatusBadRequest, "invalid body: %s", err)
+		}
+	}
+	req := request{r: r, body: body, project: project, zone: zone, name: name, action: action}
+	switch collection {
+	case "instances":
+		return c.serveInstances(req)
+	case "disks":
+		return c.serveDisks(req)
+	case "snapshots":
+		return c.serveSnapshots(req)
+	case "images", "machineImages":
+		return c.serveImages(req, collection)
+	case "operations":
+		path := globalPath(project, "operations", name)
+		if zone != "" {
+			path = zonalPath(project, zone, "operations", name)
+		}
+		op, exist := c.operations[path]
+		if !exist {
+			return nil, errorf(http.StatusNotFound, "operation %s not found", name)
+		}
+		op.Status = statusDone
+		return op, nil
+	}
+	return nil, errorf(http.StatusNotFound, "unknown collection %s", collection)
+}
+
+type request struct {
+	r                           *http.Request
+	body                        map[string]json.RawMessage
+	project, zone, name, action string
+}
+
+func (req request) decode(v interface{}) *apiError {
+	data, err := json.Marshal(req.body)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return errorf(http.StatusBadRequest, "invalid body: %s", err)
+	}
+	return nil
+}
+
+// newOperation returns a new operation that is done when polled
+func (c *Compute) newOperation(project, zone string) (interface{}, *apiError) {
+	c.counter++
+	op := &operation{Name: "operation-" + strconv.Itoa(c.counter), Status: statusRunning}
+	path := globalPath(project, "operations", op.Name)
+	if zone != "" {
+		op.Zone = "projects/" + project + "/zones/" + zone
+		path = zonalPath(project, zone, "operations", op.Name)
+	}
+	c.operations[path] = op
+	return op, nil
+}
+
+func (c *Compute) serveInstances(req request) (interface{}, *apiError) {
+	if req.name == "" && req.r.Method == http.MethodPost {
+		return c.insertInstance(req)
+	}
+	path := zonalPath(req.project, req.zone, "instances", req.name)
+	inst, exist := c.instances[path]
+	if !exist {
+		return nil, errorf(http.StatusNotFound, "instance %s not found", req.name)
+	}
+	switch {
+	case req.r.Method == http.MethodGet && req.action == "":
+		return inst, nil
+	case req.r.Method == http.MethodDelete && req.action == "":
+		for _, d := range inst.Disks {
+			disk := c.disks[d.Source]
+			disk.Users = removeString(disk.Users, path)
+			if d.AutoDelete {
+				delete(c.disks, d.Source)
+			}
+		}
+		delete(c.instances, path)
+	case req.action == "stop":
+		inst.Status = statusTerminated
+	case req.action == "start":
+		if bootDisk(inst) < 0 {
+			return nil, errorf(http.StatusBadRequest, "instance %s has no boot disk", req.name)
+		}
+		inst.Status = statusRunning
+	case req.action == "setMetadata":
+		md := new(Metadata)
+		if err := req.decode(md); err != nil {
+			return nil, err
+		}
+		if md.Fingerprint != inst.Metadata.Fingerprint {
+			return nil, errorf(http.StatusPreconditionFailed, "metadata fingerprint mismatch")
+		}
+		md.Fingerprint = c.fingerprint()
+		inst.Metadata = md
+	case req.action == "setLabels":
+		labels, err := c.labels(req, inst.LabelFingerprint)
+		if err != nil {
+			return nil, err
+		}
+		inst.Labels, inst.LabelFingerprint = labels, c.fingerprint()
+	case req.action == "attachDisk":
+		return c.attachDisk(req, path, inst)
+	case req.action == "detachDisk":
+		return c.detachDisk(req, path, inst)
+	case req.action == "setDiskAutoDelete":
+		device := req.r.URL.Query().Get("deviceName")
+		for i := range inst.Disks {
+			if inst.Disks[i].DeviceName == device {
+				inst.Disks[i].AutoDelete = req.r.URL.Query().Get("autoDelete") == "true"
+				return c.newOperation(req.project, req.zone)
+			}
+		}
+		return nil, errorf(http.StatusBadRequest, "no disk attached as %s", device)
+	default:
+		return nil, errorf(http.StatusNotFound, "unknown action %s", req.action)
+	}
+	return c.newOperation(req.project, req.zone)
+}
+
+func (c *Compute) insertInstance(req request) (interface{}, *apiError) {
+	spec := new(Instance)
+	if err := req.decode(spec); err != nil {
+		return nil, err
+	}
+	path := zonalPath(req.project, req.zone, "instances", spec.Name)
+	if _, exist := c.instances[path]; exist {
+		return nil, errorf(http.StatusConflict, "instance %s already exists", spec.Name)
+	}
+	disks := spec.Disks
+	if spec.SourceMachineImage != "" {
+		img, exist := c.machineImages[resourcePath(req.project, spec.SourceMachineImage)]
+		if !exist {
+			return nil, errorf(http.StatusNotFound, "machine image %s not found", spec.SourceMachineImage)
+		}
+		disks = img.SavedDisks
+	}
+	inst := c.newInstance(req.project, req.zone, spec.Name, spec.Labels)
+	if spec.Metadata != nil {
+		inst.Metadata.Items = spec.Metadata.Items
+	}
+	if len(spec.NetworkInterfaces) > 0 {
+		inst.NetworkInterfaces[0].Subnetwork = spec.NetworkInterfaces[0].Subnetwork
+	}
+	for i, d := range disks {
+		disk := &Disk{
+			Name:             spec.Name,
+			SizeGB:           defaultDiskSizeGB,
+			Status:           statusReady,
+			Users:            []string{path},
+			LabelFingerprint: c.fingerprint(),
+		}
+		if i > 0 {
+			disk.Name = fmt.Sprintf("%s-%d", spec.Name, i)
+		}
+		if d.InitializeParams != nil && d.InitializeParams.SourceImage != "" {
+			img, exist := c.images[resourcePath(req.project, d.InitializeParams.SourceImage)]
+			if !exist {
+				return nil, errorf(http.StatusNotFound, "image %s not found", d.InitializeParams.SourceImage)
+			}
+			disk.SourceImage, disk.SizeGB = d.InitializeParams.SourceImage, img.DiskSizeGB
+		}
+		if d.InitializeParams != nil && d.InitializeParams.SourceSnapshot != "" {
+			snap, exist := c.snapshots[resourcePath(req.project, d.InitializeParams.SourceSnapshot)]
+			if !exist {
+				return nil, errorf(http.StatusNotFound, "snapshot %s not found", d.InitializeParams.SourceSnapshot)
+			}
+			disk.SourceSnapshot, disk.SizeGB = d.InitializeParams.SourceSnapshot, snap.DiskSizeGB
+		}
+		device := d.DeviceName
+		if device == "" {
+			device = fmt.Sprintf("persistent-disk-%d", i)
+		}
+		diskPath := zonalPath(req.project, req.zone, "disks", disk.Name)
+		c.disks[diskPath] = disk
+		inst.Disks = append(inst.Disks, AttachedDisk{
+			DeviceName: device,
+			Source:     diskPath,
+			Boot:       d.Boot,
+			AutoDelete: d.AutoDelete,
+		})
+	}
+	c.instances[path] = inst
+	return c.newOperation(req.project, req.zone)
+}
+
+func (c *Compute) attachDisk(req request, path string, inst *Instance) (interface{}, *apiError) {
+	spec := new(AttachedDisk)
+	if err := req.decode(spec); err != nil {
+		return nil, err
+	}
+	diskPath := resourcePath(req.project, spec.Source)
+	disk, exist := c.disks[diskPath]
+	if !exist {
+		return nil, errorf(http.StatusNotFound, "disk %s not found", spec.Source)
+	}
+	if len(disk.Users) > 0 {
+		return nil, errorf(http.StatusBadRequest, "disk %s is already being used by %s", disk.Name, disk.Users[0])
+	}
+	for _, d := range inst.Disks {
+		if d.DeviceName == spec.DeviceName {
+			return nil, errorf(http.StatusBadRequest, "device %s is already in use", spec.DeviceName)
+		}
+	}
+	if spec.Boot && (inst.Status != statusTerminated || bootDisk(inst) >= 0) {
+		return nil, errorf(http.StatusBadRequest, "boot disks can only be attached to stopped instances without a boot disk")
+	}
+	disk.Users = append(disk.Users, path)
+	inst.Disks = append(inst.Disks, AttachedDisk{
+		DeviceName: spec.DeviceName,
+		Source:     diskPath,
+		Boot:       spec.Boot,
+		AutoDelete: spec.AutoDelete,
+	})
+	return c.newOperation(req.project, req.zone)
+}
+
+func (c *Compute) detachDisk(req request, path string, inst *Instance) (interface{}, *apiError) {
+	device := req.r.URL.Query().Get("deviceName")
+	for i, d := range inst.Disks {
+		if d.DeviceName != device {
+			continue
+		}
+		if d.Boot && inst.Status != statusTerminated {
+			return nil, errorf(http.StatusBadRequest, "boot disks can only be detached from stopped instances")
+		}
+		c.disks[d.Source].Users = removeString(c.disks[d.Source].Users, path)
+		inst.Disks = append(inst.Disks[:i], inst.Disks[i+1:]...)
+		return c.newOperation(req.project, req.zone)
+	}
+	return nil, errorf(http.StatusBadRequest, "no disk attached as %s", device)
+}
+
+func (c *Compute) serveDisks(req request) (interface{}, *apiError) {
+	if req.name == "" && req.r.Method == http.MethodPost {
+		spec := new(Disk)
+		if err := req.decode(spec); err != nil {
+			return nil, err
+		}
+		path := zonalPath(req.project, req.zone, "disks", spec.Name)
+		if _, exist := c.disks[path]; exist {
+			return nil, errorf(http.StatusConflict, "disk %s already exists", spec.Name)
+		}
+		img, exist := c.images[resourcePath(req.project, spec.SourceImage)]
+		if !exist {
+			return nil, errorf(http.StatusNotFound, "image %s not found", spec.SourceImage)
+		}
+		c.disks[path] = &Disk{
+			Name:             spec.Name,
+			SizeGB:           img.DiskSizeGB,
+			SourceImage:      spec.SourceImage,
+			Status:           statusReady,
+			Labels:           spec.Labels,
+			LabelFingerprint: c.fingerprint(),
+		}
+		return c.newOperation(req.project, req.zone)
+	}
+	path := zonalPath(req.project, req.zone, "disks", req.name)
+	disk, exist := c.disks[path]
+	if !exist {
+		return nil, errorf(http.StatusNotFound, "disk %s not found", req.name)
+	}
+	switch {
+	case req.r.Method == http.MethodGet && req.action == "":
+		return disk, nil
+	case req.r.Method == http.MethodDelete && req.action == "":
+		if len(disk.Users) > 0 {
+			return nil, errorf(http.StatusBadRequest, "disk %s is being used by %s", disk.Name, disk.Users[0])
+		}
+		delete(c.disks, path)
+	case req.action == "setLabels":
+		labels, err := c.labels(req, disk.LabelFingerprint)
+		if err != nil {
+			return nil, err
+		}
+		disk.Labels, disk.LabelFingerprint = labels, c.fingerprint()
+	case req.action == "createSnapshot":
+		spec := new(Snapshot)
+		if err := req.decode(spec); err != nil {
+			return nil, err
+		}
+		c.snapshots[globalPath(req.project, "snapshots", spec.Name)] = &Snapshot{
+			Name:             spec.Name,
+			DiskSizeGB:       disk.SizeGB,
+			SourceDisk:       path,
+			Status:           statusReady,
+			Labels:           spec.Labels,
+			LabelFingerprint: c.fingerprint(),
+		}
+	default:
+		return nil, errorf(http.StatusNotFound, "unknown action %s", req.action)
+	}
+	return c.newOperation(req.project, req.zone)
+}
+
+func (c *Compute) serveSnapshots(req request) (interface{}, *apiError) {
+	path := globalPath(req.project, "snapshots", req.name)
+	snap, exist := c.snapshots[path]
+	if !exist {
+		return nil, errorf(http.StatusNotFound, "snapshot %s not found", req.name)
+	}
+	switch {
+	case req.r.Method == http.MethodGet && req.action == "":
+		return snap, nil
+	case req.r.Method == http.MethodDelete && req.action == "":
+		delete(c.snapshots, path)
+	case req.action == "setLabels":
+		labels, err := c.labels(req, snap.LabelFingerprint)
+		if err != nil {
+			return nil, err
+		}
+		snap.Labels, snap.LabelFingerprint = labels, c.fingerprint()
+	default:
+		return nil, errorf(http.StatusNotFound, "unknown action %s", req.action)
+	}
+	return c.newOperation(req.project, "")
+}
+
+func (c *Compute) serveImages(req request, collection string) (interface{}, *apiError) {
+	images := c.images
+	if collection == "machineImages" {
+		images = c.machineImages
+	}
+	if req.name == "" && req.r.Method == http.MethodPost && collection == "machineImages" {
+		spec := new(Image)
+		if err := req.decode(spec); err != nil {
+			return nil, err
+		}
+		path := globalPath(req.project, collection, spec.Name)
+		if _, exist := images[path]; exist {
+			return nil, errorf(http.StatusConflict, "machine image %s already exists", spec.Name)
+		}
+		inst, exist := c.instances[resourcePath(req.project, spec.SourceInstance)]
+		if !exist {
+			return nil, errorf(http.StatusNotFound, "instance %s not found", spec.SourceInstance)
+		}
+		img := &Image{
+			Name:             spec.Name,
+			Description:      spec.Description,
+			Status:           statusReady,
+			SourceInstance:   spec.SourceInstance,
+			LabelFingerprint: c.fingerprint(),
+		}
+		for _, d := range inst.Disks {
+			img.SavedDisks = append(img.SavedDisks, AttachedDisk{
+				DeviceName: d.DeviceName,
+				Boot:       d.Boot,
+				AutoDelete: true,
+			})
+		}
+		images[path] = img
+		return c.newOperation(req.project, "")
+	}
+	path := globalPath(req.project, collection, req.name)
+	img, exist := images[path]
+	if !exist {
+		return nil, errorf(http.StatusNotFound, "image %s not found", req.name)
+	}
+	switch {
+	case req.r.Method == http.MethodGet && req.action == "":
+		return img, nil
+	case req.r.Method == http.MethodDelete && req.action == "":
+		delete(images, path)
+	case req.action == "setLabels":
+		labels, err := c.labels(req, img.LabelFingerprint)
+		if err != nil {
+			return nil, err
+		}
+		img.Labels, img.LabelFingerprint = labels, c.fingerprint()
+	default:
+		return nil, errorf(http.StatusNotFound, "unknown action %s", req.action)
+	}
+	return c.newOperation(req.project, "")
+}
+
+// labels returns the labels of a setLabels request, if the fingerprint is
+// the current one
+func (c *Compute) labels(req request, fingerprint string) (map[string]string, *apiError) {
+	var spec struct {
+		Labels           map[string]string `json:"labels"`
+		LabelFingerprint string            `json:"labelFingerprint"`
+	}
+	if err := req.decode(&spec); err != nil {
+		return nil, err
+	}
+	if spec.LabelFingerprint != fingerprint {
+		return nil, errorf(http.StatusPreconditionFailed, "label fingerprint mismatch")
+	}
+	return spec.Labels, nil
+}
+
+func bootDisk(inst *Instance) int {
+	for i, d := range inst.Disks {
+		if d.Boot {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeString(list []string, s string) []string {
+	var res []string
+	for _, v := range list {
+		if v != s {
+			res = append(res, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,321 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package gcp implements csp.Provider for Google Cloud Platform, by talking
+// to the Compute Engine REST API directly to avoid additional dependencies.
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+const (
+	// DefaultEndpoint is the base URL of the Compute Engine API
+	DefaultEndpoint = "https://compute.googleapis.com/compute/v1"
+
+	// SmallMachineType is a generic smaller machine type in GCP
+	SmallMachineType = "e2-small"
+	// LargerMachineType is a generic larger machine type in GCP
+	LargerMachineType = "n1-standard-2"
+
+	// GuestDeviceName is the device name the Metavisor expects the guest
+	// disk to be attached as
+	GuestDeviceName = "metavisor-guest"
+	// UserdataKey is the instance metadata key the Metavisor reads its
+	// userdata from
+	UserdataKey = "user-data"
+
+	defaultPollInterval = 5 * time.Second
+	defaultAwaitTimeout = 10 * time.Minute
+
+	// A label is added to all resources created by the CLI
+	cliResourceLabelKey   = "metavisor-cli"
+	cliResourceLabelValue = "true"
+
+	statusDone       = "DONE"
+	statusReady      = "READY"
+	statusRunning    = "RUNNING"
+	statusTerminated = "TERMINATED"
+)
+
+var (
+	// ErrNoGCPCreds is returned if no credentials could be found in the
+	// config, $GOOGLE_APPLICATION_CREDENTIALS or through gcloud
+	ErrNoGCPCreds = errors.New("no valid GCP credentials present")
+	// ErrNoProject is returned if no GCP project is specified
+	ErrNoProject = errors.New("a GCP project must be specified")
+	// ErrInvalidZone is returned if the specified zone is not a valid zone
+	ErrInvalidZone = errors.New("the specified zone is not valid")
+	// ErrInvalidName is returned if trying to specify an invalid resource name
+	ErrInvalidName = errors.New("name is invalid")
+	// ErrInstanceNonExisting is returned if the specified instance doesn't exist
+	ErrInstanceNonExisting = errors.New("instance doesn't exist")
+	// ErrDiskNonExisting is returned if the specified disk doesn't exist
+	ErrDiskNonExisting = errors.New("disk doesn't exist")
+	// ErrSnapshotNonExisting is returned if the specified snapshot doesn't exist
+	ErrSnapshotNonExisting = errors.New("snapshot doesn't exist")
+	// ErrImageNonExisting is returned if the specified image doesn't exist
+	ErrImageNonExisting = errors.New("image doesn't exist")
+	// ErrNoBootDisk is returned if trying to start an instance without a
+	// boot disk
+	ErrNoBootDisk = errors.New("instance has no boot disk")
+	// ErrTimedOut is returned if a resource never reaches the expected status
+	ErrTimedOut = errors.New("timed out while waiting")
+
+	errNotFound = errors.New("resource not found")
+)
+
+// Config specifies the project and zone to operate in, and how to
+// authenticate with GCP
+type Config struct {
+	Project string
+	Zone    string
+	// CredentialsFile is a service account key file.
+	// $GOOGLE_APPLICATION_CREDENTIALS is used if empty, and if that isn't set
+	// either, an access token is requested from gcloud.
+	CredentialsFile string
+	// AccessToken is used as is instead of any credentials, if specified
+	AccessToken string
+	// Endpoint is the base URL of the Compute Engine API, DefaultEndpoint
+	// is used if empty
+	Endpoint string
+	// PollInterval is how often operations and resources are polled while
+	// waiting for them, a few seconds if zero
+	PollInterval time.Duration
+}
+
+// APIError is an error returned by the Compute Engine API
+type APIError struct {
+	Code    int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("gcp: %s (%d)", e.Message, e.Code)
+}
+
+// New returns a csp.Provider operating in the project and zone of the config
+func New(conf Config) (csp.Provider, error) {
+	if strings.TrimSpace(conf.Project) == "" {
+		return nil, ErrNoProject
+	}
+	if !IsValidZone(conf.Zone) {
+		return nil, ErrInvalidZone
+	}
+	tokens, err := newTokenSource(conf)
+	if err != nil {
+		return nil, err
+	}
+	g := &gcpService{
+		project:      conf.Project,
+		zone:         conf.Zone,
+		endpoint:     strings.TrimSuffix(conf.Endpoint, "/"),
+		pollInterval: conf.PollInterval,
+		tokens:       tokens,
+		client:       http.DefaultClient,
+	}
+	if g.endpoint == "" {
+		g.endpoint = DefaultEndpoint
+	}
+	if g.pollInterval <= 0 {
+		g.pollInterval = defaultPollInterval
+	}
+	return g, nil
+}
+
+type gcpService struct {
+	project      string
+	zone         string
+	endpoint     string
+	pollInterval time.Duration
+	tokens       tokenSource
+	client       *http.Client
+}
+
+func (g *gcpService) Name() string            { return "gcp" }
+func (g *gcpService) Region() string          { return g.zone }
+func (g *gcpService) GuestDeviceName() string { return GuestDeviceName }
+
+// zonal returns the path of a resource in the zone, e.g. zonal("disks", "d")
+func (g *gcpService) zonal(collection, name string) string {
+	return fmt.Sprintf("projects/%s/zones/%s/%s/%s", g.project, g.zone, collection, name)
+}
+
+// global returns the path of a global resource in the project
+func (g *gcpService) global(collection, name string) string {
+	return fmt.Sprintf("projects/%s/global/%s/%s", g.project, collection, name)
+}
+
+type operation struct {
+	Name   string `json:"name"`
+	Zone   string `json:"zone"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+type apiErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// call performs a request against the API, path is relative to the endpoint
+func (g *gcpService) call(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	u := fmt.Sprintf("%s/%s", g.endpoint, path)
+	if len(query) > 0 {
+		u = fmt.Sprintf("%s?%s", u, query.Encode())
+	}
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, u, &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	token, err := g.tokens.Token(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return responseError(resp.StatusCode, data)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func responseError(status int, data []byte) error {
+	switch status {
+	case http.StatusNotFound:
+		return errNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return csp.ErrNotAllowed
+	}
+	var errResp apiErrorResponse
+	if err := json.Unmarshal(data, &errResp); err != nil || errResp.Error.Message == "" {
+		return &APIError{Code: status, Message: http.StatusText(status)}
+	}
+	return &APIError{Code: status, Message: errResp.Error.Message}
+}
+
+// do performs a request returning an operation, and waits for the operation
+// to be done
+func (g *gcpService) do(ctx context.Context, method, path string, query url.Values, in interface{}) error {
+	op := new(operation)
+	if err := g.call(ctx, method, path, query, in, op); err != nil {
+		return err
+	}
+	opPath := g.global("operations", op.Name)
+	if op.Zone != "" {
+		opPath = g.zonal("operations", op.Name)
+	}
+	for op.Status != statusDone {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(g.pollInterval):
+		}
+		op = new(operation)
+		if err := g.call(ctx, http.MethodGet, opPath, nil, nil, op); err != nil {
+			return err
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		e := op.Error.Errors[0]
+		logging.Debugf("Operation %s failed with %s", op.Name, e.Code)
+		return &APIError{Code: http.StatusBadRequest, Message: e.Message}
+	}
+	return nil
+}
+
+// await polls the status of a resource until it's the wanted one
+func (g *gcpService) await(ctx context.Context, path string, wanted func(status string, users int) bool) error {
+	deadline := time.Now().Add(defaultAwaitTimeout)
+	for {
+		var res struct {
+			Status string   `json:"status"`
+			Users  []string `json:"users"`
+		}
+		if err := g.call(ctx, http.MethodGet, path, nil, nil, &res); err != nil {
+			return err
+		}
+		if wanted(res.Status, len(res.Users)) {
+			return nil
+		}
+		logging.Debugf("Waiting for %s, currently %s", lastSegment(path), res.Status)
+		if time.Now().After(deadline) {
+			return ErrTimedOut
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(g.pollInterval):
+		}
+	}
+}
+
+// setLabels adds labels to the resource at the given path, keeping the
+// labels it already has
+func (g *gcpService) setLabels(ctx context.Context, path string, tags map[string]string) error {
+	var res struct {
+		Labels           map[string]string `json:"labels"`
+		LabelFingerprint string            `json:"labelFingerprint"`
+	}
+	if err := g.call(ctx, http.MethodGet, path, nil, nil, &res); err != nil {
+		return err
+	}
+	if res.Labels == nil {
+		res.Labels = make(map[string]string)
+	}
+	for k, v := range toLabels(tags) {
+		res.Labels[k] = v
+	}
+	return g.do(ctx, http.MethodPost, path+"/setLabels", nil, res)
+}
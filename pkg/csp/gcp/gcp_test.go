@@ -0,0 +1,250 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp"
+	"github.com/immutable/metavisor-cli/pkg/csp/gcp/fake"
+)
+
+const (
+	testProject = "test-project"
+	testZone    = "us-east1-b"
+)
+
+func newTestProvider(t *testing.T) (csp.Provider, *fake.Compute, func()) {
+	compute := fake.New()
+	server := httptest.NewServer(compute)
+	p, err := New(Config{
+		Project:      testProject,
+		Zone:         testZone,
+		AccessToken:  "test-token",
+		Endpoint:     server.URL,
+		PollInterval: time.Millisecond,
+	})
+	if err != nil {
+		server.Close()
+		t.Fatalf("Got unexpected error when creating provider: %s", err)
+	}
+	return p, compute, server.Close
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	if _, err := New(Config{Zone: testZone, AccessToken: "t"}); err != ErrNoProject {
+		t.Errorf("Got unexpected error without project: %v", err)
+	}
+	if _, err := New(Config{Project: testProject, Zone: "us-east1", AccessToken: "t"}); err != ErrInvalidZone {
+		t.Errorf("Got unexpected error with region as zone: %v", err)
+	}
+}
+
+func TestGetInstance(t *testing.T) {
+	p, compute, done := newTestProvider(t)
+	defer done()
+	compute.AddInstance(testProject, testZone, "guest", map[string]string{"env": "test"})
+
+	inst, err := p.GetInstance(context.Background(), "guest")
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if inst.RootDeviceName() != fake.BootDeviceName {
+		t.Errorf("Got unexpected root device: %s", inst.RootDeviceName())
+	}
+	if inst.DeviceMapping()[fake.BootDeviceName] != "guest" {
+		t.Errorf("Got unexpected device mapping: %v", inst.DeviceMapping())
+	}
+	if inst.AvailabilityZone() != testZone || inst.InstanceType() != "e2-small" {
+		t.Errorf("Got unexpected zone %s and type %s", inst.AvailabilityZone(), inst.InstanceType())
+	}
+	if inst.PublicIP() == "" || inst.PrivateIP() == "" {
+		t.Error("Expected instance to have both public and private IP")
+	}
+	if inst.Tags()["env"] != "test" {
+		t.Errorf("Got unexpected labels: %v", inst.Tags())
+	}
+
+	if _, err = p.GetInstance(context.Background(), "missing"); err != ErrInstanceNonExisting {
+		t.Errorf("Got unexpected error for missing instance: %v", err)
+	}
+	if _, err = p.GetInstance(context.Background(), "Not A Name"); err != ErrInstanceNonExisting {
+		t.Errorf("Got unexpected error for invalid name: %v", err)
+	}
+	compute.FailNext(http.MethodGet, "/instances/guest", http.StatusForbidden)
+	if _, err = p.GetInstance(context.Background(), "guest"); err != csp.ErrNotAllowed {
+		t.Errorf("Got unexpected error when forbidden: %v", err)
+	}
+}
+
+func TestUserdataKeepsOtherMetadata(t *testing.T) {
+	p, compute, done := newTestProvider(t)
+	defer done()
+	compute.AddInstance(testProject, testZone, "guest", nil)
+	ctx := context.Background()
+
+	if err := p.SetInstanceUserdata(ctx, "guest", "first"); err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if err := p.SetInstanceUserdata(ctx, "guest", "second"); err != nil {
+		t.Fatalf("Got unexpected error when replacing userdata: %s", err)
+	}
+	data, err := p.GetInstanceUserdata(ctx, "guest")
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if data != "second" {
+		t.Errorf("Got unexpected userdata: %s", data)
+	}
+	items := compute.Instance(testProject, testZone, "guest").Metadata.Items
+	if len(items) != 1 {
+		t.Errorf("Got unexpected metadata items: %v", items)
+	}
+}
+
+func TestMoveBootDisk(t *testing.T) {
+	p, compute, done := newTestProvider(t)
+	defer done()
+	compute.AddInstance(testProject, testZone, "guest", nil)
+	compute.AddImage(testProject, "metavisor", nil)
+	ctx := context.Background()
+
+	d, err := p.CreateDiskFromImage(ctx, "metavisor", testZone)
+	if err != nil {
+		t.Fatalf("Got unexpected error when creating disk: %s", err)
+	}
+	if err = p.AttachDisk(ctx, d.ID(), "guest", fake.BootDeviceName, true); err == nil {
+		t.Error("Expected attaching a second boot disk to fail")
+	}
+	if err = p.StopInstance(ctx, "guest"); err != nil {
+		t.Fatalf("Got unexpected error when stopping: %s", err)
+	}
+	if err = p.AwaitInstanceStopped(ctx, "guest"); err != nil {
+		t.Fatalf("Got unexpected error when waiting for stop: %s", err)
+	}
+	if err = p.DetachDisk(ctx, "other", "guest", fake.BootDeviceName); err != ErrDiskNonExisting {
+		t.Errorf("Got unexpected error when detaching wrong disk: %v", err)
+	}
+	if err = p.DetachDisk(ctx, "guest", "guest", fake.BootDeviceName); err != nil {
+		t.Fatalf("Got unexpected error when detaching: %s", err)
+	}
+	if err = p.AttachDisk(ctx, d.ID(), "guest", fake.BootDeviceName, true); err != nil {
+		t.Fatalf("Got unexpected error when attaching boot disk: %s", err)
+	}
+	inst, err := p.GetInstance(ctx, "guest")
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if inst.DeviceMapping()[inst.RootDeviceName()] != d.ID() {
+		t.Errorf("Got unexpected device mapping: %v", inst.DeviceMapping())
+	}
+	if err = p.DeleteDisk(ctx, d.ID()); err == nil {
+		t.Error("Expected deleting an attached disk to fail")
+	}
+}
+
+func TestLabelsAreSanitized(t *testing.T) {
+	p, compute, done := newTestProvider(t)
+	defer done()
+	compute.AddInstance(testProject, testZone, "guest", map[string]string{"env": "test"})
+
+	err := p.TagInstance(context.Background(), "guest", map[string]string{
+		"metavisor-version": "3.1.2",
+		"Name":              "My Instance",
+	})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	labels := compute.Instance(testProject, testZone, "guest").Labels
+	expected := map[string]string{
+		"env":               "test",
+		"metavisor-version": "3-1-2",
+		"name":              "my-instance",
+	}
+	for k, v := range expected {
+		if labels[k] != v {
+			t.Errorf("Got unexpected label %s=%s, expected %s", k, labels[k], v)
+		}
+	}
+}
+
+func TestSnapshotAndLaunch(t *testing.T) {
+	p, compute, done := newTestProvider(t)
+	defer done()
+	compute.AddInstance(testProject, testZone, "guest", nil)
+	compute.AddImage(testProject, "generic", nil)
+	ctx := context.Background()
+
+	snap, err := p.CreateSnapshot(ctx, "Temporary snapshot", "guest")
+	if err != nil {
+		t.Fatalf("Got unexpected error when creating snapshot: %s", err)
+	}
+	if !IsValidName(snap.ID()) || snap.SizeGB() == 0 {
+		t.Errorf("Got unexpected snapshot %s of size %d", snap.ID(), snap.SizeGB())
+	}
+	inst, err := p.LaunchInstance(ctx, csp.LaunchConfig{
+		Image:      "generic",
+		Userdata:   "#!/bin/bash",
+		ExtraDisks: []csp.NewDisk{{DeviceName: "logs", SnapshotID: snap.ID()}},
+	})
+	if err != nil {
+		t.Fatalf("Got unexpected error when launching: %s", err)
+	}
+	if _, hasLogs := inst.DeviceMapping()["logs"]; !hasLogs {
+		t.Errorf("Got unexpected device mapping: %v", inst.DeviceMapping())
+	}
+	if inst.Tags()[cliResourceLabelKey] != cliResourceLabelValue {
+		t.Errorf("Expected launched instance to be labeled: %v", inst.Tags())
+	}
+	if err = p.TerminateInstance(ctx, inst.ID()); err != nil {
+		t.Fatalf("Got unexpected error when terminating: %s", err)
+	}
+	if err = p.DeleteSnapshot(ctx, snap.ID()); err != nil {
+		t.Fatalf("Got unexpected error when deleting snapshot: %s", err)
+	}
+	if instances, disks, snapshots := compute.Count(); instances != 1 || disks != 1 || snapshots != 0 {
+		t.Errorf("Got unexpected leftover resources: %d instances, %d disks, %d snapshots", instances, disks, snapshots)
+	}
+
+	if _, err = p.LaunchInstance(ctx, csp.LaunchConfig{Image: "missing"}); err != ErrImageNonExisting {
+		t.Errorf("Got unexpected error when launching missing image: %v", err)
+	}
+}
+
+func TestImagePath(t *testing.T) {
+	tests := map[string]string{
+		"name":                              "projects/p/global/images/name",
+		"global/machineImages/name":         "projects/p/global/machineImages/name",
+		"projects/other/global/images/name": "projects/other/global/images/name",
+		"https://x/compute/v1/projects/o/global/images/n": "projects/o/global/images/n",
+	}
+	for id, expected := range tests {
+		if res := imagePath("p", id); res != expected {
+			t.Errorf("Got unexpected path %s for %s, expected %s", res, id, expected)
+		}
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	for _, prefix := range []string{"Temporary share-logs snapshot", "3.1.2", "", "metavisor-root"} {
+		if name := resourceName(prefix); !IsValidName(name) {
+			t.Errorf("Got invalid name %s for prefix %s", name, prefix)
+		}
+	}
+}
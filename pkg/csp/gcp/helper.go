@@ -0,0 +1,110 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package gcp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+const maxLabelLength = 63
+
+var (
+	nameRegex = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	zoneRegex = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+-[a-z]$`)
+)
+
+// IsValidName checks if the given name can be used as the name of a
+// resource in GCP
+func IsValidName(name string) bool {
+	return nameRegex.MatchString(name)
+}
+
+// IsValidZone checks if the given zone looks like a GCP zone, e.g. us-east1-b
+func IsValidZone(zone string) bool {
+	return zoneRegex.MatchString(zone)
+}
+
+// imagePath returns the path of an image, which can be given either as a
+// plain image name in the project, a path relative to the project such as
+// global/machineImages/name, a path including the project or a full URL
+func imagePath(project, id string) string {
+	if i := strings.Index(id, "projects/"); i >= 0 {
+		return id[i:]
+	}
+	if strings.HasPrefix(id, "global/") {
+		return "projects/" + project + "/" + id
+	}
+	return "projects/" + project + "/global/images/" + id
+}
+
+func isMachineImage(path string) bool {
+	return strings.Contains(path, "/machineImages/")
+}
+
+// lastSegment returns the name of a resource from its URL
+func lastSegment(u string) string {
+	return u[strings.LastIndex(u, "/")+1:]
+}
+
+// toLabels turns tags into valid GCP labels. Labels can only contain
+// lowercase letters, digits, dashes and underscores, so everything else is
+// replaced with dashes, e.g. 3.1.2 becomes 3-1-2.
+func toLabels(tags map[string]string) map[string]string {
+	res := make(map[string]string)
+	for k, v := range tags {
+		key := sanitizeLabel(k)
+		if key == "" {
+			continue
+		}
+		if key[0] < 'a' || key[0] > 'z' {
+			key = "x" + key
+		}
+		res[key] = sanitizeLabel(v)
+	}
+	return res
+}
+
+func sanitizeLabel(s string) string {
+	b := []byte(strings.ToLower(s))
+	for i, c := range b {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			b[i] = '-'
+		}
+	}
+	if len(b) > maxLabelLength {
+		b = b[:maxLabelLength]
+	}
+	return string(b)
+}
+
+// resourceName returns a unique valid resource name starting with prefix
+func resourceName(prefix string) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		panic(err)
+	}
+	name := sanitizeLabel(prefix)
+	if len(name) > 50 {
+		name = name[:50]
+	}
+	name = strings.Trim(name, "-_")
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "mv" + name
+	}
+	return strings.Replace(name, "_", "-", -1) + "-" + hex.EncodeToString(suffix)
+}
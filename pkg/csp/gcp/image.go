@@ -0,0 +1,117 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/immutable/metavisor-cli/pkg/csp"
+)
+
+// computeImage is either an image or a machine image, they share the
+// fields needed here
+type computeImage struct {
+	Name           string            `json:"name"`
+	Description    string            `json:"description,omitempty"`
+	Status         string            `json:"status,omitempty"`
+	SourceInstance string            `json:"sourceInstance,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+type image struct {
+	path        string
+	name        string
+	description string
+	labels      map[string]string
+}
+
+func (i *image) ID() string              { return i.path }
+func (i *image) Name() string            { return i.name }
+func (i *image) Description() string     { return i.description }
+func (i *image) Tags() map[string]string { return i.labels }
+
+// GetImage returns the image or machine image with the given ID, see
+// CreateImage for how images are identified
+func (g *gcpService) GetImage(ctx context.Context, imageID string) (csp.Image, error) {
+	path := imagePath(g.project, imageID)
+	res := new(computeImage)
+	err := g.call(ctx, http.MethodGet, path, nil, nil, res)
+	if err == errNotFound {
+		return nil, ErrImageNonExisting
+	}
+	if err != nil {
+		return nil, err
+	}
+	img := &image{
+		path:        path,
+		name:        res.Name,
+		description: res.Description,
+		labels:      res.Labels,
+	}
+	if img.labels == nil {
+		img.labels = make(map[string]string)
+	}
+	return img, nil
+}
+
+// CreateImage creates a machine image of the instance, as regular images in
+// GCP can only contain a single disk. Images are identified by their path,
+// e.g. projects/my-project/global/machineImages/name, which is what is
+// returned. Image names are lowercase and can't contain spaces, so the name
+// is turned into a valid name.
+func (g *gcpService) CreateImage(ctx context.Context, instanceID, name, desc string) (string, error) {
+	if !IsValidName(instanceID) {
+		return "", ErrInstanceNonExisting
+	}
+	if !IsValidName(name) {
+		name = resourceName(name)
+	}
+	img := &computeImage{
+		Name:           name,
+		Description:    desc,
+		SourceInstance: g.zonal("instances", instanceID),
+	}
+	err := g.do(ctx, http.MethodPost, "projects/"+g.project+"/global/machineImages", nil, img)
+	if err == errNotFound {
+		return "", ErrInstanceNonExisting
+	}
+	if err != nil {
+		return "", err
+	}
+	return g.global("machineImages", name), nil
+}
+
+func (g *gcpService) AwaitImageAvailable(ctx context.Context, imageID string) error {
+	return g.await(ctx, imagePath(g.project, imageID), func(status string, _ int) bool {
+		return status == statusReady
+	})
+}
+
+func (g *gcpService) DeleteImage(ctx context.Context, imageID string) error {
+	err := g.do(ctx, http.MethodDelete, imagePath(g.project, imageID), nil, nil)
+	if err == errNotFound {
+		return ErrImageNonExisting
+	}
+	return err
+}
+
+func (g *gcpService) TagImage(ctx context.Context, imageID string, tags map[string]string) error {
+	err := g.setLabels(ctx, imagePath(g.project, imageID), tags)
+	if err == errNotFound {
+		return ErrImageNonExisting
+	}
+	return err
+}
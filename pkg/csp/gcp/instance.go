@@ -0,0 +1,338 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/immutable/metavisor-cli/pkg/csp"
+)
+
+type attachedDisk struct {
+	DeviceName       string            `json:"deviceName,omitempty"`
+	Source           string            `json:"source,omitempty"`
+	Boot             bool              `json:"boot,omitempty"`
+	AutoDelete       bool              `json:"autoDelete,omitempty"`
+	InitializeParams *initializeParams `json:"initializeParams,omitempty"`
+}
+
+type initializeParams struct {
+	SourceImage    string `json:"sourceImage,omitempty"`
+	SourceSnapshot string `json:"sourceSnapshot,omitempty"`
+}
+
+type metadataItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type metadata struct {
+	Fingerprint string         `json:"fingerprint,omitempty"`
+	Items       []metadataItem `json:"items"`
+}
+
+type accessConfig struct {
+	Type  string `json:"type,omitempty"`
+	NatIP string `json:"natIP,omitempty"`
+}
+
+type networkInterface struct {
+	Network       string         `json:"network,omitempty"`
+	Subnetwork    string         `json:"subnetwork,omitempty"`
+	NetworkIP     string         `json:"networkIP,omitempty"`
+	AccessConfigs []accessConfig `json:"accessConfigs,omitempty"`
+}
+
+type serviceAccount struct {
+	Email  string   `json:"email"`
+	Scopes []string `json:"scopes"`
+}
+
+type computeInstance struct {
+	Name               string             `json:"name"`
+	MachineType        string             `json:"machineType,omitempty"`
+	Status             string             `json:"status,omitempty"`
+	Zone               string             `json:"zone,omitempty"`
+	Disks              []attachedDisk     `json:"disks,omitempty"`
+	NetworkInterfaces  []networkInterface `json:"networkInterfaces,omitempty"`
+	Metadata           *metadata          `json:"metadata,omitempty"`
+	Labels             map[string]string  `json:"labels,omitempty"`
+	SourceMachineImage string             `json:"sourceMachineImage,omitempty"`
+	ServiceAccounts    []serviceAccount   `json:"serviceAccounts,omitempty"`
+}
+
+type instance struct {
+	name           string
+	machineType    string
+	rootDeviceName string
+	deviceMapping  map[string]string
+	pubIP          string
+	privIP         string
+	zone           string
+	labels         map[string]string
+}
+
+func (i *instance) ID() string                       { return i.name }
+func (i *instance) InstanceType() string             { return i.machineType }
+func (i *instance) RootDeviceName() string           { return i.rootDeviceName }
+func (i *instance) DeviceMapping() map[string]string { return i.deviceMapping }
+func (i *instance) PublicIP() string                 { return i.pubIP }
+func (i *instance) PrivateIP() string                { return i.privIP }
+func (i *instance) AvailabilityZone() string         { return i.zone }
+func (i *instance) Tags() map[string]string          { return i.labels }
+
+func instanceFromCompute(c *computeInstance) *instance {
+	inst := &instance{
+		name:          c.Name,
+		machineType:   lastSegment(c.MachineType),
+		deviceMapping: make(map[string]string),
+		zone:          lastSegment(c.Zone),
+		labels:        c.Labels,
+	}
+	if inst.labels == nil {
+		inst.labels = make(map[string]string)
+	}
+	for _, d := range c.Disks {
+		inst.deviceMapping[d.DeviceName] = lastSegment(d.Source)
+		if d.Boot {
+			inst.rootDeviceName = d.DeviceName
+		}
+	}
+	if len(c.NetworkInterfaces) > 0 {
+		nic := c.NetworkInterfaces[0]
+		inst.privIP = nic.NetworkIP
+		if len(nic.AccessConfigs) > 0 {
+			inst.pubIP = nic.AccessConfigs[0].NatIP
+		}
+	}
+	return inst
+}
+
+func (g *gcpService) getComputeInstance(ctx context.Context, instanceID string) (*computeInstance, error) {
+	if !IsValidName(instanceID) {
+		return nil, ErrInstanceNonExisting
+	}
+	res := new(computeInstance)
+	err := g.call(ctx, http.MethodGet, g.zonal("instances", instanceID), nil, nil, res)
+	if err == errNotFound {
+		return nil, ErrInstanceNonExisting
+	}
+	return res, err
+}
+
+func (g *gcpService) GetInstance(ctx context.Context, instanceID string) (csp.Instance, error) {
+	c, err := g.getComputeInstance(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return instanceFromCompute(c), nil
+}
+
+// LaunchInstance launches a new instance with a public IP, unless NoPublicIP
+// is set. Key pairs don't exist in GCP, so the key name of the config is
+// ignored.
+func (g *gcpService) LaunchInstance(ctx context.Context, conf csp.LaunchConfig) (csp.Instance, error) {
+	machineType := conf.InstanceType
+	if machineType == "" && conf.Larger {
+		machineType = LargerMachineType
+	} else if machineType == "" {
+		machineType = SmallMachineType
+	}
+	labels := toLabels(conf.Tags)
+	labels[cliResourceLabelKey] = cliResourceLabelValue
+	c := &computeInstance{
+		Name:              resourceName("metavisor"),
+		MachineType:       "zones/" + g.zone + "/machineTypes/" + machineType,
+		Labels:            labels,
+		NetworkInterfaces: []networkInterface{{}},
+	}
+	if !conf.NoPublicIP {
+		c.NetworkInterfaces[0].AccessConfigs = []accessConfig{{Type: "ONE_TO_ONE_NAT"}}
+	}
+	if conf.SubnetID != "" {
+		c.NetworkInterfaces[0].Subnetwork = conf.SubnetID
+	} else {
+		c.NetworkInterfaces[0].Network = "global/networks/default"
+	}
+	if conf.InstanceProfile != "" {
+		c.ServiceAccounts = []serviceAccount{{
+			Email:  conf.InstanceProfile,
+			Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
+		}}
+	}
+	if conf.Userdata != "" {
+		c.Metadata = &metadata{Items: []metadataItem{{Key: UserdataKey, Value: conf.Userdata}}}
+	}
+	source := imagePath(g.project, conf.Image)
+	if isMachineImage(source) {
+		c.SourceMachineImage = source
+	} else {
+		c.Disks = append(c.Disks, attachedDisk{
+			Boot:             true,
+			AutoDelete:       true,
+			InitializeParams: &initializeParams{SourceImage: source},
+		})
+	}
+	for _, d := range conf.ExtraDisks {
+		c.Disks = append(c.Disks, attachedDisk{
+			DeviceName:       d.DeviceName,
+			AutoDelete:       true,
+			InitializeParams: &initializeParams{SourceSnapshot: g.global("snapshots", d.SnapshotID)},
+		})
+	}
+	path := "projects/" + g.project + "/zones/" + g.zone + "/instances"
+	err := g.do(ctx, http.MethodPost, path, nil, c)
+	if err == errNotFound {
+		return nil, ErrImageNonExisting
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g.GetInstance(ctx, c.Name)
+}
+
+func (g *gcpService) instanceAction(ctx context.Context, instanceID, action string, query url.Values, body interface{}) error {
+	if !IsValidName(instanceID) {
+		return ErrInstanceNonExisting
+	}
+	path := g.zonal("instances", instanceID)
+	method := http.MethodDelete
+	if action != "" {
+		path += "/" + action
+		method = http.MethodPost
+	}
+	err := g.do(ctx, method, path, query, body)
+	if err == errNotFound {
+		return ErrInstanceNonExisting
+	}
+	return err
+}
+
+func (g *gcpService) StartInstance(ctx context.Context, instanceID string) error {
+	return g.instanceAction(ctx, instanceID, "start", nil, nil)
+}
+
+func (g *gcpService) StopInstance(ctx context.Context, instanceID string) error {
+	return g.instanceAction(ctx, instanceID, "stop", nil, nil)
+}
+
+func (g *gcpService) TerminateInstance(ctx context.Context, instanceID string) error {
+	return g.instanceAction(ctx, instanceID, "", nil, nil)
+}
+
+func (g *gcpService) AwaitInstanceRunning(ctx context.Context, instanceID string) error {
+	return g.await(ctx, g.zonal("instances", instanceID), func(status string, _ int) bool {
+		return status == statusRunning
+	})
+}
+
+func (g *gcpService) AwaitInstanceStopped(ctx context.Context, instanceID string) error {
+	return g.await(ctx, g.zonal("instances", instanceID), func(status string, _ int) bool {
+		return status == statusTerminated
+	})
+}
+
+func (g *gcpService) GetInstanceUserdata(ctx context.Context, instanceID string) (string, error) {
+	c, err := g.getComputeInstance(ctx, instanceID)
+	if err != nil {
+		return "", err
+	}
+	if c.Metadata == nil {
+		return "", nil
+	}
+	for _, item := range c.Metadata.Items {
+		if item.Key == UserdataKey {
+			return item.Value, nil
+		}
+	}
+	return "", nil
+}
+
+// SetInstanceUserdata replaces the user-data metadata item of the instance,
+// leaving all other metadata as is
+func (g *gcpService) SetInstanceUserdata(ctx context.Context, instanceID, userdata string) error {
+	c, err := g.getComputeInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	md := metadata{}
+	if c.Metadata != nil {
+		md.Fingerprint = c.Metadata.Fingerprint
+		for _, item := range c.Metadata.Items {
+			if item.Key != UserdataKey {
+				md.Items = append(md.Items, item)
+			}
+		}
+	}
+	md.Items = append(md.Items, metadataItem{Key: UserdataKey, Value: userdata})
+	return g.instanceAction(ctx, instanceID, "setMetadata", nil, md)
+}
+
+func (g *gcpService) TagInstance(ctx context.Context, instanceID string, tags map[string]string) error {
+	err := g.setLabels(ctx, g.zonal("instances", instanceID), tags)
+	if err == errNotFound {
+		return ErrInstanceNonExisting
+	}
+	return err
+}
+
+func (g *gcpService) DeleteDisksOnTermination(ctx context.Context, instanceID string) error {
+	c, err := g.getComputeInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	for _, d := range c.Disks {
+		if d.AutoDelete {
+			continue
+		}
+		query := url.Values{
+			"autoDelete": {strconv.FormatBool(true)},
+			"deviceName": {d.DeviceName},
+		}
+		if err = g.instanceAction(ctx, instanceID, "setDiskAutoDelete", query, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *gcpService) AttachDisk(ctx context.Context, diskID, instanceID, deviceName string, root bool) error {
+	if !IsValidName(diskID) {
+		return ErrDiskNonExisting
+	}
+	return g.instanceAction(ctx, instanceID, "attachDisk", nil, attachedDisk{
+		DeviceName: deviceName,
+		Source:     g.zonal("disks", diskID),
+		Boot:       root,
+	})
+}
+
+func (g *gcpService) DetachDisk(ctx context.Context, diskID, instanceID, deviceName string) error {
+	c, err := g.getComputeInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	for _, d := range c.Disks {
+		if d.DeviceName == deviceName && !strings.HasSuffix(d.Source, "/"+diskID) {
+			// Make sure to not detach some other disk than the expected one
+			return ErrDiskNonExisting
+		}
+	}
+	return g.instanceAction(ctx, instanceID, "detachDisk", url.Values{"deviceName": {deviceName}}, nil)
+}
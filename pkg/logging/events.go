@@ -0,0 +1,154 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events
+const (
+	EventInstanceLaunched   = "instance.launched"
+	EventInstanceStopped    = "instance.stopped"
+	EventInstanceStarted    = "instance.started"
+	EventInstanceTerminated = "instance.terminated"
+	EventVolumeCreated      = "volume.created"
+	EventVolumeAttached     = "volume.attached"
+	EventVolumeDeleted      = "volume.deleted"
+	EventSnapshotCreated    = "snapshot.created"
+	EventSnapshotDeleted    = "snapshot.deleted"
+	EventImageCreated       = "image.created"
+	EventImageAvailable     = "image.available"
+	EventLogsSaved          = "logs.saved"
+	EventCleanupFailed      = "cleanup.failed"
+
+	eventFDPrefix = "fd:"
+)
+
+// ErrInvalidEventTarget is returned if the event stream can't be written to
+var ErrInvalidEventTarget = errors.New("the event stream must be a writable file or fd:N for an open file descriptor")
+
+var (
+	eventMutex  sync.Mutex
+	eventWriter io.Writer
+)
+
+// Event is something that happened to a cloud resource, written to the event
+// stream as a JSON object per line
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Elapsed is the number of seconds since the CLI was started
+	Elapsed float64 `json:"elapsed"`
+	// Operation is the operation the event is part of, if known
+	Operation string `json:"operation,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Step      string `json:"step,omitempty"`
+	// Resources maps the role of a resource in the operation, e.g.
+	// "instance" or "mv-volume", to its ID
+	Resources map[string]string `json:"resources,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// OpenEvents will write events to the given target, which is either the path
+// of a file to append to (e.g. a named pipe) or fd:N to write to the open file
+// descriptor N
+func OpenEvents(target string) error {
+	var f *os.File
+	if strings.HasPrefix(target, eventFDPrefix) {
+		fd, err := strconv.Atoi(strings.TrimPrefix(target, eventFDPrefix))
+		if err != nil || fd < 0 {
+			return ErrInvalidEventTarget
+		}
+		f = os.NewFile(uintptr(fd), target)
+		if f == nil {
+			return ErrInvalidEventTarget
+		}
+		if _, err = f.Stat(); err != nil {
+			Debugf("Could not use file descriptor for events: %s", err)
+			return ErrInvalidEventTarget
+		}
+	} else {
+		var err error
+		f, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			Debugf("Could not open event stream: %s", err)
+			return ErrInvalidEventTarget
+		}
+	}
+	SetEventWriter(f)
+	return nil
+}
+
+// SetEventWriter will write events to w, or stop writing events if nil
+func SetEventWriter(w io.Writer) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	eventWriter = w
+}
+
+// Emit writes an event to the event stream, if there is one. The time of the
+// event is set if it's zero. With FormatJSON the event is also logged at the
+// info level, otherwise it's only logged at the debug level.
+func Emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = now()
+	}
+	e.Elapsed = elapsed(e.Time)
+	e.Time = e.Time.UTC()
+	if LogFormat == FormatJSON {
+		if LevelInfo >= LogLevel {
+			printEntry(Entry{
+				Time:      e.Time,
+				Level:     levelNames[LevelInfo],
+				Message:   e.Type,
+				Elapsed:   e.Elapsed,
+				Event:     e.Type,
+				Operation: e.Operation,
+				Region:    e.Region,
+				Step:      e.Step,
+				Resources: e.Resources,
+				Error:     e.Error,
+			})
+		}
+		if fileLogger() != nil {
+			fileLogger().Printf(templateDebug, "Event "+e.Type)
+		}
+	} else {
+		Debugf("Event %s %v", e.Type, e.Resources)
+	}
+
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	if eventWriter == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if _, err = eventWriter.Write(append(data, '\n')); err != nil {
+		// Don't fail the operation because nobody is listening
+		eventWriter = nil
+		Warningf("Could not write to the event stream, no more events will be written: %s", err)
+	}
+}
@@ -0,0 +1,146 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package logging
+
+import (
+	"context"
+	"fmt"
+)
+
+type contextKey struct{}
+
+// Fields are the context of log lines, which is added to the entries logged
+// with FormatJSON, the same way as for events
+type Fields struct {
+	Operation string
+	Region    string
+	Step      string
+	// Resources maps the role of a resource in the operation to its ID,
+	// like the resources of events
+	Resources map[string]string
+}
+
+// Logger logs with fields. A nil Logger logs without fields, like the
+// functions of the package.
+type Logger struct {
+	fields Fields
+}
+
+// With returns a logger that logs with the given fields
+func With(f Fields) *Logger {
+	return (*Logger)(nil).With(f)
+}
+
+// With returns a logger that logs with the fields of l, overridden by the
+// fields that are set in f. Resources are merged.
+func (l *Logger) With(f Fields) *Logger {
+	res := &Logger{}
+	if l != nil {
+		res.fields = l.fields
+	}
+	if f.Operation != "" {
+		res.fields.Operation = f.Operation
+	}
+	if f.Region != "" {
+		res.fields.Region = f.Region
+	}
+	if f.Step != "" {
+		res.fields.Step = f.Step
+	}
+	if len(f.Resources) > 0 {
+		resources := make(map[string]string, len(res.fields.Resources)+len(f.Resources))
+		for k, v := range res.fields.Resources {
+			resources[k] = v
+		}
+		for k, v := range f.Resources {
+			resources[k] = v
+		}
+		res.fields.Resources = resources
+	}
+	return res
+}
+
+// NewContext returns a context carrying the logger, so that it can be
+// retrieved with FromContext by the functions the context is passed to
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger of the context, or nil if it has none
+func FromContext(ctx context.Context) *Logger {
+	l, _ := ctx.Value(contextKey{}).(*Logger)
+	return l
+}
+
+func (l *Logger) print(lvl level, template string, v ...interface{}) {
+	if l == nil {
+		printFields(nil, lvl, template, v...)
+		return
+	}
+	printFields(&l.fields, lvl, template, v...)
+}
+
+func (l *Logger) Debug(v ...interface{}) {
+	l.print(LevelDebug, templateDebug, v...)
+}
+
+func (l *Logger) Debugf(t string, v ...interface{}) {
+	l.print(LevelDebug, templateDebug, fmt.Sprintf(t, v...))
+}
+
+func (l *Logger) Info(v ...interface{}) {
+	l.print(LevelInfo, templateInfo, v...)
+}
+
+func (l *Logger) Infof(t string, v ...interface{}) {
+	l.print(LevelInfo, templateInfo, fmt.Sprintf(t, v...))
+}
+
+func (l *Logger) Warning(v ...interface{}) {
+	l.print(LevelWarning, templateWarning, v...)
+}
+
+func (l *Logger) Warningf(t string, v ...interface{}) {
+	l.print(LevelWarning, templateWarning, fmt.Sprintf(t, v...))
+}
+
+func (l *Logger) Error(v ...interface{}) {
+	l.print(LevelError, templateError, v...)
+}
+
+func (l *Logger) Errorf(t string, v ...interface{}) {
+	l.print(LevelError, templateError, fmt.Sprintf(t, v...))
+}
+
+// EmitStep writes an event for a step of an operation, with the operation
+// and region of the logger, see Emit
+func (l *Logger) EmitStep(eventType, step string, resources map[string]string) {
+	e := Event{
+		Type:      eventType,
+		Step:      step,
+		Resources: resources,
+	}
+	if l != nil {
+		e.Operation = l.fields.Operation
+		e.Region = l.fields.Region
+	}
+	Emit(e)
+}
+
+// EmitStep writes an event for a step of an operation in the region, see
+// Emit
+func EmitStep(eventType, region, step string, resources map[string]string) {
+	With(Fields{Region: region}).EmitStep(eventType, step, resources)
+}
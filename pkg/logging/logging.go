@@ -15,10 +15,14 @@
 package logging
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"strings"
+	"time"
 )
 
 type level int
@@ -41,6 +45,11 @@ const (
 	templateError   = "ERROR: %v"
 	templateOutput  = "OUTPUT: %s"
 	templateFatal   = "FATAL: %s"
+
+	// FormatText logs human readable lines
+	FormatText = "text"
+	// FormatJSON logs a JSON object per line, see Entry
+	FormatJSON = "json"
 )
 
 var (
@@ -52,12 +61,34 @@ var (
 	LogToFile = true
 	// LogFilePath is where the log will be saved, temp file will be used if set to ""
 	LogFilePath = ""
+	// LogFormat is the format of the logs shown in console, FormatText or
+	// FormatJSON. The log file is always written as text.
+	LogFormat = FormatText
 
 	outLogger  = log.New(os.Stdout, "", 0)
 	termLogger = log.New(os.Stderr, "", 0)
 	fileLog    *log.Logger
+
+	now     = time.Now
+	started = time.Now()
 )
 
+// Entry is a log line when logging with FormatJSON. Entries logged for
+// events also have the fields of the event.
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	// Elapsed is the number of seconds since the CLI was started
+	Elapsed   float64           `json:"elapsed"`
+	Event     string            `json:"event,omitempty"`
+	Operation string            `json:"operation,omitempty"`
+	Region    string            `json:"region,omitempty"`
+	Step      string            `json:"step,omitempty"`
+	Resources map[string]string `json:"resources,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
 func LogFile() string {
 	return LogFilePath
 }
@@ -109,26 +140,47 @@ func Outputf(t string, v ...interface{}) {
 }
 
 func Fatal(v ...interface{}) {
-	termLogger.Printf(templateFatal, fmt.Sprintln(v...))
-	if fileLogger() != nil {
-		fileLogger().Printf(templateFatal, fmt.Sprintln(v...))
-		outLogger.Printf("Logs are available at:\n%s", LogFilePath)
-	}
-	os.Exit(1)
+	fatal(fmt.Sprintln(v...))
 }
 
 func Fatalf(t string, v ...interface{}) {
-	termLogger.Printf(templateFatal, fmt.Sprintf(t, v...))
+	fatal(fmt.Sprintf(t, v...))
+}
+
+// fatal logs the message and exits. Where the log file is goes to stderr
+// along with the logs, so that stdout only has results and can be parsed.
+func fatal(msg string) {
+	if LogFormat == FormatJSON {
+		printEntry(newEntry("fatal", msg))
+	} else {
+		termLogger.Printf(templateFatal, msg)
+	}
 	if fileLogger() != nil {
-		fileLogger().Printf(templateFatal, fmt.Sprintf(t, v...))
-		outLogger.Printf("Logs are available at:\n%s", LogFilePath)
+		fileLogger().Printf(templateFatal, msg)
+		if LogFormat != FormatJSON {
+			termLogger.Printf("Logs are available at:\n%s", LogFilePath)
+		}
 	}
 	os.Exit(1)
 }
 
 func print(lvl level, template string, v ...interface{}) {
+	printFields(nil, lvl, template, v...)
+}
+
+// printFields logs like print, adding the fields to entries with FormatJSON
+func printFields(f *Fields, lvl level, template string, v ...interface{}) {
 	if lvl >= LogLevel {
-		if lvl == LevelInfo && LogLevel != LevelDebug {
+		if LogFormat == FormatJSON {
+			e := newEntry(levelNames[lvl], fmt.Sprintln(v...))
+			if f != nil {
+				e.Operation = f.Operation
+				e.Region = f.Region
+				e.Step = f.Step
+				e.Resources = f.Resources
+			}
+			printEntry(e)
+		} else if lvl == LevelInfo && LogLevel != LevelDebug {
 			termLogger.Print(fmt.Sprintln(v...))
 		} else {
 			termLogger.Printf(template, fmt.Sprintln(v...))
@@ -139,6 +191,39 @@ func print(lvl level, template string, v ...interface{}) {
 	}
 }
 
+var levelNames = map[level]string{
+	LevelDebug:   "debug",
+	LevelInfo:    "info",
+	LevelWarning: "warning",
+	LevelError:   "error",
+	LevelOutput:  "output",
+}
+
+func newEntry(lvl, msg string) Entry {
+	t := now()
+	return Entry{
+		Time:    t.UTC(),
+		Level:   lvl,
+		Message: strings.TrimRight(msg, "\n"),
+		Elapsed: elapsed(t),
+	}
+}
+
+// elapsed returns the seconds since the CLI was started, in milliseconds
+func elapsed(t time.Time) float64 {
+	return math.Round(t.Sub(started).Seconds()*1000) / 1000
+}
+
+func printEntry(e Entry) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		// Only strings are logged, so this should never happen
+		termLogger.Printf(templateError, err)
+		return
+	}
+	termLogger.Print(string(data))
+}
+
 func fileLogger() *log.Logger {
 	if !LogToFile {
 		return nil
@@ -16,9 +16,13 @@ package logging
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoggingBasic(t *testing.T) {
@@ -67,3 +71,141 @@ func TestLogOutvsErr(t *testing.T) {
 		t.Error("only the output should be logged to stdOut")
 	}
 }
+
+func TestLogJSON(t *testing.T) {
+	var b bytes.Buffer
+	termLogger = log.New(&b, "", 0)
+	LogLevel = LevelInfo
+	LogFormat = FormatJSON
+	defer func() { LogFormat = FormatText }()
+	now = func() time.Time { return started.Add(1500 * time.Millisecond) }
+	defer func() { now = time.Now }()
+
+	Info("Hello info")
+	Debug("Hello debug") // Should not show
+	Errorf("Hello %s", "error")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two log lines, got:\n%s", b.String())
+	}
+	expected := []Entry{
+		{Level: "info", Message: "Hello info", Elapsed: 1.5},
+		{Level: "error", Message: "Hello error", Elapsed: 1.5},
+	}
+	for i, l := range lines {
+		var e Entry
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("Log line is not valid JSON: %s", l)
+		}
+		if e.Level != expected[i].Level || e.Message != expected[i].Message || e.Elapsed != expected[i].Elapsed || e.Time.IsZero() {
+			t.Errorf("Got unexpected log entry: %+v", e)
+		}
+	}
+}
+
+func TestEmit(t *testing.T) {
+	var events, stdErr bytes.Buffer
+	termLogger = log.New(&stdErr, "", 0)
+	LogLevel = LevelInfo
+	SetEventWriter(&events)
+	defer SetEventWriter(nil)
+
+	Emit(Event{Type: EventInstanceStopped, Region: "us-west-2", Resources: map[string]string{"instance": "i-1"}})
+	Emit(Event{Type: EventCleanupFailed, Step: "delete-mv-volume", Error: "failed"})
+	if stdErr.Len() != 0 {
+		t.Errorf("Events should only be logged at debug level with text logs, got: %s", stdErr.String())
+	}
+	lines := strings.Split(strings.TrimSpace(events.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two events, got:\n%s", events.String())
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatalf("Event is not valid JSON: %s", lines[0])
+	}
+	if e.Type != EventInstanceStopped || e.Region != "us-west-2" || e.Resources["instance"] != "i-1" || e.Time.IsZero() {
+		t.Errorf("Got unexpected event: %+v", e)
+	}
+
+	LogFormat = FormatJSON
+	defer func() { LogFormat = FormatText }()
+	Emit(Event{Type: EventVolumeCreated, Step: "mv-volume-created", Resources: map[string]string{"mv-volume": "vol-1"}})
+	var entry Entry
+	if err := json.Unmarshal(stdErr.Bytes(), &entry); err != nil {
+		t.Fatalf("Log line is not valid JSON: %s", stdErr.String())
+	}
+	if entry.Event != EventVolumeCreated || entry.Step != "mv-volume-created" || entry.Resources["mv-volume"] != "vol-1" {
+		t.Errorf("Expected event fields in log entry, got: %+v", entry)
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	var b bytes.Buffer
+	termLogger = log.New(&b, "", 0)
+	LogLevel = LevelInfo
+	LogFormat = FormatJSON
+	defer func() { LogFormat = FormatText }()
+
+	l := With(Fields{Operation: "aws-wrap-instance", Region: "us-west-2", Resources: map[string]string{"instance": "i-1"}})
+	ctx := NewContext(context.Background(), l)
+	FromContext(ctx).With(Fields{Step: "delete-mv-volume", Resources: map[string]string{"mv-volume": "vol-1"}}).Infof("Deleting %s", "vol-1")
+	var e Entry
+	if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatalf("Log line is not valid JSON: %s", b.String())
+	}
+	if e.Message != "Deleting vol-1" || e.Operation != "aws-wrap-instance" || e.Region != "us-west-2" || e.Step != "delete-mv-volume" {
+		t.Errorf("Expected fields in log entry, got: %+v", e)
+	}
+	if len(e.Resources) != 2 || e.Resources["instance"] != "i-1" || e.Resources["mv-volume"] != "vol-1" {
+		t.Errorf("Expected merged resources in log entry, got: %v", e.Resources)
+	}
+	if len(l.fields.Resources) != 1 {
+		t.Errorf("With should not modify the resources of the logger, got: %v", l.fields.Resources)
+	}
+
+	// Without a logger in the context, lines are logged without fields
+	b.Reset()
+	FromContext(context.Background()).Info("Hello info")
+	e = Entry{}
+	if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatalf("Log line is not valid JSON: %s", b.String())
+	}
+	if e.Message != "Hello info" || e.Operation != "" || e.Region != "" || e.Resources != nil {
+		t.Errorf("Got unexpected log entry: %+v", e)
+	}
+}
+
+func TestEmitStep(t *testing.T) {
+	var events bytes.Buffer
+	SetEventWriter(&events)
+	defer SetEventWriter(nil)
+
+	With(Fields{Operation: "aws-wrap-ami", Region: "us-east-1"}).EmitStep(EventImageCreated, "image-created", map[string]string{"image": "ami-1"})
+	EmitStep(EventInstanceStopped, "us-west-2", "instance-stopped", nil)
+	lines := strings.Split(strings.TrimSpace(events.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two events, got:\n%s", events.String())
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatalf("Event is not valid JSON: %s", lines[0])
+	}
+	if e.Type != EventImageCreated || e.Operation != "aws-wrap-ami" || e.Region != "us-east-1" || e.Step != "image-created" || e.Resources["image"] != "ami-1" {
+		t.Errorf("Got unexpected event: %+v", e)
+	}
+	e = Event{}
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatalf("Event is not valid JSON: %s", lines[1])
+	}
+	if e.Type != EventInstanceStopped || e.Operation != "" || e.Region != "us-west-2" || e.Step != "instance-stopped" {
+		t.Errorf("Got unexpected event: %+v", e)
+	}
+}
+
+func TestOpenEventsInvalid(t *testing.T) {
+	for _, target := range []string{"fd:", "fd:abc", "fd:12345", "/nonexisting/dir/events"} {
+		if err := OpenEvents(target); err != ErrInvalidEventTarget {
+			t.Errorf("Expected %s to be invalid, got: %v", target, err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+const (
+	// StateInProgress means that the operation has not finished yet, either
+	// because it's still running or because the process was killed
+	StateInProgress = "in-progress"
+	// StateCompleted means that the operation finished successfully
+	StateCompleted = "completed"
+	// StateFailed means that the operation failed and cleanup was attempted
+	StateFailed = "failed"
+	// StateRolledBack means that the operation was explicitly rolled back
+	StateRolledBack = "rolled-back"
+
+	journalDirName = ".metavisor/journals"
+	// journalPerm only lets the owner read journals, as they can hold data
+	// that shouldn't be shared, like the userdata of instances
+	journalPerm = 0600
+)
+
+var (
+	// ErrNotResumable is returned if trying to resume an operation that is
+	// not in progress anymore
+	ErrNotResumable = errors.New("the journal is not for an operation in progress")
+
+	// ErrInvalidJournal is returned if a journal file can't be parsed
+	ErrInvalidJournal = errors.New("the specified file is not a valid journal")
+)
+
+// Journal records the progress of a long running operation on disk, so that
+// the operation can be resumed or rolled back if the process is killed before
+// it finishes. All methods are safe to call on a nil Journal, in which case
+// nothing is recorded. Journals are only readable by their owner, as the
+// resources recorded can include e.g. the original userdata of an instance.
+type Journal struct {
+	// Operation is the type of operation being recorded, e.g. "aws-wrap-instance"
+	Operation string `json:"operation"`
+	// Region is the region where the operation takes place
+	Region string `json:"region"`
+	// ID is the ID of the resource the operation was started on
+	ID string `json:"id"`
+	// State is the state of the operation, see the State constants
+	State string `json:"state"`
+	// Started is when the operation was started
+	Started time.Time `json:"started"`
+	// Updated is when the journal was last written
+	Updated time.Time `json:"updated"`
+	// Params are non-sensitive parameters needed to resume the operation
+	Params map[string]string `json:"params,omitempty"`
+	// Resources maps a name to the ID of a resource involved in the operation
+	Resources map[string]string `json:"resources"`
+	// Steps are the steps completed so far, in order
+	Steps []Step `json:"steps"`
+
+	path  string
+	mutex sync.Mutex
+}
+
+// Step is a single completed step of an operation
+type Step struct {
+	Name      string    `json:"name"`
+	Completed time.Time `json:"completed"`
+}
+
+// DefaultDir is the directory where journals are saved if no other path is
+// specified
+func DefaultDir() string {
+	home := os.Getenv("HOME")
+	if runtime.GOOS == "windows" {
+		home = os.Getenv("USERPROFILE")
+	}
+	if home == "" {
+		return filepath.Join(os.TempDir(), filepath.FromSlash(journalDirName))
+	}
+	return filepath.Join(home, filepath.FromSlash(journalDirName))
+}
+
+// New will create a new journal for the given operation and write it to disk.
+// If path is empty, a new file will be created in DefaultDir().
+func New(path, operation, region, id string) (*Journal, error) {
+	if path == "" {
+		name := fmt.Sprintf("%s-%s-%s.json", operation, id, time.Now().Format("20060102-150405"))
+		path = filepath.Join(DefaultDir(), name)
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	j := &Journal{
+		Operation: operation,
+		Region:    region,
+		ID:        id,
+		State:     StateInProgress,
+		Started:   now,
+		Updated:   now,
+		Params:    map[string]string{},
+		Resources: map[string]string{},
+		Steps:     []Step{},
+		path:      path,
+	}
+	return j, j.save()
+}
+
+// Open will read a previously written journal from disk
+func Open(path string) (*Journal, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{}
+	err = json.Unmarshal(data, j)
+	if err != nil || j.Operation == "" {
+		logging.Debugf("Could not parse journal: %v", err)
+		return nil, ErrInvalidJournal
+	}
+	if j.Params == nil {
+		j.Params = map[string]string{}
+	}
+	if j.Resources == nil {
+		j.Resources = map[string]string{}
+	}
+	j.path = path
+	return j, nil
+}
+
+// Path returns where the journal is saved on disk
+func (j *Journal) Path() string {
+	if j == nil {
+		return ""
+	}
+	return j.path
+}
+
+// Record will mark a step as completed, together with any resources that
+// were created or modified by the step, and save the journal to disk
+func (j *Journal) Record(step string, resources map[string]string) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.State != StateInProgress {
+		// The operation has already been finished, e.g. by an interrupt
+		return nil
+	}
+	for k, v := range resources {
+		j.Resources[k] = v
+	}
+	j.Steps = append(j.Steps, Step{
+		Name:      step,
+		Completed: time.Now().UTC(),
+	})
+	logging.Debugf("Journal: completed step %s", step)
+	return j.save()
+}
+
+// SetRegion will update the region of the operation, for when it's not
+// known until after the journal has been created
+func (j *Journal) SetRegion(region string) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Region = region
+	return j.save()
+}
+
+// SetParam will save a parameter needed to resume the operation
+func (j *Journal) SetParam(key, value string) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Params[key] = value
+	return j.save()
+}
+
+// Param returns a previously saved parameter, or empty string if not set
+func (j *Journal) Param(key string) string {
+	if j == nil {
+		return ""
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.Params[key]
+}
+
+// Resource returns the ID of a recorded resource, or empty string if not set
+func (j *Journal) Resource(key string) string {
+	if j == nil {
+		return ""
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.Resources[key]
+}
+
+// Completed determines if a step has been recorded as completed
+func (j *Journal) Completed(step string) bool {
+	if j == nil {
+		return false
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for _, s := range j.Steps {
+		if s.Name == step {
+			return true
+		}
+	}
+	return false
+}
+
+// LastStep returns the name of the last completed step, or empty string if
+// no steps have been completed
+func (j *Journal) LastStep() string {
+	if j == nil {
+		return ""
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if len(j.Steps) == 0 {
+		return ""
+	}
+	return j.Steps[len(j.Steps)-1].Name
+}
+
+// Finish will set the final state of the operation and save the journal
+func (j *Journal) Finish(state string) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.State = state
+	return j.save()
+}
+
+// The journal is first written to a temporary file which is then renamed, so
+// that a killed process never leaves a half-written journal behind
+func (j *Journal) save() error {
+	j.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(j, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), journalPerm)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logging.Debugf("Failed to write journal: %s", err)
+		return err
+	}
+	return os.Rename(tmp.Name(), j.path)
+}
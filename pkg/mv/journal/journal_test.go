@@ -0,0 +1,119 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordAndOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "journal.json")
+
+	j, err := New(path, "test-op", "us-west-2", "i-123")
+	if err != nil {
+		t.Fatalf("Could not create journal: %s", err)
+	}
+	j.SetParam("domain", "example.com")
+	j.Record("first", map[string]string{"volume": "vol-1"})
+	j.Record("second", nil)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Could not stat journal: %s", err)
+	}
+	if perm := info.Mode().Perm(); perm != journalPerm {
+		t.Errorf("Expected journal to only be readable by the owner, got %v", perm)
+	}
+
+	opened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Could not open journal: %s", err)
+	}
+	if opened.Operation != "test-op" || opened.Region != "us-west-2" || opened.ID != "i-123" {
+		t.Errorf("Got unexpected journal header: %+v", opened)
+	}
+	if opened.State != StateInProgress {
+		t.Errorf("Expected state %s, got %s", StateInProgress, opened.State)
+	}
+	if !opened.Completed("first") || !opened.Completed("second") || opened.Completed("third") {
+		t.Error("Completed steps were not recorded correctly")
+	}
+	if s := opened.LastStep(); s != "second" {
+		t.Errorf("Expected last step to be second, got %s", s)
+	}
+	if v := opened.Resource("volume"); v != "vol-1" {
+		t.Errorf("Expected resource vol-1, got %s", v)
+	}
+	if v := opened.Param("domain"); v != "example.com" {
+		t.Errorf("Expected param example.com, got %s", v)
+	}
+}
+
+func TestFinishedJournalIgnoresSteps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.json")
+
+	j, err := New(path, "test-op", "us-west-2", "i-123")
+	if err != nil {
+		t.Fatalf("Could not create journal: %s", err)
+	}
+	j.Finish(StateFailed)
+	j.Record("late-step", nil)
+
+	opened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Could not open journal: %s", err)
+	}
+	if opened.State != StateFailed {
+		t.Errorf("Expected state %s, got %s", StateFailed, opened.State)
+	}
+	if opened.Completed("late-step") {
+		t.Error("Steps should not be recorded after the journal is finished")
+	}
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *Journal
+	if err := j.Record("step", map[string]string{"a": "b"}); err != nil {
+		t.Errorf("Recording to nil journal should not fail: %s", err)
+	}
+	if j.Completed("step") || j.Resource("a") != "" || j.Path() != "" {
+		t.Error("Nil journal should not report anything")
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("{\"not\": \"a journal\"}")
+	f.Close()
+	if _, err := Open(f.Name()); err != ErrInvalidJournal {
+		t.Errorf("Expected ErrInvalidJournal, got %v", err)
+	}
+}
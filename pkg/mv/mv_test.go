@@ -14,31 +14,163 @@
 
 package mv
 
-import "testing"
-
-func TestCleanup(t *testing.T) {
-	didRun := false
-	f := func() {
-		didRun = true
-	}
-	stackedCleanups = nil
-	QueueCleanup(f, true)
-	Cleanup(true)
-	if didRun {
-		t.Error("Cleanup should only have run if failure happened")
-	}
-	QueueCleanup(f, true)
-	Cleanup(false)
-	if !didRun {
-		t.Error("Cleanup never happened")
-	}
-	didAlwaysRun := false
-	fAlways := func() {
-		didAlwaysRun = true
-	}
-	QueueCleanup(fAlways, false)
-	Cleanup(true)
-	if !didAlwaysRun {
-		t.Error("Cleanup function never ran")
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+func TestTransactionCommit(t *testing.T) {
+	var compensated, finalized bool
+	tx := NewTransaction("test")
+	tx.Compensate("compensate", 0, func(ctx context.Context) error {
+		compensated = true
+		return nil
+	})
+	tx.Finally("finally", 0, func(ctx context.Context) error {
+		finalized = true
+		return nil
+	})
+	res := tx.Commit()
+	if compensated {
+		t.Error("Compensations should only run if the transaction is rolled back")
+	}
+	if !finalized {
+		t.Error("Final step never ran")
+	}
+	if !res.Committed || res.RolledBack() || len(res.Steps) != 1 {
+		t.Errorf("Got unexpected result: %+v", res)
+	}
+	if tx.Result() != res {
+		t.Error("Result should return the result of the finished transaction")
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	order := []string{}
+	tx := NewTransaction("test")
+	tx.Compensate("first", 0, func(ctx context.Context) error {
+		order = append(order, "first")
+		return nil
+	})
+	tx.Finally("second", 0, func(ctx context.Context) error {
+		order = append(order, "second")
+		return nil
+	})
+	res := tx.Rollback()
+	if len(order) != 2 || order[0] != "second" || order[1] != "first" {
+		t.Errorf("Steps should run in reverse order, got %v", order)
+	}
+	if res.Committed || !res.RolledBack() {
+		t.Errorf("Got unexpected result: %+v", res)
+	}
+	if again := tx.Commit(); again != res {
+		t.Error("Finishing a transaction twice should return the first result")
+	}
+}
+
+func TestTransactionFinish(t *testing.T) {
+	ran := false
+	tx := NewTransaction("test")
+	tx.Compensate("compensation", 0, func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	if res := tx.Finish(true); !res.Committed || ran {
+		t.Errorf("Expected successful transaction to be committed, got: %+v", res)
+	}
+	tx = NewTransaction("test")
+	tx.Compensate("compensation", 0, func(ctx context.Context) error {
+		ran = true
+		return errors.New("failed")
+	})
+	res := tx.Finish(false)
+	if res.Committed || !ran || len(res.Failed()) != 1 {
+		t.Errorf("Expected failed transaction to be rolled back, got: %+v", res)
+	}
+}
+
+func TestTransactionFailedSteps(t *testing.T) {
+	tx := NewTransaction("test")
+	tx.Compensate("fails", 0, func(ctx context.Context) error {
+		return errors.New("failed")
+	})
+	tx.Compensate("times-out", time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	res := tx.Rollback()
+	if res.RolledBack() {
+		t.Error("Transaction with failed steps should not count as rolled back")
+	}
+	failed := res.Failed()
+	if len(failed) != 2 {
+		t.Fatalf("Expected two failed steps, got %+v", failed)
+	}
+	if failed[0].Step != "times-out" || failed[0].Status != StepTimedOut {
+		t.Errorf("Expected times-out to time out, got %+v", failed[0])
+	}
+	if failed[1].Step != "fails" || failed[1].Status != StepFailed || failed[1].Error != "failed" {
+		t.Errorf("Expected fails to fail, got %+v", failed[1])
+	}
+}
+
+func TestTransactionCleanupFailedEvent(t *testing.T) {
+	var b bytes.Buffer
+	logging.SetEventWriter(&b)
+	defer logging.SetEventWriter(nil)
+	tx := NewTransaction("test")
+	tx.Finally("succeeds", 0, func(ctx context.Context) error {
+		return nil
+	})
+	tx.Finally("fails", 0, func(ctx context.Context) error {
+		return errors.New("failed")
+	})
+	tx.Commit()
+	var e logging.Event
+	if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatalf("Expected a single event, got: %s", b.String())
+	}
+	if e.Type != logging.EventCleanupFailed || e.Operation != "test" || e.Step != "fails" || e.Error != "failed" {
+		t.Errorf("Got unexpected event: %+v", e)
+	}
+}
+
+func TestSeparateTransactions(t *testing.T) {
+	var ranFirst, ranSecond bool
+	first := NewTransaction("first")
+	second := NewTransaction("second")
+	first.Compensate("first", 0, func(ctx context.Context) error {
+		ranFirst = true
+		return nil
+	})
+	second.Compensate("second", 0, func(ctx context.Context) error {
+		ranSecond = true
+		return nil
+	})
+	first.Rollback()
+	if !ranFirst || ranSecond {
+		t.Error("Only the steps of the rolled back transaction should have run")
+	}
+}
+
+func TestStepAfterRollback(t *testing.T) {
+	ran := false
+	tx := NewTransaction("test")
+	tx.Rollback()
+	tx.Compensate("late", 0, func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	if !ran {
+		t.Error("Steps registered after a rollback should run right away")
+	}
+	if n := len(tx.Result().Steps); n != 1 {
+		t.Errorf("Expected late step in result, got %d steps", n)
 	}
 }
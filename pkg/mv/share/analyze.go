@@ -0,0 +1,333 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package share
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+// Kinds of findings in the logs of a bundle
+const (
+	// FindingBoot is a boot of the Metavisor, found by the banner the kernel
+	// logs when booting
+	FindingBoot = "boot"
+	// FindingConnectivity is a failure to communicate with Yeti
+	FindingConnectivity = "connectivity"
+	// FindingInvalidToken is a launch token rejected by Yeti
+	FindingInvalidToken = "invalid-token"
+	// FindingShutdown is the Metavisor shutting itself and the instance down
+	FindingShutdown = "shutdown"
+	// FindingPanic is a kernel panic or crash of a Metavisor process
+	FindingPanic = "panic"
+)
+
+const (
+	logsDir  = "log"
+	crashDir = "crash"
+
+	// maxLineLength is the longest log line that is analyzed, the rest of
+	// longer lines is skipped
+	maxLineLength = 1024 * 1024
+	// shownFindings is how many of the last findings of each kind are shown
+	// in the summary
+	shownFindings = 5
+)
+
+var (
+	// ErrInvalidBundle is returned if a file is not a log bundle created by
+	// share-logs
+	ErrInvalidBundle = errors.New("the file is not a Metavisor log bundle")
+
+	// logPatterns are matched against each log line in order, a line is a
+	// finding of the first kind that matches
+	logPatterns = []struct {
+		kind string
+		re   *regexp.Regexp
+	}{
+		{FindingBoot, regexp.MustCompile(`Copyright \(c\) 1992-\d+ The FreeBSD Project`)},
+		{FindingPanic, regexp.MustCompile(`(?i)\bpanic:|fatal trap \d+`)},
+		{FindingInvalidToken, regexp.MustCompile(`(?i)\b(invalid|expired|malformed|unknown)( launch| identity)? token\b|\btoken\b.*\b(is invalid|expired|rejected|not valid)\b|\b401\b.*\bunauthorized\b`)},
+		{FindingConnectivity, regexp.MustCompile(`(?i)\b(yeti|yetiapi|api)\b.*\b(refused|timed out|timeout|unreachable|no route to host|could not resolve|failed to connect|connection failed|handshake)`)},
+		{FindingShutdown, regexp.MustCompile(`(?i)\bshutting down\b|\bhalting the system\b|\bpowering off\b`)},
+	}
+	// syslogTime matches the timestamp at the start of syslog lines, and
+	// RFC 3339 timestamps of the Metavisor services
+	syslogTime = regexp.MustCompile(`^([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}|\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?)`)
+	// panicString matches the panic of a crash dump summary, like in the
+	// info.N and core.txt.N files written by savecore and crashinfo
+	panicString = regexp.MustCompile(`^(?:Panic String|panic):\s*(.+)$`)
+)
+
+// Finding is a log line of interest in a log bundle
+type Finding struct {
+	Kind    string `json:"kind"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Time    string `json:"time,omitempty"`
+	Message string `json:"message"`
+}
+
+// CrashDump is a file in the crash directory of a log bundle
+type CrashDump struct {
+	File  string `json:"file"`
+	Size  int64  `json:"size"`
+	Panic string `json:"panic,omitempty"`
+}
+
+// Analysis summarises the logs in a bundle downloaded with share-logs
+type Analysis struct {
+	Bundle       string      `json:"bundle"`
+	LogFiles     []string    `json:"log_files"`
+	BootAttempts int         `json:"boot_attempts"`
+	Findings     []Finding   `json:"findings"`
+	CrashDumps   []CrashDump `json:"crash_dumps"`
+	// Diagnosis are the likely causes of the problems found
+	Diagnosis []string `json:"diagnosis"`
+}
+
+// Count returns the number of findings of the kind
+func (a *Analysis) Count(kind string) int {
+	n := 0
+	for _, f := range a.Findings {
+		if f.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// AnalyzeLogs reads the log bundle at the path, as created by share-logs,
+// and summarises the boots of the Metavisor and the problems in its logs.
+// The bundle is never unpacked to disk.
+func AnalyzeLogs(bundlePath string) (*Analysis, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		logging.Errorf("Could not open log bundle %s", bundlePath)
+		return nil, err
+	}
+	defer f.Close()
+	analysis, err := analyzeBundle(f)
+	if err != nil {
+		return nil, err
+	}
+	analysis.Bundle = bundlePath
+	return analysis, nil
+}
+
+func analyzeBundle(r io.Reader) (*Analysis, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		logging.Debugf("Got error when decompressing bundle: %s", err)
+		return nil, ErrInvalidBundle
+	}
+	defer gz.Close()
+	analysis := &Analysis{
+		LogFiles:   []string{},
+		Findings:   []Finding{},
+		CrashDumps: []CrashDump{},
+		Diagnosis:  []string{},
+	}
+	found := false
+	archive := tar.NewReader(gz)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logging.Debugf("Got error when reading bundle: %s", err)
+			return nil, ErrInvalidBundle
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		dir := strings.SplitN(name, "/", 2)[0]
+		if dir == logsDir || dir == crashDir {
+			found = true
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		switch dir {
+		case logsDir:
+			err = analysis.addLogFile(name, archive)
+		case crashDir:
+			err = analysis.addCrashFile(name, hdr.Size, archive)
+		}
+		if err != nil {
+			logging.Debugf("Got error when reading %s: %s", name, err)
+			return nil, ErrInvalidBundle
+		}
+	}
+	if !found {
+		logging.Debug("Bundle contains neither log nor crash directory")
+		return nil, ErrInvalidBundle
+	}
+	analysis.BootAttempts = analysis.Count(FindingBoot)
+	analysis.diagnose()
+	return analysis, nil
+}
+
+func (a *Analysis) addLogFile(name string, r io.Reader) error {
+	var err error
+	switch path.Ext(name) {
+	case ".gz":
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(r); err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case ".bz2":
+		r = bzip2.NewReader(r)
+	}
+	a.LogFiles = append(a.LogFiles, name)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		for _, p := range logPatterns {
+			if !p.re.MatchString(text) {
+				continue
+			}
+			a.Findings = append(a.Findings, Finding{
+				Kind:    p.kind,
+				File:    name,
+				Line:    line,
+				Time:    syslogTime.FindString(text),
+				Message: text,
+			})
+			break
+		}
+	}
+	if scanner.Err() == bufio.ErrTooLong {
+		logging.Warningf("Skipped the rest of %s after a line longer than %d bytes", name, maxLineLength)
+		return nil
+	}
+	return scanner.Err()
+}
+
+func (a *Analysis) addCrashFile(name string, size int64, r io.Reader) error {
+	base := path.Base(name)
+	if base == "bounds" || base == "minfree" {
+		// Bookkeeping of savecore, not a crash
+		return nil
+	}
+	dump := CrashDump{File: name, Size: size}
+	if strings.HasPrefix(base, "info.") || strings.HasPrefix(base, "core.txt.") {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, maxLineLength)
+		for scanner.Scan() {
+			if m := panicString.FindStringSubmatch(strings.TrimSpace(scanner.Text())); m != nil {
+				dump.Panic = m[1]
+				break
+			}
+		}
+	}
+	a.CrashDumps = append(a.CrashDumps, dump)
+	return nil
+}
+
+func (a *Analysis) diagnose() {
+	if n := a.Count(FindingInvalidToken); n > 0 {
+		a.Diagnosis = append(a.Diagnosis, "The launch token was rejected, verify that the token used when wrapping is valid and not expired")
+	}
+	if n := a.Count(FindingConnectivity); n > 0 {
+		a.Diagnosis = append(a.Diagnosis, "The Metavisor could not communicate with Yeti, verify that the instance can reach the service domain through its subnet and security groups")
+	}
+	if a.Count(FindingShutdown) > 0 && a.Count(FindingInvalidToken)+a.Count(FindingConnectivity) > 0 {
+		a.Diagnosis = append(a.Diagnosis, "The Metavisor shut the instance down because of the problems above")
+	}
+	if n := len(a.CrashDumps) + a.Count(FindingPanic); n > 0 {
+		a.Diagnosis = append(a.Diagnosis, "The Metavisor crashed, share the crash dumps with support")
+	}
+	if a.BootAttempts > 1 && len(a.Diagnosis) == 0 {
+		a.Diagnosis = append(a.Diagnosis, fmt.Sprintf("The Metavisor booted %d times, but no known problem was found in the logs", a.BootAttempts))
+	}
+}
+
+// FormatAnalysis returns the analysis as a summary for humans, or as JSON
+func FormatAnalysis(a *Analysis, withJSON bool) (string, error) {
+	if withJSON {
+		data, err := json.MarshalIndent(a, "", "\t")
+		if err != nil {
+			logging.Errorf("Failed to marshal log analysis to JSON: %s", err)
+		}
+		return string(data), err
+	}
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "Bundle:\t%s\n", a.Bundle)
+	fmt.Fprintf(w, "Log files:\t%d\n", len(a.LogFiles))
+	fmt.Fprintf(w, "Boot attempts:\t%d\n", a.BootAttempts)
+	fmt.Fprintf(w, "Connectivity failures:\t%d\n", a.Count(FindingConnectivity))
+	fmt.Fprintf(w, "Invalid token errors:\t%d\n", a.Count(FindingInvalidToken))
+	fmt.Fprintf(w, "Shutdowns:\t%d\n", a.Count(FindingShutdown))
+	fmt.Fprintf(w, "Panics:\t%d\n", a.Count(FindingPanic))
+	fmt.Fprintf(w, "Crash dumps:\t%d\n", len(a.CrashDumps))
+	w.Flush()
+
+	for _, kind := range []string{FindingConnectivity, FindingInvalidToken, FindingShutdown, FindingPanic} {
+		var findings []Finding
+		for _, f := range a.Findings {
+			if f.Kind == kind {
+				findings = append(findings, f)
+			}
+		}
+		if len(findings) == 0 {
+			continue
+		}
+		if len(findings) > shownFindings {
+			findings = findings[len(findings)-shownFindings:]
+		}
+		fmt.Fprintf(&b, "\nLast %s findings:\n", kind)
+		for _, f := range findings {
+			fmt.Fprintf(&b, "  %s:%d: %s\n", f.File, f.Line, f.Message)
+		}
+	}
+	if len(a.CrashDumps) > 0 {
+		dumps := append([]CrashDump{}, a.CrashDumps...)
+		sort.Slice(dumps, func(i, j int) bool { return dumps[i].File < dumps[j].File })
+		b.WriteString("\nCrash dumps:\n")
+		for _, d := range dumps {
+			if d.Panic != "" {
+				fmt.Fprintf(&b, "  %s (%d bytes): %s\n", d.File, d.Size, d.Panic)
+			} else {
+				fmt.Fprintf(&b, "  %s (%d bytes)\n", d.File, d.Size)
+			}
+		}
+	}
+	if len(a.Diagnosis) > 0 {
+		b.WriteString("\nLikely causes:\n")
+		for _, d := range a.Diagnosis {
+			fmt.Fprintf(&b, "  - %s\n", d)
+		}
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
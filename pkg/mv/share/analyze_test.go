@@ -0,0 +1,172 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package share
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testMessages = `Mar  4 10:00:01 mv syslogd: kernel boot file is /boot/kernel/kernel
+Mar  4 10:00:01 mv kernel: Copyright (c) 1992-2018 The FreeBSD Project.
+Mar  4 10:00:05 mv metavisor[512]: Metavisor 3.1.2 starting
+Mar  4 10:00:09 mv metavisor[512]: Failed to connect to yetiapi.mgmt.brkt.com:443: connection timed out
+Mar  4 10:00:20 mv metavisor[512]: Failed to connect to yetiapi.mgmt.brkt.com:443: connection refused
+Mar  4 10:00:21 mv metavisor[512]: Could not register with Yeti, shutting down
+Mar  4 10:05:01 mv kernel: Copyright (c) 1992-2018 The FreeBSD Project.
+Mar  4 10:05:06 mv metavisor[498]: Registration failed: invalid launch token
+`
+
+// testBundle returns a bundle like the ones created by share-logs
+func testBundle(files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for _, dir := range []string{"./log/", "./crash/"} {
+		archive.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755})
+	}
+	for name, data := range files {
+		archive.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))})
+		archive.Write(data)
+	}
+	archive.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func gzipped(data string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(data))
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestAnalyzeBundle(t *testing.T) {
+	bundle := testBundle(map[string][]byte{
+		"./log/messages":      []byte(testMessages),
+		"./log/messages.0.gz": gzipped("Mar  3 09:00:00 mv kernel: Fatal trap 12: page fault while in kernel mode\n"),
+		"./crash/bounds":      []byte("1\n"),
+		"./crash/info.0":      []byte("Dump header from device: /dev/ada0p3\n  Panic String: page fault\n"),
+		"./crash/vmcore.0":    make([]byte, 4096),
+	})
+
+	a, err := analyzeBundle(bytes.NewReader(bundle))
+	if err != nil {
+		t.Fatalf("Got unexpected error when analyzing bundle: %s", err)
+	}
+	if a.BootAttempts != 2 {
+		t.Errorf("Expected 2 boot attempts, got %d", a.BootAttempts)
+	}
+	counts := map[string]int{
+		FindingConnectivity: 2,
+		FindingInvalidToken: 1,
+		FindingShutdown:     1,
+		FindingPanic:        1,
+	}
+	for kind, expected := range counts {
+		if n := a.Count(kind); n != expected {
+			t.Errorf("Expected %d %s findings, got %d", expected, kind, n)
+		}
+	}
+	if len(a.LogFiles) != 2 {
+		t.Errorf("Expected rotated logs to be analyzed, got %v", a.LogFiles)
+	}
+	if len(a.CrashDumps) != 2 {
+		t.Fatalf("Expected 2 crash files, got %+v", a.CrashDumps)
+	}
+	for _, d := range a.CrashDumps {
+		if d.File == "crash/info.0" && d.Panic != "page fault" {
+			t.Errorf("Got unexpected panic string: %q", d.Panic)
+		}
+		if d.File == "crash/vmcore.0" && d.Size != 4096 {
+			t.Errorf("Got unexpected size of crash dump: %d", d.Size)
+		}
+	}
+	for _, f := range a.Findings {
+		if f.Kind == FindingInvalidToken && (f.Line != 8 || f.Time != "Mar  4 10:05:06" || f.File != "log/messages") {
+			t.Errorf("Got unexpected location of finding: %+v", f)
+		}
+	}
+	if len(a.Diagnosis) != 4 {
+		t.Errorf("Got unexpected diagnosis: %v", a.Diagnosis)
+	}
+
+	out, err := FormatAnalysis(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`Boot attempts:\s+2\n`, `log/messages:4: .*timed out`, `crash/info.0 \(64 bytes\): page fault`, `Likely causes:`} {
+		if !regexp.MustCompile(expected).MatchString(out) {
+			t.Errorf("Expected %q in summary:\n%s", expected, out)
+		}
+	}
+	out, err = FormatAnalysis(a, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Analysis
+	if err = json.Unmarshal([]byte(out), &decoded); err != nil || len(decoded.Findings) != len(a.Findings) {
+		t.Errorf("Expected findings as JSON, got %v:\n%s", err, out)
+	}
+}
+
+func TestAnalyzeBundleHealthy(t *testing.T) {
+	bundle := testBundle(map[string][]byte{
+		"./log/messages": []byte("Mar  4 10:00:01 mv kernel: Copyright (c) 1992-2018 The FreeBSD Project.\nMar  4 10:00:02 mv metavisor[1]: Registered with Yeti\n"),
+	})
+	a, err := analyzeBundle(bytes.NewReader(bundle))
+	if err != nil {
+		t.Fatalf("Got unexpected error when analyzing bundle: %s", err)
+	}
+	if a.BootAttempts != 1 || len(a.Findings) != 1 || len(a.Diagnosis) != 0 {
+		t.Errorf("Expected no problems in healthy logs, got %+v", a)
+	}
+}
+
+func TestAnalyzeLogsInvalidBundle(t *testing.T) {
+	if _, err := analyzeBundle(strings.NewReader("not a bundle")); err != ErrInvalidBundle {
+		t.Errorf("Expected ErrInvalidBundle for plain text, got %v", err)
+	}
+	other := testBundle(nil)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	archive.WriteHeader(&tar.Header{Name: "./home/", Typeflag: tar.TypeDir, Mode: 0755})
+	archive.Close()
+	gz.Close()
+	if _, err := analyzeBundle(&buf); err != ErrInvalidBundle {
+		t.Errorf("Expected ErrInvalidBundle for other archive, got %v", err)
+	}
+	if _, err := analyzeBundle(bytes.NewReader(other)); err != nil {
+		t.Errorf("Expected empty bundle to be valid, got %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "analyze-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err = AnalyzeLogs(dir + "/missing.tar.gz"); err == nil {
+		t.Error("Expected error for missing bundle")
+	}
+}
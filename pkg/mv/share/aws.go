@@ -15,87 +15,172 @@
 package share
 
 import (
-	"context"
+	"bytes"
 	"fmt"
-	"time"
+	"path"
+	"strings"
+	"text/template"
 
-	"github.com/immutable/metavisor-cli/pkg/csp/aws"
 	"github.com/immutable/metavisor-cli/pkg/logging"
-	"github.com/immutable/metavisor-cli/pkg/mv"
 )
 
-const awsUserDataTemplate = `#!/bin/bash
-sudo mount -t ufs -o ro,ufstype=ufs2 /dev/xvdg4 /mnt
-sudo tar czvf /tmp/temp_logs -C /mnt ./log ./crash
-mv /tmp/temp_logs /tmp/%s`
+const (
+	// logsDeviceName is where the volume with the logs is attached to the
+	// temporary instance
+	logsDeviceName = "/dev/sdg"
+	// CollectReportName is the name of the report of the script collecting
+	// the logs, which is added to the bundle
+	CollectReportName = "share-logs-report.txt"
+)
+
+// awsCollectLogsScript finds the volume with the logs, by its volume ID in
+// the serial of NVMe devices if known, otherwise by the device name it's
+// attached as. Each partition with a known filesystem is mounted read-only
+// until one with logs is found. What is done is written to a report that
+// is always archived, so that failures can be seen in the downloaded logs.
+var awsCollectLogsScript = template.Must(template.New("collect").Parse(`#!/bin/bash
+volume_id="{{.VolumeID}}"
+device_names="{{.DeviceNames}}"
+report=/tmp/{{.Report}}
+mnt=/mnt/metavisor-logs
+
+report() { echo "$1: $2" >> "$report"; }
+
+find_device() {
+	local serial=${volume_id/-/}
+	if [ -n "$serial" ]; then
+		for dev in /sys/block/nvme*n*; do
+			[ -e "$dev/device/serial" ] || continue
+			if [ "$(tr -d ' ' < "$dev/device/serial")" = "$serial" ]; then
+				echo "/dev/${dev##*/}"
+				return
+			fi
+		done
+	fi
+	for name in $device_names; do
+		if [ -b "/dev/$name" ]; then
+			readlink -f "/dev/$name"
+			return
+		fi
+	done
+}
+
+other_disks() {
+	local root=$(lsblk -no PKNAME "$(findmnt -no SOURCE /)")
+	lsblk -dnpo NAME,TYPE | awk '$2 == "disk" {print $1}' | grep -v "^/dev/$root\$"
+}
 
-func awsInstanceToSnap(ctx context.Context, awsService aws.Service, instanceID string) (aws.Snapshot, error) {
-	inst, err := awsService.GetInstance(ctx, instanceID)
+: > "$report"
+report INFO "Looking for volume ${volume_id:-attached as $device_names}"
+device=""
+for i in $(seq 1 90); do
+	device=$(find_device)
+	[ -n "$device" ] && break
+	sleep 2
+done
+if [ -z "$device" ]; then
+	disks=$(other_disks)
+	if [ "$(echo "$disks" | grep -c .)" -eq 1 ]; then
+		device=$disks
+		report WARNING "Volume not found, using the only other disk $device"
+	fi
+fi
+
+found=""
+if [ -z "$device" ]; then
+	report ERROR "Could not find the volume ${volume_id:-attached as $device_names}, disks are: $(lsblk -dnpo NAME | tr '\n' ' ')"
+else
+	report INFO "Found volume at $device"
+	mkdir -p "$mnt"
+	for part in $(lsblk -lnpo NAME "$device"); do
+		fstype=$(blkid -o value -s TYPE "$part")
+		case "$fstype" in
+		"")
+			report INFO "$part has no filesystem"
+			continue
+			;;
+		ufs)
+			opts=ro,ufstype=ufs2
+			;;
+		*)
+			opts=ro
+			;;
+		esac
+		if ! out=$(mount -t "$fstype" -o "$opts" "$part" "$mnt" 2>&1); then
+			report ERROR "Could not mount $part ($fstype): $out"
+			continue
+		fi
+		if [ -d "$mnt/log" ]; then
+			report INFO "Found logs on $part ($fstype)"
+			found=$part
+			break
+		fi
+		report INFO "$part ($fstype) has no logs"
+		umount "$mnt"
+	done
+	[ -n "$found" ] || report ERROR "None of the partitions of $device contain Metavisor logs"
+fi
+
+if [ -n "$found" ]; then
+	dirs=./log
+	[ -d "$mnt/crash" ] && dirs="$dirs ./crash"
+	tar czf /tmp/temp_logs -C /tmp {{.Report}} -C "$mnt" $dirs
+else
+	tar czf /tmp/temp_logs -C /tmp {{.Report}}
+fi
+mv /tmp/temp_logs /tmp/{{.LogsFile}}`))
+
+// awsUploadTemplate uploads the logs to a presigned URL, which contains no
+// single quotes
+const awsUploadTemplate = "curl --silent --show-error --fail --retry 5 -X PUT --upload-file /tmp/%s '%s'"
+
+// awsCollectLogs returns the script collecting the logs from the volume to
+// the logs file, the volume ID is optional
+func awsCollectLogs(logFileName, volumeID string) string {
+	name := path.Base(logsDeviceName)
+	var script bytes.Buffer
+	err := awsCollectLogsScript.Execute(&script, struct {
+		LogsFile    string
+		VolumeID    string
+		DeviceNames string
+		Report      string
+	}{
+		LogsFile: logFileName,
+		VolumeID: volumeID,
+		// Xen instances name the device xvdX instead of sdX
+		DeviceNames: strings.Join([]string{name, "xv" + strings.TrimPrefix(name, "s")}, " "),
+		Report:      CollectReportName,
+	})
 	if err != nil {
-		logging.Errorf("Could not get an instance with the ID '%s'", instanceID)
-		return nil, err
+		// The template is fixed, so this can't happen
+		panic(err)
 	}
-	rootName := inst.RootDeviceName()
-	rootID, ok := inst.DeviceMapping()[rootName]
-	if !ok {
-		return nil, ErrNoRootVolume
-	}
-	snapName := "Temporary share-logs snapshot"
-	logging.Infof("Creating a temporary snapshot with name: %s", snapName)
-	return awsService.CreateSnapshot(ctx, snapName, rootID)
+	return script.String()
 }
 
-func awsCreateUserData(logFileName string) string {
-	userdata := fmt.Sprintf(awsUserDataTemplate, logFileName)
-	logging.Debugf("Generated the following userdata:\n%s", userdata)
+// awsCreateUserData returns the userdata that creates the logs from the volume
+// with the given ID, and uploads them if an upload URL is given
+func awsCreateUserData(logFileName, volumeID, uploadURL string) string {
+	userdata := awsCollectLogs(logFileName, volumeID)
+	logged := userdata
+	if uploadURL != "" {
+		userdata += "\n" + uploadCommand(logFileName, uploadURL)
+		logged += "\n" + uploadCommand(logFileName, redactUploadURL(uploadURL))
+	}
+	logging.Debugf("Generated the following userdata:\n%s", logged)
 	return userdata
 }
 
-// Turn an instance ID or snapshot ID into a Snapshot reference
-func awsSnapFromID(ctx context.Context, id string, awsSvc aws.Service) (aws.Snapshot, error) {
-	if aws.IsInstanceID(id) {
-		logging.Debugf("The ID '%s' is an instance", id)
-		// We must create a snapshot from the instance
-		s, err := awsInstanceToSnap(ctx, awsSvc, id)
-		if err != nil {
-			// Could not create snapshot from instance
-			logging.Errorf("Failed to create snapshot from instance %s", id)
-			return nil, err
-		}
-		mv.QueueCleanup(func() {
-			logging.Info("Removing temporary snapshot")
-			err := awsSvc.DeleteSnapshot(context.Background(), s.ID())
-			if err != nil {
-				logging.Errorf("Failed to delete snapshot %s", s.ID())
-				logging.Debugf("Got error when deleting snapshot: %s", err)
-			}
-		}, false)
-		return s, nil
-	} else if aws.IsSnapshotID(id) {
-		logging.Debugf("The ID '%s' is a snapshot", id)
-		s, err := awsSvc.GetSnapshot(ctx, id)
-		if err != nil {
-			// The specified instance doesn't exist or insufficient
-			// permissions
-			return nil, err
-		}
-		return s, nil
-	} else {
-		logging.Debugf("'%s' is neither an instance or a snapshot", id)
-		return nil, aws.ErrInvalidID
-	}
+func uploadCommand(logFileName, uploadURL string) string {
+	return fmt.Sprintf(awsUploadTemplate, logFileName, uploadURL)
 }
 
-func awsAwaitPublicIP(ctx context.Context, instanceID string, awsSvc aws.Service) (aws.Instance, error) {
-	maxTries := 10
-	for try := 1; try <= maxTries; try++ {
-		inst, err := awsSvc.GetInstance(ctx, instanceID)
-		if err == nil && inst.PublicIP() != "" {
-			return inst, nil
-		}
-		logging.Debugf("Still waiting for public IP from %s...", instanceID)
-		time.Sleep(5 * time.Second)
+// redactUploadURL removes the signature and credentials from a presigned
+// URL, which let anyone who sees them write to the bucket, so that it can
+// be logged
+func redactUploadURL(uploadURL string) string {
+	if i := strings.Index(uploadURL, "?"); i >= 0 {
+		return uploadURL[:i] + "?<redacted>"
 	}
-	logging.Debugf("%s never got a public IP", instanceID)
-	return nil, ErrNoPublicIP
+	return uploadURL
 }
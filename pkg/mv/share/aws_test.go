@@ -0,0 +1,95 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package share
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestAWSCollectLogs(t *testing.T) {
+	tests := []struct {
+		logsFile string
+		volumeID string
+		expected []string
+	}{
+		{
+			logsFile: "mv-logs.tar.gz",
+			expected: []string{
+				"#!/bin/bash\n",
+				"\nvolume_id=\"\"\n",
+				"\ndevice_names=\"sdg xvdg\"\n",
+				"\nreport=/tmp/share-logs-report.txt\n",
+				"\n\ttar czf /tmp/temp_logs -C /tmp share-logs-report.txt -C \"$mnt\" $dirs\n",
+				"\nmv /tmp/temp_logs /tmp/mv-logs.tar.gz",
+			},
+		},
+		{
+			logsFile: "logs.tar.gz",
+			volumeID: "vol-0123456789abcdef0",
+			expected: []string{
+				"\nvolume_id=\"vol-0123456789abcdef0\"\n",
+				"\nmv /tmp/temp_logs /tmp/logs.tar.gz",
+			},
+		},
+	}
+	for _, test := range tests {
+		script := awsCollectLogs(test.logsFile, test.volumeID)
+		for _, expected := range test.expected {
+			if !strings.Contains(script, expected) {
+				t.Errorf("Expected %q in script:\n%s", expected, script)
+			}
+		}
+		if !strings.HasSuffix(script, "/tmp/"+test.logsFile) {
+			t.Errorf("Expected script to end with moving the logs, got:\n%s", script)
+		}
+	}
+}
+
+func TestAWSCreateUserData(t *testing.T) {
+	userdata := awsCreateUserData("mv-logs.tar.gz", "vol-0123456789abcdef0", "")
+	if !strings.Contains(userdata, "\nvolume_id=\"vol-0123456789abcdef0\"\n") {
+		t.Errorf("Expected the userdata to find the volume by its ID, got:\n%s", userdata)
+	}
+	if strings.Contains(userdata, "curl") {
+		t.Errorf("Expected no upload without an upload URL, got:\n%s", userdata)
+	}
+}
+
+func TestRedactUploadURL(t *testing.T) {
+	url := "https://bucket.s3.amazonaws.com/key?X-Amz-Credential=AKIA&X-Amz-Signature=abc"
+	if redacted := redactUploadURL(url); redacted != "https://bucket.s3.amazonaws.com/key?<redacted>" {
+		t.Errorf("Got unexpected redacted URL: %s", redacted)
+	}
+}
+
+func TestAWSCollectLogsSyntax(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+	userdata := awsCreateUserData("mv-logs.tar.gz", "", "https://bucket.s3.amazonaws.com/key?X-Amz-Signature=abc")
+	cmd := exec.Command(bash, "-n")
+	cmd.Stdin = strings.NewReader(userdata)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Got syntax error in generated userdata: %s\n%s", err, out)
+	}
+	lines := strings.Split(userdata, "\n")
+	upload := "curl --silent --show-error --fail --retry 5 -X PUT --upload-file /tmp/mv-logs.tar.gz 'https://bucket.s3.amazonaws.com/key?X-Amz-Signature=abc'"
+	if lines[len(lines)-1] != upload || lines[len(lines)-2] != "mv /tmp/temp_logs /tmp/mv-logs.tar.gz" {
+		t.Errorf("Expected logs to be uploaded once collected, got:\n%s", userdata)
+	}
+}
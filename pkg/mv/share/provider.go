@@ -0,0 +1,105 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package share
+
+import (
+	"context"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/mv/wrap"
+)
+
+const temporarySnapshotName = "Temporary share-logs snapshot"
+
+func instanceToSnap(ctx context.Context, provider csp.Provider, instanceID string) (csp.Snapshot, string, error) {
+	log := logging.FromContext(ctx)
+	inst, err := provider.GetInstance(ctx, instanceID)
+	if err != nil {
+		log.Errorf("Could not get an instance with the ID '%s'", instanceID)
+		return nil, "", err
+	}
+	rootName := inst.RootDeviceName()
+	rootID, ok := inst.DeviceMapping()[rootName]
+	if !ok {
+		return nil, "", ErrNoRootVolume
+	}
+	log.Infof("Creating a temporary snapshot with name: %s", temporarySnapshotName)
+	s, err := provider.CreateSnapshot(ctx, temporarySnapshotName, rootID)
+	if err != nil {
+		return nil, "", err
+	}
+	log.EmitStep(logging.EventSnapshotCreated, "", map[string]string{
+		resSource:   instanceID,
+		resSnapshot: s.ID(),
+	})
+	return s, inst.Tags()[wrap.TagMetavisorVersion], nil
+}
+
+// Turn an instance ID or snapshot ID into a Snapshot reference, and the
+// Metavisor version it's tagged with if any. If it's an instance, a
+// temporary snapshot of its root disk is created.
+func snapFromID(ctx context.Context, tx *mv.Transaction, provider csp.Provider, id string, isInstance bool) (csp.Snapshot, string, error) {
+	log := logging.FromContext(ctx)
+	if !isInstance {
+		log.Debugf("The ID '%s' is a snapshot", id)
+		// The specified snapshot might not exist or there might be
+		// insufficient permissions
+		s, err := provider.GetSnapshot(ctx, id)
+		if err != nil {
+			return nil, "", err
+		}
+		return s, s.Tags()[wrap.TagMetavisorVersion], nil
+	}
+	log.Debugf("The ID '%s' is an instance", id)
+	s, version, err := instanceToSnap(ctx, provider, id)
+	if err != nil {
+		// Could not create snapshot from instance
+		log.Errorf("Failed to create snapshot from instance %s", id)
+		return nil, "", err
+	}
+	tx.Finally(stepDeleteTemporarySnapshot, awsCleanupTimeout, func(ctx context.Context) error {
+		log := log.With(logging.Fields{Step: stepDeleteTemporarySnapshot})
+		log.Info("Removing temporary snapshot")
+		err := provider.DeleteSnapshot(ctx, s.ID())
+		if err != nil {
+			log.Errorf("Failed to delete snapshot %s", s.ID())
+			log.Debugf("Got error when deleting snapshot: %s", err)
+			return err
+		}
+		log.EmitStep(logging.EventSnapshotDeleted, stepDeleteTemporarySnapshot, map[string]string{
+			resSnapshot: s.ID(),
+		})
+		return nil
+	})
+	return s, version, nil
+}
+
+func awaitPublicIP(ctx context.Context, provider csp.Provider, instanceID string) (csp.Instance, error) {
+	log := logging.FromContext(ctx)
+	maxTries := 10
+	for try := 1; try <= maxTries; try++ {
+		inst, err := provider.GetInstance(ctx, instanceID)
+		if err == nil && inst.PublicIP() != "" {
+			return inst, nil
+		}
+		log.Debugf("Still waiting for public IP from %s...", instanceID)
+		time.Sleep(5 * time.Second)
+	}
+	log.Debugf("%s never got a public IP", instanceID)
+	return nil, ErrNoPublicIP
+}
@@ -0,0 +1,393 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package share
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/token"
+)
+
+const (
+	// ManifestName is the name of the manifest added to log bundles
+	ManifestName = "manifest.json"
+
+	redactedToken = "<redacted-token>"
+	redactedHost  = "<redacted-host>"
+	redactedIP    = "<redacted-ip>"
+	redacted      = "<redacted>"
+
+	// binarySniffLength is how much of a file is checked for NUL bytes to
+	// tell if it's a binary file, like git does
+	binarySniffLength = 8000
+	// binaryMask replaces every byte of secrets in binary files, which
+	// must keep their size and offsets
+	binaryMask = '*'
+)
+
+var (
+	// ErrLogsNotCollected is returned if the instance could not collect any
+	// logs from the volume
+	ErrLogsNotCollected = errors.New("the logs could not be collected from the volume, see the report in the downloaded logs")
+	// ErrInvalidRedactPattern is returned if a pattern to redact is not a
+	// valid regular expression
+	ErrInvalidRedactPattern = errors.New("invalid regular expression to redact")
+
+	// jwtPattern matches JWTs like launch tokens
+	jwtPattern = token.Pattern
+	// privateHostPattern matches the private DNS names of EC2 instances
+	privateHostPattern = regexp.MustCompile(`\bip-\d{1,3}-\d{1,3}-\d{1,3}-\d{1,3}(\.[a-z0-9-]+)*\.(compute|ec2)\.internal\b`)
+	// privateIPPattern matches IPv4 addresses in the private ranges of
+	// RFC 1918
+	privateIPPattern = regexp.MustCompile(`\b(10\.\d{1,3}\.\d{1,3}\.\d{1,3}|172\.(1[6-9]|2\d|3[01])\.\d{1,3}\.\d{1,3}|192\.168\.\d{1,3}\.\d{1,3})\b`)
+)
+
+// Manifest describes a log bundle, it's added to the bundle as ManifestName
+type Manifest struct {
+	SourceID         string         `json:"source_id"`
+	Region           string         `json:"region"`
+	MetavisorVersion string         `json:"metavisor_version"`
+	CLIVersion       string         `json:"cli_version"`
+	CollectedAt      string         `json:"collected_at"`
+	Redacted         bool           `json:"redacted"`
+	Redactions       int            `json:"redactions"`
+	Files            []ManifestFile `json:"files"`
+	// CollectionErrors are the errors in the report of collecting the logs
+	CollectionErrors []string `json:"collection_errors,omitempty"`
+}
+
+// ManifestFile is a file in a log bundle, as it is after redaction
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// redactor replaces secrets in logs, and counts how many it has replaced
+type redactor struct {
+	patterns []redactPattern
+	count    int
+}
+
+type redactPattern struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// newRedactor returns a redactor for tokens, private IPs and host names,
+// and the extra patterns. If redacting is disabled, nil is returned.
+func newRedactor(conf Config) (*redactor, error) {
+	if conf.NoRedact {
+		if len(conf.RedactPatterns) > 0 {
+			logging.Warning("Extra patterns to redact are ignored when not redacting logs")
+		}
+		return nil, nil
+	}
+	r := &redactor{patterns: []redactPattern{
+		{jwtPattern, redactedToken},
+		{privateHostPattern, redactedHost},
+		{privateIPPattern, redactedIP},
+	}}
+	for _, p := range conf.RedactPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			logging.Errorf("The pattern to redact %q is invalid: %s", p, err)
+			return nil, ErrInvalidRedactPattern
+		}
+		r.patterns = append(r.patterns, redactPattern{re, redacted})
+	}
+	return r, nil
+}
+
+// redact replaces the secrets in the line. In binary files, the secrets are
+// masked byte by byte instead, so that the size of the file doesn't change.
+func (r *redactor) redact(line []byte, binary bool) []byte {
+	for _, p := range r.patterns {
+		line = p.re.ReplaceAllFunc(line, func(match []byte) []byte {
+			if p.re == jwtPattern && !isJWT(match) {
+				return match
+			}
+			r.count++
+			if binary {
+				return bytes.Repeat([]byte{binaryMask}, len(match))
+			}
+			return []byte(p.replacement)
+		})
+	}
+	return line
+}
+
+// isJWT checks that the payload of the token is a JSON object, like when
+// launch tokens are validated before wrapping
+func isJWT(token []byte) bool {
+	parts := strings.Split(string(token), ".")
+	for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		data, err := enc.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		payload := make(map[string]interface{})
+		return json.Unmarshal(data, &payload) == nil
+	}
+	return false
+}
+
+// processBundle rewrites the log bundle at the path, redacting all files if
+// a redactor is given, and adds the manifest to it. Compressed logs are
+// redacted too, logs compressed with bzip2 are stored uncompressed. If the
+// logs can't be redacted, the bundle is removed rather than left unredacted.
+func processBundle(bundlePath string, r *redactor, manifest Manifest) error {
+	if r != nil {
+		logging.Info("Redacting secrets from logs...")
+	}
+	manifest.Redacted = r != nil
+	manifest.Files = []ManifestFile{}
+	manifest.CLIVersion = mv.CLIVersion
+	manifest.CollectedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := rewriteBundleFile(bundlePath, r, &manifest); err != nil {
+		if r == nil {
+			logging.Errorf("Failed to process the logs at %s", bundlePath)
+			return err
+		}
+		logging.Error("Failed to redact the logs, removing the downloaded logs")
+		if rerr := os.Remove(bundlePath); rerr != nil {
+			logging.Errorf("Could not remove the unredacted logs at %s, please remove them manually", bundlePath)
+			logging.Debugf("Got error when removing logs: %s", rerr)
+		}
+		return err
+	}
+	if r != nil {
+		logging.Infof("Redacted %d secrets from logs", r.count)
+	}
+	for _, e := range manifest.CollectionErrors {
+		logging.Warningf("Collecting logs: %s", e)
+	}
+	for _, f := range manifest.Files {
+		if strings.HasPrefix(f.Name, logsDir+"/") {
+			return nil
+		}
+	}
+	logging.Errorf("No logs were found on the volume, see %s in the downloaded logs", CollectReportName)
+	return ErrLogsNotCollected
+}
+
+// rewriteBundleFile replaces the bundle at the path with the rewritten bundle.
+// The bundle is only replaced if it could be rewritten completely.
+func rewriteBundleFile(bundlePath string, r *redactor, manifest *Manifest) error {
+	in, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(bundlePath), ".mv-logs-")
+	if err != nil {
+		logging.Error("Could not create file for the processed logs")
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	err = rewriteBundle(in, out, r, manifest)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), bundlePath)
+}
+
+func rewriteBundle(in io.Reader, out io.Writer, r *redactor, manifest *Manifest) error {
+	gzr, err := gzip.NewReader(in)
+	if err != nil {
+		logging.Debugf("Got error when decompressing bundle: %s", err)
+		return ErrInvalidBundle
+	}
+	defer gzr.Close()
+	gzw := gzip.NewWriter(out)
+	archive := tar.NewReader(gzr)
+	rewritten := tar.NewWriter(gzw)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logging.Debugf("Got error when reading bundle: %s", err)
+			return ErrInvalidBundle
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			if err = rewritten.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = rewriteFile(rewritten, hdr, archive, r, manifest); err != nil {
+			logging.Debugf("Got error when processing %s: %s", hdr.Name, err)
+			return err
+		}
+	}
+	if r != nil {
+		manifest.Redactions = r.count
+	}
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = rewritten.WriteHeader(&tar.Header{
+		Name:     "./" + ManifestName,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = rewritten.Write(data); err != nil {
+		return err
+	}
+	if err = rewritten.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// rewriteFile redacts the file to a temporary file, as the size must be
+// known before writing it to the bundle. Binary files, such as crash dumps,
+// are redacted with masks of the same length as the secrets.
+func rewriteFile(w *tar.Writer, hdr *tar.Header, content io.Reader, r *redactor, manifest *Manifest) error {
+	spool, err := ioutil.TempFile("", "mv-logs-file-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	var dst io.Writer = spool
+	var gzw *gzip.Writer
+	if r != nil {
+		switch path.Ext(hdr.Name) {
+		case ".gz":
+			gzr, err := gzip.NewReader(content)
+			if err != nil {
+				return err
+			}
+			defer gzr.Close()
+			content = gzr
+			gzw = gzip.NewWriter(spool)
+			dst = gzw
+		case ".bz2":
+			// There is no bzip2 compressor in the standard library
+			content = bzip2.NewReader(content)
+			hdr.Name = strings.TrimSuffix(hdr.Name, ".bz2")
+		}
+		buffered := bufio.NewReaderSize(content, maxLineLength)
+		sniff, _ := buffered.Peek(binarySniffLength)
+		binary := bytes.IndexByte(sniff, 0) >= 0
+		if binary {
+			logging.Debugf("Masking secrets in binary file %s", hdr.Name)
+		}
+		if err = redactStream(dst, buffered, r, binary); err != nil {
+			return err
+		}
+	} else if _, err = io.Copy(dst, content); err != nil {
+		return err
+	}
+	if gzw != nil {
+		if err = gzw.Close(); err != nil {
+			return err
+		}
+	}
+
+	hash := sha256.New()
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hdr.Size = size
+	if err = w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err = io.Copy(io.MultiWriter(w, hash), spool); err != nil {
+		return err
+	}
+	name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+	manifest.Files = append(manifest.Files, ManifestFile{
+		Name:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	})
+	if name == CollectReportName {
+		return readCollectionErrors(spool, manifest)
+	}
+	return nil
+}
+
+// readCollectionErrors adds the errors in the report of the collect script
+// to the manifest
+func readCollectionErrors(report io.ReadSeeker, manifest *Manifest) error {
+	if _, err := report.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(report)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "ERROR: ") {
+			manifest.CollectionErrors = append(manifest.CollectionErrors, strings.TrimPrefix(line, "ERROR: "))
+		}
+	}
+	return scanner.Err()
+}
+
+// redactStream redacts line by line. Lines longer than maxLineLength, which
+// are only expected in binary files like crash dumps, are redacted in parts.
+func redactStream(w io.Writer, content io.Reader, r *redactor, binary bool) error {
+	reader := bufio.NewReaderSize(content, maxLineLength)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			if _, werr := w.Write(r.redact(line, binary)); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
@@ -0,0 +1,81 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package share
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/immutable/metavisor-cli/pkg/output"
+)
+
+// KindShareLogs is the kind of LogsResult
+const KindShareLogs = "share-logs"
+
+// LogsResult is the result of getting the Metavisor logs
+type LogsResult struct {
+	// Path is where the log bundle was saved
+	Path string `json:"path" yaml:"path"`
+	// Size is the size of the log bundle in bytes
+	Size int64 `json:"size" yaml:"size"`
+	// SHA256 is the hex encoded SHA-256 hash of the log bundle
+	SHA256 string `json:"sha256" yaml:"sha256"`
+	// SourceID is the ID of the instance or snapshot logs were requested for
+	SourceID string `json:"source_id" yaml:"source_id"`
+	// SourceSnapshot is the ID of the snapshot the logs were read from. For
+	// instances it's a temporary snapshot, which is deleted when done.
+	SourceSnapshot   string `json:"source_snapshot" yaml:"source_snapshot"`
+	Region           string `json:"region" yaml:"region"`
+	MetavisorVersion string `json:"metavisor_version,omitempty" yaml:"metavisor_version,omitempty"`
+	// Duration is the number of seconds getting the logs took
+	Duration float64 `json:"duration" yaml:"duration"`
+}
+
+// Kind implements output.Result
+func (r *LogsResult) Kind() string {
+	return KindShareLogs
+}
+
+// Rows implements output.Result
+func (r *LogsResult) Rows() []output.Row {
+	return []output.Row{
+		{Name: "Path", Value: r.Path},
+		{Name: "Size", Value: strconv.FormatInt(r.Size, 10)},
+		{Name: "SHA-256", Value: r.SHA256},
+		{Name: "Source", Value: r.SourceID},
+		{Name: "Source snapshot", Value: r.SourceSnapshot},
+		{Name: "Region", Value: r.Region},
+		{Name: "Metavisor version", Value: r.MetavisorVersion},
+		{Name: "Duration", Value: output.Seconds(r.Duration)},
+	}
+}
+
+// fileDigest returns the size and hex encoded SHA-256 hash of a file
+func fileDigest(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -25,9 +25,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/immutable/metavisor-cli/pkg/csp"
 	"github.com/immutable/metavisor-cli/pkg/csp/aws"
 	"github.com/immutable/metavisor-cli/pkg/logging"
 	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/output"
 	"github.com/immutable/metavisor-cli/pkg/scp"
 )
 
@@ -36,6 +38,48 @@ const (
 	DefaultLogArchiveName = "mv-logs.tar.gz"
 )
 
+// Names and timeouts of the cleanup steps registered in transactions
+const (
+	stepDeleteKeyPair              = "delete-temporary-key-pair"
+	stepDeletePrivateKey           = "delete-temporary-private-key"
+	stepTerminateTemporaryInstance = "terminate-temporary-instance"
+	stepDeleteTemporarySnapshot    = "delete-temporary-snapshot"
+	stepDeleteLogsVolume           = "delete-temporary-logs-volume"
+
+	awsCleanupTimeout  = 5 * time.Minute
+	fileCleanupTimeout = 10 * time.Second
+
+	downloadAttempts = 60
+
+	// logsVolumeType is the type of the volume created from the snapshot
+	// with the logs
+	logsVolumeType = "gp2"
+)
+
+const opShareLogs = "share-logs"
+
+// Resources in events
+const (
+	resSource            = "source"
+	resSnapshot          = "snapshot"
+	resTemporaryInstance = "temporary-instance"
+	resLogsVolume        = "logs-volume"
+	resLogs              = "logs"
+)
+
+var (
+	// newSCPClient creates the client used to download the logs, tests
+	// replace it to not need a real instance
+	newSCPClient = scp.New
+
+	// checkBastion checks that the bastion hosts can be connected through
+	// before launching anything
+	checkBastion = scp.CheckReachable
+
+	// downloadRetryDelay is how long to wait between download attempts
+	downloadRetryDelay = 15 * time.Second
+)
+
 var (
 	// ErrFileExist is returned if specifying an output path leading to an existing file
 	ErrFileExist = errors.New("the specified output file already exist")
@@ -58,27 +102,64 @@ var (
 
 // Config can be used to specify extra parameters when sharing logs
 type Config struct {
-	LogsPath              string
-	AWSKeyName            string
-	PrivateKeyPath        string
-	BastionHost           string
+	LogsPath       string
+	AWSKeyName     string
+	PrivateKeyPath string
+	// BastionHosts are the hosts to connect to the temporary instance
+	// through, in the order they are connected to. Every host is on the
+	// form [user@]host[:port]. With bastion hosts, the temporary instance
+	// is launched without a public IP.
+	BastionHosts []string
+	// BastionUsername is the username of the bastion hosts that don't
+	// specify one
 	BastionUsername       string
 	BastionPrivateKeyPath string
 	IAMRoleARN            string
 	IAMDeviceARN          string
 	IAMCode               string
 	SubnetID              string
+	// Transport is how the logs are retrieved from the temporary instance,
+	// TransportSSH if empty. Only TransportSSH needs a key pair and a
+	// public IP (or bastion hosts).
+	Transport string
+	// S3Bucket is the bucket logs are uploaded to, required for TransportS3
+	// and optional for TransportSSM
+	S3Bucket string
+	// InstanceProfile is the IAM instance profile of the temporary instance,
+	// required for TransportSSM
+	InstanceProfile string
+	// NoRedact keeps tokens, private IPs and host names in the logs
+	NoRedact bool
+	// RedactPatterns are regular expressions of more secrets to redact
+	RedactPatterns []string
 }
 
 // LogsAWS will get the MV logs of an instance or snapshot in AWS and return
-// the path to the resuling log archive.
-func LogsAWS(ctx context.Context, region, id string, conf Config) (string, error) {
-	logging.Info("Getting metavisor logs...")
-	res := make(chan mv.MaybeString, 1)
+// the path to the resuling log archive. All temporary resources are removed
+// by final steps registered in the given transaction, which is finished before
+// returning. If the transaction is nil, a new one is used.
+func LogsAWS(ctx context.Context, tx *mv.Transaction, region, id string, conf Config) (*LogsResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Operation: opShareLogs})
+	ctx = logging.NewContext(ctx, log)
+	log.Info("Getting metavisor logs...")
+	start := time.Now()
+	res := make(chan maybeLogs, 1)
+	if tx == nil {
+		tx = mv.NewTransaction(fmt.Sprintf("%s %s", opShareLogs, id))
+	}
 
 	go func() {
-		out, err := awsShareLogs(ctx, region, id, conf)
-		res <- mv.MaybeString{
+		service, err := aws.New(region, &aws.IAMConfig{
+			RoleARN:      conf.IAMRoleARN,
+			MFADeviceARN: conf.IAMDeviceARN,
+			MFACode:      conf.IAMCode,
+		})
+		if err != nil {
+			res <- maybeLogs{Error: err}
+			return
+		}
+		out, err := awsShareLogs(ctx, tx, service, region, id, conf)
+		res <- maybeLogs{
 			Result: out,
 			Error:  err,
 		}
@@ -86,211 +167,484 @@ func LogsAWS(ctx context.Context, region, id string, conf Config) (string, error
 	select {
 	case <-ctx.Done():
 		// Context was cancelled, cleanup
-		mv.Cleanup(false)
-		return "", mv.ErrInterrupted
+		tx.Finish(false)
+		return nil, mv.ErrInterrupted
 	case r := <-res:
-		mv.Cleanup(r.Error == nil)
+		tx.Finish(r.Error == nil)
+		if r.Result != nil {
+			r.Result.Duration = output.Since(start)
+		}
 		return r.Result, r.Error
 	}
 }
 
+// maybeLogs is the result of getting logs, for use with result channels
+type maybeLogs struct {
+	Result *LogsResult
+	Error  error
+}
+
 // TODO: Refactor this huge function...
-func awsShareLogs(ctx context.Context, region, id string, conf Config) (string, error) {
+func awsShareLogs(ctx context.Context, tx *mv.Transaction, awsSvc aws.Service, region, id string, conf Config) (*LogsResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Region: region, Resources: map[string]string{resSource: id}})
+	ctx = logging.NewContext(ctx, log)
 	if !aws.IsInstanceID(id) && !aws.IsSnapshotID(id) {
-		return "", aws.ErrInvalidID
+		return nil, aws.ErrInvalidID
 	}
 	if conf.SubnetID != "" && !aws.IsSubnetID(conf.SubnetID) {
 		// User specified an invalid subnet ID
-		logging.Error("The specified Subnet ID is not a valid subnet ID")
-		return "", aws.ErrInvalidSubnetID
+		log.Error("The specified Subnet ID is not a valid subnet ID")
+		return nil, aws.ErrInvalidSubnetID
 	}
 	path, err := parseOutPath(conf.LogsPath)
 	if err != nil {
-		return path, err
+		return nil, err
+	}
+	if err = checkTransport(conf); err != nil {
+		return nil, err
+	}
+	redactor, err := newRedactor(conf)
+	if err != nil {
+		return nil, err
+	}
+	useSSH := conf.Transport == "" || conf.Transport == TransportSSH
+	var bastion *scp.Proxy
+	if useSSH {
+		conf, bastion, err = awsPrepareSSH(ctx, tx, awsSvc, conf)
+		if err != nil {
+			return nil, err
+		}
 	}
-	awsSvc, err := aws.New(region, &aws.IAMConfig{
+	iamConf := &aws.IAMConfig{
 		RoleARN:      conf.IAMRoleARN,
 		MFADeviceARN: conf.IAMDeviceARN,
 		MFACode:      conf.IAMCode,
-	})
-	if err != nil {
-		return "", err
 	}
-	var keyExist bool
-	if conf.AWSKeyName != "" {
-		keyExist, err = awsSvc.KeyPairExist(ctx, conf.AWSKeyName)
+	var bucket aws.Bucket
+	if !useSSH && conf.S3Bucket != "" {
+		bucket, err = newBucket(region, conf.S3Bucket, iamConf)
 		if err != nil {
-			if err == aws.ErrNotAllowed {
-				// Not allowed to check if key exist, assume it's correct and continue
-				logging.Warning("Not allowed to check if key exists in AWS, assuming it does...")
-				keyExist = true
-			} else {
-				return "", err
-			}
-		}
-		if !keyExist {
-			logging.Errorf("The specified key \"%s\" does not exist in AWS", conf.AWSKeyName)
-			return "", ErrNoAWSKey
+			return nil, err
 		}
 	}
-
-	if conf.PrivateKeyPath != "" {
-		path = filepath.FromSlash(path)
-		if _, err := os.Stat(filepath.FromSlash(conf.PrivateKeyPath)); os.IsNotExist(err) {
-			logging.Error("The specified private key file could not be found")
-			return "", ErrNoPrivateKey
+	var runner aws.CommandRunner
+	if conf.Transport == TransportSSM {
+		runner, err = newCommandRunner(region, iamConf)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	if !keyExist {
-		// Create a temporary key to be used
-		logging.Info("Creating a new temporary key pair in AWS")
-		rand.Seed(time.Now().Unix())
-		randomName := fmt.Sprintf("MetavisorTemporaryKey-%d", rand.Int())
-		logging.Debugf("Creating temporray key pair with name: %s", randomName)
-		conf.AWSKeyName = randomName
-		keyContent, err := awsSvc.CreateKeyPair(ctx, randomName)
-		if err != nil {
-			if err == aws.ErrNotAllowed {
-				// The use does not have IAM permission to create key pair, tell
-				// the user to specify a key with --key
-				logging.Error("Not enough IAM permissions to create a new key pair")
-				logging.Error("Please specify an existing key with the --key flag instead")
-				return "", err
-			}
-			return "", err
-		}
-		mv.QueueCleanup(func() {
-			logging.Info("Deleting temporary AWS key pair")
-			err := awsSvc.RemoveKeyPair(context.Background(), randomName)
-			if err != nil {
-				logging.Errorf("Failed to clean up key pair in AWS: %s", randomName)
-				logging.Debugf("Error when deleting key pair in AWS: %s", err)
-			}
-		}, false)
-		p, err := writeToTempFile(keyContent)
-		conf.PrivateKeyPath = p
-		mv.QueueCleanup(func() {
-			logging.Infof("Deleting temporary private key")
-			err := os.Remove(p)
-			if err != nil {
-				logging.Errorf("Failed to clean up private key: %s", p)
-				logging.Debugf("Could not delete file: %s", err)
-			}
-		}, false)
+	provider := aws.NewProvider(awsSvc, region)
+	snap, version, err := snapFromID(ctx, tx, provider, id, aws.IsInstanceID(id))
+	if err != nil {
+		return nil, err
 	}
+	log.Debugf("Getting logs from snapshot: %s", snap.ID())
 
-	snap, err := awsSnapFromID(ctx, id, awsSvc)
+	// The volume with the logs is created before launching the instance,
+	// so that its ID can be given to the script collecting the logs
+	zone, volumeID, err := awsCreateLogsVolume(ctx, awsSvc, region, conf.SubnetID, snap)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	attached := false
+	tx.Finally(stepDeleteLogsVolume, awsCleanupTimeout, func(ctx context.Context) error {
+		log := log.With(logging.Fields{Step: stepDeleteLogsVolume})
+		if attached {
+			// Deleted when the instance is terminated
+			return nil
+		}
+		log.Info("Removing temporary volume with logs")
+		err := awsSvc.DeleteVolume(ctx, volumeID)
+		if err != nil {
+			log.Errorf("Failed to delete volume %s", volumeID)
+			log.Debugf("Got error when deleting volume: %s", err)
+			return err
+		}
+		log.EmitStep(logging.EventVolumeDeleted, stepDeleteLogsVolume, map[string]string{
+			resLogsVolume: volumeID,
+		})
+		return nil
+	})
+	if err = awsSvc.AwaitVolumeAvailable(ctx, volumeID); err != nil {
+		log.Error("Volume with logs never became available")
+		return nil, err
 	}
-	logging.Debugf("Getting logs from snapshot: %s", snap.ID())
 
 	// Launch a temporary instance
 	_, logsFile := filepath.Split(path)
-	userdata := awsCreateUserData(logsFile)
-	device := aws.NewDevice{
-		DeviceName: "/dev/sdg",
-		SnapshotID: snap.ID(),
+	var uploadKey, uploadURL string
+	if conf.Transport == TransportS3 {
+		uploadKey, uploadURL, err = presignUpload(tx, bucket, logsFile)
+		if err != nil {
+			return nil, err
+		}
 	}
-	logging.Info("Launching a temporary instance to get logs...")
+	userdata := ""
+	if conf.Transport != TransportSSM {
+		// With SSM, the logs are collected with Run Command once the
+		// volume is attached
+		userdata = awsCreateUserData(logsFile, volumeID, uploadURL)
+	}
+	log.Info("Launching a temporary instance to get logs...")
 	ami := aws.GenericAMI(region)
 	if ami == "" {
-		return "", aws.ErrNoAMIInRegion
+		return nil, aws.ErrNoAMIInRegion
 	}
 	instanceName := "Temporary-share-logs-instance"
 	instanceTags := map[string]string{
 		"Name": instanceName,
 	}
-	instance, err := awsSvc.LaunchInstance(ctx, ami, aws.SmallInstanceType, userdata, conf.AWSKeyName, conf.SubnetID, instanceTags, device)
+	instance, err := provider.LaunchInstance(ctx, csp.LaunchConfig{
+		Image:        ami,
+		InstanceType: aws.SmallInstanceType,
+		Userdata:     userdata,
+		KeyName:      conf.AWSKeyName,
+		SubnetID:     conf.SubnetID,
+		Zone:         zone,
+		// Only SSH without bastion hosts needs a public IP
+		NoPublicIP:      bastion != nil || !useSSH,
+		InstanceProfile: conf.InstanceProfile,
+		Tags:            instanceTags,
+	})
 	if err != nil {
 		switch err {
 		case aws.ErrNotAllowed:
-			logging.Error("Not enough IAM permissions to launch an instance")
+			log.Error("Not enough IAM permissions to launch an instance")
 			break
 		case aws.ErrRequiresSubnet:
-			logging.Error("A subnet ID must be specified in order to launch instance")
-			logging.Error("Please specify subnet ID with the --subnet-id flag")
+			log.Error("A subnet ID must be specified in order to launch instance")
+			log.Error("Please specify subnet ID with the --subnet-id flag")
 			break
 		case aws.ErrKeyNonExisting:
-			logging.Errorf("The key pair '%s' does not exist in AWS", conf.AWSKeyName)
+			log.Errorf("The key pair '%s' does not exist in AWS", conf.AWSKeyName)
 			break
 		case aws.ErrNoAMIInRegion:
-			logging.Error("There is no AMI available in the specified region")
+			log.Error("There is no AMI available in the specified region")
 			break
 		case aws.ErrFailedLaunchingInstance:
-			logging.Error("Failed launching temporary instance")
+			log.Error("Failed launching temporary instance")
 			break
 		}
-		return "", err
+		return nil, err
 	}
-	mv.QueueCleanup(func() {
-		logging.Infof("Terminating temporary instance %s", instance.ID())
-		err := awsSvc.TerminateInstance(context.Background(), instance.ID())
+	instanceID := instance.ID()
+	tx.Finally(stepTerminateTemporaryInstance, awsCleanupTimeout, func(ctx context.Context) error {
+		log := log.With(logging.Fields{Step: stepTerminateTemporaryInstance})
+		log.Infof("Terminating temporary instance %s", instanceID)
+		err := provider.TerminateInstance(ctx, instanceID)
 		if err != nil {
-			logging.Errorf("Failed to cleanup instance: %s", instance.ID())
-			logging.Debugf("Got error when terminating instance: %s", err)
+			log.Errorf("Failed to cleanup instance: %s", instanceID)
+			log.Debugf("Got error when terminating instance: %s", err)
+			return err
 		}
-	}, false)
-	logging.Infof("Launched instance with ID: %s", instance.ID())
+		log.EmitStep(logging.EventInstanceTerminated, stepTerminateTemporaryInstance, map[string]string{
+			resTemporaryInstance: instanceID,
+		})
+		return nil
+	})
+	log.Infof("Launched instance with ID: %s", instance.ID())
+	log.EmitStep(logging.EventInstanceLaunched, "", map[string]string{
+		resTemporaryInstance: instanceID,
+		resSnapshot:          snap.ID(),
+	})
 
 	// Instance launched, now wait for it to become ready
-	err = awsSvc.AwaitInstanceRunning(ctx, instance.ID())
+	err = provider.AwaitInstanceRunning(ctx, instance.ID())
 	if err != nil {
 		// Instance never became ready
 		if err == aws.ErrNotAllowed {
-			logging.Error("Not enough IAM permissions to see instance status")
+			log.Error("Not enough IAM permissions to see instance status")
 		} else {
-			logging.Error("Instance never got ready")
+			log.Error("Instance never got ready")
 		}
-		return "", err
+		return nil, err
+	}
+	if err = awsAttachLogsVolume(ctx, awsSvc, region, instanceID, volumeID); err != nil {
+		return nil, err
+	}
+	attached = true
+	switch conf.Transport {
+	case TransportS3:
+		path, err = downloadUploadedLogs(ctx, bucket, uploadKey, path)
+	case TransportSSM:
+		path, err = ssmGetLogs(ctx, tx, runner, bucket, instanceID, volumeID, logsFile, path)
+	default:
+		path, err = sshGetLogs(ctx, provider, instance, bastion, conf.PrivateKeyPath, logsFile, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = processBundle(path, redactor, Manifest{
+		SourceID:         id,
+		Region:           region,
+		MetavisorVersion: version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.EmitStep(logging.EventLogsSaved, "", map[string]string{
+		resSource: id,
+		resLogs:   path,
+	})
+	res := &LogsResult{
+		Path:             path,
+		SourceID:         id,
+		SourceSnapshot:   snap.ID(),
+		Region:           region,
+		MetavisorVersion: version,
+	}
+	if res.Size, res.SHA256, err = fileDigest(path); err != nil {
+		log.Errorf("Could not read the logs saved to %s", path)
+		return nil, err
+	}
+	return res, nil
+}
+
+// awsCreateLogsVolume creates a volume from the snapshot with the logs in the
+// zone the temporary instance will be launched in, and returns the zone and
+// the ID of the volume
+func awsCreateLogsVolume(ctx context.Context, awsSvc aws.Service, region, subnetID string, snap csp.Snapshot) (string, string, error) {
+	log := logging.FromContext(ctx)
+	zone, err := awsSvc.GetLaunchZone(ctx, subnetID)
+	if err != nil {
+		switch err {
+		case aws.ErrNotAllowed:
+			log.Error("Not enough IAM permissions to find the availability zone to launch in")
+		case aws.ErrInvalidSubnetID:
+			log.Errorf("The subnet '%s' does not exist", subnetID)
+		case aws.ErrRequiresSubnet:
+			log.Error("Please specify subnet ID with the --subnet-id flag")
+		}
+		return "", "", err
+	}
+	log.Infof("Creating a temporary volume with logs in %s", zone)
+	vol, err := awsSvc.CreateVolume(ctx, snap.ID(), logsVolumeType, zone, snap.SizeGB())
+	if err != nil {
+		log.Errorf("Failed to create volume from snapshot %s", snap.ID())
+		return "", "", err
 	}
-	if instance.PublicIP() == "" {
-		logging.Info("Waiting for public IP to become available...")
-		newInstance, err := awsAwaitPublicIP(ctx, instance.ID(), awsSvc)
+	log.EmitStep(logging.EventVolumeCreated, "", map[string]string{
+		resSnapshot:   snap.ID(),
+		resLogsVolume: vol.ID(),
+	})
+	return zone, vol.ID(), nil
+}
+
+// awsAttachLogsVolume attaches the volume with the logs to the temporary
+// instance, and makes sure it's deleted when the instance is terminated
+func awsAttachLogsVolume(ctx context.Context, awsSvc aws.Service, region, instanceID, volumeID string) error {
+	log := logging.FromContext(ctx)
+	err := awsSvc.AttachVolume(ctx, volumeID, instanceID, logsDeviceName)
+	if err != nil {
+		log.Errorf("Failed to attach volume %s to instance %s", volumeID, instanceID)
+		return err
+	}
+	if err = awsSvc.DeleteInstanceDevicesOnTermination(ctx, instanceID); err != nil {
+		log.Errorf("Failed to make volume %s delete on termination", volumeID)
+		return err
+	}
+	log.EmitStep(logging.EventVolumeAttached, "", map[string]string{
+		resTemporaryInstance: instanceID,
+		resLogsVolume:        volumeID,
+	})
+	return nil
+}
+
+// sshGetLogs downloads the logs from the instance with SFTP, through the
+// bastion hosts if any
+func sshGetLogs(ctx context.Context, provider csp.Provider, instance csp.Instance, bastion *scp.Proxy, keyPath, logsFile, path string) (string, error) {
+	log := logging.FromContext(ctx)
+	var err error
+	host := instance.PublicIP()
+	if bastion != nil {
+		// The instance is only reachable through the bastion
+		host = instance.PrivateIP()
+		if host == "" {
+			if instance, err = provider.GetInstance(ctx, instance.ID()); err != nil {
+				return "", err
+			}
+			host = instance.PrivateIP()
+		}
+		log.Debugf("Connecting to private IP %s through bastion %s", host, bastion.Host)
+	} else if host == "" {
+		log.Info("Waiting for public IP to become available...")
+		newInstance, err := awaitPublicIP(ctx, provider, instance.ID())
 		if err != nil {
 			// Instance has no public IP, can't continue...
-			logging.Debugf("Instance never got a public IP: %v", err)
-			logging.Error("Temporary instance doesn't have a public IP, check your subnet/VPC")
+			log.Debugf("Instance never got a public IP: %v", err)
+			log.Error("Temporary instance doesn't have a public IP, check your subnet/VPC")
+			log.Error("Use --bastion-host to connect through a bastion host instead")
 			return "", err
 		}
-		instance = newInstance
+		host = newInstance.PublicIP()
 	}
 
 	scpConfig := scp.Config{
 		Username: "ec2-user",
-		Host:     instance.PublicIP(),
-		Key:      conf.PrivateKeyPath,
-	}
-	// TODO: Bastion support not implemented yet
-	if conf.BastionHost != "" || conf.BastionPrivateKeyPath != "" || conf.BastionUsername != "" {
-		scpProxy := &scp.Proxy{
-			Username: conf.BastionUsername,
-			Host:     conf.BastionHost,
-			Key:      conf.BastionPrivateKeyPath,
-		}
-		scpConfig.Proxy = scpProxy
+		Host:     host,
+		Key:      keyPath,
+		Proxy:    bastion,
 	}
-	scpClient, err := scp.New(scpConfig)
+	scpClient, err := newSCPClient(scpConfig)
 	if err != nil {
 		// Bad config, should not happen...
-		logging.Error("Failed to create SCP client with the specified config")
+		log.Error("Failed to create SCP client with the specified config")
 		return "", err
 	}
 
-	logging.Info("Downloading logs from temporary instance...")
-	for try := 1; try <= 60; try++ {
+	log.Info("Downloading logs from temporary instance...")
+	for try := 1; try <= downloadAttempts; try++ {
 		err = scpClient.DownloadFile(fmt.Sprintf("/tmp/%s", logsFile), path)
 		if err != nil {
-			logging.Warningf("Attempt %d: Instance refused connection, trying again...", try)
-			time.Sleep(15 * time.Second)
+			switch err {
+			case scp.ErrFileNotFound:
+				log.Warningf("Attempt %d: Logs are not ready yet, trying again...", try)
+			case scp.ErrAuthFailed:
+				// The key is installed by cloud-init, which may not have run yet
+				log.Warningf("Attempt %d: Instance rejected key, trying again...", try)
+			default:
+				log.Warningf("Attempt %d: Instance refused connection, trying again...", try)
+			}
+			log.Debugf("Got error when downloading logs: %s", err)
+			time.Sleep(downloadRetryDelay)
 			continue
 		}
-		logging.Info("Successfully downloaded logs")
+		log.Info("Successfully downloaded logs")
 
 		return path, nil
 	}
-	return "", errors.New("Timed out while waiting for logs to download")
+	return "", ErrLogTimeout
+}
+
+// awsPrepareSSH checks or creates the key pair and bastion hosts used to
+// download logs with SSH, and returns the config with the key pair to use
+func awsPrepareSSH(ctx context.Context, tx *mv.Transaction, awsSvc aws.Service, conf Config) (Config, *scp.Proxy, error) {
+	log := logging.FromContext(ctx)
+	var err error
+	var keyExist bool
+	if conf.AWSKeyName != "" {
+		keyExist, err = awsSvc.KeyPairExist(ctx, conf.AWSKeyName)
+		if err != nil {
+			if err == aws.ErrNotAllowed {
+				// Not allowed to check if key exist, assume it's correct and continue
+				log.Warning("Not allowed to check if key exists in AWS, assuming it does...")
+				keyExist = true
+			} else {
+				return conf, nil, err
+			}
+		}
+		if !keyExist {
+			log.Errorf("The specified key \"%s\" does not exist in AWS", conf.AWSKeyName)
+			return conf, nil, ErrNoAWSKey
+		}
+	}
+
+	if conf.PrivateKeyPath != "" {
+		if _, err := os.Stat(filepath.FromSlash(conf.PrivateKeyPath)); os.IsNotExist(err) {
+			log.Error("The specified private key file could not be found")
+			return conf, nil, ErrNoPrivateKey
+		}
+	}
+	bastion, err := bastionProxy(conf)
+	if err != nil {
+		return conf, nil, err
+	}
+
+	if !keyExist {
+		// Create a temporary key to be used
+		log.Info("Creating a new temporary key pair in AWS")
+		rand.Seed(time.Now().Unix())
+		randomName := fmt.Sprintf("MetavisorTemporaryKey-%d", rand.Int())
+		log.Debugf("Creating temporray key pair with name: %s", randomName)
+		conf.AWSKeyName = randomName
+		keyContent, err := awsSvc.CreateKeyPair(ctx, randomName)
+		if err != nil {
+			if err == aws.ErrNotAllowed {
+				// The use does not have IAM permission to create key pair, tell
+				// the user to specify a key with --key
+				log.Error("Not enough IAM permissions to create a new key pair")
+				log.Error("Please specify an existing key with the --key flag instead")
+				return conf, nil, err
+			}
+			return conf, nil, err
+		}
+		tx.Finally(stepDeleteKeyPair, awsCleanupTimeout, func(ctx context.Context) error {
+			log := log.With(logging.Fields{Step: stepDeleteKeyPair})
+			log.Info("Deleting temporary AWS key pair")
+			err := awsSvc.RemoveKeyPair(ctx, randomName)
+			if err != nil {
+				log.Errorf("Failed to clean up key pair in AWS: %s", randomName)
+				log.Debugf("Error when deleting key pair in AWS: %s", err)
+			}
+			return err
+		})
+		p, err := writeToTempFile(keyContent)
+		conf.PrivateKeyPath = p
+		tx.Finally(stepDeletePrivateKey, fileCleanupTimeout, func(ctx context.Context) error {
+			log := log.With(logging.Fields{Step: stepDeletePrivateKey})
+			log.Infof("Deleting temporary private key")
+			err := os.Remove(p)
+			if err != nil {
+				log.Errorf("Failed to clean up private key: %s", p)
+				log.Debugf("Could not delete file: %s", err)
+			}
+			return err
+		})
+	}
+	return conf, bastion, nil
+}
+
+// bastionProxy returns the bastion hosts as a proxy, after checking that
+// they can be reached. If no bastion host is specified, nil is returned.
+func bastionProxy(conf Config) (*scp.Proxy, error) {
+	if len(conf.BastionHosts) == 0 {
+		if conf.BastionUsername != "" || conf.BastionPrivateKeyPath != "" {
+			logging.Error("A bastion host must be specified to use a bastion user or key")
+			return nil, scp.ErrNoProxyHost
+		}
+		return nil, nil
+	}
+	if conf.BastionPrivateKeyPath != "" {
+		if _, err := os.Stat(filepath.FromSlash(conf.BastionPrivateKeyPath)); os.IsNotExist(err) {
+			logging.Error("The specified bastion private key file could not be found")
+			return nil, ErrNoPrivateKey
+		}
+	}
+	proxy, err := scp.ParseProxyJump(conf.BastionHosts, conf.BastionPrivateKeyPath)
+	if err != nil {
+		logging.Error("The bastion hosts must be on the form [user@]host[:port]")
+		return nil, err
+	}
+	for _, hop := range proxy.Hops() {
+		if hop.Username == "" {
+			hop.Username = conf.BastionUsername
+		}
+		if hop.Username == "" {
+			hop.Username = "ec2-user"
+		}
+	}
+	logging.Info("Checking that the bastion host can be reached...")
+	err = checkBastion(scp.Config{
+		Username: proxy.Username,
+		Host:     proxy.Host,
+		Port:     proxy.Port,
+		Key:      proxy.Key,
+		Proxy:    proxy.Proxy,
+	})
+	if err != nil {
+		switch err {
+		case scp.ErrAuthFailed:
+			logging.Error("The bastion host rejected the key, check --bastion-user and --bastion-key-path")
+		case scp.ErrConnectionRefused, scp.ErrConnectionTimeout:
+			logging.Error("Could not connect to the bastion host, check --bastion-host")
+		default:
+			logging.Error("Could not connect through the bastion host")
+		}
+		return nil, err
+	}
+	return proxy, nil
 }
 
 // This function will construct a valid output path based on what the
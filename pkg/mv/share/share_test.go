@@ -0,0 +1,521 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package share
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/csp/aws/fake"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/scp"
+)
+
+const testRegion = "us-west-2"
+
+// testClient writes a bundle with the path of the downloaded file as log,
+// unless failing
+type testClient struct {
+	conf scp.Config
+	fail bool
+}
+
+func (c *testClient) DownloadFile(remoteSource, localDestination string) error {
+	if c.fail {
+		return errors.New("connection refused")
+	}
+	bundle := testBundle(map[string][]byte{"./log/messages": []byte(remoteSource + "\n")})
+	return ioutil.WriteFile(localDestination, bundle, 0600)
+}
+
+func withTestClient(fail bool) (*testClient, func()) {
+	client := &testClient{fail: fail}
+	origClient, origDelay := newSCPClient, downloadRetryDelay
+	newSCPClient = func(conf scp.Config) (scp.SCPClient, error) {
+		client.conf = conf
+		return client, nil
+	}
+	downloadRetryDelay = 0
+	return client, func() {
+		newSCPClient, downloadRetryDelay = origClient, origDelay
+	}
+}
+
+// readBundle returns the files in the bundle, and its manifest
+func readBundle(t *testing.T, path string) (map[string][]byte, Manifest) {
+	files := make(map[string][]byte)
+	var manifest Manifest
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Expected logs to be downloaded, got %s", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Expected logs to be a gzipped tarball, got %s", err)
+	}
+	archive := tar.NewReader(gz)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Got unexpected error when reading logs: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[strings.TrimPrefix(hdr.Name, "./")] = data
+	}
+	if err = json.Unmarshal(files[ManifestName], &manifest); err != nil {
+		t.Errorf("Expected manifest in logs, got %s", err)
+	}
+	return files, manifest
+}
+
+func tempLogsPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "share-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "logs.tar.gz"), func() { os.RemoveAll(dir) }
+}
+
+func TestAWSShareLogs(t *testing.T) {
+	client, restore := withTestClient(false)
+	defer restore()
+	path, done := tempLogsPath(t)
+	defer done()
+	ec2 := fake.New(testRegion)
+	id := ec2.AddInstance(ec2.AddImage("wrapped", 8, nil), nil)
+	before := ec2.Resources()
+	tx := mv.NewTransaction("test")
+
+	out, err := awsShareLogs(context.Background(), tx, ec2, testRegion, id, Config{LogsPath: path})
+	launched := launchedInstance(ec2, id)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when sharing logs: %s", err)
+	}
+	if volumeID := launched.Devices[logsDeviceName]; volumeID == "" || !strings.Contains(launched.Userdata, `volume_id="`+volumeID+`"`) {
+		t.Errorf("Expected logs to be collected from volume %s, got userdata:\n%s", volumeID, launched.Userdata)
+	}
+	if out.Path != path || out.SourceID != id || out.SourceSnapshot == "" || out.Region != testRegion {
+		t.Errorf("Got unexpected result: %+v", out)
+	}
+	if size, hash, err := fileDigest(path); err != nil || out.Size != size || out.SHA256 != hash || size == 0 {
+		t.Errorf("Expected size %d and hash %s of logs in result, got %+v", size, hash, out)
+	}
+	files, manifest := readBundle(t, path)
+	if string(files["log/messages"]) != "/tmp/logs.tar.gz\n" {
+		t.Errorf("Expected logs to be downloaded, got %q", files["log/messages"])
+	}
+	if manifest.SourceID != id || manifest.Region != testRegion || !manifest.Redacted || len(manifest.Files) != 1 {
+		t.Errorf("Got unexpected manifest: %+v", manifest)
+	}
+	if client.conf.Host == "" {
+		t.Error("Expected logs to be downloaded from the public IP of the instance")
+	}
+	if _, err := os.Stat(client.conf.Key); !os.IsNotExist(err) {
+		t.Errorf("Expected temporary private key to be deleted, got %v", err)
+	}
+	after := ec2.Resources()
+	if len(after.Instances) != len(before.Instances) || len(after.Volumes) != len(before.Volumes) ||
+		len(after.Snapshots) != len(before.Snapshots) || len(after.KeyPairs) != 0 {
+		t.Errorf("Expected temporary resources to be removed, got %v", after)
+	}
+}
+
+func TestAWSShareLogsDownloadFails(t *testing.T) {
+	_, restore := withTestClient(true)
+	defer restore()
+	path, done := tempLogsPath(t)
+	defer done()
+	ec2 := fake.New(testRegion)
+	id := ec2.AddInstance(ec2.AddImage("wrapped", 8, nil), nil)
+	before := ec2.Resources()
+	tx := mv.NewTransaction("test")
+
+	_, err := awsShareLogs(context.Background(), tx, ec2, testRegion, id, Config{LogsPath: path})
+	tx.Finish(err == nil)
+	if err != ErrLogTimeout {
+		t.Fatalf("Expected ErrLogTimeout, got: %v", err)
+	}
+	if failed := tx.Result().Failed(); len(failed) > 0 {
+		t.Errorf("Got unexpected failed cleanup steps: %v", failed)
+	}
+	after := ec2.Resources()
+	if len(after.Instances) != len(before.Instances) || len(after.Volumes) != len(before.Volumes) ||
+		len(after.Snapshots) != len(before.Snapshots) || len(after.KeyPairs) != 0 {
+		t.Errorf("Expected temporary resources to be removed, got %v", after)
+	}
+}
+
+func TestAWSShareLogsLaunchFails(t *testing.T) {
+	path, done := tempLogsPath(t)
+	defer done()
+	ec2 := fake.New(testRegion)
+	id := ec2.AddInstance(ec2.AddImage("wrapped", 8, nil), nil)
+	before := ec2.Resources()
+	ec2.FailNext("RunInstances", aws.ErrFailedLaunchingInstance)
+	tx := mv.NewTransaction("test")
+
+	_, err := awsShareLogs(context.Background(), tx, ec2, testRegion, id, Config{LogsPath: path})
+	tx.Finish(err == nil)
+	if err != aws.ErrFailedLaunchingInstance {
+		t.Fatalf("Expected ErrFailedLaunchingInstance, got: %v", err)
+	}
+	if failed := tx.Result().Failed(); len(failed) > 0 {
+		t.Errorf("Got unexpected failed cleanup steps: %v", failed)
+	}
+	after := ec2.Resources()
+	if len(after.Volumes) != len(before.Volumes) || len(after.Snapshots) != len(before.Snapshots) {
+		t.Errorf("Expected the volume with logs to be removed, got %v", after)
+	}
+}
+
+func TestAWSShareLogsKeyPairDenied(t *testing.T) {
+	_, restore := withTestClient(false)
+	defer restore()
+	path, done := tempLogsPath(t)
+	defer done()
+	ec2 := fake.New(testRegion)
+	id := ec2.AddInstance(ec2.AddImage("wrapped", 8, nil), nil)
+	ec2.Deny("CreateKeyPair")
+	tx := mv.NewTransaction("test")
+
+	_, err := awsShareLogs(context.Background(), tx, ec2, testRegion, id, Config{LogsPath: path})
+	tx.Finish(err == nil)
+	if err == nil {
+		t.Fatal("Expected error when not allowed to create key pair")
+	}
+	if n := ec2.Calls("CreateSnapshot"); n != 0 {
+		t.Errorf("Expected no snapshot to be created, got %d calls", n)
+	}
+}
+
+func withBastionCheck(err error) (*scp.Config, func()) {
+	checked := &scp.Config{}
+	orig := checkBastion
+	checkBastion = func(conf scp.Config) error {
+		*checked = conf
+		return err
+	}
+	return checked, func() { checkBastion = orig }
+}
+
+func TestAWSShareLogsBastion(t *testing.T) {
+	client, restore := withTestClient(false)
+	defer restore()
+	checked, restoreCheck := withBastionCheck(nil)
+	defer restoreCheck()
+	path, done := tempLogsPath(t)
+	defer done()
+	ec2 := fake.New(testRegion)
+	id := ec2.AddInstance(ec2.AddImage("wrapped", 8, nil), nil)
+	tx := mv.NewTransaction("test")
+	conf := Config{
+		LogsPath:        path,
+		BastionHosts:    []string{"jump@203.0.113.10", "10.0.0.5:2222"},
+		BastionUsername: "admin",
+	}
+
+	_, err := awsShareLogs(context.Background(), tx, ec2, testRegion, id, conf)
+	// The temporary instance is still there until the transaction finishes
+	var launched *fake.Instance
+	for _, instID := range ec2.Resources().Instances {
+		if instID != id {
+			launched = ec2.Instance(instID)
+		}
+	}
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when sharing logs through bastion: %s", err)
+	}
+	if checked.Host != "10.0.0.5" || checked.Port != 2222 || checked.Username != "admin" {
+		t.Errorf("Expected last bastion to be checked, got %+v", checked)
+	}
+	proxy := client.conf.Proxy
+	if proxy == nil || proxy.Host != "10.0.0.5" || proxy.Proxy == nil || proxy.Proxy.Host != "203.0.113.10" || proxy.Proxy.Username != "jump" {
+		t.Fatalf("Expected logs to be downloaded through both bastions, got %+v", proxy)
+	}
+	if launched == nil || !launched.NoPublicIP {
+		t.Fatalf("Expected temporary instance to be launched without public IP, got %+v", launched)
+	}
+	if client.conf.Host != launched.PrivateIP {
+		t.Errorf("Expected logs to be downloaded from private IP %s, got %s", launched.PrivateIP, client.conf.Host)
+	}
+}
+
+func TestAWSShareLogsBastionUnreachable(t *testing.T) {
+	_, restore := withTestClient(false)
+	defer restore()
+	_, restoreCheck := withBastionCheck(scp.ErrConnectionRefused)
+	defer restoreCheck()
+	path, done := tempLogsPath(t)
+	defer done()
+	ec2 := fake.New(testRegion)
+	id := ec2.AddInstance(ec2.AddImage("wrapped", 8, nil), nil)
+	tx := mv.NewTransaction("test")
+
+	_, err := awsShareLogs(context.Background(), tx, ec2, testRegion, id, Config{LogsPath: path, BastionHosts: []string{"bastion"}})
+	tx.Finish(err == nil)
+	if err != scp.ErrConnectionRefused {
+		t.Fatalf("Expected ErrConnectionRefused, got: %v", err)
+	}
+	for _, action := range []string{"CreateKeyPair", "CreateSnapshot", "RunInstances"} {
+		if n := ec2.Calls(action); n != 0 {
+			t.Errorf("Expected nothing to be created before checking bastion, got %d %s calls", n, action)
+		}
+	}
+	_, err = awsShareLogs(context.Background(), mv.NewTransaction("test"), ec2, testRegion, id, Config{LogsPath: path, BastionUsername: "admin"})
+	if err != scp.ErrNoProxyHost {
+		t.Errorf("Expected ErrNoProxyHost without bastion host, got: %v", err)
+	}
+}
+
+// withTransport replaces the bucket and command runner with simulated ones
+func withTransport(t *testing.T, ec2 *fake.EC2) (*fake.Bucket, *fake.CommandRunner, func()) {
+	bucket := fake.NewBucket("logs-bucket")
+	runner := fake.NewCommandRunner(ec2)
+	origBucket, origRunner, origDelay := newBucket, newCommandRunner, downloadRetryDelay
+	newBucket = func(region, name string, iamConf *aws.IAMConfig) (aws.Bucket, error) {
+		if name != bucket.Name() {
+			t.Errorf("Got unexpected bucket name: %s", name)
+		}
+		return bucket, nil
+	}
+	newCommandRunner = func(region string, iamConf *aws.IAMConfig) (aws.CommandRunner, error) {
+		return runner, nil
+	}
+	downloadRetryDelay = 0
+	return bucket, runner, func() {
+		bucket.Close()
+		newBucket, newCommandRunner, downloadRetryDelay = origBucket, origRunner, origDelay
+	}
+}
+
+var uploadURLRegexp = regexp.MustCompile(`'(http[^']+)'`)
+
+// upload simulates the instance uploading the logs with the presigned URL in
+// the script
+func upload(t *testing.T, script string, data []byte) {
+	match := uploadURLRegexp.FindStringSubmatch(script)
+	if match == nil {
+		t.Errorf("Expected upload URL in script:\n%s", script)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPut, match[1], bytes.NewReader(data))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got unexpected status when uploading logs: %s", resp.Status)
+	}
+}
+
+// launchedInstance returns the instance launched to get the logs, which is
+// there until the transaction finishes
+func launchedInstance(ec2 *fake.EC2, id string) *fake.Instance {
+	for _, instID := range ec2.Resources().Instances {
+		if instID != id {
+			return ec2.Instance(instID)
+		}
+	}
+	return nil
+}
+
+func TestAWSShareLogsS3(t *testing.T) {
+	path, done := tempLogsPath(t)
+	defer done()
+	ec2 := fake.New(testRegion)
+	bucket, _, restore := withTransport(t, ec2)
+	defer restore()
+	logs := testBundle(map[string][]byte{"./log/messages": []byte("Registered from 10.0.1.5\n")})
+	id := ec2.AddInstance(ec2.AddImage("wrapped", 8, nil), nil)
+	ec2.Boot = func(inst fake.Instance) {
+		if inst.ID != id {
+			upload(t, inst.Userdata, logs)
+		}
+	}
+	tx := mv.NewTransaction("test")
+
+	_, err := awsShareLogs(context.Background(), tx, ec2, testRegion, id, Config{LogsPath: path, Transport: TransportS3, S3Bucket: "logs-bucket"})
+	launched := launchedInstance(ec2, id)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when sharing logs with s3: %s", err)
+	}
+	if files, _ := readBundle(t, path); string(files["log/messages"]) != "Registered from <redacted-ip>\n" {
+		t.Errorf("Expected redacted logs to be downloaded from bucket, got %q", files["log/messages"])
+	}
+	if n := ec2.Calls("CreateKeyPair"); n != 0 {
+		t.Errorf("Expected no key pair to be created, got %d calls", n)
+	}
+	if launched == nil || !launched.NoPublicIP || launched.KeyName != "" {
+		t.Errorf("Expected temporary instance without key pair and public IP, got %+v", launched)
+	}
+	if keys := bucket.Keys(); len(keys) != 0 {
+		t.Errorf("Expected uploaded logs to be deleted, got %v", keys)
+	}
+}
+
+// ssmInstance simulates reading the logs on the instance with SSM
+func ssmInstance(t *testing.T, logs []byte) func(fake.Instance, []string) (string, error) {
+	return func(inst fake.Instance, commands []string) (string, error) {
+		script := strings.Join(commands, "\n")
+		if strings.Contains(script, "curl") {
+			upload(t, script, logs)
+			return "", nil
+		}
+		if strings.Contains(script, "stat -c") {
+			return fmt.Sprintf("%d\n", len(logs)), nil
+		}
+		var bs, skip int
+		if _, err := fmt.Sscanf(script[strings.Index(script, "bs="):], "bs=%d skip=%d", &bs, &skip); err != nil {
+			t.Errorf("Got unexpected command: %s", script)
+			return "", aws.ErrCommandFailed
+		}
+		end := (skip + 1) * bs
+		if end > len(logs) {
+			end = len(logs)
+		}
+		return base64.StdEncoding.EncodeToString(logs[skip*bs:end]) + "\n", nil
+	}
+}
+
+func TestAWSShareLogsSSM(t *testing.T) {
+	path, done := tempLogsPath(t)
+	defer done()
+	ec2 := fake.New(testRegion)
+	_, runner, restore := withTransport(t, ec2)
+	defer restore()
+	// Crash dumps don't compress, so the logs are downloaded in several parts
+	dump := make([]byte, 40*1024)
+	rand.New(rand.NewSource(1)).Read(dump)
+	logs := testBundle(map[string][]byte{"./log/messages": []byte("metavisor logs\n"), "./crash/vmcore.0": dump})
+	runner.Run = ssmInstance(t, logs)
+	id := ec2.AddInstance(ec2.AddImage("wrapped", 8, nil), nil)
+	tx := mv.NewTransaction("test")
+
+	_, err := awsShareLogs(context.Background(), tx, ec2, testRegion, id, Config{LogsPath: path, Transport: TransportSSM, InstanceProfile: "ssm-role"})
+	launched := launchedInstance(ec2, id)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when sharing logs with ssm: %s", err)
+	}
+	if files, _ := readBundle(t, path); !bytes.Equal(files["crash/vmcore.0"], dump) {
+		t.Errorf("Expected logs to be downloaded in parts, got %d bytes", len(files["crash/vmcore.0"]))
+	}
+	// One command for the size, and one for each part
+	if n := len(runner.Commands()); n != 4 {
+		t.Errorf("Expected logs to be read with 4 commands, got %d", n)
+	}
+	if launched == nil || launched.InstanceProfile != "ssm-role" || !launched.NoPublicIP || launched.Userdata != "" {
+		t.Fatalf("Expected temporary instance with instance profile and no userdata, got %+v", launched)
+	}
+	volumeID := launched.Devices[logsDeviceName]
+	if commands := runner.Commands(); volumeID == "" || len(commands) == 0 || !strings.Contains(commands[0][0], `volume_id="`+volumeID+`"`) {
+		t.Errorf("Expected logs to be collected from volume %s, got %v", volumeID, commands)
+	}
+	if n := ec2.Calls("CreateKeyPair"); n != 0 {
+		t.Errorf("Expected no key pair to be created, got %d calls", n)
+	}
+}
+
+func TestAWSShareLogsSSMBucket(t *testing.T) {
+	path, done := tempLogsPath(t)
+	defer done()
+	ec2 := fake.New(testRegion)
+	bucket, runner, restore := withTransport(t, ec2)
+	defer restore()
+	logs := testBundle(map[string][]byte{"./log/messages": []byte("metavisor logs\n")})
+	runner.Run = ssmInstance(t, logs)
+	id := ec2.AddInstance(ec2.AddImage("wrapped", 8, nil), nil)
+	tx := mv.NewTransaction("test")
+
+	conf := Config{LogsPath: path, Transport: TransportSSM, InstanceProfile: "ssm-role", S3Bucket: "logs-bucket"}
+	_, err := awsShareLogs(context.Background(), tx, ec2, testRegion, id, conf)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when sharing logs with ssm: %s", err)
+	}
+	if files, _ := readBundle(t, path); string(files["log/messages"]) != "metavisor logs\n" {
+		t.Errorf("Expected logs to be downloaded from bucket, got %q", files["log/messages"])
+	}
+	if n := len(runner.Commands()); n != 1 {
+		t.Errorf("Expected logs to be uploaded with one command, got %d", n)
+	}
+	if keys := bucket.Keys(); len(keys) != 0 {
+		t.Errorf("Expected uploaded logs to be deleted, got %v", keys)
+	}
+}
+
+func TestAWSShareLogsInvalidTransport(t *testing.T) {
+	path, done := tempLogsPath(t)
+	defer done()
+	ec2 := fake.New(testRegion)
+	_, _, restore := withTransport(t, ec2)
+	defer restore()
+	id := ec2.AddInstance(ec2.AddImage("wrapped", 8, nil), nil)
+
+	tests := []struct {
+		conf     Config
+		expected error
+	}{
+		{Config{LogsPath: path, Transport: "ftp"}, ErrInvalidTransport},
+		{Config{LogsPath: path, Transport: TransportS3}, ErrNoBucket},
+		{Config{LogsPath: path, Transport: TransportSSM, S3Bucket: "logs-bucket"}, ErrNoInstanceProfile},
+	}
+	for _, test := range tests {
+		_, err := awsShareLogs(context.Background(), mv.NewTransaction("test"), ec2, testRegion, id, test.conf)
+		if err != test.expected {
+			t.Errorf("Expected %v for transport %q, got: %v", test.expected, test.conf.Transport, err)
+		}
+	}
+	for _, action := range []string{"CreateKeyPair", "CreateSnapshot", "RunInstances"} {
+		if n := ec2.Calls(action); n != 0 {
+			t.Errorf("Expected nothing to be created with invalid transport, got %d %s calls", n, action)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package share
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+)
+
+// Transports the logs can be retrieved from the temporary instance with
+const (
+	// TransportSSH downloads the logs with SFTP, which requires a key pair
+	// and that the instance can be reached on port 22
+	TransportSSH = "ssh"
+	// TransportS3 makes the instance upload the logs to a presigned URL of
+	// a bucket, from where they are downloaded
+	TransportS3 = "s3"
+	// TransportSSM gets the logs with SSM Run Command, through its output or
+	// a bucket, which requires an instance profile that allows SSM
+	TransportSSM = "ssm"
+)
+
+const (
+	stepDeleteUploadedLogs = "delete-uploaded-logs"
+
+	// uploadURLExpiry is how long the instance can upload to the presigned
+	// URL, which includes launching it
+	uploadURLExpiry = time.Hour
+	// ssmChunkSize is how much of the logs is read by each command, which
+	// must fit in the command output when base64 encoded
+	ssmChunkSize = 16 * 1024
+
+	ssmAwaitLogsCommand = `for i in $(seq 1 60); do [ -f /tmp/%[1]s ] && break; sleep 10; done
+stat -c %%s /tmp/%[1]s`
+	ssmReadChunkCommand = "dd if=/tmp/%s bs=%d skip=%d count=1 2>/dev/null | base64 -w 0"
+)
+
+var (
+	// ErrInvalidTransport is returned if the transport is not one of ssh,
+	// s3 or ssm
+	ErrInvalidTransport = errors.New("transport must be one of ssh, s3 or ssm")
+	// ErrNoBucket is returned if using the s3 transport without a bucket
+	ErrNoBucket = errors.New("the s3 transport requires a bucket")
+	// ErrNoInstanceProfile is returned if using the ssm transport without
+	// an instance profile
+	ErrNoInstanceProfile = errors.New("the ssm transport requires an instance profile")
+	// ErrIncompleteLogs is returned if the size of the downloaded logs is
+	// not the size of the logs on the instance
+	ErrIncompleteLogs = errors.New("the downloaded logs are incomplete")
+
+	// newBucket and newCommandRunner create the helpers of the s3 and ssm
+	// transports, tests replace them with simulated ones
+	newBucket        = aws.NewBucket
+	newCommandRunner = aws.NewCommandRunner
+)
+
+func checkTransport(conf Config) error {
+	switch conf.Transport {
+	case "", TransportSSH:
+		return nil
+	case TransportS3:
+		if conf.S3Bucket == "" {
+			logging.Error("A bucket must be specified with --s3-bucket to use the s3 transport")
+			return ErrNoBucket
+		}
+	case TransportSSM:
+		if conf.InstanceProfile == "" {
+			logging.Error("An instance profile that allows SSM must be specified with --instance-profile to use the ssm transport")
+			return ErrNoInstanceProfile
+		}
+	default:
+		return ErrInvalidTransport
+	}
+	if len(conf.BastionHosts) > 0 {
+		logging.Warningf("Bastion hosts are only used with the ssh transport, not %s", conf.Transport)
+	}
+	return nil
+}
+
+// presignUpload returns the key and presigned URL the logs are uploaded to,
+// and makes sure the uploaded logs are deleted when done
+func presignUpload(tx *mv.Transaction, bucket aws.Bucket, logsFile string) (string, string, error) {
+	key := fmt.Sprintf("metavisor-cli/%d/%s", time.Now().UnixNano(), logsFile)
+	url, err := bucket.PresignPut(key, uploadURLExpiry)
+	if err != nil {
+		logging.Errorf("Could not create upload URL for the bucket %s", bucket.Name())
+		return "", "", err
+	}
+	logging.Debugf("Logs will be uploaded to s3://%s/%s", bucket.Name(), key)
+	tx.Finally(stepDeleteUploadedLogs, awsCleanupTimeout, func(ctx context.Context) error {
+		logging.Info("Deleting uploaded logs from bucket")
+		err := bucket.Delete(ctx, key)
+		if err != nil {
+			logging.Errorf("Failed to delete s3://%s/%s", bucket.Name(), key)
+			logging.Debugf("Got error when deleting uploaded logs: %s", err)
+		}
+		return err
+	})
+	return key, url, nil
+}
+
+// downloadUploadedLogs downloads the logs from the bucket once the instance
+// has uploaded them
+func downloadUploadedLogs(ctx context.Context, bucket aws.Bucket, key, path string) (string, error) {
+	log := logging.FromContext(ctx)
+	log.Info("Waiting for logs to be uploaded to bucket...")
+	for try := 1; try <= downloadAttempts; try++ {
+		err := bucket.Download(ctx, key, path)
+		if err == aws.ErrObjectNonExisting {
+			log.Warningf("Attempt %d: Logs have not been uploaded yet, trying again...", try)
+			time.Sleep(downloadRetryDelay)
+			continue
+		}
+		if err != nil {
+			switch err {
+			case aws.ErrNotAllowed:
+				log.Errorf("Not enough IAM permissions to download from the bucket %s", bucket.Name())
+			case aws.ErrBucketNonExisting:
+				log.Errorf("The bucket %s does not exist", bucket.Name())
+			default:
+				log.Error("Failed to download logs from bucket")
+			}
+			return "", err
+		}
+		log.Info("Successfully downloaded logs")
+		return path, nil
+	}
+	return "", ErrLogTimeout
+}
+
+// ssmGetLogs collects and gets the logs with SSM Run Command. With a bucket,
+// the instance uploads the logs to it, otherwise they are read in chunks
+// through the output of commands.
+func ssmGetLogs(ctx context.Context, tx *mv.Transaction, runner aws.CommandRunner, bucket aws.Bucket, instanceID, volumeID, logsFile, path string) (string, error) {
+	log := logging.FromContext(ctx)
+	log.Info("Waiting for instance to register with SSM...")
+	if err := runner.AwaitManaged(ctx, instanceID); err != nil {
+		if err == aws.ErrNotManaged {
+			log.Error("The instance never registered with SSM, check that the instance profile allows SSM")
+			log.Error("and that the subnet can reach SSM, either with a NAT gateway or VPC endpoints")
+		}
+		return "", err
+	}
+	collect := awsCollectLogs(logsFile, volumeID)
+	awaitLogs := fmt.Sprintf(ssmAwaitLogsCommand, logsFile)
+	if bucket != nil {
+		key, url, err := presignUpload(tx, bucket, logsFile)
+		if err != nil {
+			return "", err
+		}
+		log.Info("Uploading logs to bucket with SSM Run Command...")
+		if _, err = runner.RunShellScript(ctx, instanceID, []string{collect, awaitLogs, uploadCommand(logsFile, url)}); err != nil {
+			log.Error("Failed to upload logs from the temporary instance")
+			return "", err
+		}
+		return downloadUploadedLogs(ctx, bucket, key, path)
+	}
+
+	log.Info("Collecting logs with SSM Run Command...")
+	out, err := runner.RunShellScript(ctx, instanceID, []string{collect, awaitLogs})
+	if err != nil {
+		log.Error("The logs were never created on the temporary instance")
+		return "", err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		log.Debugf("Got unexpected output when getting size of logs: %q", out)
+		return "", ErrLogTimeout
+	}
+	chunks := (size + ssmChunkSize - 1) / ssmChunkSize
+	log.Infof("Downloading %d KiB of logs in %d parts, use --s3-bucket for large logs", size/1024, chunks)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	for i := int64(0); i < chunks; i++ {
+		err = ssmReadChunk(ctx, runner, instanceID, logsFile, i, file)
+		if err != nil {
+			break
+		}
+		log.Debugf("Downloaded part %d of %d", i+1, chunks)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if info, serr := os.Stat(path); err == nil && serr == nil && info.Size() != size {
+		log.Debugf("Downloaded %d bytes of logs, expected %d", info.Size(), size)
+		err = ErrIncompleteLogs
+	}
+	if err != nil {
+		log.Error("Failed to download logs with SSM Run Command")
+		os.Remove(path)
+		return "", err
+	}
+	log.Info("Successfully downloaded logs")
+	return path, nil
+}
+
+func ssmReadChunk(ctx context.Context, runner aws.CommandRunner, instanceID, logsFile string, i int64, file *os.File) error {
+	log := logging.FromContext(ctx)
+	out, err := runner.RunShellScript(ctx, instanceID, []string{fmt.Sprintf(ssmReadChunkCommand, logsFile, ssmChunkSize, i)})
+	if err != nil {
+		return err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out))
+	if err != nil {
+		log.Debugf("Got invalid output when reading part %d: %s", i+1, err)
+		return err
+	}
+	_, err = file.Write(data)
+	return err
+}
@@ -0,0 +1,226 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+const (
+	// StepSucceeded means that a cleanup step ran without errors
+	StepSucceeded = "succeeded"
+	// StepFailed means that a cleanup step returned an error
+	StepFailed = "failed"
+	// StepTimedOut means that a cleanup step didn't finish within its timeout
+	StepTimedOut = "timed-out"
+
+	// DefaultStepTimeout is used for cleanup steps registered without a timeout
+	DefaultStepTimeout = 10 * time.Minute
+)
+
+// Transaction keeps track of the cleanup steps of a single operation, such as
+// wrapping an instance. Compensations undo the changes made by the operation,
+// and are only ran if the transaction is rolled back. Final steps remove
+// temporary resources, and are always ran when the transaction finishes. Each
+// operation should use its own transaction, which makes it safe to run several
+// operations at the same time in the same process.
+type Transaction struct {
+	name   string
+	mutex  sync.Mutex
+	steps  []transactionStep
+	result *TransactionResult
+}
+
+type transactionStep struct {
+	name       string
+	timeout    time.Duration
+	f          func(ctx context.Context) error
+	onlyOnFail bool
+}
+
+// StepResult is the outcome of running a single cleanup step
+type StepResult struct {
+	Step   string `json:"step"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TransactionResult describes how a transaction finished, and the outcome
+// of every cleanup step that was ran, in the order they were ran
+type TransactionResult struct {
+	Name      string       `json:"name"`
+	Committed bool         `json:"committed"`
+	Steps     []StepResult `json:"steps"`
+}
+
+// NewTransaction returns a new transaction. The name is only used to identify
+// the transaction in logs and results.
+func NewTransaction(name string) *Transaction {
+	return &Transaction{
+		name:  name,
+		steps: make([]transactionStep, 0),
+	}
+}
+
+// Compensate will register a named step that is ran if the transaction is
+// rolled back. The steps are ran in reverse order of registration, each with
+// a context that times out after the given timeout (DefaultStepTimeout if 0).
+func (t *Transaction) Compensate(step string, timeout time.Duration, f func(ctx context.Context) error) {
+	t.add(transactionStep{
+		name:       step,
+		timeout:    timeout,
+		f:          f,
+		onlyOnFail: true,
+	})
+}
+
+// Finally will register a named step that is ran when the transaction
+// finishes, no matter if it's committed or rolled back
+func (t *Transaction) Finally(step string, timeout time.Duration, f func(ctx context.Context) error) {
+	t.add(transactionStep{
+		name:    step,
+		timeout: timeout,
+		f:       f,
+	})
+}
+
+// Commit finishes the transaction successfully, only running the final steps
+func (t *Transaction) Commit() *TransactionResult {
+	return t.finish(true)
+}
+
+// Rollback finishes the transaction unsuccessfully, running both compensations
+// and final steps
+func (t *Transaction) Rollback() *TransactionResult {
+	return t.finish(false)
+}
+
+// Finish commits the transaction if the operation succeeded, and rolls it
+// back otherwise. Cleanup steps that failed are logged as warnings, since the
+// resources they were cleaning up might have to be removed manually.
+func (t *Transaction) Finish(success bool) *TransactionResult {
+	res := t.finish(success)
+	for _, s := range res.Failed() {
+		logging.Warningf("Cleanup step %s %s, some resources might have to be cleaned up manually", s.Step, s.Status)
+	}
+	return res
+}
+
+// Result returns the result of the transaction, or nil if it hasn't finished
+func (t *Transaction) Result() *TransactionResult {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.result
+}
+
+func (t *Transaction) add(step transactionStep) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.result == nil {
+		t.steps = append(t.steps, step)
+		return
+	}
+	// The operation kept going after the transaction finished, e.g. because
+	// it was interrupted. Run the step right away so nothing is left behind
+	if !t.result.Committed || !step.onlyOnFail {
+		t.result.Steps = append(t.result.Steps, runStep(t.name, step))
+	}
+}
+
+func (t *Transaction) finish(success bool) *TransactionResult {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.result != nil {
+		// Already finished
+		return t.result
+	}
+	result := &TransactionResult{
+		Name:      t.name,
+		Committed: success,
+		Steps:     []StepResult{},
+	}
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		step := t.steps[i]
+		if success && step.onlyOnFail {
+			continue
+		}
+		result.Steps = append(result.Steps, runStep(t.name, step))
+	}
+	t.steps = nil
+	t.result = result
+	if len(result.Steps) > 0 {
+		logging.Info("Cleanup completed")
+	}
+	return result
+}
+
+func runStep(operation string, step transactionStep) StepResult {
+	timeout := step.timeout
+	if timeout <= 0 {
+		timeout = DefaultStepTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	logging.Debugf("Running cleanup step: %s", step.name)
+	res := StepResult{
+		Step:   step.name,
+		Status: StepSucceeded,
+	}
+	if err := step.f(ctx); err != nil {
+		res.Status = StepFailed
+		if ctx.Err() == context.DeadlineExceeded {
+			res.Status = StepTimedOut
+		}
+		res.Error = err.Error()
+		logging.Debugf("Cleanup step %s %s: %s", step.name, res.Status, err)
+		logging.Emit(logging.Event{
+			Type:      logging.EventCleanupFailed,
+			Operation: operation,
+			Step:      step.name,
+			Error:     res.Error,
+		})
+	}
+	return res
+}
+
+// RolledBack is true if the transaction was rolled back, and all cleanup
+// steps succeeded
+func (r *TransactionResult) RolledBack() bool {
+	if r == nil || r.Committed {
+		return false
+	}
+	return len(r.Steps) > 0 && len(r.Failed()) == 0
+}
+
+// Failed returns the cleanup steps that failed or timed out
+func (r *TransactionResult) Failed() []StepResult {
+	failed := []StepResult{}
+	if r == nil {
+		return failed
+	}
+	for _, s := range r.Steps {
+		if s.Status != StepSucceeded {
+			failed = append(failed, s)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,269 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+)
+
+const (
+	// StatusSucceeded means that the instance was wrapped
+	StatusSucceeded = "succeeded"
+	// StatusFailed means that wrapping failed before the instance was changed,
+	// or that some of the changes could not be rolled back
+	StatusFailed = "failed"
+	// StatusRolledBack means that wrapping failed, and the changes made to
+	// the instance were rolled back
+	StatusRolledBack = "rolled-back"
+
+	// DefaultConcurrency is the default number of instances wrapped at once
+	DefaultConcurrency = 5
+
+	// Only wrap instances that can actually be wrapped, unless the user
+	// specifies the state explicitly
+	instanceStateFilter = "instance-state-name"
+)
+
+var (
+	// ErrRegionRequired is returned if trying to find instances with filters
+	// without specifying a region
+	ErrRegionRequired = errors.New("a region must be specified when using filters")
+
+	// ErrInvalidFilter is returned if a filter is not on the format NAME=VALUE
+	ErrInvalidFilter = errors.New("filters must be on the format NAME=VALUE[,VALUE...], e.g. tag:Env=prod")
+
+	// ErrNoInstances is returned if no instances were specified or found
+	ErrNoInstances = errors.New("no instances to wrap")
+)
+
+// BatchResult is the result of wrapping a single instance in a batch
+type BatchResult struct {
+	ID     string `json:"id"`
+	Region string `json:"region"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Cleanup is the outcome of the cleanup steps that were ran
+	Cleanup []mv.StepResult `json:"cleanup,omitempty"`
+}
+
+type batchReport struct {
+	Succeeded  int           `json:"succeeded"`
+	Failed     int           `json:"failed"`
+	RolledBack int           `json:"rolled_back"`
+	Instances  []BatchResult `json:"instances"`
+}
+
+// FindInstances returns the IDs of all running and stopped instances in the
+// region which match all of the given filters. The filters are on the format
+// NAME=VALUE[,VALUE...], using the filter names of the EC2 API, e.g.
+// "tag:Env=prod" or "instance-type=m4.large,m4.xlarge".
+func FindInstances(ctx context.Context, region string, filters []string, conf Config) ([]string, error) {
+	if strings.TrimSpace(region) == "" {
+		return nil, ErrRegionRequired
+	}
+	awsFilters, err := parseFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	service, err := aws.New(region, &aws.IAMConfig{
+		RoleARN:      conf.IAMRoleARN,
+		MFADeviceARN: conf.IAMDeviceARN,
+		MFACode:      conf.IAMCode,
+	})
+	if err != nil {
+		if err == aws.ErrInvalidARN {
+			logging.Error("Failed to assume IAM role")
+		}
+		return nil, err
+	}
+	ids, err := service.FindInstances(ctx, awsFilters)
+	if err != nil {
+		if err == aws.ErrNotAllowed {
+			logging.Error("Not enough IAM permissions to list instances")
+		}
+		return nil, err
+	}
+	logging.Infof("Found %d instances matching the filters", len(ids))
+	return ids, nil
+}
+
+func parseFilters(filters []string) (map[string][]string, error) {
+	res := make(map[string][]string)
+	for _, f := range filters {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			logging.Errorf("Invalid filter: %s", f)
+			return nil, ErrInvalidFilter
+		}
+		name := strings.TrimSpace(parts[0])
+		res[name] = append(res[name], strings.Split(parts[1], ",")...)
+	}
+	if _, exist := res[instanceStateFilter]; !exist {
+		res[instanceStateFilter] = []string{"running", "stopped"}
+	}
+	return res, nil
+}
+
+// Instances will wrap all the given instances with the Metavisor, wrapping at
+// most concurrency instances at the same time. Each instance has its own
+// transaction and journal, so a failure for one instance doesn't affect
+// the others. If no region is specified, it's determined for each instance
+// separately. The result for each instance is returned in the same order as
+// the IDs were given.
+func Instances(ctx context.Context, region string, ids []string, conf Config, concurrency int) []BatchResult {
+	if concurrency < 1 {
+		concurrency = DefaultConcurrency
+	}
+	if conf.JournalPath != "" && len(ids) > 1 {
+		logging.Warning("A journal path can't be used for multiple instances, using the default journal directory")
+		conf.JournalPath = ""
+	}
+	logging.Infof("Wrapping %d instances with Metavisor, %d at a time", len(ids), concurrency)
+	return runBatch(ids, concurrency, func(id string) BatchResult {
+		return batchWrapInstance(ctx, region, id, conf)
+	})
+}
+
+// runBatch wraps all instances with the given function, using concurrency
+// workers, and returns the results in the same order as the IDs
+func runBatch(ids []string, concurrency int, wrap func(id string) BatchResult) []BatchResult {
+	results := make([]BatchResult, len(ids))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(ids); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = wrap(ids[i])
+			}
+		}()
+	}
+	for i := range ids {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+func batchWrapInstance(ctx context.Context, region, id string, conf Config) BatchResult {
+	res := BatchResult{
+		ID:     id,
+		Region: region,
+		Status: StatusFailed,
+	}
+	if ctx.Err() != nil {
+		// Don't start wrapping more instances after being interrupted
+		res.Error = mv.ErrInterrupted.Error()
+		return res
+	}
+	if strings.TrimSpace(region) == "" {
+		reg, err := aws.FindInstanceRegion(id, &aws.IAMConfig{
+			RoleARN:      conf.IAMRoleARN,
+			MFADeviceARN: conf.IAMDeviceARN,
+			MFACode:      conf.IAMCode,
+		})
+		if err != nil {
+			logging.Errorf("Could not find region of instance %s", id)
+			res.Error = err.Error()
+			return res
+		}
+		res.Region = reg
+	}
+	return wrapInBatch(res, func(tx *mv.Transaction) error {
+		_, err := Instance(ctx, tx, res.Region, id, conf)
+		return err
+	})
+}
+
+// wrapInBatch wraps an instance of a batch in its own transaction, which the
+// given function must finish, and sets the status of the result depending on
+// whether wrapping failed and the changes could be rolled back
+func wrapInBatch(res BatchResult, wrap func(tx *mv.Transaction) error) BatchResult {
+	tx := mv.NewTransaction(fmt.Sprintf("%s %s", opAWSWrapInstance, res.ID))
+	err := wrap(tx)
+	if txRes := tx.Result(); txRes != nil {
+		res.Cleanup = txRes.Steps
+	}
+	if err != nil {
+		logging.Errorf("Failed to wrap instance %s: %s", res.ID, err)
+		res.Error = err.Error()
+		res.Status = StatusFailed
+		if tx.Result().RolledBack() {
+			res.Status = StatusRolledBack
+		}
+		return res
+	}
+	logging.Infof("Successfully wrapped instance %s", res.ID)
+	res.Status = StatusSucceeded
+	return res
+}
+
+// BatchSucceeded is true if all instances in the batch were wrapped
+func BatchSucceeded(results []BatchResult) bool {
+	for _, r := range results {
+		if r.Status != StatusSucceeded {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatBatchResults will format the results of a batch wrap for display. If
+// withJSON is true, the results will be formatted as a structured JSON report,
+// otherwise as a summary table.
+func FormatBatchResults(results []BatchResult, withJSON bool) (string, error) {
+	report := batchReport{
+		Instances: results,
+	}
+	for _, r := range results {
+		switch r.Status {
+		case StatusSucceeded:
+			report.Succeeded++
+		case StatusRolledBack:
+			report.RolledBack++
+		default:
+			report.Failed++
+		}
+	}
+	if withJSON {
+		data, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			logging.Errorf("Failed to marshal batch results to JSON: %s", err)
+		}
+		return string(data), err
+	}
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tREGION\tSTATUS\tERROR")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.ID, r.Region, r.Status, r.Error)
+	}
+	w.Flush()
+	b.WriteString(fmt.Sprintf("\n%d succeeded, %d failed, %d rolled back", report.Succeeded, report.Failed, report.RolledBack))
+	return b.String(), nil
+}
@@ -0,0 +1,149 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws/fake"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+)
+
+func TestParseFilters(t *testing.T) {
+	filters, err := parseFilters([]string{"tag:Env=prod", "instance-type=m4.large,m4.xlarge", "tag:Env=staging"})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if v := filters["tag:Env"]; len(v) != 2 || v[0] != "prod" || v[1] != "staging" {
+		t.Errorf("Got unexpected values for tag:Env: %v", v)
+	}
+	if v := filters["instance-type"]; len(v) != 2 {
+		t.Errorf("Expected two values for instance-type, got %v", v)
+	}
+	if v := filters[instanceStateFilter]; len(v) != 2 {
+		t.Errorf("Expected default instance state filter, got %v", v)
+	}
+	for _, bad := range []string{"tag:Env", "=prod", "tag:Env="} {
+		if _, err := parseFilters([]string{bad}); err != ErrInvalidFilter {
+			t.Errorf("Expected ErrInvalidFilter for %s, got %v", bad, err)
+		}
+	}
+}
+
+func TestFormatBatchResults(t *testing.T) {
+	results := []BatchResult{
+		{ID: "i-1", Region: "us-west-2", Status: StatusSucceeded},
+		{ID: "i-2", Region: "us-west-2", Status: StatusRolledBack, Error: "timed out"},
+		{ID: "i-3", Region: "us-east-1", Status: StatusFailed, Error: "denied"},
+	}
+	if BatchSucceeded(results) {
+		t.Error("Batch with failures should not be reported as succeeded")
+	}
+	out, err := FormatBatchResults(results, false)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if !strings.Contains(out, "1 succeeded, 1 failed, 1 rolled back") {
+		t.Errorf("Summary is missing from output:\n%s", out)
+	}
+	out, err = FormatBatchResults(results, true)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if !strings.Contains(out, "\"rolled_back\": 1") {
+		t.Errorf("JSON report is missing counts:\n%s", out)
+	}
+}
+
+func TestBatchWrapInstances(t *testing.T) {
+	ec2, conf := newTestEC2()
+	guestAMI := ec2.AddImage("guest", 8, nil)
+	ids := []string{}
+	guestVolumes := map[string]string{}
+	for i := 0; i < 4; i++ {
+		id := ec2.AddInstance(guestAMI, nil)
+		ids = append(ids, id)
+		guestVolumes[id] = ec2.Instance(id).Devices[fake.RootDeviceName]
+	}
+	// An instance that doesn't exist fails before anything is changed
+	missing := "i-0123456789abcdef0"
+	ids = append(ids, missing)
+	// Only one of the instances fails to start after being wrapped, so its
+	// changes are rolled back
+	ec2.FailNext("StartInstances", errInjected)
+
+	var mutex sync.Mutex
+	active, maxActive := 0, 0
+	results := runBatch(ids, 2, func(id string) BatchResult {
+		mutex.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			active--
+			mutex.Unlock()
+		}()
+		return wrapInBatch(BatchResult{ID: id, Region: testRegion}, func(tx *mv.Transaction) error {
+			_, err := awsWrapInstance(context.Background(), ec2, testRegion, id, conf, nil, tx)
+			tx.Finish(err == nil)
+			return err
+		})
+	})
+	if maxActive > 2 {
+		t.Errorf("Expected at most 2 instances to be wrapped at once, got %d", maxActive)
+	}
+	if len(results) != len(ids) {
+		t.Fatalf("Expected a result for each instance, got %d", len(results))
+	}
+	statuses := map[string]int{}
+	for i, r := range results {
+		if r.ID != ids[i] || r.Region != testRegion {
+			t.Errorf("Expected result %d to be for %s, got %+v", i, ids[i], r)
+		}
+		statuses[r.Status]++
+		if r.ID == missing {
+			if r.Status != StatusFailed || r.Error == "" {
+				t.Errorf("Expected missing instance to fail, got %+v", r)
+			}
+			continue
+		}
+		inst := ec2.Instance(r.ID)
+		if inst.State != fake.StateRunning {
+			t.Errorf("Expected instance %s to be running, was %s", r.ID, inst.State)
+		}
+		switch r.Status {
+		case StatusSucceeded:
+			if inst.Devices[GuestDeviceName] != guestVolumes[r.ID] {
+				t.Errorf("Expected wrapped instance %s to have the guest volume at %s, got %v", r.ID, GuestDeviceName, inst.Devices)
+			}
+		case StatusRolledBack:
+			if r.Error != errInjected.Error() || len(r.Cleanup) == 0 {
+				t.Errorf("Expected injected error and cleanup steps, got %+v", r)
+			}
+			if inst.Devices[fake.RootDeviceName] != guestVolumes[r.ID] {
+				t.Errorf("Expected guest volume to be restored as root device of %s, got %v", r.ID, inst.Devices)
+			}
+		}
+	}
+	if statuses[StatusSucceeded] != 3 || statuses[StatusRolledBack] != 1 || statuses[StatusFailed] != 1 {
+		t.Errorf("Expected 3 succeeded, 1 rolled back and 1 failed, got %v", statuses)
+	}
+}
@@ -15,30 +15,32 @@
 package wrap
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/token"
 	"github.com/immutable/metavisor-cli/pkg/userdata"
 )
 
 const (
-	compressUserdata    = true
-	servicePort         = 443
-	modeMetavisor       = "metavisor"
-	configContentType   = "text/brkt-config"
-	tokenTypeKey        = "brkt.token_type"
-	tokenTypeValidValue = "launch"
+	servicePort       = 443
+	modeMetavisor     = "metavisor"
+	configContentType = "text/brkt-config"
 )
 
 var (
 	// ErrInvalidLaunchToken is returned if trying to use a token that's not valid
 	ErrInvalidLaunchToken = errors.New("specified token is not a valid launch token")
+
+	// ErrNoBrktConfig is returned if userdata has no Metavisor config
+	ErrNoBrktConfig = errors.New("userdata has no Metavisor config")
+
+	// ErrInvalidGuestUserdata is returned if the existing userdata of an
+	// instance can't be parsed, so it can't be kept when wrapping
+	ErrInvalidGuestUserdata = errors.New("the userdata of the instance could not be parsed")
 )
 
 type instanceConfig struct {
@@ -66,89 +68,138 @@ func configFromDomain(domain string) instanceConfig {
 	}
 }
 
-// Manually decoding JWT to avoid additional dependencies
-func isValidToken(token string) bool {
-	tokenSlice := strings.Split(token, ".")
-	if len(tokenSlice) != 3 {
-		// JWT is three parts
-		logging.Debug("Token does not seem to be a JWT")
-		return false
-	}
-	// Payload is in middle part of JWT
-	payload := tokenSlice[1]
-	data, err := base64.RawStdEncoding.DecodeString(payload)
-	if err != nil {
-		logging.Debug("Token could not be raw base64 decoded")
-		data, err = base64.StdEncoding.DecodeString(payload)
-		if err != nil {
-			// Unable to decode token
-			logging.Debug("Token could not be base64 decoded")
-			return false
-		}
-	}
-	// Payload is map from string -> arbitrary value
-	res := make(map[string]interface{})
-	err = json.Unmarshal(data, &res)
-	if err != nil {
-		// Could not unmarshal payload
-		logging.Debug("Token could not be unmarshaled to JSON")
-		return false
+// validateToken checks that the token is a launch token that can be used
+// with the service domain now. ErrInvalidLaunchToken is returned if it's not
+// a launch token, otherwise the reason it can't be used is returned.
+func validateToken(launchToken, domain string) error {
+	if domain == "" {
+		domain = ProdDomain
 	}
-	tokenType, exist := res[tokenTypeKey]
-	if !exist {
-		// Payload has no token type
-		logging.Debug("Token has no token type attribute")
-		return false
+	t, err := token.Parse(launchToken)
+	if err == nil {
+		err = t.Validate(token.Options{ServiceDomain: domain})
 	}
-	tokenTypeString, ok := tokenType.(string)
-	if !ok {
-		// Token type is not a string
-		logging.Debug("Token type is not of a valid type")
-		return false
+	switch err {
+	case nil:
+		return nil
+	case token.ErrMalformed, token.ErrNotLaunchToken:
+		// The specified token is not a valid launch token
+		logging.Error("The specified token is not a launch token")
+		return ErrInvalidLaunchToken
+	default:
+		logging.Errorf("The specified launch token can't be used: %s", err)
+		return err
 	}
-	return strings.ToLower(tokenTypeString) == tokenTypeValidValue
 }
 
-func generateUserdataString(launchToken, domain string, compress bool) (string, error) {
+// generateUserdataString generates userdata with the Metavisor config. The
+// parts of the guest's existing userdata are kept after the config, except
+// for any earlier Metavisor config.
+func generateUserdataString(launchToken, domain, guestUserdata string, compress bool) (string, error) {
 	conf := configFromDomain(domain)
 	conf.AllowUnencrypyed = true
 	conf.SoloMode = modeMetavisor
 	// It's important to log before setting the token, as it's sensitive
 	logging.Debugf("Parsed instance config: %s", conf.ToJSON())
 	if launchToken != "" {
-		isValid := isValidToken(launchToken)
-		if !isValid {
-			// The specified token is not a valid launch token
-			return "", ErrInvalidLaunchToken
+		if err := validateToken(launchToken, domain); err != nil {
+			return "", err
 		}
 		conf.IdentityToken = launchToken
 	}
+	guest, err := guestParts(guestUserdata)
+	if err != nil {
+		return "", err
+	}
+	if len(guest) > 0 {
+		logging.Infof("Keeping %d part(s) of the existing userdata of the instance", len(guest))
+	}
 	userDataContainer := userdata.New()
 	userDataContainer.AddPart(configContentType, conf.ToJSON())
-	userDataMIME := userDataContainer.ToMIMEText()
-	if compress {
-		compressed, err := compressString(userDataMIME)
-		if err != nil {
-			logging.Warning("Error while compressing userdata, using un-compressed instead")
-		} else {
-			userDataMIME = compressed
+	userDataContainer.Append(guest...)
+	return userdata.Encode(userDataContainer, compress)
+}
+
+// guestParts returns the parts of userdata that are not Metavisor config
+func guestParts(data string) ([]userdata.Part, error) {
+	container, err := userdata.Parse(data)
+	if err != nil {
+		logging.Debugf("Got error when parsing userdata: %s", err)
+		return nil, ErrInvalidGuestUserdata
+	}
+	parts := []userdata.Part{}
+	for _, p := range container.Parts() {
+		if p.ContentType == configContentType || isPlainBrktConfig(p) {
+			continue
 		}
+		parts = append(parts, p)
 	}
-	return userDataMIME, nil
+	return parts, nil
 }
 
-func compressString(input string) (string, error) {
-	buffer := new(bytes.Buffer)
-	writer := gzip.NewWriter(buffer)
-	_, err := writer.Write([]byte(input))
-	if err != nil {
-		logging.Debugf("Got error when gzipping data: %s", err)
+// restoreGuestUserdata returns the userdata of a wrapped instance without
+// the Metavisor config. A single part that cloud-init recognizes by itself,
+// like a script, is returned as is, otherwise a MIME message is returned.
+// ErrNoBrktConfig is returned if the userdata has no Metavisor config, as
+// it's then not the userdata of a wrapped instance.
+func restoreGuestUserdata(data string) (string, error) {
+	if _, err := parseBrktConfig(data); err != nil {
 		return "", err
 	}
-	err = writer.Close()
+	parts, err := guestParts(data)
 	if err != nil {
-		logging.Debugf("Got error when gzipping userdata: %s", err)
 		return "", err
 	}
-	return buffer.String(), nil
+	switch {
+	case len(parts) == 0:
+		return "", nil
+	case len(parts) == 1 && parts[0].Filename == "" && userdata.DetectContentType(parts[0].Content) == parts[0].ContentType:
+		return parts[0].Content, nil
+	}
+	container := userdata.New()
+	container.Append(parts...)
+	return userdata.Encode(container, len(container.ToMIMEText()) > userdata.MaxSize)
+}
+
+func isPlainBrktConfig(part userdata.Part) bool {
+	if !strings.HasPrefix(strings.TrimSpace(part.Content), "{") {
+		return false
+	}
+	_, err := unmarshalBrktConfig([]byte(part.Content))
+	return err == nil
+}
+
+// parseBrktConfig will find and parse the Metavisor config in userdata. The
+// userdata can be gzipped, and either a MIME multipart message with a
+// text/brkt-config part, or the JSON config by itself.
+func parseBrktConfig(data string) (instanceConfig, error) {
+	container, err := userdata.Parse(data)
+	if err != nil {
+		return instanceConfig{}, err
+	}
+	parts := container.Parts()
+	if len(parts) == 1 && strings.HasPrefix(strings.TrimSpace(parts[0].Content), "{") {
+		return unmarshalBrktConfig([]byte(parts[0].Content))
+	}
+	for _, p := range parts {
+		if p.ContentType == configContentType {
+			return unmarshalBrktConfig([]byte(p.Content))
+		}
+	}
+	logging.Debugf("No %s part found in userdata", configContentType)
+	return instanceConfig{}, ErrNoBrktConfig
+}
+
+func unmarshalBrktConfig(data []byte) (instanceConfig, error) {
+	conf := struct {
+		Config *instanceConfig `json:"brkt"`
+	}{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		logging.Debugf("Metavisor config could not be unmarshaled: %s", err)
+		return instanceConfig{}, err
+	}
+	if conf.Config == nil {
+		return instanceConfig{}, ErrNoBrktConfig
+	}
+	return *conf.Config, nil
 }
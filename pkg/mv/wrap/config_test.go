@@ -0,0 +1,124 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"testing"
+
+	"github.com/immutable/metavisor-cli/pkg/userdata"
+)
+
+func TestParseBrktConfig(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		data, err := generateUserdataString("", "example.com", "", compress)
+		if err != nil {
+			t.Fatalf("Got unexpected error when generating userdata: %s", err)
+		}
+		conf, err := parseBrktConfig(data)
+		if err != nil {
+			t.Fatalf("Got unexpected error when parsing userdata (compressed: %t): %s", compress, err)
+		}
+		if conf.APIHost != "yetiapi.example.com:443" {
+			t.Errorf("Got unexpected API host: %s", conf.APIHost)
+		}
+		if status, _ := brktConfigStatus(data); status != ConfigValid {
+			t.Errorf("Expected config to be %s, got %s", ConfigValid, status)
+		}
+	}
+}
+
+func TestParseBrktConfigPlainJSON(t *testing.T) {
+	conf, err := parseBrktConfig(`{"brkt": {"api_host": "yetiapi.example.com:443"}}`)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if conf.APIHost != "yetiapi.example.com:443" {
+		t.Errorf("Got unexpected API host: %s", conf.APIHost)
+	}
+}
+
+func TestBrktConfigStatus(t *testing.T) {
+	tests := map[string]string{
+		"":                              ConfigMissing,
+		"#!/bin/bash\necho hello":       ConfigMissing,
+		`{"brkt": {}}`:                  ConfigInvalid,
+		`{"brkt": {"api_host": "a:1"`:   ConfigInvalid,
+		`{"brkt": {"api_host": "a:1"}}`: ConfigValid,
+		`{"brkt": {"api_host": "a:1", "identity_token": "not-a-token"}}`: ConfigInvalid,
+	}
+	for data, expected := range tests {
+		if status, _ := brktConfigStatus(data); status != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, data, status)
+		}
+	}
+}
+
+func TestGenerateUserdataKeepsGuest(t *testing.T) {
+	guest := userdata.New()
+	guest.AddPart(configContentType, `{"brkt": {"api_host": "yetiapi.old.example.com:443"}}`)
+	guest.AddPart("text/cloud-config", "#cloud-config\npackages: [nginx]\n")
+	guest.Append(userdata.Part{ContentType: "text/x-shellscript", Filename: "setup.sh", Content: "#!/bin/sh\n"})
+	guestData, err := userdata.Encode(guest, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := generateUserdataString("", "example.com", guestData, true)
+	if err != nil {
+		t.Fatalf("Got unexpected error when generating userdata: %s", err)
+	}
+	if conf, err := parseBrktConfig(data); err != nil || conf.APIHost != "yetiapi.example.com:443" {
+		t.Errorf("Expected new Metavisor config, got %+v (%v)", conf, err)
+	}
+	parsed, err := userdata.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := parsed.Parts()
+	if len(parts) != 3 || parts[0].ContentType != configContentType || parts[2].Filename != "setup.sh" {
+		t.Errorf("Expected old config to be replaced and guest parts kept, got %+v", parts)
+	}
+
+	restored, err := restoreGuestUserdata(data)
+	if err != nil {
+		t.Fatalf("Got unexpected error when restoring userdata: %s", err)
+	}
+	parsed, err = userdata.Parse(restored)
+	if err != nil || len(parsed.Parts()) != 2 || parsed.Parts()[0].ContentType != "text/cloud-config" {
+		t.Errorf("Expected guest parts to be restored, got %+v (%v)", parsed, err)
+	}
+}
+
+func TestRestoreGuestUserdata(t *testing.T) {
+	tests := map[string]string{
+		"":                              "",
+		`{"brkt": {"api_host": "a:1"}}`: "",
+		"#!/bin/bash\necho hello\n":     "#!/bin/bash\necho hello\n",
+	}
+	for data, expected := range tests {
+		wrapped, err := generateUserdataString("", "example.com", data, false)
+		if err != nil {
+			t.Fatalf("Got unexpected error when generating userdata: %s", err)
+		}
+		if restored, err := restoreGuestUserdata(wrapped); err != nil || restored != expected {
+			t.Errorf("Expected %q to be restored, got %q (%v)", expected, restored, err)
+		}
+	}
+	if _, err := restoreGuestUserdata("#!/bin/bash\necho hello\n"); err != ErrNoBrktConfig {
+		t.Errorf("Expected ErrNoBrktConfig for userdata without config, got %v", err)
+	}
+	if _, err := generateUserdataString("", "example.com", "Content-Type: multipart/mixed\n\n", false); err != ErrInvalidGuestUserdata {
+		t.Errorf("Expected ErrInvalidGuestUserdata, got %v", err)
+	}
+}
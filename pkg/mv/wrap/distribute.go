@@ -0,0 +1,281 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+)
+
+const (
+	opAWSCopyImage = "aws-copy-image"
+
+	stepDeregisterImageCopy = "deregister-image-copy"
+	deregisterImageTimeout  = 2 * time.Minute
+)
+
+var (
+	// ErrInvalidRegion is returned if trying to copy an image to a region
+	// that doesn't exist
+	ErrInvalidRegion = errors.New("the specified region is not a valid AWS region")
+
+	// ErrInvalidPrincipal is returned if trying to share an image with
+	// something else than an account, organization or organizational unit
+	ErrInvalidPrincipal = errors.New("images can only be shared with account IDs, organization ARNs and organizational unit ARNs")
+
+	// ErrDistributionFailed is returned if the image could not be copied to,
+	// or shared in, all of the regions
+	ErrDistributionFailed = errors.New("the image could not be copied to or shared in all regions")
+)
+
+// DistributeConfig specifies where a wrapped image is copied to, and who
+// it's shared with
+type DistributeConfig struct {
+	// CopyToRegions are the regions the image is copied to, in addition to
+	// the region it was created in
+	CopyToRegions []string
+	// ShareWith are the account IDs, organization ARNs and organizational
+	// unit ARNs that the image and all of its copies are shared with
+	ShareWith    []string
+	IAMRoleARN   string
+	IAMDeviceARN string
+	IAMCode      string
+}
+
+// Empty is true if the image would neither be copied nor shared
+func (c DistributeConfig) Empty() bool {
+	return len(c.CopyToRegions) == 0 && len(c.ShareWith) == 0
+}
+
+// VerifyDistribution checks that all regions and principals in the config
+// are valid. It should be called before wrapping, so that the image isn't
+// created only to find out that it can't be distributed.
+func VerifyDistribution(conf DistributeConfig) error {
+	for _, r := range conf.CopyToRegions {
+		if !aws.IsValidRegion(r) {
+			logging.Errorf("Can't copy image to %s", r)
+			return ErrInvalidRegion
+		}
+	}
+	_, err := launchPermissions(conf.ShareWith)
+	return err
+}
+
+func launchPermissions(principals []string) (aws.LaunchPermissions, error) {
+	perms := aws.LaunchPermissions{}
+	for _, p := range principals {
+		switch {
+		case aws.IsAccountID(p):
+			perms.AccountIDs = append(perms.AccountIDs, p)
+		case aws.IsOrganizationARN(p):
+			perms.OrganizationARNs = append(perms.OrganizationARNs, p)
+		case aws.IsOrganizationalUnitARN(p):
+			perms.OrganizationalUnitARNs = append(perms.OrganizationalUnitARNs, p)
+		default:
+			logging.Errorf("Can't share image with %s", p)
+			return perms, ErrInvalidPrincipal
+		}
+	}
+	return perms, nil
+}
+
+// Distribute will copy the given image to all the regions in the config, at
+// the same time, and share the image and its copies. The result is a mapping
+// from region to AMI ID, which includes the given image. If some regions
+// fail, the regions that succeeded are still returned, together with
+// ErrDistributionFailed. Copies that never become available are deregistered.
+func Distribute(ctx context.Context, region, ami string, conf DistributeConfig) (map[string]string, error) {
+	err := VerifyDistribution(conf)
+	if err != nil {
+		return nil, err
+	}
+	perms, _ := launchPermissions(conf.ShareWith)
+	iamConf := &aws.IAMConfig{
+		RoleARN:      conf.IAMRoleARN,
+		MFADeviceARN: conf.IAMDeviceARN,
+		MFACode:      conf.IAMCode,
+	}
+	service, err := aws.New(region, iamConf)
+	if err != nil {
+		if err == aws.ErrInvalidARN {
+			logging.Error("Failed to assume IAM role")
+		}
+		return nil, err
+	}
+	source, err := service.GetImage(ctx, ami)
+	if err != nil {
+		return nil, err
+	}
+
+	images := map[string]string{region: ami}
+	failed := false
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, r := range distinctRegions(region, conf.CopyToRegions) {
+		wg.Add(1)
+		go func(dest string) {
+			defer wg.Done()
+			copied, err := awsCopyImage(ctx, region, dest, source, iamConf)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				logging.Errorf("Failed to copy image to %s: %s", dest, err)
+				failed = true
+				return
+			}
+			images[dest] = copied
+		}(r)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return images, mv.ErrInterrupted
+	}
+
+	if !perms.Empty() {
+		for r, id := range images {
+			err = awsShareImage(ctx, r, id, perms, iamConf)
+			if err != nil {
+				logging.Errorf("Failed to share image %s in %s: %s", id, r, err)
+				failed = true
+			}
+		}
+	}
+	if failed {
+		return images, ErrDistributionFailed
+	}
+	return images, nil
+}
+
+func distinctRegions(source string, regions []string) []string {
+	seen := map[string]bool{source: true}
+	res := []string{}
+	for _, r := range regions {
+		if !seen[r] {
+			seen[r] = true
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+func awsCopyImage(ctx context.Context, sourceRegion, region string, source aws.Image, iamConf *aws.IAMConfig) (string, error) {
+	service, err := aws.New(region, iamConf)
+	if err != nil {
+		return "", err
+	}
+	tx := mv.NewTransaction(fmt.Sprintf("%s %s %s", opAWSCopyImage, source.ID(), region))
+	ami, err := awsCopyImageTx(ctx, service, sourceRegion, region, source, tx)
+	tx.Finish(err == nil)
+	return ami, err
+}
+
+func awsCopyImageTx(ctx context.Context, awsSvc aws.Service, sourceRegion, region string, source aws.Image, tx *mv.Transaction) (string, error) {
+	logging.Infof("Copying image %s to %s", source.ID(), region)
+	ami, err := awsSvc.CopyImage(ctx, sourceRegion, source.ID(), source.Name(), source.Description())
+	if err != nil {
+		if err == aws.ErrNotAllowed {
+			logging.Errorf("Not enough IAM permissions to copy image to %s", region)
+		}
+		return "", err
+	}
+	tx.Compensate(stepDeregisterImageCopy, deregisterImageTimeout, func(ctx context.Context) error {
+		logging.Infof("Deregistering image copy %s in %s", ami, region)
+		return awsSvc.DeregisterImage(ctx, ami)
+	})
+	// Tags are not copied with the image, which includes the Metavisor tags
+	if err = awsSvc.TagResources(ctx, userTags(source.Tags()), ami); err != nil {
+		logging.Warningf("Failed to tag image %s", ami)
+		logging.Debugf("Got error while tagging image: %s", err)
+	}
+	logging.Infof("Waiting for image %s in %s to become available", ami, region)
+	err = awsSvc.AwaitImageAvailable(ctx, ami)
+	if err != nil {
+		logging.Errorf("Image %s in %s never became available", ami, region)
+		return "", err
+	}
+	logging.Infof("Image %s is available in %s", ami, region)
+	return ami, nil
+}
+
+func awsShareImage(ctx context.Context, region, ami string, perms aws.LaunchPermissions, iamConf *aws.IAMConfig) error {
+	service, err := aws.New(region, iamConf)
+	if err != nil {
+		return err
+	}
+	logging.Infof("Sharing image %s in %s", ami, region)
+	err = service.ShareImage(ctx, ami, perms)
+	if err != nil {
+		if err == aws.ErrNotAllowed {
+			logging.Error("Not enough IAM permissions to share image")
+		}
+		return err
+	}
+	if len(perms.AccountIDs) == 0 {
+		// Organizations can't be given access to snapshots, but can still
+		// launch the image
+		return nil
+	}
+	img, err := service.GetImage(ctx, ami)
+	if err != nil {
+		return err
+	}
+	for _, snap := range img.DeviceMapping() {
+		err = service.ShareSnapshot(ctx, snap, perms.AccountIDs...)
+		if err != nil {
+			if err == aws.ErrNotAllowed {
+				logging.Error("Not enough IAM permissions to share snapshot")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// FormatImages will format a mapping from region to AMI ID for display. If
+// withJSON is true, the mapping will be formatted as a JSON object.
+func FormatImages(images map[string]string, withJSON bool) (string, error) {
+	if withJSON {
+		data, err := json.MarshalIndent(images, "", "\t")
+		if err != nil {
+			logging.Errorf("Failed to marshal images to JSON: %s", err)
+		}
+		return string(data), err
+	}
+	regions := make([]string, 0, len(images))
+	for r := range images {
+		regions = append(regions, r)
+	}
+	sort.Strings(regions)
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "REGION\tAMI")
+	for _, r := range regions {
+		fmt.Fprintf(w, "%s\t%s\n", r, images[r])
+	}
+	w.Flush()
+	return strings.TrimRight(b.String(), "\n"), nil
+}
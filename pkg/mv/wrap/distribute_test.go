@@ -0,0 +1,62 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVerifyDistribution(t *testing.T) {
+	valid := DistributeConfig{
+		CopyToRegions: []string{"us-east-1", "eu-west-1"},
+		ShareWith: []string{
+			"123456789012",
+			"arn:aws:organizations::123456789012:organization/o-abc123",
+			"arn:aws:organizations::123456789012:ou/o-abc123/ou-ab12-cd34ef56",
+		},
+	}
+	if err := VerifyDistribution(valid); err != nil {
+		t.Errorf("Got unexpected error: %s", err)
+	}
+	if err := VerifyDistribution(DistributeConfig{CopyToRegions: []string{"mars-north-1"}}); err != ErrInvalidRegion {
+		t.Errorf("Expected ErrInvalidRegion, got %v", err)
+	}
+	if err := VerifyDistribution(DistributeConfig{ShareWith: []string{"arn:aws:iam::123456789012:root"}}); err != ErrInvalidPrincipal {
+		t.Errorf("Expected ErrInvalidPrincipal, got %v", err)
+	}
+}
+
+func TestDistinctRegions(t *testing.T) {
+	regions := distinctRegions("us-west-2", []string{"us-east-1", "us-west-2", "us-east-1", "eu-west-1"})
+	if len(regions) != 2 || regions[0] != "us-east-1" || regions[1] != "eu-west-1" {
+		t.Errorf("Got unexpected regions: %v", regions)
+	}
+}
+
+func TestFormatImagesJSON(t *testing.T) {
+	images := map[string]string{"us-west-2": "ami-1", "us-east-1": "ami-2"}
+	output, err := FormatImages(images, true)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	res := make(map[string]string)
+	if err = json.Unmarshal([]byte(output), &res); err != nil {
+		t.Fatalf("Output is not valid JSON: %s", err)
+	}
+	if len(res) != 2 || res["us-east-1"] != "ami-2" {
+		t.Errorf("Got unexpected output: %s", output)
+	}
+}
@@ -0,0 +1,160 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/gcp"
+	"github.com/immutable/metavisor-cli/pkg/csp/gcp/fake"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+)
+
+const (
+	testProject = "test-project"
+	testZone    = "us-east1-b"
+	testMVImage = "projects/metavisor/global/images/metavisor-3-1-2"
+)
+
+func newTestGCP(t *testing.T) (gcp.Config, *fake.Compute, func()) {
+	compute := fake.New()
+	compute.AddImage("metavisor", "metavisor-3-1-2", nil)
+	server := httptest.NewServer(compute)
+	return gcp.Config{
+		Project:      testProject,
+		Zone:         testZone,
+		AccessToken:  "test-token",
+		Endpoint:     server.URL,
+		PollInterval: time.Millisecond,
+	}, compute, server.Close
+}
+
+func TestWrapGCPInstance(t *testing.T) {
+	gcpConf, compute, done := newTestGCP(t)
+	defer done()
+	compute.AddInstance(testProject, testZone, "guest", nil)
+	conf := Config{MetavisorAMI: testMVImage, MetavisorVersion: "3.1.2"}
+
+	wrapped, err := GCPInstance(context.Background(), nil, gcpConf, "guest", conf)
+	if err != nil {
+		t.Fatalf("Got unexpected error when wrapping: %s", err)
+	}
+	if wrapped.InstanceID != "guest" || wrapped.Region != testZone {
+		t.Errorf("Got unexpected result: %+v", wrapped)
+	}
+	inst := compute.Instance(testProject, testZone, "guest")
+	if inst.Status != "RUNNING" {
+		t.Errorf("Expected wrapped instance to be running, was %s", inst.Status)
+	}
+	for _, d := range inst.Disks {
+		switch d.DeviceName {
+		case fake.BootDeviceName:
+			if !d.Boot || strings.HasSuffix(d.Source, "/guest") {
+				t.Errorf("Expected Metavisor disk to be the boot disk, got %s", d.Source)
+			}
+		case gcp.GuestDeviceName:
+			if d.Boot || !strings.HasSuffix(d.Source, "/guest") {
+				t.Errorf("Expected guest disk on the guest device, got %s", d.Source)
+			}
+		default:
+			t.Errorf("Got unexpected device %s", d.DeviceName)
+		}
+		if !d.AutoDelete {
+			t.Errorf("Expected %s to be deleted with the instance", d.DeviceName)
+		}
+	}
+	if inst.Labels[TagMetavisorVersion] != "3-1-2" {
+		t.Errorf("Got unexpected labels: %v", inst.Labels)
+	}
+	if len(inst.Metadata.Items) != 1 || !strings.Contains(inst.Metadata.Items[0].Value, "text/brkt-config") {
+		t.Errorf("Got unexpected metadata: %v", inst.Metadata.Items)
+	}
+
+	// Wrapping it again must be refused
+	if _, err = GCPInstance(context.Background(), nil, gcpConf, "guest", conf); err != ErrAlreadyWrapped {
+		t.Errorf("Got unexpected error when wrapping twice: %v", err)
+	}
+}
+
+func TestGCPWrapInstanceRollback(t *testing.T) {
+	gcpConf, compute, done := newTestGCP(t)
+	defer done()
+	compute.AddInstance(testProject, testZone, "guest", nil)
+	compute.FailNext(http.MethodPost, "/instances/guest/start", http.StatusInternalServerError)
+
+	tx := mv.NewTransaction("test")
+	_, err := GCPInstance(context.Background(), tx, gcpConf, "guest", Config{MetavisorAMI: testMVImage})
+	if err == nil {
+		t.Fatal("Expected wrap to fail when the instance can't be started")
+	}
+	res := tx.Result()
+	if !res.RolledBack() || len(res.Failed()) != 0 {
+		t.Errorf("Expected all cleanup steps to succeed: %v", res.Steps)
+	}
+	inst := compute.Instance(testProject, testZone, "guest")
+	if len(inst.Disks) != 1 || !inst.Disks[0].Boot || !strings.HasSuffix(inst.Disks[0].Source, "/guest") {
+		t.Errorf("Expected guest disk to be restored as boot disk: %v", inst.Disks)
+	}
+	if instances, disks, _ := compute.Count(); instances != 1 || disks != 1 {
+		t.Errorf("Got unexpected leftover resources: %d instances, %d disks", instances, disks)
+	}
+}
+
+func TestGCPWrapInstanceRequiresImage(t *testing.T) {
+	gcpConf, compute, done := newTestGCP(t)
+	defer done()
+	compute.AddInstance(testProject, testZone, "guest", nil)
+	if _, err := GCPInstance(context.Background(), nil, gcpConf, "guest", Config{}); err != ErrNoMetavisorImage {
+		t.Errorf("Got unexpected error without Metavisor image: %v", err)
+	}
+}
+
+func TestWrapGCPImage(t *testing.T) {
+	gcpConf, compute, done := newTestGCP(t)
+	defer done()
+	compute.AddImage(testProject, "guest-image", map[string]string{"team": "infra"})
+	conf := Config{
+		MetavisorAMI:     testMVImage,
+		MetavisorVersion: "3.1.2",
+		NameTemplate:     "{{.SourceName}}-mv-{{.MetavisorVersion}}",
+	}
+
+	wrapped, err := GCPImage(context.Background(), nil, gcpConf, "guest-image", conf)
+	if err != nil {
+		t.Fatalf("Got unexpected error when wrapping image: %s", err)
+	}
+	img := wrapped.ImageID
+	machineImage := compute.MachineImage(testProject, img[strings.LastIndex(img, "/")+1:])
+	if machineImage == nil {
+		t.Fatalf("Expected machine image %s to exist", img)
+	}
+	if !strings.HasPrefix(machineImage.Name, "guest-image-mv-3-1-2") {
+		t.Errorf("Got unexpected image name: %s", machineImage.Name)
+	}
+	if len(machineImage.SavedDisks) != 2 {
+		t.Errorf("Expected image to contain both Metavisor and guest disk: %v", machineImage.SavedDisks)
+	}
+	if machineImage.Labels["team"] != "infra" || machineImage.Labels[TagMetavisorVersion] != "3-1-2" {
+		t.Errorf("Got unexpected image labels: %v", machineImage.Labels)
+	}
+	if instances, disks, _ := compute.Count(); instances != 0 || disks != 0 {
+		t.Errorf("Got unexpected leftover resources: %d instances, %d disks", instances, disks)
+	}
+}
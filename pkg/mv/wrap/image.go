@@ -16,148 +16,232 @@ package wrap
 
 import (
 	"context"
-	"fmt"
 	"strings"
-	"time"
 
+	"github.com/immutable/metavisor-cli/pkg/csp"
 	"github.com/immutable/metavisor-cli/pkg/csp/aws"
 	"github.com/immutable/metavisor-cli/pkg/logging"
 	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/mv/journal"
 )
 
-const (
-	newNameTemplate    = "Metavisor wrapped image based on %s (%s)"
-	newDesc            = "Metavisor wrapped by Immutable Systems"
-	appendDescTemplate = "%s - %s - wrapped by Immutable Systems"
-)
-
-func awsWrapImage(ctx context.Context, awsSvc aws.Service, region, id string, conf Config) (string, error) {
+// awsWrapImage checks the parts of the config that are specific to AWS, and
+// finds the Metavisor AMI if it wasn't specified, before wrapping the image
+// in the same way as in any other cloud
+func awsWrapImage(ctx context.Context, awsSvc aws.Service, region, id string, conf Config, jrnl *journal.Journal, tx *mv.Transaction) (*ImageResult, error) {
 	if !aws.IsAMIID(id) {
-		return "", aws.ErrInvalidAMIID
+		return nil, aws.ErrInvalidAMIID
 	}
-	if conf.SubnetID != "" && !aws.IsSubnetID(conf.SubnetID) {
-		// User specified an invalid subnet ID
-		logging.Error("The specified Subnet ID is not a valid subnet ID")
-		return "", aws.ErrInvalidSubnetID
+	err := awsVerifyConfig(conf)
+	if err != nil {
+		return nil, err
 	}
-	if conf.Token != "" {
-		isValid := isValidToken(conf.Token)
-		if !isValid {
-			// The specified token is not a valid launch token
-			logging.Error("The specified token is not a launch token")
-			return "", ErrInvalidLaunchToken
-		}
+	conf, err = awsMetavisorConfig(ctx, region, conf, jrnl)
+	if err != nil {
+		return nil, err
 	}
+	return wrapImage(ctx, aws.NewProvider(awsSvc, region), id, conf, jrnl, tx)
+}
 
-	// Launch a new instance
-	logging.Info("Launching temporary wrapper instance")
-	instanceName := "Temporary-Metavisor-wrapper-instance"
-	instanceTags := map[string]string{
-		"Name": instanceName,
-	}
-	inst, err := awsSvc.LaunchInstance(ctx, id, aws.LargerInstanceType, "", "", conf.SubnetID, instanceTags)
-	if err != nil {
-		switch err {
-		case aws.ErrNotAllowed:
-			logging.Error("Not enough IAM permissions to launch instance")
-			break
-		case aws.ErrRequiresSubnet:
-			logging.Error("A subnet ID must be specified in order to launch instance")
-			logging.Error("Please specify subnet ID with the --subnet-id flag")
-			break
-		default:
-			logging.Error("Could not launch instance based on specified AMI")
-			break
+// wrapImage launches a temporary instance from the image, wraps it with the
+// Metavisor image in the config, and creates a new image from it. Progress is
+// recorded in the journal, which can be nil, in the same way as wrapInstance.
+func wrapImage(ctx context.Context, provider csp.Provider, id string, conf Config, jrnl *journal.Journal, tx *mv.Transaction) (*ImageResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Region: provider.Region(), Resources: map[string]string{resImage: id}})
+	ctx = logging.NewContext(ctx, log)
+	region := provider.Region()
+	instID := jrnl.Resource(resTemporaryInstance)
+	if instID == "" {
+		sourceImage, err := provider.GetImage(ctx, id)
+		if err != nil {
+			log.Errorf("Could not get image %s", id)
+			return nil, err
 		}
-		return "", err
+		if err = checkImageNotWrapped(provider, sourceImage); err != nil {
+			return nil, err
+		}
+		// When resuming, this was checked before the instance was launched
+		data := newImageTemplateData(sourceImage, id, conf.MetavisorVersion, region)
+		if err = verifyImageNaming(conf, data); err != nil {
+			return nil, err
+		}
+		// Launch a new instance
+		log.Info("Launching temporary wrapper instance")
+		inst, err := provider.LaunchInstance(ctx, csp.LaunchConfig{
+			Image:    id,
+			Larger:   true,
+			SubnetID: conf.SubnetID,
+			Tags:     map[string]string{"Name": temporaryInstanceTag},
+		})
+		if err != nil {
+			switch err {
+			case csp.ErrNotAllowed:
+				log.Error("Not enough permissions to launch instance")
+			case aws.ErrRequiresSubnet:
+				log.Error("A subnet ID must be specified in order to launch instance")
+				log.Error("Please specify subnet ID with the --subnet-id flag")
+			default:
+				log.Error("Could not launch instance based on specified image")
+			}
+			return nil, err
+		}
+		instID = inst.ID()
+		recordStep(jrnl, stepTemporaryLaunched, map[string]string{
+			resTemporaryInstance: instID,
+		})
+		log.Infof("Launched instance with ID: %s", instID)
+		log.EmitStep(logging.EventInstanceLaunched, stepTemporaryLaunched, map[string]string{
+			resTemporaryInstance: instID,
+		})
 	}
-	mv.QueueCleanup(func() {
+	tx.Finally(stepTerminateTemporaryInstance, terminateInstanceTimeout, func(ctx context.Context) error {
+		log := log.With(logging.Fields{Step: stepTerminateTemporaryInstance})
 		// Finally clean up temporary instance
-		logging.Info("Cleaning up temporary instance")
-		err = awsSvc.TerminateInstance(context.Background(), inst.ID())
+		log.Info("Cleaning up temporary instance")
+		// Volumes that were moved around, e.g. when restoring the guest
+		// volume, no longer go away with the instance unless told to
+		if err := provider.DeleteDisksOnTermination(ctx, instID); err != nil {
+			log.Debugf("Could not set devices to delete on termination: %s", err)
+		}
+		err := provider.TerminateInstance(ctx, instID)
 		if err != nil {
-			logging.Warningf("Failed to cleanup temporary instance %s", inst.ID())
-			logging.Debugf("Error when cleaning up instance: %s", err)
+			log.Warningf("Failed to cleanup temporary instance %s", instID)
+			log.Debugf("Error when cleaning up instance: %s", err)
+			return err
 		}
-		logging.Infof("Instance %s terminated", inst.ID())
-	}, false)
-	logging.Infof("Launched instance with ID: %s", inst.ID())
-	logging.Info("Waiting for instance to become ready...")
-	err = awsSvc.AwaitInstanceRunning(ctx, inst.ID())
-	if err != nil {
-		// Instance never became ready
-		if err == aws.ErrNotAllowed {
-			logging.Error("Not enough IAM permissions to see instance status")
-		} else {
-			logging.Error("Instance never got ready")
+		log.Infof("Instance %s terminated", instID)
+		log.EmitStep(logging.EventInstanceTerminated, stepTerminateTemporaryInstance, map[string]string{
+			resTemporaryInstance: instID,
+		})
+		return nil
+	})
+	if !jrnl.Completed(stepInstanceStopped) {
+		log.Info("Waiting for instance to become ready...")
+		err := provider.AwaitInstanceRunning(ctx, instID)
+		if err != nil {
+			// Instance never became ready
+			if err == csp.ErrNotAllowed {
+				log.Error("Not enough permissions to see instance status")
+			} else {
+				log.Error("Instance never got ready")
+			}
+			return nil, err
 		}
-		return "", err
+		log.Info("Instance is ready")
 	}
-	logging.Info("Instance is ready")
 
-	// Then wrap the instance
-	logging.Info("Wrapping the temporary instance with Metavisor")
-	instID, err := awsWrapInstance(ctx, awsSvc, region, inst.ID(), conf)
-	if err != nil {
-		logging.Error("Failed to wrap the temporary instance")
-		return "", err
-	}
-	logging.Infof("Successfully wrapped temporary instance %s", instID)
-	logging.Info("Waiting for instance to become ready before creating AMI...")
+	img := jrnl.Resource(resImage)
+	if img == "" {
+		// Then wrap the instance
+		log.Info("Wrapping the temporary instance with Metavisor")
+		_, err := wrapInstance(ctx, provider, instID, conf, jrnl, tx)
+		if err != nil {
+			log.Error("Failed to wrap the temporary instance")
+			return nil, err
+		}
+		log.Infof("Successfully wrapped temporary instance %s", instID)
+		if checker, ok := provider.(csp.HealthChecker); ok {
+			log.Info("Waiting for instance to become ready before creating image...")
+			err = checker.AwaitInstanceOK(ctx, instID)
+			if err != nil {
+				switch err {
+				case csp.ErrNotAllowed:
+					log.Error("Not enough permissions to get instance health status")
+				case aws.ErrInstanceImpaired:
+					log.Error("The instance is not passing health checks")
+				default:
+					log.Error("An error occurred while waiting for instance to get healthy")
+				}
+				return nil, err
+			}
+			log.Info("Instance is ready")
+		}
 
-	err = awsSvc.AwaitInstanceOK(ctx, instID)
-	if err != nil {
-		switch err {
-		case aws.ErrNotAllowed:
-			logging.Error("Not enough IAM permissions to get instance health status")
-		case aws.ErrInstanceImpaired:
-			logging.Error("The instance is not passing health checks")
-		default:
-			logging.Error("An error occurred while waiting for instance to get healthy")
+		// Now create an image from the instance
+		log.Info("Getting name and description of source image")
+		sourceImage, err := provider.GetImage(ctx, id)
+		if err != nil {
+			if err != csp.ErrNotAllowed {
+				return nil, err
+			}
+			log.Warning("Not enough permissions to get image details, using defaults")
+			sourceImage = nil
 		}
-		return "", err
-	}
-	logging.Info("Instance is ready")
+		version := conf.MetavisorVersion
+		if version == "" {
+			// The version is also tagged on the wrapped instance
+			if inst, err := provider.GetInstance(ctx, instID); err == nil {
+				version = inst.Tags()[TagMetavisorVersion]
+			}
+		}
+		data := newImageTemplateData(sourceImage, id, version, region)
+		name, desc, err := imageNameAndDescription(conf, data, sourceImage != nil)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("New image name will be \"%s\"", name)
+		log.Infof("New image description will be \"%s\"", desc)
+		log.Info("Creating new image based on wrapped instance")
 
-	// Now create an AMI from the instance
-	logging.Info("Getting name and description of source image")
-	var name, desc string
-	sourceImage, err := awsSvc.GetImage(ctx, id)
-	if err != nil {
-		if err == aws.ErrNotAllowed {
-			logging.Warning("Not enough IAM permissions to get image details, using defaults")
-			name = fmt.Sprintf(newNameTemplate, id, time.Now().Format("2006-01-02 15.04.05"))
-			desc = newDesc
-		} else {
-			return "", err
+		img, err = provider.CreateImage(ctx, instID, name, desc)
+		if err != nil {
+			log.Error("Failed to create new image")
+			if strings.Contains(err.Error(), "not in state 'running' or 'stopped'") {
+				// This errors means that the MV started shutting the instance down.
+				// In 90% of the cases this is because of an invalid token and the MV
+				// can't communicate with Yeti.
+				log.Debugf("Got error while creating image: %v", err)
+				return nil, ErrMetavisorShuttingDown
+			}
+			return nil, err
 		}
-	} else {
-		name = fmt.Sprintf(newNameTemplate, id, time.Now().Format("2006-01-02 15.04.05"))
-		desc = fmt.Sprintf(appendDescTemplate, sourceImage.Name(), sourceImage.Description())
+		recordStep(jrnl, stepImageCreated, map[string]string{
+			resImage: img,
+		})
+		log.Infof("Created image: %s", img)
+		log.EmitStep(logging.EventImageCreated, stepImageCreated, map[string]string{
+			resImage:             img,
+			resTemporaryInstance: instID,
+		})
+		tagWrappedImage(ctx, provider, instID, img)
 	}
-	logging.Infof("New AMI name will be \"%s\"", name)
-	logging.Infof("New AMI description will be \"%s\"", desc)
-	logging.Info("Creating new AMI based on wrapped instance")
-
-	ami, err := awsSvc.CreateImage(ctx, instID, name, desc)
+	tx.Compensate(stepDeleteImage, deleteImageTimeout, func(ctx context.Context) error {
+		log := log.With(logging.Fields{Step: stepDeleteImage})
+		log.Infof("Deleting image %s", img)
+		return provider.DeleteImage(ctx, img)
+	})
+	log.Info("Waiting for image to become available")
+	err := provider.AwaitImageAvailable(ctx, img)
 	if err != nil {
-		logging.Error("Failed to create new AMI")
-		if strings.Contains(err.Error(), "not in state 'running' or 'stopped'") {
-			// This errors means that the MV started shutting the instance down.
-			// In 90% of the cases this is because of an invalid token and the MV
-			// can't communicate with Yeti.
-			logging.Debugf("Got AWS error while creating AMI: %v", err)
-			return "", ErrMetavisorShuttingDown
-		}
-		return "", err
+		log.Error("Image never became available")
+		return nil, err
 	}
-	logging.Infof("Created AMI: %s", ami)
-	logging.Info("Waiting for image to become available")
-	err = awsSvc.AwaitImageAvailable(ctx, ami)
+	log.Info("Image is available")
+	sourceImage, err := provider.GetImage(ctx, id)
 	if err != nil {
-		logging.Error("Image never became available")
-		return "", err
+		log.Warning("Could not get the source image, its tags will not be copied")
+		log.Debugf("Got error while getting source image: %s", err)
+		sourceImage = nil
+	}
+	propagateTags(ctx, provider, sourceImage, img, conf.Tags)
+	recordStep(jrnl, stepImageAvailable, nil)
+	log.EmitStep(logging.EventImageAvailable, stepImageAvailable, map[string]string{
+		resImage: img,
+	})
+	res := &ImageResult{
+		ImageID:           img,
+		Region:            region,
+		SourceImage:       id,
+		TemporaryInstance: instID,
+	}
+	if wrapped, err := provider.GetImage(ctx, img); err == nil {
+		res.MetavisorVersion = wrapped.Tags()[TagMetavisorVersion]
+		res.MetavisorAMI = wrapped.Tags()[TagMetavisorAMI]
+		if mapped, ok := wrapped.(csp.MappedImage); ok {
+			res.Snapshots = mapped.DeviceMapping()
+		}
+	} else {
+		log.Debugf("Could not get details of wrapped image: %s", err)
 	}
-	logging.Info("Image is available")
-	return ami, nil
+	return res, nil
 }
@@ -0,0 +1,131 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws/fake"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestAWSWrapImage(t *testing.T) {
+	ec2, conf := newTestEC2()
+	ec2.Latencies.InstanceStart = 5 * time.Millisecond
+	ec2.Latencies.Image = 5 * time.Millisecond
+	source := ec2.AddImage("guest", 8, map[string]string{"team": "platform"})
+	conf.Tags = map[string]string{"env": "test"}
+	tx := mv.NewTransaction("test")
+
+	wrapped, err := awsWrapImage(context.Background(), ec2, testRegion, source, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when wrapping: %s", err)
+	}
+	img := ec2.Image(wrapped.ImageID)
+	if img.State != fake.StateAvailable {
+		t.Errorf("Expected wrapped image to be available, was %s", img.State)
+	}
+	if _, hasGuest := img.Devices[GuestDeviceName]; !hasGuest || len(img.Devices) != 2 {
+		t.Errorf("Expected Metavisor and guest devices in image, got %v", img.Devices)
+	}
+	if !img.ENASupport {
+		t.Error("Expected wrapped image to support ENA")
+	}
+	if img.Tags["team"] != "platform" || img.Tags["env"] != "test" || img.Tags[TagMetavisorVersion] == "" {
+		t.Errorf("Got unexpected image tags: %v", img.Tags)
+	}
+	if wrapped.SourceImage != source || wrapped.MetavisorVersion != conf.MetavisorVersion || wrapped.MetavisorAMI != conf.MetavisorAMI || wrapped.TemporaryInstance == "" {
+		t.Errorf("Got unexpected result: %+v", wrapped)
+	}
+	if len(wrapped.Snapshots) != 2 || wrapped.Snapshots[GuestDeviceName] != img.Devices[GuestDeviceName] {
+		t.Errorf("Expected snapshots of image in result, got %v", wrapped.Snapshots)
+	}
+	res := ec2.Resources()
+	if len(res.Instances) != 0 || len(res.Volumes) != 0 {
+		t.Errorf("Expected temporary instance and volumes to be gone, got %v", res)
+	}
+}
+
+func TestAWSWrapImageShuttingDown(t *testing.T) {
+	ec2, conf := newTestEC2()
+	source := ec2.AddImage("guest", 8, nil)
+	before := ec2.Resources()
+	ec2.FailNext("CreateImage", awserr.New("IncorrectInstanceState", "Instance 'i-1' is not in state 'running' or 'stopped'", nil))
+	tx := mv.NewTransaction("test")
+
+	_, err := awsWrapImage(context.Background(), ec2, testRegion, source, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != ErrMetavisorShuttingDown {
+		t.Fatalf("Expected ErrMetavisorShuttingDown, got: %v", err)
+	}
+	if failed := tx.Result().Failed(); len(failed) > 0 {
+		t.Errorf("Got unexpected failed cleanup steps: %v", failed)
+	}
+	after := ec2.Resources()
+	if len(after.Instances) != 0 || len(after.Volumes) != 0 || len(after.Images) != len(before.Images) {
+		t.Errorf("Expected no resources to be left behind, got %v", after)
+	}
+}
+
+func TestAWSWrapImageRequiresSubnet(t *testing.T) {
+	ec2, conf := newTestEC2()
+	ec2.RequireSubnet = true
+	source := ec2.AddImage("guest", 8, nil)
+	tx := mv.NewTransaction("test")
+
+	_, err := awsWrapImage(context.Background(), ec2, testRegion, source, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err == nil {
+		t.Fatal("Expected error when launching without subnet")
+	}
+	if n := ec2.Calls("TerminateInstances"); n != 0 {
+		t.Errorf("Expected no instance to be terminated, got %d calls", n)
+	}
+}
+
+func TestAWSWrapImageAlreadyWrapped(t *testing.T) {
+	ec2, conf := newTestEC2()
+	source := ec2.AddImage("guest", 8, nil)
+	tx := mv.NewTransaction("test")
+	wrapped, err := awsWrapImage(context.Background(), ec2, testRegion, source, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when wrapping: %s", err)
+	}
+
+	tx = mv.NewTransaction("test")
+	_, err = awsWrapImage(context.Background(), ec2, testRegion, wrapped.ImageID, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != ErrAlreadyWrapped {
+		t.Errorf("Expected ErrAlreadyWrapped for tagged image, got: %v", err)
+	}
+
+	// Without the tags only the guest device is in the way
+	err = ec2.UntagResources(context.Background(), []string{TagMetavisorVersion}, wrapped.ImageID)
+	if err != nil {
+		t.Fatalf("Got unexpected error when untagging: %s", err)
+	}
+	tx = mv.NewTransaction("test")
+	_, err = awsWrapImage(context.Background(), ec2, testRegion, wrapped.ImageID, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != ErrDeviceOccupied {
+		t.Errorf("Expected ErrDeviceOccupied for untagged image, got: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/token"
+)
+
+const (
+	// ResourceInstance is the type of inspected instances
+	ResourceInstance = "instance"
+	// ResourceImage is the type of inspected images
+	ResourceImage = "image"
+
+	// ConfigValid means that the userdata has a valid Metavisor config
+	ConfigValid = "valid"
+	// ConfigInvalid means that the userdata has a Metavisor config, but it
+	// can't be used by the Metavisor
+	ConfigInvalid = "invalid"
+	// ConfigMissing means that the userdata has no Metavisor config
+	ConfigMissing = "missing"
+)
+
+var (
+	// ErrImageRegionRequired is returned if trying to inspect an image
+	// without specifying a region
+	ErrImageRegionRequired = errors.New("a region must be specified when inspecting an image")
+
+	// ErrUnknownResource is returned if trying to inspect something that is
+	// neither an instance nor an image
+	ErrUnknownResource = errors.New("only instances (i-XXXXXXX) and images (ami-XXXXXXX) can be inspected")
+
+	errNoAPIHost      = errors.New("the Metavisor config has no api_host")
+	errInvalidIDToken = errors.New("the identity token is not a valid launch token")
+)
+
+// Inspection describes if an instance or image is wrapped with Metavisor.
+// For images, the volume fields hold snapshot IDs instead of volume IDs.
+type Inspection struct {
+	ID               string `json:"id"`
+	Type             string `json:"type"`
+	Region           string `json:"region"`
+	Wrapped          bool   `json:"wrapped"`
+	MetavisorVersion string `json:"metavisor_version,omitempty"`
+	MetavisorAMI     string `json:"metavisor_ami,omitempty"`
+	WrappedAt        string `json:"wrapped_at,omitempty"`
+	MetavisorVolume  string `json:"metavisor_volume,omitempty"`
+	GuestVolume      string `json:"guest_volume,omitempty"`
+	GuestDevice      string `json:"guest_device,omitempty"`
+	// Config is the status of the Metavisor config in the userdata of an
+	// instance, and is one of ConfigValid, ConfigInvalid and ConfigMissing
+	Config      string `json:"config,omitempty"`
+	ConfigError string `json:"config_error,omitempty"`
+}
+
+// Inspect will determine if the given instance or image is wrapped with
+// Metavisor, and with which version. If no region is specified for an
+// instance, it's determined automatically. Nothing is modified in AWS.
+func Inspect(ctx context.Context, region, id string, conf Config) (*Inspection, error) {
+	if !aws.IsInstanceID(id) && !aws.IsAMIID(id) {
+		return nil, ErrUnknownResource
+	}
+	iamConf := &aws.IAMConfig{
+		RoleARN:      conf.IAMRoleARN,
+		MFADeviceARN: conf.IAMDeviceARN,
+		MFACode:      conf.IAMCode,
+	}
+	if strings.TrimSpace(region) == "" {
+		if aws.IsAMIID(id) {
+			return nil, ErrImageRegionRequired
+		}
+		logging.Info("No region was specified, attempting to find it automatically")
+		reg, err := aws.FindInstanceRegion(id, iamConf)
+		if err != nil {
+			if err == aws.ErrAmbigiousInstanceRegion {
+				logging.Warning("Please specify instance region with: --region")
+			}
+			return nil, err
+		}
+		region = reg
+	}
+	service, err := aws.New(region, iamConf)
+	if err != nil {
+		if err == aws.ErrInvalidARN {
+			logging.Error("Failed to assume IAM role")
+		}
+		return nil, err
+	}
+	if aws.IsAMIID(id) {
+		return awsInspectImage(ctx, service, region, id)
+	}
+	return awsInspectInstance(ctx, service, region, id)
+}
+
+func awsInspectInstance(ctx context.Context, awsSvc aws.Service, region, id string) (*Inspection, error) {
+	inst, err := awsSvc.GetInstance(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	res := &Inspection{
+		ID:     id,
+		Type:   ResourceInstance,
+		Region: region,
+	}
+	tagged := setWrapTags(res, inst.Tags())
+
+	data, err := awsSvc.GetInstanceUserdata(ctx, id)
+	if err != nil {
+		if err == aws.ErrNotAllowed {
+			logging.Error("Not enough IAM permissions to get the userdata of the instance")
+		}
+		return nil, err
+	}
+	res.Config, res.ConfigError = brktConfigStatus(data)
+
+	mvVolID, guestVolID, err := awsWrappedVolumes(inst)
+	if err != nil {
+		// Tagged instances without a guest volume are not usable, so only
+		// the volume layout and the config decide if it's wrapped
+		logging.Debugf("Instance does not have the volumes of a wrapped instance: %s", err)
+		if tagged {
+			logging.Warningf("Instance %s is tagged as wrapped, but has no guest volume on %s", id, GuestDeviceName)
+		}
+		return res, nil
+	}
+	res.MetavisorVolume = mvVolID
+	res.GuestVolume = guestVolID
+	res.GuestDevice = GuestDeviceName
+	res.Wrapped = tagged || res.Config != ConfigMissing
+	if !res.Wrapped {
+		// The instance has a volume on the guest device, but it doesn't
+		// look like Metavisor
+		res.MetavisorVolume, res.GuestVolume, res.GuestDevice = "", "", ""
+		return res, nil
+	}
+	if !tagged {
+		// Wrapped before instances were tagged, find the Metavisor AMI from
+		// the lineage of the Metavisor volume instead
+		img, err := awsMetavisorVolumeImage(ctx, awsSvc, mvVolID)
+		if err == nil {
+			res.MetavisorAMI = img.ID()
+		}
+	}
+	return res, nil
+}
+
+func awsInspectImage(ctx context.Context, awsSvc aws.Service, region, id string) (*Inspection, error) {
+	img, err := awsSvc.GetImage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	res := &Inspection{
+		ID:     id,
+		Type:   ResourceImage,
+		Region: region,
+	}
+	// Images don't have a Metavisor config to look at, so only the tags
+	// decide if it's wrapped. A volume on the guest device alone could be
+	// any data volume.
+	res.Wrapped = setWrapTags(res, img.Tags())
+	guestSnap, hasGuest := img.DeviceMapping()[GuestDeviceName]
+	if !res.Wrapped {
+		if hasGuest {
+			logging.Debugf("Image %s has a volume on %s, but is not tagged as wrapped", id, GuestDeviceName)
+		}
+		return res, nil
+	}
+	if !hasGuest {
+		logging.Warningf("Image %s is tagged as wrapped, but has no guest volume on %s", id, GuestDeviceName)
+		return res, nil
+	}
+	res.MetavisorVolume = img.DeviceMapping()[img.RootDeviceName()]
+	res.GuestVolume = guestSnap
+	res.GuestDevice = GuestDeviceName
+	return res, nil
+}
+
+// setWrapTags copies the Metavisor tags to the inspection, and returns true
+// if the resource was tagged as wrapped
+func setWrapTags(res *Inspection, tags map[string]string) bool {
+	version, tagged := tags[TagMetavisorVersion]
+	if !tagged {
+		return false
+	}
+	res.MetavisorVersion = version
+	res.MetavisorAMI = tags[TagMetavisorAMI]
+	res.WrappedAt = tags[TagWrappedAt]
+	return true
+}
+
+func brktConfigStatus(data string) (string, string) {
+	if strings.TrimSpace(data) == "" {
+		return ConfigMissing, ""
+	}
+	conf, err := parseBrktConfig(data)
+	if err == ErrNoBrktConfig {
+		return ConfigMissing, ""
+	}
+	if err != nil {
+		return ConfigInvalid, err.Error()
+	}
+	if conf.APIHost == "" {
+		return ConfigInvalid, errNoAPIHost.Error()
+	}
+	if conf.IdentityToken != "" {
+		// Only the token type is checked, as the token may have expired
+		// since the instance was wrapped
+		if t, err := token.Parse(conf.IdentityToken); err != nil || !t.IsLaunchToken() {
+			return ConfigInvalid, errInvalidIDToken.Error()
+		}
+	}
+	return ConfigValid, ""
+}
+
+// FormatInspection will format an inspection for display. If withJSON is
+// true, the inspection will be formatted as JSON.
+func FormatInspection(i *Inspection, withJSON bool) (string, error) {
+	if withJSON {
+		data, err := json.MarshalIndent(i, "", "\t")
+		if err != nil {
+			logging.Errorf("Failed to marshal inspection to JSON: %s", err)
+		}
+		return string(data), err
+	}
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", i.ID)
+	fmt.Fprintf(w, "Type:\t%s\n", i.Type)
+	fmt.Fprintf(w, "Region:\t%s\n", i.Region)
+	fmt.Fprintf(w, "Wrapped:\t%t\n", i.Wrapped)
+	if i.Wrapped {
+		fmt.Fprintf(w, "Metavisor version:\t%s\n", valueOrUnknown(i.MetavisorVersion))
+		fmt.Fprintf(w, "Metavisor AMI:\t%s\n", valueOrUnknown(i.MetavisorAMI))
+		fmt.Fprintf(w, "Wrapped at:\t%s\n", valueOrUnknown(i.WrappedAt))
+		volumeKind := "volume"
+		if i.Type == ResourceImage {
+			volumeKind = "snapshot"
+		}
+		fmt.Fprintf(w, "Metavisor %s:\t%s\n", volumeKind, valueOrUnknown(i.MetavisorVolume))
+		fmt.Fprintf(w, "Guest %s:\t%s (%s)\n", volumeKind, valueOrUnknown(i.GuestVolume), valueOrUnknown(i.GuestDevice))
+	}
+	if i.Config != "" {
+		if i.ConfigError != "" {
+			fmt.Fprintf(w, "Metavisor config:\t%s (%s)\n", i.Config, i.ConfigError)
+		} else {
+			fmt.Fprintf(w, "Metavisor config:\t%s\n", i.Config)
+		}
+	}
+	w.Flush()
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+func valueOrUnknown(v string) string {
+	if v == "" {
+		return unknownVersion
+	}
+	return v
+}
@@ -16,120 +16,255 @@ package wrap
 
 import (
 	"context"
+	"encoding/base64"
 	"time"
 
 	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/mv/journal"
 
+	"github.com/immutable/metavisor-cli/pkg/csp"
 	"github.com/immutable/metavisor-cli/pkg/csp/aws"
 	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/userdata"
 )
 
-func awsWrapInstance(ctx context.Context, awsSvc aws.Service, region, id string, conf Config) (string, error) {
+// awsWrapInstance checks the parts of the config that are specific to AWS,
+// and finds the Metavisor AMI if it wasn't specified, before wrapping the
+// instance in the same way as in any other cloud
+func awsWrapInstance(ctx context.Context, awsSvc aws.Service, region, id string, conf Config, jrnl *journal.Journal, tx *mv.Transaction) (*InstanceResult, error) {
 	if !aws.IsInstanceID(id) {
-		return "", aws.ErrInvalidInstanceID
+		return nil, aws.ErrInvalidInstanceID
 	}
 	err := awsVerifyConfig(conf)
 	if err != nil {
-		return "", err
-	}
-	inst, err := awsSvc.GetInstance(ctx, id)
-	if err != nil {
-		return "", err
+		return nil, err
 	}
-	err = awsVerifyInstance(inst)
+	conf, err = awsMetavisorConfig(ctx, region, conf, jrnl)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return wrapInstance(ctx, aws.NewProvider(awsSvc, region), id, conf, jrnl, tx)
+}
 
+// awsMetavisorConfig sets the Metavisor AMI and version of the config, if the
+// AMI wasn't specified. They are taken from the journal when resuming, and
+// otherwise the AMI of the given (or latest) version in the region is used.
+func awsMetavisorConfig(ctx context.Context, region string, conf Config, jrnl *journal.Journal) (Config, error) {
+	if conf.MetavisorAMI == "" && jrnl.Resource(resMetavisorAMI) != "" {
+		conf.MetavisorAMI = jrnl.Resource(resMetavisorAMI)
+		conf.MetavisorVersion = jrnl.Resource(resMetavisorVersion)
+	}
 	if conf.MetavisorAMI == "" {
 		// Get the metavisor AMI if it was not specified as an option
-		mvAMI, err := getMetavisorAMI(ctx, conf.MetavisorVersion, region)
+		mvAMI, version, err := getMetavisorAMI(ctx, conf.MetavisorVersion, region)
 		if err != nil {
-			return "", err
+			return conf, err
 		}
 		conf.MetavisorAMI = mvAMI
+		conf.MetavisorVersion = version
 	}
-	// Get the Metavisor snapshot attached to the AMI
-	mvSnapshot, mvENASupport, err := awsMetavisorSnapshot(ctx, awsSvc, conf.MetavisorAMI)
-	if err != nil {
-		return "", err
-	}
-	mvVolumeSize := mvSnapshot.SizeGB()
-	logging.Debugf("MV snapshot is %d GiB", mvVolumeSize)
+	return conf, nil
+}
 
-	// Stop the instance so that devices can be modified
-	logging.Infof("Stopping the instance: %s", id)
-	err = awsSvc.StopInstance(ctx, id)
+// wrapInstance wraps the instance with the Metavisor image in the config.
+// Progress is recorded in the journal, so that wrapping can be resumed, but
+// the journal can be nil, e.g. in clouds where resuming isn't supported.
+func wrapInstance(ctx context.Context, provider csp.Provider, id string, conf Config, jrnl *journal.Journal, tx *mv.Transaction) (*InstanceResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Region: provider.Region(), Resources: map[string]string{resInstance: id}})
+	ctx = logging.NewContext(ctx, log)
+	region := provider.Region()
+	inst, err := provider.GetInstance(ctx, id)
 	if err != nil {
-		// Could not stop the instance
-		return "", err
+		if err == csp.ErrNotAllowed {
+			log.Error("Not enough permissions to get instance details")
+		}
+		return nil, err
 	}
-	logging.Info("Waiting for instance to stop...")
-	err = awsSvc.AwaitInstanceStopped(ctx, id)
-	if err != nil {
-		// Instance never became ready
-		if err == aws.ErrNotAllowed {
-			logging.Error("Not enough IAM permissions to see instance status")
-		} else {
-			logging.Error("Instance never stopped")
+	resuming := jrnl.Completed(stepInstanceStopped)
+	if !resuming {
+		err = checkNotWrapped(ctx, provider, inst)
+		if err != nil {
+			return nil, err
+		}
+		err = verifyInstance(provider, inst)
+		if err != nil {
+			return nil, err
 		}
-		return "", err
 	}
-	logging.Info("Instance stopped")
+	// Make sure the Metavisor image can be used before changing anything
+	err = verifyMetavisorImage(ctx, provider, conf.MetavisorAMI)
+	if err != nil {
+		return nil, err
+	}
 
-	// Set userdata on instance based on parameters
-	logging.Info("Generating new instance userdata")
-	if conf.ServiceDomain == "" {
-		conf.ServiceDomain = ProdDomain
+	guestVolID := jrnl.Resource(resGuestVolume)
+	if !resuming {
+		guestVolID = inst.DeviceMapping()[inst.RootDeviceName()]
+	}
+	var guestUserdata, newUserdata string
+	if !jrnl.Completed(stepUserdataSet) {
+		// Generate the userdata before stopping the instance, so that
+		// nothing is changed if the guest's userdata can't be kept
+		guestUserdata, err = getGuestUserdata(ctx, provider, id, jrnl)
+		if err == csp.ErrNotAllowed {
+			// Getting the userdata isn't needed for anything else, so
+			// don't fail wrapping without it
+			log.Warning("Not enough permissions to get the userdata of the instance, it will be replaced by the Metavisor config")
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if conf.ServiceDomain == "" {
+			conf.ServiceDomain = ProdDomain
+		}
+		compress := false
+		if g, ok := provider.(csp.GzipUserdata); ok {
+			compress = g.AcceptsGzipUserdata()
+		}
+		log.Info("Generating new instance userdata")
+		newUserdata, err = generateUserdataString(conf.Token, conf.ServiceDomain, guestUserdata, compress)
+		if err != nil {
+			if err == userdata.ErrTooLarge {
+				log.Error("The userdata of the instance is too large to add the Metavisor config to")
+			}
+			return nil, err
+		}
 	}
-	err = awsSetInstanceUserdata(ctx, awsSvc, inst, conf.ServiceDomain, conf.Token)
-	if err != nil {
-		return "", err
+	if !jrnl.Completed(stepAttributesSet) {
+		// Stop the instance so that devices can be modified. This is also done
+		// when resuming, in case someone started the instance in between
+		log.Infof("Stopping the instance: %s", id)
+		err = provider.StopInstance(ctx, id)
+		if err != nil {
+			// Could not stop the instance
+			return nil, err
+		}
+		log.Info("Waiting for instance to stop...")
+		err = provider.AwaitInstanceStopped(ctx, id)
+		if err != nil {
+			// Instance never became ready
+			if err == csp.ErrNotAllowed {
+				log.Error("Not enough permissions to see instance status")
+			} else {
+				log.Error("Instance never stopped")
+			}
+			return nil, err
+		}
+		log.Info("Instance stopped")
+		log.EmitStep(logging.EventInstanceStopped, stepInstanceStopped, map[string]string{
+			resInstance: id,
+		})
+		if !resuming {
+			recordStep(jrnl, stepInstanceStopped, map[string]string{
+				resInstance:         id,
+				resGuestVolume:      guestVolID,
+				resMetavisorAMI:     conf.MetavisorAMI,
+				resMetavisorVersion: conf.MetavisorVersion,
+				resRootDeviceName:   inst.RootDeviceName(),
+				resGuestUserdata:    base64.StdEncoding.EncodeToString([]byte(guestUserdata)),
+			})
+		}
 	}
-	logging.Info("Successfully set userdata on instance")
 
-	logging.Info("Creating new Metavisor root volume")
-	// Create a new volume from the MV snapshot
-	mvVol, err := awsSvc.CreateVolume(ctx, mvSnapshot.ID(), rootVolumeType, inst.AvailabilityZone(), mvSnapshot.SizeGB())
-	if err != nil {
-		// Could not create MV root volume
-		return "", err
+	if !jrnl.Completed(stepUserdataSet) {
+		err = setInstanceUserdata(ctx, provider, id, newUserdata)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Successfully set userdata on instance")
+		recordStep(jrnl, stepUserdataSet, nil)
 	}
-	mv.QueueCleanup(func() {
+
+	mvVolID := jrnl.Resource(resMetavisorVolume)
+	if mvVolID == "" {
+		log.Info("Creating new Metavisor root volume")
+		// Create a new volume from the root of the Metavisor image
+		mvVol, err := provider.CreateDiskFromImage(ctx, conf.MetavisorAMI, inst.AvailabilityZone())
+		if err != nil {
+			// Could not create MV root volume
+			return nil, err
+		}
+		mvVolID = mvVol.ID()
+		recordStep(jrnl, stepVolumeCreated, map[string]string{
+			resMetavisorVolume: mvVolID,
+		})
+		log.Debugf("Created MV root volume %s", mvVolID)
+		log.EmitStep(logging.EventVolumeCreated, stepVolumeCreated, map[string]string{
+			resInstance:        id,
+			resMetavisorVolume: mvVolID,
+		})
+	}
+	tx.Compensate(stepDeleteMetavisorVolume, deleteVolumeTimeout, func(ctx context.Context) error {
+		log := log.With(logging.Fields{Step: stepDeleteMetavisorVolume})
 		// Clean this volume up if wrapping fails
-		logging.Info("Deleting Metavisor volume")
-		err := awsSvc.DeleteVolume(context.Background(), mvVol.ID())
+		log.Info("Deleting Metavisor volume")
+		err := provider.DeleteDisk(ctx, mvVolID)
 		if err != nil {
-			logging.Errorf("Failed to clean up MV volume: %s", mvVol.ID())
-			logging.Debugf("Could not delete volume: %s", err)
+			log.Errorf("Failed to clean up MV volume: %s", mvVolID)
+			log.Debugf("Could not delete volume: %s", err)
+			return err
 		}
-	}, true)
-	logging.Debugf("Created MV root volume %s", mvVol.ID())
-	logging.Info("Waiting for for volume to be available...")
-	err = awsSvc.AwaitVolumeAvailable(ctx, mvVol.ID())
-	if err != nil {
-		logging.Error("Volume never became available")
-		return "", err
+		log.EmitStep(logging.EventVolumeDeleted, stepDeleteMetavisorVolume, map[string]string{
+			resMetavisorVolume: mvVolID,
+		})
+		return nil
+	})
+	if !jrnl.Completed(stepVolumeAvailable) {
+		log.Info("Waiting for for volume to be available...")
+		err = provider.AwaitDiskAvailable(ctx, mvVolID)
+		if err != nil {
+			log.Error("Volume never became available")
+			return nil, err
+		}
+		log.Info("Volume is available")
+		recordStep(jrnl, stepVolumeAvailable, nil)
 	}
-	logging.Info("Volume is available")
 
 	// Move guest volume and attach MV volume as root device
-	inst, err = awsShuffleInstanceVolumes(ctx, awsSvc, inst, mvVol.ID())
+	inst, err = shuffleInstanceVolumes(ctx, provider, inst, guestVolID, mvVolID, jrnl, tx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	log.EmitStep(logging.EventVolumeAttached, stepMetavisorAttached, map[string]string{
+		resInstance:        id,
+		resMetavisorVolume: mvVolID,
+		resGuestVolume:     guestVolID,
+	})
 
-	awsEnableSriovNetSupport(ctx, awsSvc, inst)
-	err = awsEnableENASupport(ctx, awsSvc, inst, mvENASupport)
-	if err != nil {
-		return "", err
+	if !jrnl.Completed(stepAttributesSet) {
+		err = enableNetworking(ctx, provider, id, conf.MetavisorAMI)
+		if err != nil {
+			return nil, err
+		}
+		tagWrapped(ctx, provider, conf.MetavisorVersion, conf.MetavisorAMI, id, mvVolID, guestVolID)
+		recordStep(jrnl, stepAttributesSet, nil)
 	}
 
-	err = awsFinalizeInstance(ctx, awsSvc, inst)
-	return inst.ID(), err
+	res := &InstanceResult{
+		InstanceID:       inst.ID(),
+		Region:           region,
+		MetavisorVersion: conf.MetavisorVersion,
+		MetavisorAMI:     conf.MetavisorAMI,
+		MetavisorVolume:  mvVolID,
+		GuestVolume:      guestVolID,
+	}
+	err = finalizeInstance(ctx, provider, id)
+	if err != nil {
+		return res, err
+	}
+	recordStep(jrnl, stepInstanceStarted, nil)
+	log.EmitStep(logging.EventInstanceStarted, stepInstanceStarted, map[string]string{
+		resInstance:         id,
+		resMetavisorVolume:  mvVolID,
+		resGuestVolume:      guestVolID,
+		resMetavisorAMI:     conf.MetavisorAMI,
+		resMetavisorVersion: conf.MetavisorVersion,
+	})
+	return res, nil
 }
 
-func awsVerifyInstance(instance aws.Instance) error {
+func verifyInstance(provider csp.Provider, instance csp.Instance) error {
 	if _, hasRootDevice := instance.DeviceMapping()[instance.RootDeviceName()]; !hasRootDevice {
 		return ErrNoRootDevice
 	}
@@ -139,13 +274,33 @@ func awsVerifyInstance(instance aws.Instance) error {
 			return ErrInvalidType
 		}
 	}
-	if _, sdfAvailable := instance.DeviceMapping()[GuestDeviceName]; sdfAvailable {
-		logging.Errorf("The device %s must be available to wrap with Metavisor", GuestDeviceName)
+	guestDevice := provider.GuestDeviceName()
+	if _, occupied := instance.DeviceMapping()[guestDevice]; occupied {
+		logging.Errorf("The device %s must be available to wrap with Metavisor", guestDevice)
 		return ErrDeviceOccupied
 	}
 	return nil
 }
 
+// verifyMetavisorImage returns ErrInvalidAMI if the Metavisor image has no
+// root snapshot to create the Metavisor volume from
+func verifyMetavisorImage(ctx context.Context, provider csp.Provider, mvImageID string) error {
+	log := logging.FromContext(ctx)
+	log.Debugf("Fetching Metavisor image %s", mvImageID)
+	img, err := provider.GetImage(ctx, mvImageID)
+	if err != nil {
+		log.Errorf("Could not get the Metavisor image %s", mvImageID)
+		return err
+	}
+	if mapped, ok := img.(csp.MappedImage); ok {
+		if _, exist := mapped.DeviceMapping()[mapped.RootDeviceName()]; !exist {
+			// Something is wrong with this MV AMI, it doesn't have any root device
+			return ErrInvalidAMI
+		}
+	}
+	return nil
+}
+
 func awsVerifyConfig(conf Config) error {
 	if conf.MetavisorVersion != "" && conf.MetavisorAMI != "" {
 		logging.Debug("Both MV version and MV AMI specified, using AMI")
@@ -161,208 +316,236 @@ func awsVerifyConfig(conf Config) error {
 		return aws.ErrInvalidSubnetID
 	}
 	if conf.Token != "" {
-		isValid := isValidToken(conf.Token)
-		if !isValid {
-			// The specified token is not a valid launch token
-			logging.Error("The specified token is not a launch token")
-			return ErrInvalidLaunchToken
+		if err := validateToken(conf.Token, conf.ServiceDomain); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func awsShuffleInstanceVolumes(ctx context.Context, service aws.Service, instance aws.Instance, mvVolID string) (aws.Instance, error) {
-	logging.Infof("Moving guest volume to %s", GuestDeviceName)
-	instanceRootVolID, exist := instance.DeviceMapping()[instance.RootDeviceName()]
-	if !exist {
+func shuffleInstanceVolumes(ctx context.Context, provider csp.Provider, instance csp.Instance, guestVolID, mvVolID string, jrnl *journal.Journal, tx *mv.Transaction) (csp.Instance, error) {
+	log := logging.FromContext(ctx)
+	if guestVolID == "" {
 		// Instance has no root device, we already checked this, so it should be fine
 		return nil, ErrNoRootDevice
 	}
 
-	mv.QueueCleanup(func() {
+	tx.Compensate(stepRestoreGuestVolume, restoreGuestVolumeTimeout, func(ctx context.Context) error {
+		log := log.With(logging.Fields{Step: stepRestoreGuestVolume})
+		ctx = logging.NewContext(ctx, log)
 		// If wrapping fails, let's attempty to detach the MV root volume,
-		// then re-attach the instance volume as the root volume
-		logging.Info("Attempting to restore instance root volume")
-		err := restoreGuestVolume(context.Background(), service, instance.ID(), instanceRootVolID)
+		// then re-attach the instance volume as the root volume. The MV
+		// volume is deleted by its own cleanup step.
+		log.Info("Attempting to restore instance root volume")
+		err := restoreGuestVolume(ctx, provider, instance.ID(), guestVolID, false)
 		if err != nil {
-			logging.Debugf("Got error while trying to restore instance: %s", err)
+			log.Debugf("Got error while trying to restore instance: %s", err)
 		}
-	}, true)
+		return err
+	})
+	if jrnl.Completed(stepMetavisorAttached) {
+		// Volumes were already moved before resuming
+		return instance, nil
+	}
 
+	// When resuming, the process might have been killed after a volume was
+	// moved but before it was recorded, so also check the current mapping
 	instanceRootDeviceName := instance.RootDeviceName()
-	err := service.DetachVolume(ctx, instanceRootVolID, instance.ID(), instanceRootDeviceName)
-	if err != nil {
-		// Could not detach instance root device
-		return nil, err
+	guestDeviceName := provider.GuestDeviceName()
+	mapping := instance.DeviceMapping()
+	if !jrnl.Completed(stepRootDetached) && mapping[instanceRootDeviceName] == guestVolID {
+		log.Infof("Moving guest volume to %s", guestDeviceName)
+		err := provider.DetachDisk(ctx, guestVolID, instance.ID(), instanceRootDeviceName)
+		if err != nil {
+			// Could not detach instance root device
+			return nil, err
+		}
+		log.Debug("Detached instance root device")
+		recordStep(jrnl, stepRootDetached, nil)
 	}
-	logging.Debug("Detached instance root device")
 
-	err = service.AttachVolume(ctx, instanceRootVolID, instance.ID(), GuestDeviceName)
-	if err != nil {
-		// Could not attach volume
-		return nil, err
+	if !jrnl.Completed(stepGuestAttached) && mapping[guestDeviceName] != guestVolID {
+		err := provider.AttachDisk(ctx, guestVolID, instance.ID(), guestDeviceName, false)
+		if err != nil {
+			// Could not attach volume
+			return nil, err
+		}
+		log.Debugf("Attached instance root device to %s", guestDeviceName)
+		log.Debug("Guest volume successfully moved")
+		recordStep(jrnl, stepGuestAttached, nil)
 	}
-	logging.Debugf("Attached instance root device to %s", GuestDeviceName)
-	logging.Debug("Guest volume successfully moved")
-	logging.Infof("Attaching Metavisor root to %s", instanceRootDeviceName)
-	err = service.AttachVolume(ctx, mvVolID, instance.ID(), instanceRootDeviceName)
-	if err != nil {
-		// Could not attach MV root device
-		return nil, err
+	if mapping[instanceRootDeviceName] != mvVolID {
+		log.Infof("Attaching Metavisor root to %s", instanceRootDeviceName)
+		err := provider.AttachDisk(ctx, mvVolID, instance.ID(), instanceRootDeviceName, true)
+		if err != nil {
+			// Could not attach MV root device
+			return nil, err
+		}
 	}
 
-	logging.Info("Waiting for Metavisor and instance volumes to be attached")
+	log.Info("Waiting for Metavisor and instance volumes to be attached")
 	// Wait for devices to get attached and shows up in instance block device mapping
-	return awaitInstanceDevices(ctx, service, instance, mvVolID, instanceRootVolID)
+	inst, err := awaitDevices(ctx, provider, instance.ID(), map[string]string{
+		instanceRootDeviceName: mvVolID,
+		guestDeviceName:        guestVolID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	recordStep(jrnl, stepMetavisorAttached, nil)
+	return inst, nil
 }
 
-func restoreGuestVolume(ctx context.Context, service aws.Service, instanceID, guestVolID string) error {
+func restoreGuestVolume(ctx context.Context, provider csp.Provider, instanceID, guestVolID string, deleteMVVolume bool) error {
+	log := logging.FromContext(ctx)
 	// Attemptt to restore instance to non-wrapped
 
 	// First make sure instance is stopped so volumes can be moved
-	if err := service.StopInstance(ctx, instanceID); err != nil {
-		logging.Error("Could not stop instance to restore guest volume")
+	if err := provider.StopInstance(ctx, instanceID); err != nil {
+		log.Error("Could not stop instance to restore guest volume")
 		return err
 	}
-	if err := service.AwaitInstanceStopped(ctx, instanceID); err != nil {
-		logging.Error("Could not stop instance to restore guest volume")
+	if err := provider.AwaitInstanceStopped(ctx, instanceID); err != nil {
+		log.Error("Could not stop instance to restore guest volume")
 		return err
 	}
-	inst, err := service.GetInstance(ctx, instanceID)
+	inst, err := provider.GetInstance(ctx, instanceID)
+	if err != nil {
+		log.Error("Could not get instance details while cleaning up")
+		return err
+	}
+	mvVolID, err := moveGuestToRoot(ctx, provider, inst, guestVolID)
+	if mvVolID != "" && deleteMVVolume {
+		defer provider.DeleteDisk(ctx, mvVolID)
+	}
 	if err != nil {
-		logging.Error("Could not get instance details while cleaning up")
 		return err
 	}
+	if err = provider.StartInstance(ctx, instanceID); err != nil {
+		log.Warningf("Could not start instance %s after attaching guest volume", instanceID)
+	}
+	log.Infof("Instance %s successfully restored", instanceID)
+	// We don't care about waiting for the instance to start here
+	return nil
+}
+
+// moveGuestToRoot will detach whatever volume is attached as root device
+// of the (stopped) instance, and then move the guest volume from the guest
+// device to the root device. The ID of the detached root volume is returned,
+// or an empty string if the guest volume was already the root volume.
+func moveGuestToRoot(ctx context.Context, provider csp.Provider, inst csp.Instance, guestVolID string) (string, error) {
+	log := logging.FromContext(ctx)
 	rootDeviceName := inst.RootDeviceName()
+	guestDeviceName := provider.GuestDeviceName()
 	rootID, rootAttached := inst.DeviceMapping()[rootDeviceName]
-	secondaryID, secondaryAttached := inst.DeviceMapping()[GuestDeviceName]
+	secondaryID, secondaryAttached := inst.DeviceMapping()[guestDeviceName]
+	var detachedID string
 	if rootAttached && rootID == guestVolID {
 		// Guest volume already attached as root
-		logging.Info("Guest volume already attached as root device, nothing to clean up")
-		return nil
+		log.Info("Guest volume already attached as root device, nothing to clean up")
+		return "", nil
 	} else if rootAttached {
 		// Detach the root device, as it's not the guest volume
-		if err = service.DetachVolume(ctx, rootID, instanceID, rootDeviceName); err != nil {
-			logging.Error("Could not detach non-guest volume from root device")
-			return err
+		if err := provider.DetachDisk(ctx, rootID, inst.ID(), rootDeviceName); err != nil {
+			log.Error("Could not detach non-guest volume from root device")
+			return "", err
 		}
-		defer service.DeleteVolume(ctx, rootID)
-		logging.Info("Detached Metavisor volume from root device")
+		detachedID = rootID
+		log.Info("Detached Metavisor volume from root device")
 	}
 
 	if secondaryAttached && secondaryID == guestVolID {
 		// Detach the guest volume from secondary device
-		if err = service.DetachVolume(ctx, guestVolID, instanceID, GuestDeviceName); err != nil {
-			logging.Error("Could not detach guest volume from secondary device")
-			return err
+		if err := provider.DetachDisk(ctx, guestVolID, inst.ID(), guestDeviceName); err != nil {
+			log.Error("Could not detach guest volume from secondary device")
+			return detachedID, err
 		}
 	}
-	if err = service.AttachVolume(ctx, guestVolID, instanceID, rootDeviceName); err != nil {
-		logging.Error("Could not re-attach guest volume as root device")
-		return err
-	}
-	logging.Info("Guest volume re-attached to root device")
-	if err = service.StartInstance(ctx, instanceID); err != nil {
-		logging.Warningf("Could not start instance %s after attaching guest volume", instanceID)
+	if err := provider.AttachDisk(ctx, guestVolID, inst.ID(), rootDeviceName, true); err != nil {
+		log.Error("Could not re-attach guest volume as root device")
+		return detachedID, err
 	}
-	logging.Infof("Instance %s successfully restored", instanceID)
-	// We don't care about waiting for the instance to start here
-	return nil
+	log.Info("Guest volume re-attached to root device")
+	return detachedID, nil
 }
 
-// Here we also want to return if the MV has ENA support or not, as this is needed later
-func awsMetavisorSnapshot(ctx context.Context, service aws.Service, mvImageID string) (mvSnapshot aws.Snapshot, enaSupport bool, err error) {
-	logging.Debugf("Fetching AMI %s from AWS", mvImageID)
-	mvImage, err := service.GetImage(ctx, mvImageID)
-	if err != nil {
-		return mvSnapshot, enaSupport, err
-	}
-	logging.Debug("Determining snapshot from Metavisor image")
-	mvSnapshotID, exist := mvImage.DeviceMapping()[mvImage.RootDeviceName()]
-	if !exist {
-		// Something is wrong with this MV AMI, it doesn't have any root device
-		return mvSnapshot, enaSupport, ErrInvalidAMI
+// getGuestUserdata returns the userdata of the instance before wrapping,
+// from the journal if it was recorded there when stopping the instance.
+// ErrNotAllowed is left to the caller to handle.
+func getGuestUserdata(ctx context.Context, provider csp.Provider, id string, jrnl *journal.Journal) (string, error) {
+	log := logging.FromContext(ctx)
+	if recorded := jrnl.Resource(resGuestUserdata); recorded != "" {
+		data, err := base64.StdEncoding.DecodeString(recorded)
+		if err == nil {
+			return string(data), nil
+		}
+		log.Debugf("Could not decode userdata in journal: %s", err)
 	}
-	logging.Debugf("Fetching snapshot %s from AWS", mvSnapshotID)
-	mvSnapshot, err = service.GetSnapshot(ctx, mvSnapshotID)
+	data, err := provider.GetInstanceUserdata(ctx, id)
 	if err != nil {
-		return mvSnapshot, enaSupport, err
+		if err != csp.ErrNotAllowed {
+			log.Error("Failed to get the userdata of the instance")
+		}
+		return "", err
 	}
-	return mvSnapshot, mvImage.ENASupport(), nil
+	return data, nil
 }
 
-func awsSetInstanceUserdata(ctx context.Context, service aws.Service, instance aws.Instance, domain, token string) error {
-	userdata, err := generateUserdataString(token, domain, compressUserdata)
-	if err != nil {
-		return ErrBadUserdata
-	}
-	err = service.ModifyInstanceAttribute(ctx, instance.ID(), aws.AttrUserData, userdata)
+func setInstanceUserdata(ctx context.Context, provider csp.Provider, id, data string) error {
+	log := logging.FromContext(ctx)
+	err := provider.SetInstanceUserdata(ctx, id, data)
 	if err != nil {
 		switch err {
-		case aws.ErrNotAllowed:
-			logging.Error("Not enough IAM permissions to set userdata on instance")
+		case csp.ErrNotAllowed:
+			log.Error("Not enough permissions to set userdata on instance")
 			return err
 		default:
-			logging.Error("Failed to set userdata on instance")
+			log.Error("Failed to set userdata on instance")
+			log.Debugf("Got error while setting userdata: %s", err)
 			return ErrBadUserdata
 		}
 	}
 	return nil
 }
 
-func awsEnableSriovNetSupport(ctx context.Context, service aws.Service, instance aws.Instance) {
-	// Enable sriovNetSupport on the instance if it's not already enabled
-	if instance.SriovNetSupport() != aws.SriovNetIsSupported {
-		logging.Debug("Enabling sriovNetSupport on instance")
-		err := service.ModifyInstanceAttribute(ctx, instance.ID(), aws.AttrSriovNetSupport, aws.SriovNetIsSupported)
-		if err != nil {
-			logging.Debugf("Failed to enable sriovNetSupport:\n%s", err)
-			logging.Warningf("Failed to enable sriovNetSupport for instance %s", instance.ID())
-		}
-	}
-}
-
-func awsEnableENASupport(ctx context.Context, service aws.Service, instance aws.Instance, mvENASupport bool) error {
-	// Enable ENA support if the MV supports it and it's not already enabled on the instance
-	logging.Debugf("ENA support: metavisor=%t, guest=%t", mvENASupport, instance.ENASupport())
-	if mvENASupport && !instance.ENASupport() {
-		logging.Info("Enabling ENA support on instance")
-		err := service.ModifyInstanceAttribute(ctx, instance.ID(), aws.AttrENASupport, true)
-		if err != nil {
-			logging.Error("Failed to enable ENA support on the instance")
-			return err
-		}
+// enableNetworking enables the networking features of the Metavisor image on
+// the instance, in clouds where that has to be done before booting it
+func enableNetworking(ctx context.Context, provider csp.Provider, id, mvImageID string) error {
+	enabler, ok := provider.(csp.NetworkEnabler)
+	if !ok {
+		return nil
 	}
-	return nil
+	return enabler.EnableNetworking(ctx, id, mvImageID)
 }
 
-func awsFinalizeInstance(ctx context.Context, service aws.Service, instance aws.Instance) error {
+func finalizeInstance(ctx context.Context, provider csp.Provider, id string) error {
+	log := logging.FromContext(ctx)
 	// Wrapping is complete, start the instance again
-	logging.Infof("Starting instance %s again", instance.ID())
-	err := service.StartInstance(ctx, instance.ID())
+	log.Infof("Starting instance %s again", id)
+	err := provider.StartInstance(ctx, id)
 	if err != nil {
-		logging.Error("Failed to start instance after wrapping it with Metavisor")
+		log.Error("Failed to start instance after wrapping it with Metavisor")
 		return err
 	}
-	logging.Info("Waiting for instance to become ready...")
-	err = service.AwaitInstanceRunning(ctx, instance.ID())
+	log.Info("Waiting for instance to become ready...")
+	err = provider.AwaitInstanceRunning(ctx, id)
 	if err != nil {
 		// Instance never became ready
-		if err == aws.ErrNotAllowed {
-			logging.Error("Not enough IAM permissions to see instance status")
+		if err == csp.ErrNotAllowed {
+			log.Error("Not enough permissions to see instance status")
 		} else {
-			logging.Error("Instance never got ready")
+			log.Error("Instance never got ready")
 		}
 		return err
 	}
-	logging.Info("Instance is ready")
+	log.Info("Instance is ready")
 	// The DeleteOnTerminate attribute gets reset when detaching stuff, make sure
 	// it's enabled again.
-	logging.Debug("Setting instance devices to delete on termination")
-	err = service.DeleteInstanceDevicesOnTermination(ctx, instance.ID())
+	log.Debug("Setting instance devices to delete on termination")
+	err = provider.DeleteDisksOnTermination(ctx, id)
 	if err != nil {
-		if err == aws.ErrNotAllowed {
-			logging.Warning("Not enough IAM permissions to set devices to delete on termination, skipping...")
+		if err == csp.ErrNotAllowed {
+			log.Warning("Not enough permissions to set devices to delete on termination, skipping...")
 		} else {
 			return err
 		}
@@ -370,38 +553,48 @@ func awsFinalizeInstance(ctx context.Context, service aws.Service, instance aws.
 	return nil
 }
 
-func awaitInstanceDevices(ctx context.Context, service aws.Service, instance aws.Instance, mvVolID, guestVolID string) (aws.Instance, error) {
+// awaitDevices waits until the instance has the expected volumes attached,
+// given as a mapping from device name to volume ID
+func awaitDevices(ctx context.Context, provider csp.Provider, id string, expected map[string]string) (csp.Instance, error) {
+	log := logging.FromContext(ctx)
 	maxTries := 60
 	sleepTime := 10 * time.Second
 	for try := 1; try <= maxTries; try++ {
-		inst, err := service.GetInstance(ctx, instance.ID())
-		if err != nil {
-			if err == aws.ErrNotAllowed {
-				// No point in retrying if we don't have permissions
-				logging.Error("Not enough IAM permissions to get instance details")
-				return nil, err
-			}
-			logging.Warning("Failed to get instance details, retrying...")
-			time.Sleep(sleepTime)
-			continue
-		}
-		gVID, guestAttached := inst.DeviceMapping()[GuestDeviceName]
-		mVID, mvAttached := inst.DeviceMapping()[instance.RootDeviceName()]
-		if guestAttached && mvAttached && guestVolID == gVID && mvVolID == mVID {
-			logging.Info("Volumes successfully attached")
+		inst, err := provider.GetInstance(ctx, id)
+		if err == csp.ErrNotAllowed {
+			// No point in retrying if we don't have permissions
+			log.Error("Not enough permissions to get instance details")
+			return nil, err
+		} else if err != nil {
+			log.Warning("Failed to get instance details, retrying...")
+		} else if hasDevices(inst, expected) {
+			log.Info("Volumes successfully attached")
 			return inst, nil
-		}
-		logging.Debug("Got instance device mapping:")
-		for d, v := range inst.DeviceMapping() {
-			logging.Debugf("\t%s: %s", d, v)
+		} else {
+			log.Debug("Got instance device mapping:")
+			for d, v := range inst.DeviceMapping() {
+				log.Debugf("\t%s: %s", d, v)
+			}
 		}
 		if try == maxTries {
-			logging.Error("Volumes never got attached to instance")
-			return nil, ErrTimedOut
+			break
+		}
+		log.Infof("Attempt %d: Still waiting for volumes to attach", try)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(sleepTime):
 		}
-
-		logging.Infof("Attempt %d: Still waiting for volumes to attach", try)
-		time.Sleep(sleepTime)
 	}
+	log.Error("Volumes never got attached to instance")
 	return nil, ErrTimedOut
 }
+
+func hasDevices(inst csp.Instance, expected map[string]string) bool {
+	for device, volID := range expected {
+		if inst.DeviceMapping()[device] != volID {
+			return false
+		}
+	}
+	return true
+}
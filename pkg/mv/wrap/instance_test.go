@@ -0,0 +1,293 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws/fake"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/mv/journal"
+	"github.com/immutable/metavisor-cli/pkg/userdata"
+)
+
+const testRegion = "us-west-2"
+
+var errInjected = errors.New("injected failure")
+
+// newTestEC2 returns a simulated EC2 with a Metavisor AMI, and a config
+// using it so that no lookup of the latest version is done
+func newTestEC2() (*fake.EC2, Config) {
+	ec2 := fake.New(testRegion)
+	mvAMI := ec2.AddImage("metavisor-3-1-2", 1, nil)
+	ec2.SetImage(mvAMI, func(img *fake.Image) { img.ENASupport = true })
+	return ec2, Config{MetavisorAMI: mvAMI, MetavisorVersion: "3.1.2"}
+}
+
+const testGuestUserdata = "#!/bin/bash\necho hello\n"
+
+func TestAWSWrapInstance(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	ec2.SetInstance(id, func(inst *fake.Instance) { inst.Userdata = testGuestUserdata })
+	guestVolID := ec2.Instance(id).Devices[fake.RootDeviceName]
+	tx := mv.NewTransaction("test")
+
+	wrapped, err := awsWrapInstance(context.Background(), ec2, testRegion, id, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when wrapping: %s", err)
+	}
+	if wrapped.InstanceID != id || wrapped.Region != testRegion || wrapped.GuestVolume != guestVolID {
+		t.Errorf("Got unexpected result: %+v", wrapped)
+	}
+	inst := ec2.Instance(id)
+	if inst.State != fake.StateRunning {
+		t.Errorf("Expected wrapped instance to be running, was %s", inst.State)
+	}
+	if inst.Devices[GuestDeviceName] != guestVolID {
+		t.Errorf("Expected guest volume on %s, got %v", GuestDeviceName, inst.Devices)
+	}
+	mvVolID := inst.Devices[fake.RootDeviceName]
+	if wrapped.MetavisorVolume != mvVolID || wrapped.MetavisorVersion != conf.MetavisorVersion {
+		t.Errorf("Expected Metavisor volume %s and version in result, got %+v", mvVolID, wrapped)
+	}
+	if mvVolID == guestVolID || ec2.Volume(mvVolID).Tags[TagVolumeRole] != VolumeRoleMetavisor {
+		t.Errorf("Expected Metavisor volume as root device, got %s", mvVolID)
+	}
+	if !inst.ENASupport || inst.Userdata == "" {
+		t.Error("Expected ENA support and userdata to be set")
+	}
+	parsed, err := userdata.Parse(inst.Userdata)
+	if err != nil {
+		t.Fatalf("Got unexpected error when parsing userdata: %s", err)
+	}
+	if parts := parsed.Parts(); len(parts) != 2 || parts[0].ContentType != configContentType || parts[1].Content != testGuestUserdata {
+		t.Errorf("Expected Metavisor config and guest userdata, got %+v", parts)
+	}
+	if inst.Tags[TagMetavisorVersion] != conf.MetavisorVersion {
+		t.Errorf("Expected instance to be tagged as wrapped, got %v", inst.Tags)
+	}
+	for device, del := range inst.DeleteOnTermination {
+		if !del {
+			t.Errorf("Expected %s to be deleted on termination", device)
+		}
+	}
+}
+
+func TestAWSWrapInstanceEvents(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	var b bytes.Buffer
+	logging.SetEventWriter(&b)
+	defer logging.SetEventWriter(nil)
+	tx := mv.NewTransaction("test")
+
+	_, err := awsWrapInstance(context.Background(), ec2, testRegion, id, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when wrapping: %s", err)
+	}
+	expected := []string{
+		logging.EventInstanceStopped,
+		logging.EventVolumeCreated,
+		logging.EventVolumeAttached,
+		logging.EventInstanceStarted,
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected events %v, got:\n%s", expected, b.String())
+	}
+	for i, l := range lines {
+		var e logging.Event
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("Event is not valid JSON: %s", l)
+		}
+		if e.Type != expected[i] || e.Region != testRegion || e.Resources[resInstance] != id {
+			t.Errorf("Expected %s event for %s, got %+v", expected[i], id, e)
+		}
+	}
+}
+
+func TestAWSWrapInstanceRollback(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	guestVolID := ec2.Instance(id).Devices[fake.RootDeviceName]
+	before := ec2.Resources()
+	ec2.FailNext("StartInstances", errInjected)
+	tx := mv.NewTransaction("test")
+
+	_, err := awsWrapInstance(context.Background(), ec2, testRegion, id, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != errInjected {
+		t.Fatalf("Expected injected error, got: %v", err)
+	}
+	if failed := tx.Result().Failed(); len(failed) > 0 {
+		t.Errorf("Got unexpected failed cleanup steps: %v", failed)
+	}
+	inst := ec2.Instance(id)
+	if inst.Devices[fake.RootDeviceName] != guestVolID || len(inst.Devices) != 1 {
+		t.Errorf("Expected guest volume to be restored as root device, got %v", inst.Devices)
+	}
+	if inst.State != fake.StateRunning {
+		t.Errorf("Expected restored instance to be running, was %s", inst.State)
+	}
+	if after := ec2.Resources(); len(after.Volumes) != len(before.Volumes) {
+		t.Errorf("Expected Metavisor volume to be deleted, got volumes %v", after.Volumes)
+	}
+}
+
+func newTestJournal(t *testing.T, id string) (*journal.Journal, func()) {
+	dir, err := ioutil.TempDir("", "wrap-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jrnl, err := journal.New(filepath.Join(dir, "journal.json"), opAWSWrapInstance, testRegion, id)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not create journal: %s", err)
+	}
+	return jrnl, func() { os.RemoveAll(dir) }
+}
+
+func TestAWSWrapInstanceResume(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	jrnl, done := newTestJournal(t, id)
+	defer done()
+	ec2.FailNext("StartInstances", errInjected)
+
+	// The transaction is never finished, as if the process was killed
+	_, err := awsWrapInstance(context.Background(), ec2, testRegion, id, conf, jrnl, mv.NewTransaction("test"))
+	if err != errInjected {
+		t.Fatalf("Expected injected error, got: %v", err)
+	}
+	jrnl, err = journal.Open(jrnl.Path())
+	if err != nil {
+		t.Fatalf("Could not open journal: %s", err)
+	}
+	if !jrnl.Completed(stepAttributesSet) || jrnl.Completed(stepInstanceStarted) {
+		t.Fatalf("Got unexpected last step in journal: %s", jrnl.LastStep())
+	}
+	tx := mv.NewTransaction("test")
+	_, err = awsWrapInstance(context.Background(), ec2, testRegion, id, conf, jrnl, tx)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when resuming: %s", err)
+	}
+	if n := ec2.Calls("CreateVolume"); n != 1 {
+		t.Errorf("Expected Metavisor volume to be created once, was created %d times", n)
+	}
+	if n := ec2.Calls("AttachVolume"); n != 2 {
+		t.Errorf("Expected volumes to be attached twice, got %d", n)
+	}
+	if s := ec2.Instance(id).State; s != fake.StateRunning {
+		t.Errorf("Expected resumed instance to be running, was %s", s)
+	}
+}
+
+func TestAWSWrapInstanceUserdataTooLarge(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	random := make([]byte, userdata.MaxSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	ec2.SetInstance(id, func(inst *fake.Instance) { inst.Userdata = string(random) })
+
+	_, err := awsWrapInstance(context.Background(), ec2, testRegion, id, conf, nil, mv.NewTransaction("test"))
+	if err != userdata.ErrTooLarge {
+		t.Fatalf("Expected ErrTooLarge, got: %v", err)
+	}
+	if inst := ec2.Instance(id); inst.State != fake.StateRunning || inst.Userdata != string(random) {
+		t.Errorf("Expected instance to be left untouched, was %s", inst.State)
+	}
+}
+
+func TestAWSWrapInstanceUserdataDenied(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	ec2.SetInstance(id, func(inst *fake.Instance) { inst.Userdata = testGuestUserdata })
+	ec2.Deny("DescribeInstanceAttribute")
+	tx := mv.NewTransaction("test")
+
+	_, err := awsWrapInstance(context.Background(), ec2, testRegion, id, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when not allowed to get userdata: %s", err)
+	}
+	parsed, err := userdata.Parse(ec2.Instance(id).Userdata)
+	if err != nil {
+		t.Fatalf("Got unexpected error when parsing userdata: %s", err)
+	}
+	if parts := parsed.Parts(); len(parts) != 1 || parts[0].ContentType != configContentType {
+		t.Errorf("Expected only the Metavisor config, got %+v", parts)
+	}
+}
+
+func TestAWSRollbackInstance(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	ec2.SetInstance(id, func(inst *fake.Instance) { inst.Userdata = testGuestUserdata })
+	guestVolID := ec2.Instance(id).Devices[fake.RootDeviceName]
+	before := ec2.Resources()
+	jrnl, done := newTestJournal(t, id)
+	defer done()
+	ec2.FailNext("StartInstances", errInjected)
+
+	_, err := awsWrapInstance(context.Background(), ec2, testRegion, id, conf, jrnl, mv.NewTransaction("test"))
+	if err != errInjected {
+		t.Fatalf("Expected injected error, got: %v", err)
+	}
+	if err = awsRollbackInstance(context.Background(), ec2, jrnl); err != nil {
+		t.Fatalf("Got unexpected error when rolling back: %s", err)
+	}
+	if root := ec2.Instance(id).Devices[fake.RootDeviceName]; root != guestVolID {
+		t.Errorf("Expected guest volume to be root device again, got %s", root)
+	}
+	if data := ec2.Instance(id).Userdata; data != testGuestUserdata {
+		t.Errorf("Expected original userdata to be restored, got %q", data)
+	}
+	if after := ec2.Resources(); len(after.Volumes) != len(before.Volumes) {
+		t.Errorf("Expected Metavisor volume to be deleted, got volumes %v", after.Volumes)
+	}
+}
+
+func TestAWSWrapInstanceDenied(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	before := ec2.Resources()
+	ec2.Deny("AttachVolume")
+	tx := mv.NewTransaction("test")
+
+	_, err := awsWrapInstance(context.Background(), ec2, testRegion, id, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err == nil {
+		t.Fatal("Expected error when not allowed to attach volumes")
+	}
+	// The guest volume can't be moved back without AttachVolume, but the
+	// Metavisor volume must not be left behind
+	if after := ec2.Resources(); len(after.Volumes) != len(before.Volumes) {
+		t.Errorf("Expected Metavisor volume to be deleted, got volumes %v", after.Volumes)
+	}
+}
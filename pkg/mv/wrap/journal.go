@@ -0,0 +1,420 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/mv/journal"
+	"github.com/immutable/metavisor-cli/pkg/output"
+)
+
+// Operations recorded in journals
+const (
+	opAWSWrapInstance = "aws-wrap-instance"
+	opAWSWrapImage    = "aws-wrap-ami"
+)
+
+// Operations that aren't journaled
+const (
+	opAWSUnwrapInstance = "aws-unwrap-instance"
+	opGCPWrapInstance   = "gcp-wrap-instance"
+	opGCPWrapImage      = "gcp-wrap-image"
+)
+
+// Steps recorded in journals, in the order they are performed
+const (
+	stepTemporaryLaunched = "temporary-instance-launched"
+	stepInstanceStopped   = "instance-stopped"
+	stepUserdataSet       = "userdata-set"
+	stepVolumeCreated     = "mv-volume-created"
+	stepVolumeAvailable   = "mv-volume-available"
+	stepRootDetached      = "root-volume-detached"
+	stepGuestAttached     = "guest-volume-attached"
+	stepMetavisorAttached = "mv-volume-attached"
+	stepAttributesSet     = "instance-attributes-set"
+	stepInstanceStarted   = "instance-started"
+	stepImageCreated      = "image-created"
+	stepImageAvailable    = "image-available"
+)
+
+// Resources recorded in journals
+const (
+	resInstance          = "instance"
+	resTemporaryInstance = "temporary-instance"
+	resGuestVolume       = "guest-volume"
+	resRootDeviceName    = "root-device-name"
+	resMetavisorVolume   = "mv-volume"
+	resMetavisorAMI      = "mv-ami"
+	resMetavisorVersion  = "mv-version"
+	resImage             = "image"
+	// resGuestUserdata is the base64 encoded userdata of the instance
+	// before wrapping, it's not an ID but it's needed to roll back. It can
+	// contain secrets, which is why journals are only readable by the owner.
+	resGuestUserdata = "guest-userdata"
+)
+
+// Parameters recorded in journals
+const (
+	paramServiceDomain = "service-domain"
+	paramSubnetID      = "subnet-id"
+	paramNameTemplate  = "name-template"
+	paramDescTemplate  = "description-template"
+	paramTags          = "tags"
+)
+
+var (
+	// ErrUnknownOperation is returned if a journal is for an operation this
+	// version of the CLI can't handle
+	ErrUnknownOperation = errors.New("the journal is for an unknown operation")
+
+	// ErrTokenRequired is returned when resuming an operation which hasn't set
+	// the instance userdata yet, without specifying a launch token
+	ErrTokenRequired = errors.New("a launch token must be specified to resume this operation")
+
+	// ErrOperationCompleted is returned if trying to roll back an operation
+	// which has already completed successfully
+	ErrOperationCompleted = errors.New("the operation has already completed, use unwrap-instance to remove the Metavisor")
+)
+
+// Resume will continue an interrupted wrap-instance or wrap-ami operation from
+// the last step recorded in the journal at the given path. The config is used
+// for parameters that are not saved in the journal, such as the launch token
+// and IAM parameters. The result has the result of the wrap, as returned by
+// Instance or Image.
+func Resume(ctx context.Context, journalPath string, conf Config) (*ResumeResult, error) {
+	jrnl, err := journal.Open(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	if jrnl.State != journal.StateInProgress {
+		logging.Errorf("The operation in the journal is %s, it can't be resumed", jrnl.State)
+		return nil, journal.ErrNotResumable
+	}
+	if jrnl.Operation != opAWSWrapInstance && jrnl.Operation != opAWSWrapImage {
+		return nil, ErrUnknownOperation
+	}
+	log := logging.FromContext(ctx).With(logging.Fields{Operation: jrnl.Operation})
+	ctx = logging.NewContext(ctx, log)
+	if !jrnl.Completed(stepUserdataSet) {
+		if conf.Token, err = ResolveToken(ctx, jrnl.Region, conf); err != nil {
+			return nil, err
+		}
+		if conf.Token == "" {
+			return nil, ErrTokenRequired
+		}
+	}
+	if conf.ServiceDomain == "" {
+		conf.ServiceDomain = jrnl.Param(paramServiceDomain)
+	}
+	if conf.SubnetID == "" {
+		conf.SubnetID = jrnl.Param(paramSubnetID)
+	}
+	if conf.NameTemplate == "" {
+		conf.NameTemplate = jrnl.Param(paramNameTemplate)
+	}
+	if conf.DescriptionTemplate == "" {
+		conf.DescriptionTemplate = jrnl.Param(paramDescTemplate)
+	}
+	if len(conf.Tags) == 0 && jrnl.Param(paramTags) != "" {
+		if err = json.Unmarshal([]byte(jrnl.Param(paramTags)), &conf.Tags); err != nil {
+			log.Warning("Could not read the tags in the journal, no extra tags will be added")
+			log.Debugf("Got error while unmarshaling tags: %s", err)
+		}
+	}
+	log.Infof("Resuming %s of %s after step \"%s\"", jrnl.Operation, jrnl.ID, jrnl.LastStep())
+	start := time.Now()
+	res := make(chan maybeResume, 1)
+	tx := mv.NewTransaction(fmt.Sprintf("resume %s %s", jrnl.Operation, jrnl.ID))
+
+	go func() {
+		service, err := aws.New(jrnl.Region, &aws.IAMConfig{
+			RoleARN:      conf.IAMRoleARN,
+			MFADeviceARN: conf.IAMDeviceARN,
+			MFACode:      conf.IAMCode,
+		})
+		if err != nil {
+			if err == aws.ErrInvalidARN {
+				log.Error("Failed to assume IAM role")
+			}
+			res <- maybeResume{Error: err}
+			return
+		}
+		out := &ResumeResult{Operation: jrnl.Operation, Journal: jrnl.Path()}
+		if jrnl.Operation == opAWSWrapInstance {
+			out.Instance, err = awsWrapInstance(ctx, service, jrnl.Region, jrnl.ID, conf, jrnl, tx)
+		} else {
+			out.Image, err = awsWrapImage(ctx, service, jrnl.Region, jrnl.ID, conf, jrnl, tx)
+		}
+		if err != nil {
+			out = nil
+		}
+		res <- maybeResume{Result: out, Error: err}
+	}()
+	select {
+	case <-ctx.Done():
+		// Context was cancelled, cleanup
+		tx.Rollback()
+		finishJournal(jrnl, false)
+		return nil, mv.ErrInterrupted
+	case r := <-res:
+		tx.Finish(r.Error == nil)
+		finishJournal(jrnl, r.Error == nil)
+		if r.Result != nil {
+			r.Result.Duration = output.Since(start)
+		}
+		return r.Result, r.Error
+	}
+}
+
+// Rollback will undo an interrupted wrap-instance or wrap-ami operation, based
+// on the steps recorded in the journal at the given path. For wrap-instance,
+// the guest volume is moved back to the root device and the Metavisor volume
+// is deleted. For wrap-ami, all temporary resources are removed. The ID of the
+// resource the operation was started on is in the result.
+func Rollback(ctx context.Context, journalPath string, conf Config) (*RollbackResult, error) {
+	start := time.Now()
+	jrnl, err := journal.Open(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	switch jrnl.State {
+	case journal.StateCompleted:
+		return nil, ErrOperationCompleted
+	case journal.StateRolledBack:
+		logging.Info("The operation has already been rolled back")
+		return rollbackResult(jrnl, start), nil
+	}
+	if jrnl.Operation != opAWSWrapInstance && jrnl.Operation != opAWSWrapImage {
+		return nil, ErrUnknownOperation
+	}
+	logging.Infof("Rolling back %s of %s from step \"%s\"", jrnl.Operation, jrnl.ID, jrnl.LastStep())
+	res := make(chan error, 1)
+
+	go func() {
+		service, err := aws.New(jrnl.Region, &aws.IAMConfig{
+			RoleARN:      conf.IAMRoleARN,
+			MFADeviceARN: conf.IAMDeviceARN,
+			MFACode:      conf.IAMCode,
+		})
+		if err != nil {
+			if err == aws.ErrInvalidARN {
+				logging.Error("Failed to assume IAM role")
+			}
+			res <- err
+			return
+		}
+		if jrnl.Operation == opAWSWrapInstance {
+			err = awsRollbackInstance(ctx, service, jrnl)
+		} else {
+			err = awsRollbackImage(ctx, service, jrnl)
+		}
+		res <- err
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, mv.ErrInterrupted
+	case err = <-res:
+		if err != nil {
+			return nil, err
+		}
+		jrnl.Finish(journal.StateRolledBack)
+		return rollbackResult(jrnl, start), nil
+	}
+}
+
+func rollbackResult(jrnl *journal.Journal, start time.Time) *RollbackResult {
+	return &RollbackResult{
+		Operation:  jrnl.Operation,
+		Journal:    jrnl.Path(),
+		ResourceID: jrnl.ID,
+		Region:     jrnl.Region,
+		Duration:   output.Since(start),
+	}
+}
+
+func newJournal(path, operation, region, id string, conf Config) *journal.Journal {
+	jrnl, err := journal.New(path, operation, region, id)
+	if err != nil {
+		// Not being able to write the journal shouldn't stop the operation
+		logging.Warning("Could not create journal, the operation can't be resumed if interrupted")
+		logging.Debugf("Got error while creating journal: %s", err)
+		return nil
+	}
+	params := map[string]string{
+		paramServiceDomain: conf.ServiceDomain,
+		paramSubnetID:      conf.SubnetID,
+		paramNameTemplate:  conf.NameTemplate,
+		paramDescTemplate:  conf.DescriptionTemplate,
+	}
+	if len(conf.Tags) > 0 {
+		tags, _ := json.Marshal(conf.Tags)
+		params[paramTags] = string(tags)
+	}
+	for key, value := range params {
+		if err = jrnl.SetParam(key, value); err != nil {
+			journalNotSaved(jrnl, err)
+			break
+		}
+	}
+	logging.Infof("Progress is recorded in the journal: %s", jrnl.Path())
+	return jrnl
+}
+
+// recordStep will record a completed step in the journal. Like when creating
+// the journal, not being able to write it doesn't stop the operation.
+func recordStep(jrnl *journal.Journal, step string, resources map[string]string) {
+	if err := jrnl.Record(step, resources); err != nil {
+		journalNotSaved(jrnl, err)
+	}
+}
+
+func journalNotSaved(jrnl *journal.Journal, err error) {
+	logging.Warningf("Could not update journal %s, the operation can't be resumed if interrupted", jrnl.Path())
+	logging.Debugf("Got error while saving journal: %s", err)
+}
+
+func finishJournal(jrnl *journal.Journal, success bool) {
+	if jrnl == nil {
+		return
+	}
+	state := journal.StateCompleted
+	if !success {
+		state = journal.StateFailed
+	}
+	if err := jrnl.Finish(state); err != nil {
+		logging.Warningf("Failed to update journal %s", jrnl.Path())
+		logging.Debugf("Got error while updating journal: %s", err)
+	}
+}
+
+func awsRollbackInstance(ctx context.Context, awsSvc aws.Service, jrnl *journal.Journal) error {
+	instanceID := jrnl.Resource(resInstance)
+	if instanceID == "" {
+		// Nothing was modified before the operation was stopped
+		logging.Info("No changes were made to the instance, nothing to roll back")
+		return nil
+	}
+	guestVolID := jrnl.Resource(resGuestVolume)
+	mvVolID := jrnl.Resource(resMetavisorVolume)
+	inst, err := awsSvc.GetInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	if jrnl.Completed(stepUserdataSet) {
+		// This is done first, as the instance is started again below
+		awsRollbackUserdata(ctx, awsSvc, instanceID, jrnl)
+	}
+	rootVolID := inst.DeviceMapping()[jrnl.Resource(resRootDeviceName)]
+	if guestVolID != "" && rootVolID != guestVolID {
+		logging.Info("Moving guest volume back to the root device")
+		// The Metavisor volume is deleted below, also if it was never attached
+		err = restoreGuestVolume(ctx, aws.NewProvider(awsSvc, jrnl.Region), instanceID, guestVolID, false)
+		if err != nil {
+			return err
+		}
+	} else if jrnl.Completed(stepInstanceStopped) {
+		logging.Infof("Starting instance %s again", instanceID)
+		if err = awsSvc.StartInstance(ctx, instanceID); err != nil {
+			logging.Warningf("Could not start instance %s", instanceID)
+		}
+	}
+	if mvVolID != "" {
+		logging.Infof("Deleting Metavisor volume %s", mvVolID)
+		if err = awsSvc.DeleteVolume(ctx, mvVolID); err != nil {
+			logging.Warningf("Failed to delete Metavisor volume %s", mvVolID)
+			logging.Debugf("Could not delete volume: %s", err)
+		}
+	}
+	logging.Infof("Instance %s has been rolled back", instanceID)
+	return nil
+}
+
+// awsRollbackUserdata restores the userdata recorded in the journal, or
+// removes the Metavisor config from the userdata for older journals. The
+// instance is stopped, since the userdata can't be changed otherwise.
+func awsRollbackUserdata(ctx context.Context, awsSvc aws.Service, instanceID string, jrnl *journal.Journal) {
+	logging.Info("Restoring instance userdata")
+	data, err := getGuestUserdata(ctx, aws.NewProvider(awsSvc, jrnl.Region), instanceID, jrnl)
+	if err == nil && jrnl.Resource(resGuestUserdata) == "" {
+		data, err = restoreGuestUserdata(data)
+	}
+	if err == nil {
+		err = awsSvc.StopInstance(ctx, instanceID)
+	}
+	if err == nil {
+		err = awsSvc.AwaitInstanceStopped(ctx, instanceID)
+	}
+	if err == nil {
+		err = awsSvc.ModifyInstanceAttribute(ctx, instanceID, aws.AttrUserData, data)
+	}
+	if err != nil {
+		logging.Warning("The original userdata of the instance could not be restored")
+		logging.Debugf("Got error while restoring userdata: %s", err)
+	}
+}
+
+func awsRollbackImage(ctx context.Context, awsSvc aws.Service, jrnl *journal.Journal) error {
+	if ami := jrnl.Resource(resImage); ami != "" {
+		img, err := awsSvc.GetImage(ctx, ami)
+		if err != nil && err != aws.ErrImageNonExisting {
+			return err
+		}
+		logging.Infof("Deregistering image %s", ami)
+		if err = awsSvc.DeregisterImage(ctx, ami); err != nil && err != aws.ErrImageNonExisting {
+			return err
+		}
+		if img != nil {
+			for _, snap := range img.DeviceMapping() {
+				logging.Infof("Deleting image snapshot %s", snap)
+				if err = awsSvc.DeleteSnapshot(ctx, snap); err != nil {
+					logging.Warningf("Failed to delete snapshot %s", snap)
+					logging.Debugf("Could not delete snapshot: %s", err)
+				}
+			}
+		}
+	}
+	instID := jrnl.Resource(resTemporaryInstance)
+	if instID == "" {
+		logging.Info("No temporary instance was launched, nothing more to roll back")
+		return nil
+	}
+	// Make sure that both the guest and Metavisor volumes go away with
+	// the instance, as moving them around resets DeleteOnTermination
+	if err := awsSvc.DeleteInstanceDevicesOnTermination(ctx, instID); err != nil && err != aws.ErrInstanceNonExisting {
+		logging.Debugf("Could not set devices to delete on termination: %s", err)
+	}
+	logging.Infof("Terminating temporary instance %s", instID)
+	if err := awsSvc.TerminateInstance(ctx, instID); err != nil {
+		return err
+	}
+	for _, volID := range []string{jrnl.Resource(resMetavisorVolume), jrnl.Resource(resGuestVolume)} {
+		if volID == "" {
+			continue
+		}
+		// Volumes that are still attached are deleted with the instance
+		if err := awsSvc.DeleteVolume(ctx, volID); err != nil {
+			logging.Debugf("Did not delete volume %s: %s", volID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/immutable/metavisor-cli/pkg/csp"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+const (
+	// DefaultNameTemplate is used to name wrapped images if no other template
+	// is specified
+	DefaultNameTemplate = `Metavisor wrapped image based on {{.SourceID}} ({{.Time.Format "2006-01-02 15.04.05"}})`
+	// DefaultDescriptionTemplate is used for the description of wrapped images
+	// if no other template is specified
+	DefaultDescriptionTemplate = `{{.SourceName}} - {{.SourceDescription}} - wrapped by Immutable Systems`
+
+	// Used instead of DefaultDescriptionTemplate if the source image can't
+	// be read
+	newDesc = "Metavisor wrapped by Immutable Systems"
+
+	minImageNameLength = 3
+	maxImageNameLength = 128
+	maxImageDescLength = 255
+	reservedTagPrefix  = "aws:"
+)
+
+var (
+	// ErrInvalidTemplate is returned if a name or description template can't
+	// be parsed or executed
+	ErrInvalidTemplate = errors.New("the specified template is not valid")
+
+	// ErrInvalidTag is returned if trying to add a tag with an empty or
+	// reserved key
+	ErrInvalidTag = errors.New("tag keys can't be empty, start with \"aws:\" or be one of the Metavisor tags")
+
+	// ErrInvalidImageName is returned if the name template of wrapped images
+	// renders a name that can't be used for an AMI
+	ErrInvalidImageName = errors.New("image names must be 3-128 characters of letters, numbers, spaces and ()[]./-'@_")
+
+	imageNamePattern = regexp.MustCompile(`^[a-zA-Z0-9()\[\] ./\-'@_]*$`)
+)
+
+// ImageTemplateData is what name and description templates of wrapped images
+// can refer to, e.g. "{{.SourceName}}-mv-{{.MetavisorVersion}}-{{.Date}}"
+type ImageTemplateData struct {
+	SourceID          string
+	SourceName        string
+	SourceDescription string
+	MetavisorVersion  string
+	Region            string
+	// Date is when the image was wrapped, formatted as 2006-01-02
+	Date string
+	// Time is when the image was wrapped, and can be formatted freely, e.g.
+	// {{.Time.Format "20060102-1504"}}
+	Time time.Time
+}
+
+func newImageTemplateData(source csp.Image, id, version, region string) ImageTemplateData {
+	now := time.Now().UTC()
+	if version == "" {
+		version = unknownVersion
+	}
+	data := ImageTemplateData{
+		SourceID:         id,
+		MetavisorVersion: version,
+		Region:           region,
+		Date:             now.Format("2006-01-02"),
+		Time:             now,
+	}
+	if source != nil {
+		data.SourceName = source.Name()
+		data.SourceDescription = source.Description()
+	}
+	return data
+}
+
+// verifyImageNaming makes sure the templates and tags can be used, so that
+// the wrap doesn't fail after the instance has already been wrapped. The
+// templates are rendered with the data of the source image, although the
+// time, and possibly the Metavisor version, will differ from the final name.
+func verifyImageNaming(conf Config, data ImageTemplateData) error {
+	name, _, err := imageNameAndDescription(conf, data, true)
+	if err != nil {
+		return err
+	}
+	if err = verifyImageName(name); err != nil {
+		return err
+	}
+	for key := range conf.Tags {
+		if strings.TrimSpace(key) == "" || strings.HasPrefix(key, reservedTagPrefix) || isMetavisorTag(key) {
+			logging.Errorf("Invalid tag key: \"%s\"", key)
+			return ErrInvalidTag
+		}
+	}
+	return nil
+}
+
+// renderImageTemplate executes the template with the given data, truncating
+// the result to maxLength if it's larger than 0
+func renderImageTemplate(tmpl string, data ImageTemplateData, maxLength int) (string, error) {
+	t, err := template.New("image").Parse(tmpl)
+	if err != nil {
+		logging.Errorf("Could not parse template \"%s\": %s", tmpl, err)
+		return "", ErrInvalidTemplate
+	}
+	var b bytes.Buffer
+	if err = t.Execute(&b, data); err != nil {
+		logging.Errorf("Could not execute template \"%s\": %s", tmpl, err)
+		return "", ErrInvalidTemplate
+	}
+	res := strings.TrimSpace(b.String())
+	if maxLength > 0 && utf8.RuneCountInString(res) > maxLength {
+		logging.Debugf("Truncating \"%s\" to %d characters", res, maxLength)
+		res = string([]rune(res)[:maxLength])
+	}
+	return res, nil
+}
+
+// verifyImageName returns ErrInvalidImageName if the name can't be used for
+// an AMI
+func verifyImageName(name string) error {
+	if len(name) < minImageNameLength || len(name) > maxImageNameLength || !imageNamePattern.MatchString(name) {
+		logging.Errorf("Invalid image name: \"%s\"", name)
+		return ErrInvalidImageName
+	}
+	return nil
+}
+
+// imageNameAndDescription renders the name and description of a new wrapped
+// image. If the source image couldn't be read, the default description is
+// replaced by a generic one.
+func imageNameAndDescription(conf Config, data ImageTemplateData, sourceAvailable bool) (string, string, error) {
+	nameTmpl := conf.NameTemplate
+	if nameTmpl == "" {
+		nameTmpl = DefaultNameTemplate
+	}
+	name, err := renderImageTemplate(nameTmpl, data, maxImageNameLength)
+	if err != nil {
+		return "", "", err
+	}
+	descTmpl := conf.DescriptionTemplate
+	if descTmpl == "" {
+		if !sourceAvailable {
+			return name, newDesc, nil
+		}
+		descTmpl = DefaultDescriptionTemplate
+	}
+	desc, err := renderImageTemplate(descTmpl, data, maxImageDescLength)
+	return name, desc, err
+}
+
+// userTags returns the tags that can be copied from a resource, which are
+// all except the ones reserved by AWS
+func userTags(tags map[string]string) map[string]string {
+	res := make(map[string]string)
+	for k, v := range tags {
+		if !strings.HasPrefix(k, reservedTagPrefix) {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func isMetavisorTag(key string) bool {
+	switch key {
+	case TagMetavisorVersion, TagMetavisorAMI, TagWrappedAt, TagVolumeRole:
+		return true
+	}
+	return false
+}
+
+func mergeTags(tags ...map[string]string) map[string]string {
+	res := make(map[string]string)
+	for _, t := range tags {
+		for k, v := range t {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// propagateTags copies the tags of the source image to the wrapped image.
+// In clouds where images are made of snapshots that can be tagged, the tags
+// of each source snapshot are copied to the snapshot of the wrapped image on
+// the corresponding device. The root snapshot of the source image
+// corresponds to the guest device of the wrapped image. The extra tags are
+// added to the image and all of its snapshots. Tagging is not essential for
+// the image to work, so failures are only logged.
+func propagateTags(ctx context.Context, provider csp.Provider, source csp.Image, imageID string, extra map[string]string) {
+	log := logging.FromContext(ctx)
+	sourceTags := map[string]string{}
+	if source != nil {
+		sourceTags = userTags(source.Tags())
+	}
+	err := provider.TagImage(ctx, imageID, mergeTags(sourceTags, extra))
+	if err != nil {
+		log.Warningf("Failed to tag image %s", imageID)
+		log.Debugf("Got error while tagging image: %s", err)
+		return
+	}
+	tagger, ok := provider.(csp.SnapshotTagger)
+	if !ok {
+		return
+	}
+	img, err := provider.GetImage(ctx, imageID)
+	if err != nil {
+		log.Warningf("Failed to tag the snapshots of image %s", imageID)
+		log.Debugf("Got error while getting image: %s", err)
+		return
+	}
+	mapped, ok := img.(csp.MappedImage)
+	if !ok {
+		return
+	}
+	sourceMapped, _ := source.(csp.MappedImage)
+	for device, snapID := range mapped.DeviceMapping() {
+		snapTags := map[string]string{}
+		sourceDevice := device
+		if device == provider.GuestDeviceName() && sourceMapped != nil {
+			sourceDevice = sourceMapped.RootDeviceName()
+		} else if device == mapped.RootDeviceName() {
+			// The root device is the Metavisor, which has no source snapshot
+			sourceDevice = ""
+		}
+		if sourceMapped != nil && sourceDevice != "" {
+			if sourceSnapID, exist := sourceMapped.DeviceMapping()[sourceDevice]; exist {
+				sourceSnap, err := provider.GetSnapshot(ctx, sourceSnapID)
+				if err != nil {
+					log.Debugf("Could not get tags of source snapshot %s: %s", sourceSnapID, err)
+				} else {
+					snapTags = userTags(sourceSnap.Tags())
+				}
+			}
+		}
+		err = tagger.TagSnapshot(ctx, snapID, mergeTags(snapTags, extra))
+		if err != nil {
+			log.Warningf("Failed to tag snapshot %s", snapID)
+			log.Debugf("Got error while tagging snapshot: %s", err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTemplateData() ImageTemplateData {
+	return ImageTemplateData{
+		SourceID:          "ami-12345678",
+		SourceName:        "centos-7",
+		SourceDescription: "CentOS 7",
+		MetavisorVersion:  "3.1.2",
+		Region:            "us-west-2",
+		Date:              "2018-03-01",
+		Time:              time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestDefaultImageNaming(t *testing.T) {
+	name, desc, err := imageNameAndDescription(Config{}, testTemplateData(), true)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if name != "Metavisor wrapped image based on ami-12345678 (2018-03-01 12.00.00)" {
+		t.Errorf("Got unexpected name: %s", name)
+	}
+	if desc != "centos-7 - CentOS 7 - wrapped by Immutable Systems" {
+		t.Errorf("Got unexpected description: %s", desc)
+	}
+	_, desc, err = imageNameAndDescription(Config{}, testTemplateData(), false)
+	if err != nil || desc != newDesc {
+		t.Errorf("Expected generic description without source image, got %s (%v)", desc, err)
+	}
+}
+
+func TestCustomImageNaming(t *testing.T) {
+	conf := Config{
+		NameTemplate:        "{{.SourceName}}-mv-{{.MetavisorVersion}}-{{.Region}}-{{.Date}}",
+		DescriptionTemplate: `{{.SourceDescription}} ({{.Time.Format "20060102"}})`,
+	}
+	name, desc, err := imageNameAndDescription(conf, testTemplateData(), true)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if name != "centos-7-mv-3.1.2-us-west-2-2018-03-01" {
+		t.Errorf("Got unexpected name: %s", name)
+	}
+	if desc != "CentOS 7 (20180301)" {
+		t.Errorf("Got unexpected description: %s", desc)
+	}
+	conf.NameTemplate = strings.Repeat("{{.SourceName}}", 50)
+	name, _, err = imageNameAndDescription(conf, testTemplateData(), true)
+	if err != nil || len(name) != maxImageNameLength {
+		t.Errorf("Expected name to be truncated to %d characters, got %d (%v)", maxImageNameLength, len(name), err)
+	}
+	conf.DescriptionTemplate = strings.Repeat("é", maxImageDescLength+1)
+	_, desc, err = imageNameAndDescription(conf, testTemplateData(), true)
+	if err != nil || desc != strings.Repeat("é", maxImageDescLength) {
+		t.Errorf("Expected description to be truncated to %d characters, got %q (%v)", maxImageDescLength, desc, err)
+	}
+}
+
+func TestVerifyImageNaming(t *testing.T) {
+	invalid := []Config{
+		{NameTemplate: "{{.SourceName"},
+		{DescriptionTemplate: "{{.NoSuchField}}"},
+		{Tags: map[string]string{"aws:cloudformation": "x"}},
+		{Tags: map[string]string{TagMetavisorVersion: "x"}},
+		{Tags: map[string]string{" ": "x"}},
+		{NameTemplate: "mv"},
+		{NameTemplate: "{{.SourceName}}:{{.Date}}"},
+		{NameTemplate: "{{.SourceDescription}}"},
+		{NameTemplate: "centos-7-été"},
+	}
+	data := testTemplateData()
+	data.SourceDescription = "CentOS 7, minimal"
+	for _, conf := range invalid {
+		if err := verifyImageNaming(conf, data); err == nil {
+			t.Errorf("Expected error for %+v", conf)
+		}
+	}
+	valid := Config{
+		NameTemplate: "{{.SourceName}}-{{.Date}}",
+		Tags:         map[string]string{"Team": "platform"},
+	}
+	if err := verifyImageNaming(valid, data); err != nil {
+		t.Errorf("Got unexpected error: %s", err)
+	}
+	if err := verifyImageNaming(Config{}, data); err != nil {
+		t.Errorf("Got unexpected error for the default templates: %s", err)
+	}
+}
+
+func TestUserTags(t *testing.T) {
+	tags := userTags(map[string]string{"Name": "web", "aws:cloudformation:stack-name": "stack"})
+	if len(tags) != 1 || tags["Name"] != "web" {
+		t.Errorf("Got unexpected tags: %v", tags)
+	}
+	merged := mergeTags(map[string]string{"a": "1", "b": "1"}, map[string]string{"b": "2"})
+	if merged["a"] != "1" || merged["b"] != "2" {
+		t.Errorf("Got unexpected merged tags: %v", merged)
+	}
+}
@@ -0,0 +1,448 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+const (
+	// PermissionAllowed means that a dry run of the action succeeded
+	PermissionAllowed = "allowed"
+	// PermissionDenied means that IAM permissions are missing for the action
+	PermissionDenied = "denied"
+	// PermissionUnknown means that the dry run failed for some other reason
+	PermissionUnknown = "unknown"
+
+	temporaryInstanceName = "the temporary instance"
+)
+
+// ErrPlanNotPermitted is returned if the dry runs of a plan show that
+// some IAM permissions are missing
+var ErrPlanNotPermitted = errors.New("missing IAM permissions for some of the planned operations")
+
+// Plan describes what wrapping an instance or an image would do, without
+// actually doing it
+type Plan struct {
+	Operation         string            `json:"operation"`
+	Region            string            `json:"region"`
+	ID                string            `json:"id"`
+	MetavisorVersion  string            `json:"mv_version,omitempty"`
+	MetavisorAMI      string            `json:"mv_ami"`
+	MetavisorSnapshot string            `json:"mv_snapshot"`
+	SnapshotSizeGB    int64             `json:"mv_snapshot_size_gb"`
+	VolumeType        string            `json:"volume_type"`
+	AvailabilityZone  string            `json:"availability_zone,omitempty"`
+	Steps             []PlanStep        `json:"steps"`
+	Permissions       []PermissionCheck `json:"permission_checks"`
+}
+
+// PlanStep is a single step of a plan
+type PlanStep struct {
+	Description string `json:"description"`
+	// Temporary is set if the step creates a resource that is removed again
+	Temporary bool `json:"temporary,omitempty"`
+}
+
+// PermissionCheck is the result of dry running an action of a plan
+type PermissionCheck struct {
+	Action string `json:"action"`
+	// Region is set if the action is checked in another region than the
+	// region of the plan
+	Region string `json:"region,omitempty"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Permitted is true if none of the dry runs of the plan were denied
+func (p *Plan) Permitted() bool {
+	for _, c := range p.Permissions {
+		if c.Result == PermissionDenied {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Plan) addStep(temporary bool, format string, v ...interface{}) {
+	p.Steps = append(p.Steps, PlanStep{
+		Description: fmt.Sprintf(format, v...),
+		Temporary:   temporary,
+	})
+}
+
+// FormatPlan will format a plan for display. If withJSON is true, the plan
+// will be formatted as structured JSON, otherwise as a human readable list
+// of steps.
+func FormatPlan(plan *Plan, withJSON bool) (string, error) {
+	if withJSON {
+		data, err := json.MarshalIndent(plan, "", "\t")
+		if err != nil {
+			logging.Errorf("Failed to marshal plan to JSON: %s", err)
+		}
+		return string(data), err
+	}
+	var b bytes.Buffer
+	b.WriteString(fmt.Sprintf("Plan for %s of %s in %s\n\n", plan.Operation, plan.ID, plan.Region))
+	w := tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+	version := plan.MetavisorVersion
+	if version == "" {
+		version = "<from specified AMI>"
+	}
+	fmt.Fprintf(w, "Metavisor version:\t%s\n", version)
+	fmt.Fprintf(w, "Metavisor AMI:\t%s\n", plan.MetavisorAMI)
+	fmt.Fprintf(w, "Metavisor snapshot:\t%s (%d GiB)\n", plan.MetavisorSnapshot, plan.SnapshotSizeGB)
+	fmt.Fprintf(w, "Volume type:\t%s\n", plan.VolumeType)
+	if plan.AvailabilityZone != "" {
+		fmt.Fprintf(w, "Availability zone:\t%s\n", plan.AvailabilityZone)
+	}
+	w.Flush()
+	b.WriteString("\nSteps:\n")
+	for i, s := range plan.Steps {
+		temp := ""
+		if s.Temporary {
+			temp = " (temporary)"
+		}
+		b.WriteString(fmt.Sprintf("%3d. %s%s\n", i+1, s.Description, temp))
+	}
+	b.WriteString("\nPermission checks:\n")
+	w = tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	for _, c := range plan.Permissions {
+		action := c.Action
+		if c.Region != "" {
+			action = fmt.Sprintf("%s in %s", c.Action, c.Region)
+		}
+		if c.Error != "" {
+			fmt.Fprintf(w, "  %s\t%s\t(%s)\n", action, c.Result, c.Error)
+		} else {
+			fmt.Fprintf(w, "  %s\t%s\n", action, c.Result)
+		}
+	}
+	w.Flush()
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+// PlanInstance will determine what wrapping the given instance would do,
+// using only read-only calls and dry runs. Nothing is modified in AWS.
+func PlanInstance(ctx context.Context, region, id string, conf Config) (*Plan, error) {
+	iamConf := &aws.IAMConfig{
+		RoleARN:      conf.IAMRoleARN,
+		MFADeviceARN: conf.IAMDeviceARN,
+		MFACode:      conf.IAMCode,
+	}
+	if strings.TrimSpace(region) == "" {
+		logging.Info("No region was specified, attempting to find it automatically")
+		reg, err := aws.FindInstanceRegion(id, iamConf)
+		if err != nil {
+			if err == aws.ErrAmbigiousInstanceRegion {
+				logging.Warning("Please specify instance region with: --region")
+			}
+			return nil, err
+		}
+		region = reg
+	}
+	service, err := aws.New(region, iamConf)
+	if err != nil {
+		if err == aws.ErrInvalidARN {
+			logging.Error("Failed to assume IAM role")
+		}
+		return nil, err
+	}
+	return awsPlanInstance(ctx, service, region, id, conf)
+}
+
+// PlanImage will determine what wrapping the given image would do, using
+// only read-only calls and dry runs. Nothing is modified in AWS. Copying and
+// sharing the wrapped image is planned as well if distConf isn't empty.
+func PlanImage(ctx context.Context, region, id string, conf Config, distConf DistributeConfig) (*Plan, error) {
+	err := VerifyDistribution(distConf)
+	if err != nil {
+		return nil, err
+	}
+	iamConf := &aws.IAMConfig{
+		RoleARN:      conf.IAMRoleARN,
+		MFADeviceARN: conf.IAMDeviceARN,
+		MFACode:      conf.IAMCode,
+	}
+	service, err := aws.New(region, iamConf)
+	if err != nil {
+		if err == aws.ErrInvalidARN {
+			logging.Error("Failed to assume IAM role")
+		}
+		return nil, err
+	}
+	// Copies are made from the region they are copied to, like in Distribute
+	copyServices := map[string]aws.Service{}
+	for _, r := range distinctRegions(region, distConf.CopyToRegions) {
+		if copyServices[r], err = aws.New(r, iamConf); err != nil {
+			return nil, err
+		}
+	}
+	return awsPlanImage(ctx, service, region, id, conf, distConf, copyServices)
+}
+
+func awsPlanInstance(ctx context.Context, awsSvc aws.Service, region, id string, conf Config) (*Plan, error) {
+	if !aws.IsInstanceID(id) {
+		return nil, aws.ErrInvalidInstanceID
+	}
+	err := awsVerifyConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	inst, err := awsSvc.GetInstance(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	provider := aws.NewProvider(awsSvc, region)
+	err = checkNotWrapped(ctx, provider, inst)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyInstance(provider, inst)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{
+		Operation:        opAWSWrapInstance,
+		Region:           region,
+		ID:               id,
+		AvailabilityZone: inst.AvailabilityZone(),
+	}
+	mvENASupport, err := awsPlanMetavisor(ctx, awsSvc, plan, conf)
+	if err != nil {
+		return nil, err
+	}
+	guestVolID := inst.DeviceMapping()[inst.RootDeviceName()]
+	awsPlanWrapSteps(plan, id, inst.RootDeviceName(), guestVolID, conf, !inst.ENASupport() && mvENASupport, inst.SriovNetSupport() != aws.SriovNetIsSupported)
+
+	logging.Info("Checking IAM permissions with dry runs...")
+	plan.checkPermission(ctx, awsSvc, aws.DryRunStopInstances, aws.DryRunParams{InstanceID: id})
+	plan.checkPermission(ctx, awsSvc, aws.DryRunModifyInstanceAttribute, aws.DryRunParams{InstanceID: id})
+	plan.checkPermission(ctx, awsSvc, aws.DryRunCreateVolume, aws.DryRunParams{
+		SnapshotID: plan.MetavisorSnapshot,
+		VolumeType: plan.VolumeType,
+		Zone:       plan.AvailabilityZone,
+		SizeGB:     plan.SnapshotSizeGB,
+	})
+	plan.checkPermission(ctx, awsSvc, aws.DryRunDetachVolume, aws.DryRunParams{
+		InstanceID: id,
+		VolumeID:   guestVolID,
+		DeviceName: inst.RootDeviceName(),
+	})
+	plan.checkPermission(ctx, awsSvc, aws.DryRunAttachVolume, aws.DryRunParams{
+		InstanceID: id,
+		VolumeID:   guestVolID,
+		DeviceName: GuestDeviceName,
+	})
+	plan.checkPermission(ctx, awsSvc, aws.DryRunStartInstances, aws.DryRunParams{InstanceID: id})
+	return plan, nil
+}
+
+func awsPlanImage(ctx context.Context, awsSvc aws.Service, region, id string, conf Config, distConf DistributeConfig, copyServices map[string]aws.Service) (*Plan, error) {
+	if !aws.IsAMIID(id) {
+		return nil, aws.ErrInvalidAMIID
+	}
+	err := awsVerifyConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	sourceImage, err := awsSvc.GetImage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyImageNaming(conf, newImageTemplateData(sourceImage, id, conf.MetavisorVersion, region))
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{
+		Operation: opAWSWrapImage,
+		Region:    region,
+		ID:        id,
+	}
+	mvENASupport, err := awsPlanMetavisor(ctx, awsSvc, plan, conf)
+	if err != nil {
+		return nil, err
+	}
+	subnet := "the default subnet"
+	if conf.SubnetID != "" {
+		subnet = conf.SubnetID
+	}
+	plan.addStep(true, "Launch %s from %s (%s) as %s in %s", temporaryInstanceName, id, sourceImage.Name(), aws.LargerInstanceType, subnet)
+	plan.addStep(false, "Wait for %s to be running", temporaryInstanceName)
+	// ENA and sriovNetSupport depend on the temporary instance, assume
+	// they need to be enabled
+	awsPlanWrapSteps(plan, temporaryInstanceName, sourceImage.RootDeviceName(), "its root volume", conf, mvENASupport, true)
+	plan.addStep(false, "Wait for %s to pass health checks", temporaryInstanceName)
+	plan.addStep(false, "Create a new AMI from %s", temporaryInstanceName)
+	plan.addStep(false, "Wait for the new AMI to become available")
+	plan.addStep(false, "Terminate %s", temporaryInstanceName)
+
+	logging.Info("Checking IAM permissions with dry runs...")
+	plan.checkPermission(ctx, awsSvc, aws.DryRunRunInstances, aws.DryRunParams{
+		ImageID:      id,
+		InstanceType: aws.LargerInstanceType,
+		SubnetID:     conf.SubnetID,
+	})
+	awsPlanDistribution(ctx, awsSvc, plan, sourceImage, distConf, copyServices)
+	return plan, nil
+}
+
+// awsPlanDistribution adds the steps and dry runs of copying and sharing the
+// wrapped image. The wrapped image doesn't exist yet, so the dry runs are
+// done with the source image and its root snapshot instead.
+func awsPlanDistribution(ctx context.Context, awsSvc aws.Service, plan *Plan, source aws.Image, conf DistributeConfig, copyServices map[string]aws.Service) {
+	regions := distinctRegions(plan.Region, conf.CopyToRegions)
+	perms, _ := launchPermissions(conf.ShareWith)
+	for _, r := range regions {
+		plan.addStep(false, "Copy the new AMI to %s and wait for the copy to become available", r)
+	}
+	images := "the new AMI"
+	if len(regions) > 0 {
+		images = "the new AMI and its copies"
+	}
+	if !perms.Empty() {
+		plan.addStep(false, "Share %s with %s", images, strings.Join(conf.ShareWith, ", "))
+	}
+	if len(perms.AccountIDs) > 0 {
+		plan.addStep(false, "Share the snapshots of %s with %s", images, strings.Join(perms.AccountIDs, ", "))
+	}
+
+	for _, r := range regions {
+		plan.checkPermissionIn(ctx, copyServices[r], r, aws.DryRunCopyImage, aws.DryRunParams{
+			ImageID:      source.ID(),
+			SourceRegion: plan.Region,
+		})
+	}
+	if !perms.Empty() {
+		plan.checkPermission(ctx, awsSvc, aws.DryRunModifyImageAttribute, aws.DryRunParams{
+			ImageID:     source.ID(),
+			Permissions: perms,
+		})
+	}
+	if len(perms.AccountIDs) > 0 {
+		plan.checkPermission(ctx, awsSvc, aws.DryRunModifySnapshotAttribute, aws.DryRunParams{
+			SnapshotID:  source.DeviceMapping()[source.RootDeviceName()],
+			Permissions: perms,
+		})
+	}
+}
+
+// Resolve the Metavisor version, AMI and snapshot to use, and return whether
+// the Metavisor supports ENA or not
+func awsPlanMetavisor(ctx context.Context, awsSvc aws.Service, plan *Plan, conf Config) (bool, error) {
+	plan.MetavisorAMI = conf.MetavisorAMI
+	if plan.MetavisorAMI == "" {
+		version := conf.MetavisorVersion
+		if version == "" {
+			logging.Info("Getting the latest Metavisor version...")
+			v, err := getLatestMVVersion(ctx)
+			if err != nil {
+				return false, err
+			}
+			version = v
+		}
+		ami, err := getAMIForVersion(ctx, version, plan.Region)
+		if err != nil {
+			return false, err
+		}
+		plan.MetavisorVersion = version
+		plan.MetavisorAMI = ami
+	}
+	mvSnapshot, mvENASupport, err := awsMetavisorSnapshot(ctx, awsSvc, plan.MetavisorAMI)
+	if err != nil {
+		return false, err
+	}
+	plan.MetavisorSnapshot = mvSnapshot.ID()
+	plan.SnapshotSizeGB = mvSnapshot.SizeGB()
+	plan.VolumeType = rootVolumeType
+	return mvENASupport, nil
+}
+
+func awsPlanWrapSteps(plan *Plan, instance, rootDevice, guestVolume string, conf Config, enableENA, enableSriov bool) {
+	domain := conf.ServiceDomain
+	if domain == "" {
+		domain = ProdDomain
+	}
+	zone := plan.AvailabilityZone
+	if zone == "" {
+		zone = "the availability zone of " + instance
+	}
+	plan.addStep(false, "Stop %s", instance)
+	plan.addStep(false, "Add Metavisor config for %s to the userdata of %s, keeping the existing userdata", domain, instance)
+	plan.addStep(false, "Create Metavisor root volume from %s (%d GiB, %s) in %s", plan.MetavisorSnapshot, plan.SnapshotSizeGB, plan.VolumeType, zone)
+	plan.addStep(false, "Detach guest volume %s from %s", guestVolume, rootDevice)
+	plan.addStep(false, "Attach guest volume %s to %s", guestVolume, GuestDeviceName)
+	plan.addStep(false, "Attach Metavisor root volume to %s", rootDevice)
+	if enableSriov {
+		plan.addStep(false, "Set SriovNetSupport to %s on %s", aws.SriovNetIsSupported, instance)
+	}
+	if enableENA {
+		plan.addStep(false, "Enable ENA support on %s", instance)
+	}
+	plan.addStep(false, "Start %s", instance)
+	plan.addStep(false, "Set all devices of %s to delete on termination", instance)
+}
+
+func (p *Plan) checkPermission(ctx context.Context, awsSvc aws.Service, action aws.DryRunAction, params aws.DryRunParams) {
+	p.checkPermissionIn(ctx, awsSvc, "", action, params)
+}
+
+// checkPermissionIn dry runs an action with a service of another region
+func (p *Plan) checkPermissionIn(ctx context.Context, awsSvc aws.Service, region string, action aws.DryRunAction, params aws.DryRunParams) {
+	check := PermissionCheck{
+		Action: aws.DryRunActionName(action),
+		Region: region,
+		Result: PermissionAllowed,
+	}
+	err := awsSvc.DryRun(ctx, action, params)
+	if err == aws.ErrNotAllowed {
+		check.Result = PermissionDenied
+	} else if err != nil {
+		logging.Debugf("Dry run of %s failed: %s", check.Action, err)
+		check.Result = PermissionUnknown
+		check.Error = err.Error()
+	}
+	p.Permissions = append(p.Permissions, check)
+}
+
+// Here we also want to return if the MV has ENA support or not, as this is needed later
+func awsMetavisorSnapshot(ctx context.Context, service aws.Service, mvImageID string) (mvSnapshot aws.Snapshot, enaSupport bool, err error) {
+	logging.Debugf("Fetching AMI %s from AWS", mvImageID)
+	mvImage, err := service.GetImage(ctx, mvImageID)
+	if err != nil {
+		return mvSnapshot, enaSupport, err
+	}
+	logging.Debug("Determining snapshot from Metavisor image")
+	mvSnapshotID, exist := mvImage.DeviceMapping()[mvImage.RootDeviceName()]
+	if !exist {
+		// Something is wrong with this MV AMI, it doesn't have any root device
+		return mvSnapshot, enaSupport, ErrInvalidAMI
+	}
+	logging.Debugf("Fetching snapshot %s from AWS", mvSnapshotID)
+	mvSnapshot, err = service.GetSnapshot(ctx, mvSnapshotID)
+	if err != nil {
+		return mvSnapshot, enaSupport, err
+	}
+	return mvSnapshot, mvImage.ENASupport(), nil
+}
@@ -0,0 +1,136 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/csp/aws/fake"
+)
+
+// permission returns the result of the permission check of an action in a
+// plan, or an empty string if the action wasn't checked
+func permission(plan *Plan, action, region string) string {
+	for _, c := range plan.Permissions {
+		if c.Action == action && c.Region == region {
+			return c.Result
+		}
+	}
+	return ""
+}
+
+func TestAWSPlanInstance(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	before := ec2.Resources()
+
+	plan, err := awsPlanInstance(context.Background(), ec2, testRegion, id, conf)
+	if err != nil {
+		t.Fatalf("Got unexpected error when planning: %s", err)
+	}
+	if plan.Operation != opAWSWrapInstance || plan.MetavisorAMI != conf.MetavisorAMI || plan.AvailabilityZone != ec2.Zone() {
+		t.Errorf("Got unexpected plan: %+v", plan)
+	}
+	if !plan.Permitted() || len(plan.Permissions) != 6 {
+		t.Errorf("Expected all actions to be allowed, got %+v", plan.Permissions)
+	}
+	if ec2.Calls("StopInstances") != 0 {
+		t.Error("Expected planning not to stop the instance")
+	}
+	if after := ec2.Resources(); len(after.Volumes) != len(before.Volumes) {
+		t.Errorf("Expected planning not to create volumes, got %v", after.Volumes)
+	}
+}
+
+func TestAWSPlanInstanceDenied(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	ec2.Deny("StopInstances")
+
+	plan, err := awsPlanInstance(context.Background(), ec2, testRegion, id, conf)
+	if err != nil {
+		t.Fatalf("Got unexpected error when planning: %s", err)
+	}
+	if plan.Permitted() {
+		t.Error("Expected plan not to be permitted")
+	}
+	if res := permission(plan, "ec2:StopInstances", ""); res != PermissionDenied {
+		t.Errorf("Expected ec2:StopInstances to be denied, got %q", res)
+	}
+	if res := permission(plan, "ec2:StartInstances", ""); res != PermissionAllowed {
+		t.Errorf("Expected ec2:StartInstances to be allowed, got %q", res)
+	}
+}
+
+func TestAWSPlanImage(t *testing.T) {
+	ec2, conf := newTestEC2()
+	ami := ec2.AddImage("guest", 8, nil)
+
+	plan, err := awsPlanImage(context.Background(), ec2, testRegion, ami, conf, DistributeConfig{}, nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when planning: %s", err)
+	}
+	if plan.Operation != opAWSWrapImage || !plan.Permitted() || len(plan.Permissions) != 1 {
+		t.Errorf("Got unexpected plan: %+v", plan)
+	}
+	for _, s := range plan.Steps {
+		if strings.Contains(s.Description, "Copy") || strings.Contains(s.Description, "Share") {
+			t.Errorf("Got unexpected distribution step: %s", s.Description)
+		}
+	}
+}
+
+func TestAWSPlanImageDistribution(t *testing.T) {
+	ec2, conf := newTestEC2()
+	ami := ec2.AddImage("guest", 8, nil)
+	other := fake.New("us-east-1")
+	ec2.Peer(other)
+	other.Deny("CopyImage")
+	distConf := DistributeConfig{
+		CopyToRegions: []string{"us-east-1"},
+		ShareWith:     []string{"123456789012"},
+	}
+
+	plan, err := awsPlanImage(context.Background(), ec2, testRegion, ami, conf, distConf, map[string]aws.Service{"us-east-1": other})
+	if err != nil {
+		t.Fatalf("Got unexpected error when planning: %s", err)
+	}
+	steps := []string{}
+	for _, s := range plan.Steps {
+		steps = append(steps, s.Description)
+	}
+	all := strings.Join(steps, "\n")
+	if !strings.Contains(all, "Copy the new AMI to us-east-1") || !strings.Contains(all, "Share the snapshots of the new AMI and its copies with 123456789012") {
+		t.Errorf("Expected copy and share steps, got:\n%s", all)
+	}
+	if res := permission(plan, "ec2:CopyImage", "us-east-1"); res != PermissionDenied {
+		t.Errorf("Expected ec2:CopyImage in us-east-1 to be denied, got %q", res)
+	}
+	if res := permission(plan, "ec2:ModifyImageAttribute", ""); res != PermissionAllowed {
+		t.Errorf("Expected ec2:ModifyImageAttribute to be allowed, got %q", res)
+	}
+	if res := permission(plan, "ec2:ModifySnapshotAttribute", ""); res != PermissionAllowed {
+		t.Errorf("Expected ec2:ModifySnapshotAttribute to be allowed, got %q", res)
+	}
+	if plan.Permitted() {
+		t.Error("Expected plan not to be permitted")
+	}
+	if out, err := FormatPlan(plan, false); err != nil || !strings.Contains(out, "ec2:CopyImage in us-east-1") {
+		t.Errorf("Expected region of copy check to be shown, got:\n%s", out)
+	}
+}
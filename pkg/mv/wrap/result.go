@@ -0,0 +1,244 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"strconv"
+
+	"github.com/immutable/metavisor-cli/pkg/output"
+)
+
+const (
+	// KindWrapInstance is the kind of InstanceResult
+	KindWrapInstance = "wrap-instance"
+	// KindWrapImage is the kind of ImageResult
+	KindWrapImage = "wrap-ami"
+	// KindUnwrapInstance is the kind of UnwrapResult
+	KindUnwrapInstance = "unwrap-instance"
+	// KindUpgradeInstance is the kind of UpgradeResult
+	KindUpgradeInstance = "upgrade-instance"
+	// KindResume is the kind of ResumeResult
+	KindResume = "resume"
+	// KindRollback is the kind of RollbackResult
+	KindRollback = "rollback"
+)
+
+// InstanceResult is the result of wrapping an instance
+type InstanceResult struct {
+	InstanceID       string `json:"instance_id" yaml:"instance_id"`
+	Region           string `json:"region" yaml:"region"`
+	MetavisorVersion string `json:"metavisor_version" yaml:"metavisor_version"`
+	MetavisorAMI     string `json:"metavisor_ami" yaml:"metavisor_ami"`
+	MetavisorVolume  string `json:"metavisor_volume" yaml:"metavisor_volume"`
+	GuestVolume      string `json:"guest_volume" yaml:"guest_volume"`
+	// Duration is the number of seconds wrapping took
+	Duration float64 `json:"duration" yaml:"duration"`
+}
+
+// Kind implements output.Result
+func (r *InstanceResult) Kind() string {
+	return KindWrapInstance
+}
+
+// Rows implements output.Result
+func (r *InstanceResult) Rows() []output.Row {
+	return []output.Row{
+		{Name: "Instance ID", Value: r.InstanceID},
+		{Name: "Region", Value: r.Region},
+		{Name: "Metavisor version", Value: r.MetavisorVersion},
+		{Name: "Metavisor AMI", Value: r.MetavisorAMI},
+		{Name: "Metavisor volume", Value: r.MetavisorVolume},
+		{Name: "Guest volume", Value: r.GuestVolume},
+		{Name: "Duration", Value: output.Seconds(r.Duration)},
+	}
+}
+
+// ImageResult is the result of wrapping an image
+type ImageResult struct {
+	ImageID          string `json:"image_id" yaml:"image_id"`
+	Region           string `json:"region" yaml:"region"`
+	SourceImage      string `json:"source_image" yaml:"source_image"`
+	MetavisorVersion string `json:"metavisor_version" yaml:"metavisor_version"`
+	MetavisorAMI     string `json:"metavisor_ami" yaml:"metavisor_ami"`
+	// Snapshots maps the devices of the image to the IDs of their snapshots
+	Snapshots map[string]string `json:"snapshots" yaml:"snapshots"`
+	// TemporaryInstance is the ID of the instance that was wrapped to
+	// create the image, it's terminated when done
+	TemporaryInstance string `json:"temporary_instance" yaml:"temporary_instance"`
+	// Copies maps the regions the image was copied to to the IDs of the
+	// copies
+	Copies map[string]string `json:"copies,omitempty" yaml:"copies,omitempty"`
+	// Duration is the number of seconds wrapping took, not including
+	// copying the image
+	Duration float64 `json:"duration" yaml:"duration"`
+}
+
+// Kind implements output.Result
+func (r *ImageResult) Kind() string {
+	return KindWrapImage
+}
+
+// Rows implements output.Result
+func (r *ImageResult) Rows() []output.Row {
+	return []output.Row{
+		{Name: "Image ID", Value: r.ImageID},
+		{Name: "Region", Value: r.Region},
+		{Name: "Source image", Value: r.SourceImage},
+		{Name: "Metavisor version", Value: r.MetavisorVersion},
+		{Name: "Metavisor AMI", Value: r.MetavisorAMI},
+		{Name: "Snapshots", Value: output.Map(r.Snapshots)},
+		{Name: "Temporary instance", Value: r.TemporaryInstance},
+		{Name: "Copies", Value: output.Map(r.Copies)},
+		{Name: "Duration", Value: output.Seconds(r.Duration)},
+	}
+}
+
+// UnwrapResult is the result of unwrapping an instance
+type UnwrapResult struct {
+	InstanceID  string `json:"instance_id" yaml:"instance_id"`
+	Region      string `json:"region" yaml:"region"`
+	GuestVolume string `json:"guest_volume" yaml:"guest_volume"`
+	// MetavisorVolume is the volume that was detached from the instance,
+	// it no longer exists if MetavisorVolumeDeleted is set
+	MetavisorVolume        string `json:"metavisor_volume" yaml:"metavisor_volume"`
+	MetavisorVolumeDeleted bool   `json:"metavisor_volume_deleted" yaml:"metavisor_volume_deleted"`
+	// Duration is the number of seconds unwrapping took
+	Duration float64 `json:"duration" yaml:"duration"`
+}
+
+// Kind implements output.Result
+func (r *UnwrapResult) Kind() string {
+	return KindUnwrapInstance
+}
+
+// Rows implements output.Result
+func (r *UnwrapResult) Rows() []output.Row {
+	return []output.Row{
+		{Name: "Instance ID", Value: r.InstanceID},
+		{Name: "Region", Value: r.Region},
+		{Name: "Guest volume", Value: r.GuestVolume},
+		{Name: "Metavisor volume", Value: r.MetavisorVolume},
+		{Name: "Metavisor volume deleted", Value: strconv.FormatBool(r.MetavisorVolumeDeleted)},
+		{Name: "Duration", Value: output.Seconds(r.Duration)},
+	}
+}
+
+// UpgradeResult is the result of upgrading the Metavisor of an instance
+type UpgradeResult struct {
+	InstanceID           string `json:"instance_id" yaml:"instance_id"`
+	Region               string `json:"region" yaml:"region"`
+	MetavisorVersion     string `json:"metavisor_version" yaml:"metavisor_version"`
+	MetavisorAMI         string `json:"metavisor_ami" yaml:"metavisor_ami"`
+	MetavisorVolume      string `json:"metavisor_volume" yaml:"metavisor_volume"`
+	GuestVolume          string `json:"guest_volume" yaml:"guest_volume"`
+	PreviousMetavisorAMI string `json:"previous_metavisor_ami" yaml:"previous_metavisor_ami"`
+	// PreviousMetavisorVolume is the volume that was replaced, it no longer
+	// exists if PreviousMetavisorVolumeDeleted is set
+	PreviousMetavisorVolume        string `json:"previous_metavisor_volume" yaml:"previous_metavisor_volume"`
+	PreviousMetavisorVolumeDeleted bool   `json:"previous_metavisor_volume_deleted" yaml:"previous_metavisor_volume_deleted"`
+	// Duration is the number of seconds upgrading took
+	Duration float64 `json:"duration" yaml:"duration"`
+}
+
+// Kind implements output.Result
+func (r *UpgradeResult) Kind() string {
+	return KindUpgradeInstance
+}
+
+// Rows implements output.Result
+func (r *UpgradeResult) Rows() []output.Row {
+	return []output.Row{
+		{Name: "Instance ID", Value: r.InstanceID},
+		{Name: "Region", Value: r.Region},
+		{Name: "Metavisor version", Value: r.MetavisorVersion},
+		{Name: "Metavisor AMI", Value: r.MetavisorAMI},
+		{Name: "Metavisor volume", Value: r.MetavisorVolume},
+		{Name: "Guest volume", Value: r.GuestVolume},
+		{Name: "Previous Metavisor AMI", Value: r.PreviousMetavisorAMI},
+		{Name: "Previous Metavisor volume", Value: r.PreviousMetavisorVolume},
+		{Name: "Previous volume deleted", Value: strconv.FormatBool(r.PreviousMetavisorVolumeDeleted)},
+		{Name: "Duration", Value: output.Seconds(r.Duration)},
+	}
+}
+
+// ResumeResult is the result of resuming an interrupted operation. Either
+// Instance or Image is set, depending on the operation.
+type ResumeResult struct {
+	Operation string          `json:"operation" yaml:"operation"`
+	Journal   string          `json:"journal" yaml:"journal"`
+	Instance  *InstanceResult `json:"instance,omitempty" yaml:"instance,omitempty"`
+	Image     *ImageResult    `json:"image,omitempty" yaml:"image,omitempty"`
+	// Duration is the number of seconds resuming took
+	Duration float64 `json:"duration" yaml:"duration"`
+}
+
+// ID returns the ID of the wrapped instance or image
+func (r *ResumeResult) ID() string {
+	if r.Instance != nil {
+		return r.Instance.InstanceID
+	}
+	if r.Image != nil {
+		return r.Image.ImageID
+	}
+	return ""
+}
+
+// Kind implements output.Result
+func (r *ResumeResult) Kind() string {
+	return KindResume
+}
+
+// Rows implements output.Result
+func (r *ResumeResult) Rows() []output.Row {
+	rows := []output.Row{
+		{Name: "Operation", Value: r.Operation},
+		{Name: "Journal", Value: r.Journal},
+	}
+	switch {
+	case r.Instance != nil:
+		rows = append(rows, r.Instance.Rows()...)
+	case r.Image != nil:
+		rows = append(rows, r.Image.Rows()...)
+	}
+	return rows
+}
+
+// RollbackResult is the result of rolling back an interrupted operation
+type RollbackResult struct {
+	Operation string `json:"operation" yaml:"operation"`
+	Journal   string `json:"journal" yaml:"journal"`
+	// ResourceID is the ID of the instance or image the operation was
+	// started on
+	ResourceID string `json:"resource_id" yaml:"resource_id"`
+	Region     string `json:"region" yaml:"region"`
+	// Duration is the number of seconds rolling back took
+	Duration float64 `json:"duration" yaml:"duration"`
+}
+
+// Kind implements output.Result
+func (r *RollbackResult) Kind() string {
+	return KindRollback
+}
+
+// Rows implements output.Result
+func (r *RollbackResult) Rows() []output.Row {
+	return []output.Row{
+		{Name: "Operation", Value: r.Operation},
+		{Name: "Journal", Value: r.Journal},
+		{Name: "Resource ID", Value: r.ResourceID},
+		{Name: "Region", Value: r.Region},
+		{Name: "Duration", Value: output.Seconds(r.Duration)},
+	}
+}
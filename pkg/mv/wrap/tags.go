@@ -0,0 +1,193 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp"
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+// Tags put on wrapped instances, images and their volumes
+const (
+	// TagMetavisorVersion is the Metavisor version a resource is wrapped with
+	TagMetavisorVersion = "metavisor-version"
+	// TagMetavisorAMI is the Metavisor AMI a resource is wrapped with
+	TagMetavisorAMI = "metavisor-ami"
+	// TagWrappedAt is when the resource was wrapped, in RFC 3339 format
+	TagWrappedAt = "metavisor-wrapped-at"
+	// TagVolumeRole is put on the volumes of a wrapped instance, and is
+	// either VolumeRoleMetavisor or VolumeRoleGuest
+	TagVolumeRole = "metavisor-volume"
+
+	// VolumeRoleMetavisor is the role of the Metavisor root volume
+	VolumeRoleMetavisor = "metavisor"
+	// VolumeRoleGuest is the role of the guest volume
+	VolumeRoleGuest = "guest"
+
+	unknownVersion = "unknown"
+
+	// metavisorImagePrefix starts the names of the published Metavisor AMIs,
+	// which are named after the version, e.g. metavisor-3-1-2-abc
+	metavisorImagePrefix = "metavisor-"
+)
+
+// ErrAlreadyWrapped is returned if trying to wrap an instance which is
+// already wrapped with the Metavisor
+var ErrAlreadyWrapped = errors.New("instance is already wrapped with Metavisor, use upgrade-instance to change the Metavisor version")
+
+func wrapTags(version, mvAMI string) map[string]string {
+	if version == "" {
+		version = unknownVersion
+	}
+	return map[string]string{
+		TagMetavisorVersion: version,
+		TagMetavisorAMI:     mvAMI,
+		TagWrappedAt:        time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// tagWrapped tags a wrapped instance and its volumes. Tagging is not
+// essential for the instance to work, so failures are only logged.
+func tagWrapped(ctx context.Context, provider csp.Provider, version, mvAMI, instanceID, mvVolID, guestVolID string) {
+	log := logging.FromContext(ctx)
+	log.Debug("Tagging wrapped instance and volumes")
+	tags := wrapTags(version, mvAMI)
+	err := provider.TagInstance(ctx, instanceID, tags)
+	if err == nil {
+		err = provider.TagDisk(ctx, mvVolID, mergeTags(tags, map[string]string{TagVolumeRole: VolumeRoleMetavisor}))
+	}
+	if err == nil {
+		err = provider.TagDisk(ctx, guestVolID, map[string]string{TagVolumeRole: VolumeRoleGuest})
+	}
+	if err != nil {
+		log.Warningf("Failed to tag instance %s as wrapped", instanceID)
+		log.Debugf("Got error while tagging instance: %s", err)
+	}
+}
+
+// tagWrappedImage copies the Metavisor tags of the wrapped instance the
+// image was created from to the image
+func tagWrappedImage(ctx context.Context, provider csp.Provider, instanceID, imageID string) {
+	log := logging.FromContext(ctx)
+	inst, err := provider.GetInstance(ctx, instanceID)
+	if err != nil {
+		log.Debugf("Could not get tags of wrapped instance: %s", err)
+		return
+	}
+	tags := make(map[string]string)
+	for _, key := range []string{TagMetavisorVersion, TagMetavisorAMI, TagWrappedAt} {
+		if v, exist := inst.Tags()[key]; exist {
+			tags[key] = v
+		}
+	}
+	if err = provider.TagImage(ctx, imageID, tags); err != nil {
+		log.Warningf("Failed to tag image %s as wrapped", imageID)
+		log.Debugf("Got error while tagging image: %s", err)
+	}
+}
+
+// awsUntagWrapped removes the tags added by awsTagWrapped
+func awsUntagWrapped(ctx context.Context, awsSvc aws.Service, instanceID, guestVolID string) {
+	log := logging.FromContext(ctx)
+	log.Debug("Removing Metavisor tags from instance and volumes")
+	err := awsSvc.UntagResources(ctx, []string{TagMetavisorVersion, TagMetavisorAMI, TagWrappedAt}, instanceID)
+	if err == nil {
+		err = awsSvc.UntagResources(ctx, []string{TagVolumeRole}, guestVolID)
+	}
+	if err != nil {
+		log.Warningf("Failed to remove Metavisor tags from instance %s", instanceID)
+		log.Debugf("Got error while removing tags: %s", err)
+	}
+}
+
+// checkImageNotWrapped returns ErrAlreadyWrapped if the image is tagged as
+// wrapped. Untagged images with a volume on the guest device can't be wrapped
+// either, since the guest volume is moved there, so ErrDeviceOccupied is
+// returned for those.
+func checkImageNotWrapped(provider csp.Provider, img csp.Image) error {
+	guestDevice := provider.GuestDeviceName()
+	hasGuest := false
+	if mapped, ok := img.(csp.MappedImage); ok {
+		_, hasGuest = mapped.DeviceMapping()[guestDevice]
+	}
+	if v, tagged := img.Tags()[TagMetavisorVersion]; tagged {
+		logging.Errorf("Image %s is already wrapped with Metavisor version %s", img.ID(), v)
+		if !hasGuest {
+			logging.Warningf("Image %s is tagged as wrapped, but has no guest volume on %s", img.ID(), guestDevice)
+		}
+		return ErrAlreadyWrapped
+	}
+	if hasGuest {
+		logging.Errorf("The device %s must be available in the image to wrap with Metavisor", guestDevice)
+		return ErrDeviceOccupied
+	}
+	return nil
+}
+
+// checkNotWrapped returns ErrAlreadyWrapped if the instance is tagged as
+// wrapped, or if its root volume is a Metavisor volume
+func checkNotWrapped(ctx context.Context, provider csp.Provider, instance csp.Instance) error {
+	log := logging.FromContext(ctx)
+	if v, tagged := instance.Tags()[TagMetavisorVersion]; tagged {
+		log.Errorf("Instance %s is already wrapped with Metavisor version %s", instance.ID(), v)
+		return ErrAlreadyWrapped
+	}
+	rootVolID, hasRoot := instance.DeviceMapping()[instance.RootDeviceName()]
+	if !hasRoot {
+		return nil
+	}
+	vol, err := provider.GetDisk(ctx, rootVolID)
+	if err != nil {
+		// Not being able to check the volume shouldn't stop the wrap
+		log.Debugf("Could not check root volume of instance: %s", err)
+		return nil
+	}
+	if vol.Tags()[TagVolumeRole] == VolumeRoleMetavisor {
+		log.Errorf("The root volume %s of instance %s is a Metavisor volume", rootVolID, instance.ID())
+		return ErrAlreadyWrapped
+	}
+	return nil
+}
+
+// awsTaggedAsWrapped reports if the instance is tagged as wrapped, or if the
+// volume on its root device is tagged as a Metavisor volume
+func awsTaggedAsWrapped(ctx context.Context, awsSvc aws.Service, instance aws.Instance) bool {
+	log := logging.FromContext(ctx)
+	if _, tagged := instance.Tags()[TagMetavisorVersion]; tagged {
+		return true
+	}
+	rootVolID, hasRoot := instance.DeviceMapping()[instance.RootDeviceName()]
+	if !hasRoot {
+		return false
+	}
+	vol, err := awsSvc.GetVolume(ctx, rootVolID)
+	if err != nil {
+		log.Debugf("Could not check root volume of instance: %s", err)
+		return false
+	}
+	return vol.Tags()[TagVolumeRole] == VolumeRoleMetavisor
+}
+
+// isMetavisorImage reports if the image is one of the published Metavisor
+// images, judging by its name
+func isMetavisorImage(img csp.Image) bool {
+	return strings.HasPrefix(img.Name(), metavisorImagePrefix)
+}
@@ -0,0 +1,201 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+// KeyringService is the service the launch token is stored under in the OS
+// keyring, with the name of the token as the account
+const KeyringService = "metavisor-cli"
+
+var (
+	// ErrEmptyToken is returned if a token source has no token
+	ErrEmptyToken = errors.New("the launch token source is empty")
+	// ErrKeyringNotSupported is returned if the OS keyring can't be used on
+	// this platform, or its command line tool is not installed
+	ErrKeyringNotSupported = errors.New("the OS keyring is not supported on this platform")
+)
+
+// TokenSource provides the launch token, so that it doesn't have to be
+// given on the command line. The token is fetched once and never logged.
+type TokenSource interface {
+	// Token returns the launch token. Sources in AWS use the region if it's
+	// not part of the ARN of the secret or parameter.
+	Token(ctx context.Context, region string, iamConf *aws.IAMConfig) (string, error)
+}
+
+// cachedTokenSource fetches the token the first time it's needed, so that
+// it's only read once when wrapping several instances
+type cachedTokenSource struct {
+	name  string
+	fetch func(ctx context.Context, region string, iamConf *aws.IAMConfig) (string, error)
+
+	mutex sync.Mutex
+	token string
+}
+
+func (s *cachedTokenSource) Token(ctx context.Context, region string, iamConf *aws.IAMConfig) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token != "" {
+		return s.token, nil
+	}
+	logging.Debugf("Reading launch token from %s", s.name)
+	t, err := s.fetch(ctx, region, iamConf)
+	if err != nil {
+		return "", err
+	}
+	t = strings.TrimSpace(t)
+	if t == "" {
+		logging.Errorf("No launch token found in %s", s.name)
+		return "", ErrEmptyToken
+	}
+	s.token = t
+	return t, nil
+}
+
+// TokenFile reads the launch token from a file
+func TokenFile(path string) TokenSource {
+	return &cachedTokenSource{
+		name: "file " + path,
+		fetch: func(context.Context, string, *aws.IAMConfig) (string, error) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				logging.Debugf("Got error while reading token file: %s", err)
+				logging.Errorf("Could not read the launch token file %s", path)
+				return "", err
+			}
+			return string(data), nil
+		},
+	}
+}
+
+// TokenReader reads the launch token from a reader, such as stdin
+func TokenReader(name string, r io.Reader) TokenSource {
+	return &cachedTokenSource{
+		name: name,
+		fetch: func(context.Context, string, *aws.IAMConfig) (string, error) {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				logging.Errorf("Could not read the launch token from %s", name)
+				return "", err
+			}
+			return string(data), nil
+		},
+	}
+}
+
+// TokenSecret gets the launch token from a secret in AWS Secrets Manager
+func TokenSecret(secretARN string) TokenSource {
+	return &cachedTokenSource{
+		name: "secret " + secretARN,
+		fetch: func(ctx context.Context, region string, iamConf *aws.IAMConfig) (string, error) {
+			t, err := aws.GetSecretString(ctx, secretARN, iamConf)
+			if err != nil {
+				if err == aws.ErrNotAllowed {
+					logging.Error("Not enough IAM permissions to get the launch token secret")
+				}
+				return "", err
+			}
+			return t, nil
+		},
+	}
+}
+
+// TokenParameter gets the launch token from a parameter in the SSM
+// Parameter Store, which can be a SecureString
+func TokenParameter(name string) TokenSource {
+	return &cachedTokenSource{
+		name: "parameter " + name,
+		fetch: func(ctx context.Context, region string, iamConf *aws.IAMConfig) (string, error) {
+			if strings.TrimSpace(region) == "" && !strings.HasPrefix(name, "arn:") {
+				logging.Error("Specify the parameter with its ARN to get it from another region")
+				return "", aws.ErrNonExistingRegion
+			}
+			t, err := aws.GetParameter(ctx, region, name, iamConf)
+			if err != nil {
+				if err == aws.ErrNotAllowed {
+					logging.Error("Not enough IAM permissions to get the launch token parameter")
+				}
+				return "", err
+			}
+			return t, nil
+		},
+	}
+}
+
+// TokenKeyring gets the launch token with the given name from the OS
+// keyring, with security on macOS and secret-tool on Linux
+func TokenKeyring(name string) TokenSource {
+	return &cachedTokenSource{
+		name: "keyring entry " + name,
+		fetch: func(ctx context.Context, region string, iamConf *aws.IAMConfig) (string, error) {
+			cmd, err := keyringCommand(ctx, name)
+			if err != nil {
+				return "", err
+			}
+			out, err := cmd.Output()
+			if err != nil {
+				logging.Debugf("Got error while reading keyring: %s", err)
+				logging.Errorf("Could not find the launch token %s in the keyring", name)
+				return "", err
+			}
+			return string(out), nil
+		},
+	}
+}
+
+func keyringCommand(ctx context.Context, name string) (*exec.Cmd, error) {
+	var args []string
+	switch runtime.GOOS {
+	case "darwin":
+		args = []string{"security", "find-generic-password", "-s", KeyringService, "-a", name, "-w"}
+	case "linux", "freebsd", "openbsd":
+		args = []string{"secret-tool", "lookup", "service", KeyringService, "account", name}
+	default:
+		return nil, ErrKeyringNotSupported
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		logging.Errorf("The %s command is needed to read the keyring", args[0])
+		return nil, ErrKeyringNotSupported
+	}
+	return exec.CommandContext(ctx, args[0], args[1:]...), nil
+}
+
+// ResolveToken returns the launch token of the config, which is the token
+// itself or the token of its token source. If neither are set, the token is
+// empty.
+func ResolveToken(ctx context.Context, region string, conf Config) (string, error) {
+	if conf.Token != "" || conf.TokenSource == nil {
+		return conf.Token, nil
+	}
+	return conf.TokenSource.Token(ctx, region, &aws.IAMConfig{
+		RoleARN:      conf.IAMRoleARN,
+		MFADeviceARN: conf.IAMDeviceARN,
+		MFACode:      conf.IAMCode,
+	})
+}
@@ -0,0 +1,76 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+)
+
+func TestTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(path, []byte(testToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if tok, err := ResolveToken(ctx, "", Config{TokenSource: TokenFile(path)}); err != nil || tok != testToken {
+		t.Errorf("Got unexpected token %q (%v)", tok, err)
+	}
+	if _, err = ResolveToken(ctx, "", Config{TokenSource: TokenFile(filepath.Join(dir, "missing"))}); err == nil {
+		t.Error("Expected error for missing token file")
+	}
+	empty := filepath.Join(dir, "empty")
+	if err = ioutil.WriteFile(empty, []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ResolveToken(ctx, "", Config{TokenSource: TokenFile(empty)}); err != ErrEmptyToken {
+		t.Errorf("Expected ErrEmptyToken, got %v", err)
+	}
+}
+
+func TestTokenReader(t *testing.T) {
+	ctx := context.Background()
+	src := TokenReader("stdin", strings.NewReader(testToken))
+	for i := 0; i < 2; i++ {
+		// The reader is consumed the first time, the token is kept after that
+		if tok, err := src.Token(ctx, "", nil); err != nil || tok != testToken {
+			t.Errorf("Got unexpected token %q (%v) on read %d", tok, err, i+1)
+		}
+	}
+	conf := Config{Token: "from-flag", TokenSource: TokenReader("stdin", strings.NewReader(testToken))}
+	if tok, _ := ResolveToken(ctx, "", conf); tok != "from-flag" {
+		t.Errorf("Expected the token of the config to be used, got %q", tok)
+	}
+	if tok, err := ResolveToken(ctx, "", Config{}); err != nil || tok != "" {
+		t.Errorf("Expected no token without a source, got %q (%v)", tok, err)
+	}
+}
+
+func TestTokenParameterRegion(t *testing.T) {
+	if _, err := TokenParameter("/metavisor/token").Token(context.Background(), "", nil); err != aws.ErrNonExistingRegion {
+		t.Errorf("Expected ErrNonExistingRegion, got %v", err)
+	}
+}
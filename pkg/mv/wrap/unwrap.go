@@ -0,0 +1,274 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/output"
+)
+
+var (
+	// ErrNotWrapped is returned if trying to unwrap an instance which doesn't
+	// look like it's wrapped with the Metavisor
+	ErrNotWrapped = errors.New("instance is not wrapped with Metavisor")
+)
+
+// UnwrapConfig can be passed to specify optional parameters when unwrapping
+type UnwrapConfig struct {
+	// Userdata is set on the instance after unwrapping it. If empty, the
+	// Metavisor config is removed from the userdata, and the guest's userdata
+	// that was kept when wrapping is restored.
+	Userdata              string
+	DeleteMetavisorVolume bool
+	IAMRoleARN            string
+	IAMDeviceARN          string
+	IAMCode               string
+}
+
+// Unwrap will remove the Metavisor from an instance that has previously been
+// wrapped. The guest volume is moved back to the root device, and the
+// Metavisor volume is detached (and optionally deleted). If no region is
+// specified, the CLI will attempt to find it automatically. The result has
+// the ID of the unwrapped instance and the volumes that were moved.
+func Unwrap(ctx context.Context, region, id string, conf UnwrapConfig) (*UnwrapResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Operation: opAWSUnwrapInstance})
+	ctx = logging.NewContext(ctx, log)
+	log.Infof("Unwrapping instance %s...", id)
+	start := time.Now()
+	res := make(chan maybeUnwrap, 1)
+	tx := mv.NewTransaction(fmt.Sprintf("%s %s", opAWSUnwrapInstance, id))
+
+	go func() {
+		iamConf := &aws.IAMConfig{
+			RoleARN:      conf.IAMRoleARN,
+			MFADeviceARN: conf.IAMDeviceARN,
+			MFACode:      conf.IAMCode,
+		}
+		if strings.TrimSpace(region) == "" {
+			log.Info("No region was specified, attempting to find it automatically")
+			reg, err := aws.FindInstanceRegion(id, iamConf)
+			if err != nil {
+				if err == aws.ErrAmbigiousInstanceRegion {
+					log.Warning("Please specify instance region with: --region")
+				}
+				res <- maybeUnwrap{Error: err}
+				return
+			}
+			log.Infof("Found instance in region %s", reg)
+			region = reg
+		}
+		service, err := aws.New(region, iamConf)
+		if err != nil {
+			if err == aws.ErrInvalidARN {
+				log.Error("Failed to assume IAM role")
+			}
+			res <- maybeUnwrap{Error: err}
+			return
+		}
+		inst, err := awsUnwrapInstance(ctx, service, region, id, conf, tx)
+		res <- maybeUnwrap{Result: inst, Error: err}
+	}()
+	select {
+	case <-ctx.Done():
+		// Context was cancelled, cleanup
+		tx.Rollback()
+		return nil, mv.ErrInterrupted
+	case r := <-res:
+		tx.Finish(r.Error == nil)
+		if r.Result != nil {
+			r.Result.Duration = output.Since(start)
+		}
+		return r.Result, r.Error
+	}
+}
+
+func awsUnwrapInstance(ctx context.Context, awsSvc aws.Service, region, id string, conf UnwrapConfig, tx *mv.Transaction) (*UnwrapResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Region: region, Resources: map[string]string{resInstance: id}})
+	ctx = logging.NewContext(ctx, log)
+	if !aws.IsInstanceID(id) {
+		return nil, aws.ErrInvalidInstanceID
+	}
+	provider := aws.NewProvider(awsSvc, region)
+	inst, err := awsSvc.GetInstance(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	mvVolID, guestVolID, err := awsWrappedVolumes(inst)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Metavisor volume is %s, guest volume is %s", mvVolID, guestVolID)
+	// Any volume can be attached to the guest device, so make sure that the
+	// instance really is wrapped before moving its volumes around
+	tagged := awsTaggedAsWrapped(ctx, awsSvc, inst)
+	var data string
+	if !tagged || conf.Userdata == "" {
+		data, err = awsSvc.GetInstanceUserdata(ctx, id)
+		if err != nil {
+			if err == aws.ErrNotAllowed {
+				log.Error("Not enough IAM permissions to get the userdata of the instance")
+			}
+			return nil, err
+		}
+	}
+	if !tagged {
+		if _, err = parseBrktConfig(data); err != nil {
+			log.Errorf("Instance %s is not tagged as wrapped, and its userdata has no Metavisor config", id)
+			log.Debugf("Got error while parsing userdata: %s", err)
+			return nil, ErrNotWrapped
+		}
+	}
+	restoredUserdata := conf.Userdata
+	if restoredUserdata == "" {
+		restoredUserdata, err = restoreGuestUserdata(data)
+		if err != nil {
+			log.Error("The guest's userdata could not be restored, specify the userdata to restore with --userdata-file")
+			return nil, err
+		}
+	}
+
+	log.Infof("Stopping the instance: %s", id)
+	err = awsSvc.StopInstance(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Waiting for instance to stop...")
+	err = awsSvc.AwaitInstanceStopped(ctx, id)
+	if err != nil {
+		if err == aws.ErrNotAllowed {
+			log.Error("Not enough IAM permissions to see instance status")
+		} else {
+			log.Error("Instance never stopped")
+		}
+		return nil, err
+	}
+	log.Info("Instance stopped")
+
+	tx.Compensate(stepRestoreGuestVolume, restoreGuestVolumeTimeout, func(ctx context.Context) error {
+		log := log.With(logging.Fields{Step: stepRestoreGuestVolume})
+		ctx = logging.NewContext(ctx, log)
+		// If unwrapping fails half-way, we rather leave the instance with
+		// the guest volume as root than in some undefined state
+		log.Info("Attempting to restore instance root volume")
+		err := restoreGuestVolume(ctx, provider, id, guestVolID, conf.DeleteMetavisorVolume)
+		if err != nil {
+			log.Debugf("Got error while trying to restore instance: %s", err)
+		}
+		return err
+	})
+
+	log.Infof("Moving guest volume back to %s", inst.RootDeviceName())
+	_, err = moveGuestToRoot(ctx, provider, inst, guestVolID)
+	if err != nil {
+		return nil, err
+	}
+	inst, err = awaitUnwrappedDevices(ctx, awsSvc, inst, guestVolID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Restoring instance userdata")
+	err = awsSvc.ModifyInstanceAttribute(ctx, id, aws.AttrUserData, restoredUserdata)
+	if err != nil {
+		if err == aws.ErrNotAllowed {
+			log.Error("Not enough IAM permissions to set userdata on instance")
+		} else {
+			log.Error("Failed to restore userdata on instance")
+		}
+		return nil, err
+	}
+
+	awsUntagWrapped(ctx, awsSvc, id, guestVolID)
+
+	res := &UnwrapResult{
+		InstanceID:      id,
+		Region:          region,
+		GuestVolume:     guestVolID,
+		MetavisorVolume: mvVolID,
+	}
+	if conf.DeleteMetavisorVolume {
+		log.Infof("Deleting Metavisor volume %s", mvVolID)
+		err = awsSvc.DeleteVolume(ctx, mvVolID)
+		res.MetavisorVolumeDeleted = err == nil
+		if err != nil {
+			// The instance is already unwrapped at this point, so don't fail
+			log.Warningf("Failed to delete Metavisor volume %s", mvVolID)
+			log.Debugf("Could not delete volume: %s", err)
+		}
+	} else {
+		log.Infof("Keeping detached Metavisor volume %s", mvVolID)
+	}
+
+	err = finalizeInstance(ctx, provider, id)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// awsWrappedVolumes determines the Metavisor volume and the guest volume of
+// an instance which has been wrapped. An error is returned if the instance
+// doesn't look like it's wrapped.
+func awsWrappedVolumes(instance aws.Instance) (mvVolID, guestVolID string, err error) {
+	mvVolID, hasRoot := instance.DeviceMapping()[instance.RootDeviceName()]
+	if !hasRoot {
+		return "", "", ErrNoRootDevice
+	}
+	guestVolID, hasGuest := instance.DeviceMapping()[GuestDeviceName]
+	if !hasGuest || guestVolID == mvVolID {
+		logging.Errorf("Instance has no guest volume attached to %s", GuestDeviceName)
+		return "", "", ErrNotWrapped
+	}
+	return mvVolID, guestVolID, nil
+}
+
+func awaitUnwrappedDevices(ctx context.Context, service aws.Service, instance aws.Instance, guestVolID string) (aws.Instance, error) {
+	log := logging.FromContext(ctx)
+	maxTries := 60
+	sleepTime := 10 * time.Second
+	for try := 1; try <= maxTries; try++ {
+		inst, err := service.GetInstance(ctx, instance.ID())
+		if err != nil {
+			if err == aws.ErrNotAllowed {
+				log.Error("Not enough IAM permissions to get instance details")
+				return nil, err
+			}
+			log.Warning("Failed to get instance details, retrying...")
+			time.Sleep(sleepTime)
+			continue
+		}
+		rootVolID, rootAttached := inst.DeviceMapping()[instance.RootDeviceName()]
+		_, guestAttached := inst.DeviceMapping()[GuestDeviceName]
+		if rootAttached && rootVolID == guestVolID && !guestAttached {
+			log.Info("Guest volume successfully attached as root device")
+			return inst, nil
+		}
+		if try == maxTries {
+			log.Error("Guest volume never got attached as root device")
+			return nil, ErrTimedOut
+		}
+		log.Infof("Attempt %d: Still waiting for guest volume to attach", try)
+		time.Sleep(sleepTime)
+	}
+	return nil, ErrTimedOut
+}
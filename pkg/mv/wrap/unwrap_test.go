@@ -0,0 +1,105 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws/fake"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+)
+
+// attachTestVolume attaches a new plain data volume to an instance on the
+// given device, and returns the ID of the volume
+func attachTestVolume(t *testing.T, ec2 *fake.EC2, id, device string) string {
+	ctx := context.Background()
+	snap := ec2.Image(ec2.AddImage("data", 10, nil)).Devices[fake.RootDeviceName]
+	vol, err := ec2.CreateVolume(ctx, snap, rootVolumeType, ec2.Zone(), 10)
+	if err != nil {
+		t.Fatalf("Got unexpected error when creating data volume: %s", err)
+	}
+	if err = ec2.AwaitVolumeAvailable(ctx, vol.ID()); err != nil {
+		t.Fatalf("Got unexpected error when creating data volume: %s", err)
+	}
+	if err = ec2.AttachVolume(ctx, vol.ID(), id, device); err != nil {
+		t.Fatalf("Got unexpected error when attaching data volume: %s", err)
+	}
+	return vol.ID()
+}
+
+func TestAWSUnwrapInstance(t *testing.T) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	ec2.SetInstance(id, func(inst *fake.Instance) { inst.Userdata = testGuestUserdata })
+	guestVolID := ec2.Instance(id).Devices[fake.RootDeviceName]
+	ctx := context.Background()
+	tx := mv.NewTransaction("test")
+	_, err := awsWrapInstance(ctx, ec2, testRegion, id, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when wrapping: %s", err)
+	}
+	mvVolID := ec2.Instance(id).Devices[fake.RootDeviceName]
+	tx = mv.NewTransaction("test")
+
+	unwrapped, err := awsUnwrapInstance(ctx, ec2, testRegion, id, UnwrapConfig{DeleteMetavisorVolume: true}, tx)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when unwrapping: %s", err)
+	}
+	if unwrapped.InstanceID != id || unwrapped.GuestVolume != guestVolID || unwrapped.MetavisorVolume != mvVolID || !unwrapped.MetavisorVolumeDeleted {
+		t.Errorf("Got unexpected unwrap result: %+v", unwrapped)
+	}
+	inst := ec2.Instance(id)
+	if len(inst.Devices) != 1 || inst.Devices[fake.RootDeviceName] != guestVolID {
+		t.Errorf("Expected guest volume as the only root device, got %v", inst.Devices)
+	}
+	if inst.State != fake.StateRunning {
+		t.Errorf("Expected unwrapped instance to be running, was %s", inst.State)
+	}
+	if inst.Userdata != testGuestUserdata {
+		t.Errorf("Expected guest userdata to be restored, got %q", inst.Userdata)
+	}
+	if _, ok := inst.Tags[TagMetavisorVersion]; ok {
+		t.Errorf("Expected Metavisor tags to be removed, got %v", inst.Tags)
+	}
+	if ec2.Volume(mvVolID) != nil {
+		t.Errorf("Expected Metavisor volume %s to be deleted", mvVolID)
+	}
+}
+
+func TestAWSUnwrapUnwrappedInstance(t *testing.T) {
+	ec2, _ := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("ubuntu", 8, nil), nil)
+	ec2.SetInstance(id, func(inst *fake.Instance) { inst.Userdata = testGuestUserdata })
+	rootVolID := ec2.Instance(id).Devices[fake.RootDeviceName]
+	// A plain data volume on the guest device doesn't make it wrapped
+	dataVolID := attachTestVolume(t, ec2, id, GuestDeviceName)
+	tx := mv.NewTransaction("test")
+
+	_, err := awsUnwrapInstance(context.Background(), ec2, testRegion, id, UnwrapConfig{DeleteMetavisorVolume: true}, tx)
+	tx.Finish(err == nil)
+	if err != ErrNotWrapped {
+		t.Fatalf("Expected ErrNotWrapped, got: %v", err)
+	}
+	inst := ec2.Instance(id)
+	if inst.State != fake.StateRunning || inst.Devices[fake.RootDeviceName] != rootVolID || inst.Devices[GuestDeviceName] != dataVolID {
+		t.Errorf("Expected instance to be left untouched, got %s with %v", inst.State, inst.Devices)
+	}
+	if inst.Userdata != testGuestUserdata || ec2.Volume(rootVolID) == nil {
+		t.Errorf("Expected userdata and volumes to be left untouched")
+	}
+}
@@ -0,0 +1,358 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/csp"
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/output"
+)
+
+const (
+	opAWSUpgradeInstance = "aws-upgrade-instance"
+
+	stepRestorePreviousMetavisor = "restore-previous-mv-volume"
+)
+
+var (
+	// ErrAlreadyUpgraded is returned if trying to upgrade an instance to the
+	// Metavisor version it's already running
+	ErrAlreadyUpgraded = errors.New("instance is already wrapped with the specified Metavisor version")
+
+	// ErrUnknownMetavisorVolume is returned if the root volume of a wrapped
+	// instance was not created from a Metavisor image
+	ErrUnknownMetavisorVolume = errors.New("the root volume of the instance was not created from a Metavisor image")
+)
+
+// UpgradeConfig can be passed to specify optional parameters when upgrading
+type UpgradeConfig struct {
+	MetavisorVersion string
+	MetavisorAMI     string
+	// KeepMetavisorVolume will keep the previous Metavisor volume after the
+	// upgrade, instead of deleting it
+	KeepMetavisorVolume bool
+	IAMRoleARN          string
+	IAMDeviceARN        string
+	IAMCode             string
+}
+
+// Upgrade will replace the Metavisor of an already wrapped instance with
+// another Metavisor version, the latest version if none is specified. Only the
+// root device is swapped, the guest volume stays attached. The previous
+// Metavisor volume is kept until the instance passes health checks, and is
+// put back if it doesn't. The cleanup steps are registered in the given
+// transaction, in the same way as for Instance. The result has the ID of the
+// upgraded instance and the new and previous Metavisor.
+func Upgrade(ctx context.Context, tx *mv.Transaction, region, id string, conf UpgradeConfig) (*UpgradeResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Operation: opAWSUpgradeInstance})
+	ctx = logging.NewContext(ctx, log)
+	log.Infof("Upgrading the Metavisor of instance %s...", id)
+	start := time.Now()
+	res := make(chan maybeUpgrade, 1)
+	if tx == nil {
+		tx = mv.NewTransaction(fmt.Sprintf("%s %s", opAWSUpgradeInstance, id))
+	}
+
+	go func() {
+		iamConf := &aws.IAMConfig{
+			RoleARN:      conf.IAMRoleARN,
+			MFADeviceARN: conf.IAMDeviceARN,
+			MFACode:      conf.IAMCode,
+		}
+		if strings.TrimSpace(region) == "" {
+			log.Info("No region was specified, attempting to find it automatically")
+			reg, err := aws.FindInstanceRegion(id, iamConf)
+			if err != nil {
+				if err == aws.ErrAmbigiousInstanceRegion {
+					log.Warning("Please specify instance region with: --region")
+				}
+				res <- maybeUpgrade{Error: err}
+				return
+			}
+			log.Infof("Found instance in region %s", reg)
+			region = reg
+		}
+		service, err := aws.New(region, iamConf)
+		if err != nil {
+			if err == aws.ErrInvalidARN {
+				log.Error("Failed to assume IAM role")
+			}
+			res <- maybeUpgrade{Error: err}
+			return
+		}
+		inst, err := awsUpgradeInstance(ctx, service, region, id, conf, tx)
+		res <- maybeUpgrade{Result: inst, Error: err}
+	}()
+	select {
+	case <-ctx.Done():
+		// Context was cancelled, cleanup
+		tx.Rollback()
+		return nil, mv.ErrInterrupted
+	case r := <-res:
+		tx.Finish(r.Error == nil)
+		if r.Result != nil {
+			r.Result.Duration = output.Since(start)
+		}
+		return r.Result, r.Error
+	}
+}
+
+func awsUpgradeInstance(ctx context.Context, awsSvc aws.Service, region, id string, conf UpgradeConfig, tx *mv.Transaction) (*UpgradeResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Region: region, Resources: map[string]string{resInstance: id}})
+	ctx = logging.NewContext(ctx, log)
+	if !aws.IsInstanceID(id) {
+		return nil, aws.ErrInvalidInstanceID
+	}
+	if conf.MetavisorAMI != "" && !aws.IsAMIID(conf.MetavisorAMI) {
+		log.Error("The specified Metavisor AMI is not a valid AMI ID")
+		return nil, ErrInvalidAMI
+	}
+	provider := aws.NewProvider(awsSvc, region)
+	inst, err := awsSvc.GetInstance(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	oldVolID, guestVolID, err := awsWrappedVolumes(inst)
+	if err != nil {
+		return nil, err
+	}
+	oldImage, err := awsMetavisorVolumeImage(ctx, awsSvc, oldVolID)
+	if err != nil {
+		return nil, err
+	}
+	// Any volume can be attached to the guest device, so make sure that the
+	// root volume really is a Metavisor before replacing it
+	if !awsTaggedAsWrapped(ctx, awsSvc, inst) && !isMetavisorImage(oldImage) {
+		log.Errorf("Instance %s is not tagged as wrapped, and its root volume was created from %s, which is not a Metavisor AMI", id, oldImage.ID())
+		return nil, ErrNotWrapped
+	}
+	oldAMI := oldImage.ID()
+	log.Infof("Instance is wrapped with Metavisor from %s", oldAMI)
+
+	mvAMI, version := conf.MetavisorAMI, conf.MetavisorVersion
+	if mvAMI == "" {
+		mvAMI, version, err = getMetavisorAMI(ctx, conf.MetavisorVersion, region)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if mvAMI == oldAMI {
+		return nil, ErrAlreadyUpgraded
+	}
+	err = verifyMetavisorImage(ctx, provider, mvAMI)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Creating new Metavisor root volume")
+	mvVol, err := provider.CreateDiskFromImage(ctx, mvAMI, inst.AvailabilityZone())
+	if err != nil {
+		return nil, err
+	}
+	newVolID := mvVol.ID()
+	tx.Compensate(stepDeleteMetavisorVolume, deleteVolumeTimeout, func(ctx context.Context) error {
+		log := log.With(logging.Fields{Step: stepDeleteMetavisorVolume})
+		log.Info("Deleting new Metavisor volume")
+		err := provider.DeleteDisk(ctx, newVolID)
+		if err != nil {
+			log.Errorf("Failed to clean up MV volume: %s", newVolID)
+			log.Debugf("Could not delete volume: %s", err)
+		}
+		return err
+	})
+	log.Info("Waiting for for volume to be available...")
+	err = provider.AwaitDiskAvailable(ctx, newVolID)
+	if err != nil {
+		log.Error("Volume never became available")
+		return nil, err
+	}
+
+	log.Infof("Stopping the instance: %s", id)
+	err = awsSvc.StopInstance(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Waiting for instance to stop...")
+	err = awsSvc.AwaitInstanceStopped(ctx, id)
+	if err != nil {
+		if err == aws.ErrNotAllowed {
+			log.Error("Not enough IAM permissions to see instance status")
+		} else {
+			log.Error("Instance never stopped")
+		}
+		return nil, err
+	}
+	log.Info("Instance stopped")
+
+	tx.Compensate(stepRestorePreviousMetavisor, restoreGuestVolumeTimeout, func(ctx context.Context) error {
+		log := log.With(logging.Fields{Step: stepRestorePreviousMetavisor})
+		ctx = logging.NewContext(ctx, log)
+		// If the new Metavisor doesn't work, put the previous one back
+		log.Info("Attempting to restore the previous Metavisor volume")
+		err := awsRestoreMetavisorVolume(ctx, provider, id, oldVolID, guestVolID)
+		if err != nil {
+			log.Errorf("Failed to restore Metavisor volume %s on instance %s", oldVolID, id)
+			log.Debugf("Got error while trying to restore instance: %s", err)
+		}
+		return err
+	})
+	err = awsSwapMetavisorVolume(ctx, provider, inst, oldVolID, newVolID, guestVolID)
+	if err != nil {
+		return nil, err
+	}
+	err = enableNetworking(ctx, provider, id, mvAMI)
+	if err != nil {
+		return nil, err
+	}
+	err = finalizeInstance(ctx, provider, id)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Waiting for instance to pass health checks...")
+	err = awsSvc.AwaitInstanceOK(ctx, id)
+	if err != nil {
+		switch err {
+		case aws.ErrNotAllowed:
+			log.Error("Not enough IAM permissions to get instance health status")
+		case aws.ErrInstanceImpaired:
+			log.Error("The instance is not passing health checks with the new Metavisor")
+		default:
+			log.Error("An error occurred while waiting for instance to get healthy")
+		}
+		return nil, err
+	}
+	log.Info("Instance is healthy")
+	tagWrapped(ctx, provider, version, mvAMI, id, newVolID, guestVolID)
+
+	res := &UpgradeResult{
+		InstanceID:              id,
+		Region:                  region,
+		MetavisorVersion:        version,
+		MetavisorAMI:            mvAMI,
+		MetavisorVolume:         newVolID,
+		GuestVolume:             guestVolID,
+		PreviousMetavisorAMI:    oldAMI,
+		PreviousMetavisorVolume: oldVolID,
+	}
+	if conf.KeepMetavisorVolume {
+		log.Infof("Keeping previous Metavisor volume %s", oldVolID)
+	} else {
+		log.Infof("Deleting previous Metavisor volume %s", oldVolID)
+		err = awsSvc.DeleteVolume(ctx, oldVolID)
+		res.PreviousMetavisorVolumeDeleted = err == nil
+		if err != nil {
+			// The upgrade is done at this point, so don't fail
+			log.Warningf("Failed to delete previous Metavisor volume %s", oldVolID)
+			log.Debugf("Could not delete volume: %s", err)
+		}
+	}
+	return res, nil
+}
+
+// awsMetavisorVolumeImage returns the Metavisor AMI that the given volume was
+// created from
+func awsMetavisorVolumeImage(ctx context.Context, awsSvc aws.Service, volumeID string) (aws.Image, error) {
+	log := logging.FromContext(ctx)
+	vol, err := awsSvc.GetVolume(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if vol.SnapshotID() == "" {
+		log.Errorf("Root volume %s was not created from a snapshot", volumeID)
+		return nil, ErrUnknownMetavisorVolume
+	}
+	img, err := awsSvc.GetImageBySnapshot(ctx, vol.SnapshotID())
+	if err != nil {
+		if err == aws.ErrImageNonExisting {
+			log.Errorf("Snapshot %s of the root volume doesn't belong to any image", vol.SnapshotID())
+			return nil, ErrUnknownMetavisorVolume
+		}
+		return nil, err
+	}
+	if img.DeviceMapping()[img.RootDeviceName()] != vol.SnapshotID() {
+		log.Errorf("Snapshot %s is not the root snapshot of %s", vol.SnapshotID(), img.ID())
+		return nil, ErrUnknownMetavisorVolume
+	}
+	return img, nil
+}
+
+// awsSwapMetavisorVolume replaces the Metavisor volume on the root device of
+// the (stopped) instance, and waits for the new volume to be attached
+func awsSwapMetavisorVolume(ctx context.Context, provider csp.Provider, inst csp.Instance, oldVolID, newVolID, guestVolID string) error {
+	log := logging.FromContext(ctx)
+	rootDeviceName := inst.RootDeviceName()
+	if inst.DeviceMapping()[rootDeviceName] == oldVolID {
+		log.Infof("Detaching Metavisor volume %s", oldVolID)
+		err := provider.DetachDisk(ctx, oldVolID, inst.ID(), rootDeviceName)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Attaching Metavisor volume %s to %s", newVolID, rootDeviceName)
+	err := provider.AttachDisk(ctx, newVolID, inst.ID(), rootDeviceName, true)
+	if err != nil {
+		return err
+	}
+	_, err = awaitDevices(ctx, provider, inst.ID(), map[string]string{
+		rootDeviceName:             newVolID,
+		provider.GuestDeviceName(): guestVolID,
+	})
+	return err
+}
+
+func awsRestoreMetavisorVolume(ctx context.Context, provider csp.Provider, instanceID, oldVolID, guestVolID string) error {
+	log := logging.FromContext(ctx)
+	if err := provider.StopInstance(ctx, instanceID); err != nil {
+		return err
+	}
+	if err := provider.AwaitInstanceStopped(ctx, instanceID); err != nil {
+		return err
+	}
+	inst, err := provider.GetInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+	rootDeviceName := inst.RootDeviceName()
+	if rootID, attached := inst.DeviceMapping()[rootDeviceName]; attached && rootID != oldVolID {
+		if err = provider.DetachDisk(ctx, rootID, instanceID, rootDeviceName); err != nil {
+			return err
+		}
+	}
+	if inst.DeviceMapping()[rootDeviceName] != oldVolID {
+		if err = provider.AttachDisk(ctx, oldVolID, instanceID, rootDeviceName, true); err != nil {
+			return err
+		}
+	}
+	if _, err = awaitDevices(ctx, provider, instanceID, map[string]string{
+		rootDeviceName:             oldVolID,
+		provider.GuestDeviceName(): guestVolID,
+	}); err != nil {
+		return err
+	}
+	if err = provider.StartInstance(ctx, instanceID); err != nil {
+		log.Warningf("Could not start instance %s after restoring Metavisor volume", instanceID)
+	}
+	log.Infof("Instance %s restored to the previous Metavisor", instanceID)
+	return nil
+}
@@ -0,0 +1,121 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws/fake"
+	"github.com/immutable/metavisor-cli/pkg/mv"
+)
+
+// newWrappedTestInstance returns a simulated EC2 with an instance wrapped
+// with the Metavisor, and an upgrade config using a newer Metavisor AMI
+func newWrappedTestInstance(t *testing.T) (*fake.EC2, string, UpgradeConfig) {
+	ec2, conf := newTestEC2()
+	id := ec2.AddInstance(ec2.AddImage("guest", 8, nil), nil)
+	tx := mv.NewTransaction("test")
+	_, err := awsWrapInstance(context.Background(), ec2, testRegion, id, conf, nil, tx)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when wrapping: %s", err)
+	}
+	newAMI := ec2.AddImage("metavisor-3-2-0", 1, nil)
+	return ec2, id, UpgradeConfig{MetavisorAMI: newAMI, MetavisorVersion: "3.2.0"}
+}
+
+func TestAWSUpgradeInstance(t *testing.T) {
+	ec2, id, conf := newWrappedTestInstance(t)
+	oldVolID := ec2.Instance(id).Devices[fake.RootDeviceName]
+	guestVolID := ec2.Instance(id).Devices[GuestDeviceName]
+	tx := mv.NewTransaction("test")
+
+	upgraded, err := awsUpgradeInstance(context.Background(), ec2, testRegion, id, conf, tx)
+	tx.Finish(err == nil)
+	if err != nil {
+		t.Fatalf("Got unexpected error when upgrading: %s", err)
+	}
+	if upgraded.InstanceID != id || upgraded.PreviousMetavisorVolume != oldVolID || !upgraded.PreviousMetavisorVolumeDeleted {
+		t.Errorf("Got unexpected upgrade result: %+v", upgraded)
+	}
+	inst := ec2.Instance(id)
+	newVolID := inst.Devices[fake.RootDeviceName]
+	if newVolID == oldVolID || newVolID != upgraded.MetavisorVolume || inst.Devices[GuestDeviceName] != guestVolID {
+		t.Errorf("Expected new Metavisor volume as root device and same guest volume, got %v", inst.Devices)
+	}
+	if inst.State != fake.StateRunning {
+		t.Errorf("Expected upgraded instance to be running, was %s", inst.State)
+	}
+	if inst.Tags[TagMetavisorVersion] != conf.MetavisorVersion || inst.Tags[TagMetavisorAMI] != conf.MetavisorAMI {
+		t.Errorf("Expected instance to be tagged with the new Metavisor, got %v", inst.Tags)
+	}
+	if ec2.Volume(oldVolID) != nil {
+		t.Errorf("Expected previous Metavisor volume %s to be deleted", oldVolID)
+	}
+}
+
+func TestAWSUpgradeInstanceRollback(t *testing.T) {
+	ec2, id, conf := newWrappedTestInstance(t)
+	oldVolID := ec2.Instance(id).Devices[fake.RootDeviceName]
+	guestVolID := ec2.Instance(id).Devices[GuestDeviceName]
+	before := ec2.Resources()
+	ec2.FailNext("DescribeInstanceStatus", errInjected)
+	tx := mv.NewTransaction("test")
+
+	_, err := awsUpgradeInstance(context.Background(), ec2, testRegion, id, conf, tx)
+	tx.Finish(err == nil)
+	if err != errInjected {
+		t.Fatalf("Expected injected error, got: %v", err)
+	}
+	if failed := tx.Result().Failed(); len(failed) > 0 {
+		t.Errorf("Got unexpected failed cleanup steps: %v", failed)
+	}
+	inst := ec2.Instance(id)
+	if inst.Devices[fake.RootDeviceName] != oldVolID || inst.Devices[GuestDeviceName] != guestVolID {
+		t.Errorf("Expected previous Metavisor volume to be restored, got %v", inst.Devices)
+	}
+	if inst.State != fake.StateRunning {
+		t.Errorf("Expected restored instance to be running, was %s", inst.State)
+	}
+	if after := ec2.Resources(); len(after.Volumes) != len(before.Volumes) {
+		t.Errorf("Expected new Metavisor volume to be deleted, got volumes %v", after.Volumes)
+	}
+}
+
+func TestAWSUpgradeUnwrappedInstance(t *testing.T) {
+	ec2, conf := newTestEC2()
+	newAMI := ec2.AddImage("metavisor-3-2-0", 1, nil)
+	id := ec2.AddInstance(ec2.AddImage("ubuntu", 8, nil), nil)
+	guestVolID := ec2.Instance(id).Devices[fake.RootDeviceName]
+	// A plain data volume on the guest device doesn't make it wrapped
+	attachTestVolume(t, ec2, id, GuestDeviceName)
+	before := ec2.Resources()
+	tx := mv.NewTransaction("test")
+
+	upgradeConf := UpgradeConfig{MetavisorAMI: newAMI, MetavisorVersion: conf.MetavisorVersion}
+	_, err := awsUpgradeInstance(context.Background(), ec2, testRegion, id, upgradeConf, tx)
+	tx.Finish(err == nil)
+	if err != ErrNotWrapped {
+		t.Fatalf("Expected ErrNotWrapped, got: %v", err)
+	}
+	inst := ec2.Instance(id)
+	if inst.State != fake.StateRunning || inst.Devices[fake.RootDeviceName] != guestVolID {
+		t.Errorf("Expected instance to be left untouched, got %s with %v", inst.State, inst.Devices)
+	}
+	if after := ec2.Resources(); len(after.Volumes) != len(before.Volumes) {
+		t.Errorf("Expected no volumes to be created, got volumes %v", after.Volumes)
+	}
+}
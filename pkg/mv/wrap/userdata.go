@@ -0,0 +1,236 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package wrap
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/logging"
+	"github.com/immutable/metavisor-cli/pkg/token"
+	"github.com/immutable/metavisor-cli/pkg/userdata"
+)
+
+// UserdataInspection describes userdata and the parts in it
+type UserdataInspection struct {
+	Source     string         `json:"source"`
+	Size       int            `json:"size"`
+	Base64     bool           `json:"base64"`
+	Compressed bool           `json:"compressed"`
+	Parts      []UserdataPart `json:"parts"`
+	// Config is the status of the Metavisor config, and is one of
+	// ConfigValid, ConfigInvalid and ConfigMissing
+	Config      string `json:"config"`
+	ConfigError string `json:"config_error,omitempty"`
+}
+
+// UserdataPart is a part of inspected userdata. The identity token of the
+// Metavisor config is masked in the content.
+type UserdataPart struct {
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename,omitempty"`
+	Size        int    `json:"size"`
+	Content     string `json:"content"`
+}
+
+// GenerateUserdata returns the userdata that wrapping sets on an instance,
+// so that wrapped images can be launched with other tools. The userdata can
+// be gzipped, and base64 encoded like EC2 expects it in most APIs.
+func GenerateUserdata(launchToken, domain string, compress, encode bool) (string, error) {
+	if domain == "" {
+		domain = ProdDomain
+	}
+	data, err := generateUserdataString(launchToken, domain, "", compress)
+	if err != nil {
+		return "", err
+	}
+	if encode {
+		return base64.StdEncoding.EncodeToString([]byte(data)), nil
+	}
+	return data, nil
+}
+
+// InspectUserdata decodes and parses the userdata in the given file, or of
+// the given instance if an instance ID is given. Userdata in files can be
+// gzipped and base64 encoded. If no region is specified for an instance,
+// it's determined automatically.
+func InspectUserdata(ctx context.Context, region, source string, conf Config) (*UserdataInspection, error) {
+	var data string
+	if aws.IsInstanceID(source) {
+		iamConf := &aws.IAMConfig{
+			RoleARN:      conf.IAMRoleARN,
+			MFADeviceARN: conf.IAMDeviceARN,
+			MFACode:      conf.IAMCode,
+		}
+		if strings.TrimSpace(region) == "" {
+			logging.Info("No region was specified, attempting to find it automatically")
+			reg, err := aws.FindInstanceRegion(source, iamConf)
+			if err != nil {
+				if err == aws.ErrAmbigiousInstanceRegion {
+					logging.Warning("Please specify instance region with: --region")
+				}
+				return nil, err
+			}
+			region = reg
+		}
+		service, err := aws.New(region, iamConf)
+		if err != nil {
+			if err == aws.ErrInvalidARN {
+				logging.Error("Failed to assume IAM role")
+			}
+			return nil, err
+		}
+		data, err = service.GetInstanceUserdata(ctx, source)
+		if err != nil {
+			if err == aws.ErrNotAllowed {
+				logging.Error("Not enough IAM permissions to get the userdata of the instance")
+			}
+			return nil, err
+		}
+	} else {
+		raw, err := ioutil.ReadFile(source)
+		if err != nil {
+			logging.Debugf("Got error while reading userdata file: %s", err)
+			logging.Errorf("Could not read the userdata file %s", source)
+			return nil, err
+		}
+		data = string(raw)
+	}
+	return inspectUserdata(source, data)
+}
+
+func inspectUserdata(source, data string) (*UserdataInspection, error) {
+	res := &UserdataInspection{
+		Source: source,
+		Size:   len(data),
+		Parts:  []UserdataPart{},
+	}
+	if decoded, ok := decodeBase64Userdata(data); ok {
+		res.Base64 = true
+		data = decoded
+	}
+	res.Compressed = userdata.IsCompressed(data)
+	parsed, err := userdata.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parsed.Parts() {
+		part := UserdataPart{
+			ContentType: p.ContentType,
+			Filename:    p.Filename,
+			Size:        len(p.Content),
+			Content:     p.Content,
+		}
+		if p.ContentType == configContentType || isPlainBrktConfig(p) {
+			part.Content = maskBrktConfig(p.Content)
+		}
+		res.Parts = append(res.Parts, part)
+	}
+	res.Config, res.ConfigError = brktConfigStatus(data)
+	return res, nil
+}
+
+// decodeBase64Userdata decodes userdata that is base64 encoded. Only
+// userdata that decodes to gzipped data or text is considered encoded, as
+// short text can be valid base64 by chance.
+func decodeBase64Userdata(data string) (string, bool) {
+	trimmed := strings.TrimSpace(data)
+	if trimmed == "" {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(trimmed)
+	if err != nil {
+		return "", false
+	}
+	if !userdata.IsCompressed(string(decoded)) && !utf8.Valid(decoded) {
+		return "", false
+	}
+	return string(decoded), true
+}
+
+// maskBrktConfig pretty-prints the Metavisor config with the identity token
+// masked. In config that is not valid JSON, anything that looks like a token
+// is masked instead.
+func maskBrktConfig(content string) string {
+	conf := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(content), &conf); err != nil {
+		return token.MaskAll(content)
+	}
+	if brkt, ok := conf["brkt"].(map[string]interface{}); ok {
+		if identityToken, ok := brkt["identity_token"].(string); ok {
+			brkt["identity_token"] = token.Mask(identityToken)
+		}
+	}
+	data, err := json.MarshalIndent(conf, "", "\t")
+	if err != nil {
+		return token.MaskAll(content)
+	}
+	return string(data)
+}
+
+// FormatUserdataInspection will format an inspection of userdata for
+// display. If withJSON is true, the inspection will be formatted as JSON.
+func FormatUserdataInspection(i *UserdataInspection, withJSON bool) (string, error) {
+	if withJSON {
+		data, err := json.MarshalIndent(i, "", "\t")
+		if err != nil {
+			logging.Errorf("Failed to marshal userdata inspection to JSON: %s", err)
+		}
+		return string(data), err
+	}
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "Source:\t%s\n", i.Source)
+	encodings := []string{}
+	if i.Base64 {
+		encodings = append(encodings, "base64")
+	}
+	if i.Compressed {
+		encodings = append(encodings, "gzip")
+	}
+	if len(encodings) > 0 {
+		fmt.Fprintf(w, "Size:\t%d bytes (%s)\n", i.Size, strings.Join(encodings, ", "))
+	} else {
+		fmt.Fprintf(w, "Size:\t%d bytes\n", i.Size)
+	}
+	if i.ConfigError != "" {
+		fmt.Fprintf(w, "Metavisor config:\t%s (%s)\n", i.Config, i.ConfigError)
+	} else {
+		fmt.Fprintf(w, "Metavisor config:\t%s\n", i.Config)
+	}
+	fmt.Fprintf(w, "Parts:\t%d\n", len(i.Parts))
+	w.Flush()
+	for n, p := range i.Parts {
+		name := p.ContentType
+		if p.Filename != "" {
+			name = fmt.Sprintf("%s, %s", p.ContentType, p.Filename)
+		}
+		fmt.Fprintf(&b, "\n--- Part %d: %s (%d bytes)\n", n+1, name, p.Size)
+		if utf8.ValidString(p.Content) {
+			b.WriteString(strings.TrimRight(p.Content, "\n") + "\n")
+		} else {
+			b.WriteString("(binary content)\n")
+		}
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
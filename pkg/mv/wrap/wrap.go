@@ -19,15 +19,22 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/immutable/metavisor-cli/pkg/csp"
 	"github.com/immutable/metavisor-cli/pkg/csp/aws"
+	"github.com/immutable/metavisor-cli/pkg/csp/gcp"
 	"github.com/immutable/metavisor-cli/pkg/logging"
 	"github.com/immutable/metavisor-cli/pkg/mv"
+	"github.com/immutable/metavisor-cli/pkg/output"
 )
 
 // Config can be passed to specify optional parameters when wrapping
 type Config struct {
-	Token            string
+	Token string
+	// TokenSource provides the launch token if Token is empty, see
+	// ResolveToken
+	TokenSource      TokenSource
 	MetavisorVersion string
 	MetavisorAMI     string
 	ServiceDomain    string
@@ -35,18 +42,46 @@ type Config struct {
 	IAMDeviceARN     string
 	IAMCode          string
 	SubnetID         string
+	// NameTemplate and DescriptionTemplate are Go templates used for the
+	// name and description of wrapped images, see ImageTemplateData for
+	// what they can refer to. DefaultNameTemplate and
+	// DefaultDescriptionTemplate are used if they are empty.
+	NameTemplate        string
+	DescriptionTemplate string
+	// Tags are added to wrapped images and their snapshots, in addition to
+	// the tags copied from the source image
+	Tags map[string]string
+	// JournalPath is where progress is recorded, so that the operation can be
+	// resumed or rolled back. A new file in journal.DefaultDir() is used if empty.
+	JournalPath string
 }
 
 const (
 	// GuestDeviceName is where the MV expects the guest OS to be mounted
-	// after being wrapped
-	GuestDeviceName = "/dev/sdf"
+	// after being wrapped in AWS
+	GuestDeviceName = aws.GuestDeviceName
 	// ProdDomain is the domain of the production service
 	ProdDomain = "mgmt.brkt.com"
 
 	rootVolumeType = "gp2"
 )
 
+// Names and timeouts of the cleanup steps registered in transactions
+const (
+	stepDeleteMetavisorVolume      = "delete-mv-volume"
+	stepRestoreGuestVolume         = "restore-guest-volume"
+	stepTerminateTemporaryInstance = "terminate-temporary-instance"
+	stepDeleteImage                = "delete-image"
+
+	deleteVolumeTimeout       = 2 * time.Minute
+	restoreGuestVolumeTimeout = 20 * time.Minute
+	terminateInstanceTimeout  = 5 * time.Minute
+	deleteImageTimeout        = 5 * time.Minute
+)
+
+// temporaryInstanceTag is the name of instances launched to wrap images
+const temporaryInstanceTag = "Temporary-Metavisor-wrapper-instance"
+
 var disallowedInstanceTypes = []string{
 	"t2.nano",
 	"t1.micro",
@@ -59,7 +94,7 @@ var (
 
 	// ErrDeviceOccupied is returned if trying to wrap an instance which already
 	// has the device where we put the guest volume occupied
-	ErrDeviceOccupied = fmt.Errorf("instance already has %s mounted", GuestDeviceName)
+	ErrDeviceOccupied = errors.New("instance already has a volume on the guest device")
 
 	// ErrInvalidAMI is returned if trying to specify an invalid AMI
 	ErrInvalidAMI = errors.New("specified AMI is not valid")
@@ -83,6 +118,10 @@ var (
 	// --metavisor-version which doesn't exist
 	ErrInvalidMetavisorVersion = errors.New("specified metavisor version doesn't exist, use the \"list\" command to find available versions")
 
+	// ErrNoMetavisorImage is returned if no Metavisor image is specified when
+	// wrapping in GCP, where it can't be looked up from the version
+	ErrNoMetavisorImage = errors.New("a Metavisor image must be specified")
+
 	// ErrMetavisorShuttingDown is returned when the instance is starting to shut itself down right after
 	// being wrapped with MV. This is in 90% of the cases because the MV can't communicate with Yeti,
 	// and thus shuts itself down — this is usually a sign of having used a bad launch token.
@@ -93,11 +132,24 @@ var (
 // ID must exist in the specified region. A config can be optionally
 // specified to give extra parameters when wrapping. If a specified
 // parameter is invalid, an error will be returned, otherwise the
-// ID of the wrapped instance will be returned (typically the same
-// as the ID given as a parameter).
-func Instance(ctx context.Context, region, id string, conf Config) (string, error) {
-	logging.Infof("Wrapping instance %s with Metavisor...", id)
-	res := make(chan mv.MaybeString, 1)
+// result will be returned, with the ID of the wrapped instance
+// (typically the same as the ID given as a parameter) and the
+// volumes and Metavisor it was wrapped with.
+//
+// The cleanup steps of the wrap are registered in the given transaction,
+// which is committed or rolled back before returning. Its result can be
+// inspected afterwards to see which cleanup steps succeeded. If the
+// transaction is nil, a new one is used.
+func Instance(ctx context.Context, tx *mv.Transaction, region, id string, conf Config) (*InstanceResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Operation: opAWSWrapInstance})
+	ctx = logging.NewContext(ctx, log)
+	log.Infof("Wrapping instance %s with Metavisor...", id)
+	start := time.Now()
+	res := make(chan maybeInstance, 1)
+	if tx == nil {
+		tx = mv.NewTransaction(fmt.Sprintf("%s %s", opAWSWrapInstance, id))
+	}
+	jrnl := newJournal(conf.JournalPath, opAWSWrapInstance, region, id, conf)
 
 	go func() {
 		iamConf := &aws.IAMConfig{
@@ -110,36 +162,48 @@ func Instance(ctx context.Context, region, id string, conf Config) (string, erro
 			// will try to figure it out. This is possible since the instance ID
 			// should be locally unique across regions within the current account,
 			// especially for a limited time frame
-			logging.Info("No region was specified, attempting to find it automatically")
+			log.Info("No region was specified, attempting to find it automatically")
 			reg, err := aws.FindInstanceRegion(id, iamConf)
 			if err != nil {
 				if err == aws.ErrAmbigiousInstanceRegion {
-					logging.Warning("Please specify instance region with: --region")
+					log.Warning("Please specify instance region with: --region")
 				}
-				res <- mv.MaybeString{Result: "", Error: err}
+				res <- maybeInstance{Error: err}
 				return
 			}
-			logging.Infof("Found instance in region %s", reg)
+			log.Infof("Found instance in region %s", reg)
 			region = reg
+			if err = jrnl.SetRegion(region); err != nil {
+				journalNotSaved(jrnl, err)
+			}
 		}
 		service, err := aws.New(region, iamConf)
 		if err != nil {
 			if err == aws.ErrInvalidARN {
-				logging.Error("Failed to assume IAM role")
+				log.Error("Failed to assume IAM role")
 			}
-			res <- mv.MaybeString{Result: "", Error: err}
+			res <- maybeInstance{Error: err}
+			return
+		}
+		if conf.Token, err = ResolveToken(ctx, region, conf); err != nil {
+			res <- maybeInstance{Error: err}
 			return
 		}
-		inst, err := awsWrapInstance(ctx, service, region, id, conf)
-		res <- mv.MaybeString{Result: inst, Error: err}
+		inst, err := awsWrapInstance(ctx, service, region, id, conf, jrnl, tx)
+		res <- maybeInstance{Result: inst, Error: err}
 	}()
 	select {
 	case <-ctx.Done():
 		// Context was cancelled, cleanup
-		mv.Cleanup(false)
-		return "", mv.ErrInterrupted
+		tx.Rollback()
+		finishJournal(jrnl, false)
+		return nil, mv.ErrInterrupted
 	case r := <-res:
-		mv.Cleanup(r.Error == nil)
+		tx.Finish(r.Error == nil)
+		finishJournal(jrnl, r.Error == nil)
+		if r.Result != nil {
+			r.Result.Duration = output.Since(start)
+		}
 		return r.Result, r.Error
 	}
 }
@@ -147,10 +211,19 @@ func Instance(ctx context.Context, region, id string, conf Config) (string, erro
 // Image will wrap a given image with the Metavisor, and then output
 // a new image that can be used to launch instances. The specified
 // image ID must exist in the specified region. A config can be optionally
-// specified ot give extra parameters when wrapping.
-func Image(ctx context.Context, region, id string, conf Config) (string, error) {
-	logging.Infof("Creating wrapped image based on %s...", id)
-	res := make(chan mv.MaybeString, 1)
+// specified ot give extra parameters when wrapping. The result has the ID
+// of the new image and its snapshots. The cleanup steps are registered in
+// the given transaction, in the same way as for Instance.
+func Image(ctx context.Context, tx *mv.Transaction, region, id string, conf Config) (*ImageResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Operation: opAWSWrapImage})
+	ctx = logging.NewContext(ctx, log)
+	log.Infof("Creating wrapped image based on %s...", id)
+	start := time.Now()
+	res := make(chan maybeImage, 1)
+	if tx == nil {
+		tx = mv.NewTransaction(fmt.Sprintf("%s %s", opAWSWrapImage, id))
+	}
+	jrnl := newJournal(conf.JournalPath, opAWSWrapImage, region, id, conf)
 
 	go func() {
 		service, err := aws.New(region, &aws.IAMConfig{
@@ -160,38 +233,168 @@ func Image(ctx context.Context, region, id string, conf Config) (string, error)
 		})
 		if err != nil {
 			if err == aws.ErrInvalidARN {
-				logging.Error("Failed to assume IAM role")
+				log.Error("Failed to assume IAM role")
 			}
-			res <- mv.MaybeString{Result: "", Error: err}
+			res <- maybeImage{Error: err}
+			return
+		}
+		if conf.Token, err = ResolveToken(ctx, region, conf); err != nil {
+			res <- maybeImage{Error: err}
+			return
+		}
+		img, err := awsWrapImage(ctx, service, region, id, conf, jrnl, tx)
+		res <- maybeImage{Result: img, Error: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// Context was cancelled, cleanup
+		tx.Rollback()
+		finishJournal(jrnl, false)
+		return nil, mv.ErrInterrupted
+	case r := <-res:
+		tx.Finish(r.Error == nil)
+		finishJournal(jrnl, r.Error == nil)
+		if r.Result != nil {
+			r.Result.Duration = output.Since(start)
+		}
+		return r.Result, r.Error
+	}
+}
+
+// GCPInstance wraps an instance in Google Cloud with the Metavisor, in the
+// same way as Instance. The Metavisor image must be specified with
+// MetavisorAMI in the config, and progress is not journaled, so the wrap
+// can't be resumed. The version in the config is only used for labels.
+func GCPInstance(ctx context.Context, tx *mv.Transaction, gcpConf gcp.Config, id string, conf Config) (*InstanceResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Operation: opGCPWrapInstance})
+	ctx = logging.NewContext(ctx, log)
+	log.Infof("Wrapping instance %s with Metavisor...", id)
+	start := time.Now()
+	res := make(chan maybeInstance, 1)
+	if tx == nil {
+		tx = mv.NewTransaction(fmt.Sprintf("%s %s", opGCPWrapInstance, id))
+	}
+
+	go func() {
+		provider, err := gcpProvider(ctx, gcpConf, &conf)
+		if err != nil {
+			res <- maybeInstance{Error: err}
 			return
 		}
-		img, err := awsWrapImage(ctx, service, region, id, conf)
-		res <- mv.MaybeString{Result: img, Error: err}
+		inst, err := wrapInstance(ctx, provider, id, conf, nil, tx)
+		res <- maybeInstance{Result: inst, Error: err}
 	}()
+	select {
+	case <-ctx.Done():
+		// Context was cancelled, cleanup
+		tx.Rollback()
+		return nil, mv.ErrInterrupted
+	case r := <-res:
+		tx.Finish(r.Error == nil)
+		if r.Result != nil {
+			r.Result.Duration = output.Since(start)
+		}
+		return r.Result, r.Error
+	}
+}
 
+// GCPImage creates a wrapped machine image in Google Cloud based on the given
+// image, in the same way as Image. The config is used as for GCPInstance.
+func GCPImage(ctx context.Context, tx *mv.Transaction, gcpConf gcp.Config, id string, conf Config) (*ImageResult, error) {
+	log := logging.FromContext(ctx).With(logging.Fields{Operation: opGCPWrapImage})
+	ctx = logging.NewContext(ctx, log)
+	log.Infof("Creating wrapped image based on %s...", id)
+	start := time.Now()
+	res := make(chan maybeImage, 1)
+	if tx == nil {
+		tx = mv.NewTransaction(fmt.Sprintf("%s %s", opGCPWrapImage, id))
+	}
+
+	go func() {
+		provider, err := gcpProvider(ctx, gcpConf, &conf)
+		if err != nil {
+			res <- maybeImage{Error: err}
+			return
+		}
+		img, err := wrapImage(ctx, provider, id, conf, nil, tx)
+		res <- maybeImage{Result: img, Error: err}
+	}()
 	select {
 	case <-ctx.Done():
 		// Context was cancelled, cleanup
-		mv.Cleanup(false)
-		return "", mv.ErrInterrupted
+		tx.Rollback()
+		return nil, mv.ErrInterrupted
 	case r := <-res:
-		mv.Cleanup(r.Error == nil)
+		tx.Finish(r.Error == nil)
+		if r.Result != nil {
+			r.Result.Duration = output.Since(start)
+		}
 		return r.Result, r.Error
 	}
 }
 
-func getMetavisorAMI(ctx context.Context, version, region string) (string, error) {
+// gcpProvider checks the config for wrapping in GCP and resolves its token,
+// before connecting to GCP
+func gcpProvider(ctx context.Context, gcpConf gcp.Config, conf *Config) (csp.Provider, error) {
+	if conf.MetavisorAMI == "" {
+		logging.Error("The Metavisor image to wrap with must be specified")
+		return nil, ErrNoMetavisorImage
+	}
+	var err error
+	if conf.Token, err = ResolveToken(ctx, "", *conf); err != nil {
+		return nil, err
+	}
+	if conf.Token != "" {
+		if err = validateToken(conf.Token, conf.ServiceDomain); err != nil {
+			return nil, err
+		}
+	}
+	return gcp.New(gcpConf)
+}
+
+// maybeInstance and maybeImage are the results of wrapping, and the others
+// of the other operations, for use with result channels
+type maybeInstance struct {
+	Result *InstanceResult
+	Error  error
+}
+
+type maybeImage struct {
+	Result *ImageResult
+	Error  error
+}
+
+type maybeUnwrap struct {
+	Result *UnwrapResult
+	Error  error
+}
+
+type maybeUpgrade struct {
+	Result *UpgradeResult
+	Error  error
+}
+
+type maybeResume struct {
+	Result *ResumeResult
+	Error  error
+}
+
+// getMetavisorAMI returns the Metavisor AMI of the given version in the region,
+// as well as the version itself, which is the latest version if none is given
+func getMetavisorAMI(ctx context.Context, version, region string) (string, string, error) {
 	// If no version was specified, get the latest version
 	if version == "" {
 		logging.Info("Getting the latest Metavisor version...")
 		v, err := getLatestMVVersion(ctx)
 		if err != nil {
-			return "", err
+			return "", "", err
 		}
 		version = v
 	}
 	logging.Infof("Using Metavisor version %s", version)
-	return getAMIForVersion(ctx, version, region)
+	ami, err := getAMIForVersion(ctx, version, region)
+	return ami, version, err
 }
 
 func getAMIForVersion(ctx context.Context, version, region string) (string, error) {
@@ -0,0 +1,131 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package output formats the results of commands as JSON, YAML or a table.
+// JSON and YAML results are wrapped in a document with the version of the
+// schema and the kind of result, so that scripts can tell what they get.
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// FormatJSON formats results as JSON
+	FormatJSON = "json"
+	// FormatYAML formats results as YAML
+	FormatYAML = "yaml"
+	// FormatTable formats results as a table of names and values
+	FormatTable = "table"
+
+	// SchemaVersion is the version of the schema of all results. It's
+	// increased when a field is removed or changes meaning, but not when
+	// fields are added.
+	SchemaVersion = 1
+)
+
+// ErrUnknownFormat is returned if results are formatted with an unknown format
+var ErrUnknownFormat = errors.New("the output format must be json, yaml or table")
+
+// Result is the typed result of a command. Results are marshaled with their
+// json and yaml tags.
+type Result interface {
+	// Kind is the kind of result, which determines its fields, e.g.
+	// "wrap-instance"
+	Kind() string
+	// Rows are the names and values shown when formatted as a table
+	Rows() []Row
+}
+
+// Row is a line of a table
+type Row struct {
+	Name  string
+	Value string
+}
+
+// Document is what results are wrapped in when formatted as JSON or YAML
+type Document struct {
+	SchemaVersion int    `json:"schema_version" yaml:"schema_version"`
+	Kind          string `json:"kind" yaml:"kind"`
+	Result        Result `json:"result" yaml:"result"`
+}
+
+// Format will format a result with the given format, see the Format
+// constants
+func Format(r Result, format string) (string, error) {
+	doc := Document{
+		SchemaVersion: SchemaVersion,
+		Kind:          r.Kind(),
+		Result:        r,
+	}
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(doc, "", "\t")
+		if err != nil {
+			logging.Errorf("Failed to marshal result to JSON: %s", err)
+		}
+		return string(data), err
+	case FormatYAML:
+		data, err := yaml.Marshal(doc)
+		if err != nil {
+			logging.Errorf("Failed to marshal result to YAML: %s", err)
+		}
+		return strings.TrimRight(string(data), "\n"), err
+	case FormatTable:
+		var b bytes.Buffer
+		w := tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+		for _, row := range r.Rows() {
+			if row.Value == "" {
+				continue
+			}
+			fmt.Fprintf(w, "%s:\t%s\n", row.Name, row.Value)
+		}
+		w.Flush()
+		return strings.TrimRight(b.String(), "\n"), nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// Since returns the seconds since start, in tenths of seconds, which is
+// how durations are given in results
+func Since(start time.Time) float64 {
+	return math.Round(time.Since(start).Seconds()*10) / 10
+}
+
+// Seconds formats a duration in seconds for a table, e.g. 4m12s
+func Seconds(seconds float64) string {
+	return (time.Duration(math.Round(seconds)) * time.Second).String()
+}
+
+// Map formats a map for a table, as KEY=VALUE pairs sorted by key
+func Map(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
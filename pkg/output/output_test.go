@@ -0,0 +1,100 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package output
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+type testResult struct {
+	ID   string            `json:"id" yaml:"id"`
+	Tags map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
+}
+
+func (r *testResult) Kind() string {
+	return "test"
+}
+
+func (r *testResult) Rows() []Row {
+	return []Row{
+		{Name: "ID", Value: r.ID},
+		{Name: "Tags", Value: Map(r.Tags)},
+		{Name: "Duration", Value: Seconds(252.4)},
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	out, err := Format(&testResult{ID: "i-1"}, FormatJSON)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	var doc struct {
+		SchemaVersion int        `json:"schema_version"`
+		Kind          string     `json:"kind"`
+		Result        testResult `json:"result"`
+	}
+	if err = json.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("Output is not valid JSON: %s", out)
+	}
+	if doc.SchemaVersion != SchemaVersion || doc.Kind != "test" || doc.Result.ID != "i-1" {
+		t.Errorf("Got unexpected document: %+v", doc)
+	}
+}
+
+func TestFormatYAML(t *testing.T) {
+	out, err := Format(&testResult{ID: "i-1", Tags: map[string]string{"env": "test"}}, FormatYAML)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	expected := `schema_version: 1
+kind: test
+result:
+  id: i-1
+  tags:
+    env: test`
+	if out != expected {
+		t.Errorf("Got unexpected YAML.\nGot:\n%s\nExpected:\n%s", out, expected)
+	}
+	var doc map[string]interface{}
+	if err = yaml.Unmarshal([]byte(out), &doc); err != nil {
+		t.Errorf("Output is not valid YAML: %s", err)
+	}
+}
+
+func TestFormatTable(t *testing.T) {
+	out, err := Format(&testResult{ID: "i-1", Tags: map[string]string{"b": "2", "a": "1"}}, FormatTable)
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	expected := `ID:       i-1
+Tags:     a=1, b=2
+Duration: 4m12s`
+	if out != expected {
+		t.Errorf("Got unexpected table.\nGot:\n%s\nExpected:\n%s", out, expected)
+	}
+	out, _ = Format(&testResult{ID: "i-1"}, FormatTable)
+	if out != "ID:       i-1\nDuration: 4m12s" {
+		t.Errorf("Expected empty values to be left out, got:\n%s", out)
+	}
+}
+
+func TestFormatUnknown(t *testing.T) {
+	if _, err := Format(&testResult{}, "xml"); err != ErrUnknownFormat {
+		t.Errorf("Expected ErrUnknownFormat, got: %v", err)
+	}
+}
@@ -17,15 +17,22 @@ package scp
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/immutable/metavisor-cli/pkg/logging"
+
+	"golang.org/x/crypto/ssh"
 )
 
 const (
 	// DefaultPort is the default port used if not specified
 	DefaultPort = 22
+	// DefaultTimeout is how long to wait for a connection if not specified
+	DefaultTimeout = 5 * time.Second
 )
 
 var (
@@ -37,23 +44,32 @@ var (
 	ErrNoHost = errors.New("must specify a host")
 	// ErrNoProxyHost is returned if trying to specify a proxy without a host
 	ErrNoProxyHost = errors.New("proxy must have a host")
+	// ErrInvalidProxy is returned if a proxy jump isn't on the form
+	// [user@]host[:port]
+	ErrInvalidProxy = errors.New("proxy must be on the form [user@]host[:port]")
 
 	simpleClientDefaultFlags = []string{
-		"-o ServerAliveInterval=10",
-		"-o UserKnownHostsFile=/dev/null",
-		"-o StrictHostKeyChecking=no",
-		"-o ConnectTimeout=5",
-		"-o LogLevel=quiet",
+		"-o", "ServerAliveInterval=10",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "ConnectTimeout=5",
+		"-o", "LogLevel=quiet",
 	}
 )
 
-// Config is used to specify connection details for the client
+// Config is used to specify connection details for the client. Keys in a
+// running ssh-agent are used in addition to Key.
 type Config struct {
 	Username string
 	Host     string
 	Port     int
 	Key      string
 	Proxy    *Proxy
+	// Timeout is how long to wait for connections, DefaultTimeout if zero
+	Timeout time.Duration
+	// HostKeyCallback verifies the host keys, all keys are accepted if nil
+	// as the hosts are usually temporary instances
+	HostKeyCallback ssh.HostKeyCallback
 }
 
 // Proxy can be passed to a Config to do SSH hopping
@@ -62,6 +78,48 @@ type Proxy struct {
 	Host     string
 	Port     int
 	Key      string
+	// Proxy is the proxy to connect to this proxy through, when more than
+	// one hop is needed
+	Proxy *Proxy
+}
+
+// ParseProxyJump parses the hops in the same order as ssh -J, i.e. the first
+// hop is the one connected to first. Every hop is on the form
+// [user@]host[:port], and uses the specified key. The returned proxy is the
+// last hop, which is the one to put in a Config.
+func ParseProxyJump(hops []string, key string) (*Proxy, error) {
+	var proxy *Proxy
+	for _, hop := range hops {
+		next := &Proxy{Key: key, Proxy: proxy}
+		if i := strings.LastIndex(hop, "@"); i >= 0 {
+			next.Username, hop = hop[:i], hop[i+1:]
+			if next.Username == "" {
+				return nil, ErrInvalidProxy
+			}
+		}
+		next.Host = hop
+		if host, port, err := net.SplitHostPort(hop); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil || p <= 0 {
+				return nil, ErrInvalidProxy
+			}
+			next.Host, next.Port = host, p
+		}
+		if next.Host == "" || strings.ContainsAny(next.Host, " /@") {
+			return nil, ErrInvalidProxy
+		}
+		proxy = next
+	}
+	return proxy, nil
+}
+
+// Hops returns the proxy and the proxies before it, starting with the one
+// connected to first
+func (p *Proxy) Hops() []*Proxy {
+	if p == nil {
+		return nil
+	}
+	return append(p.Proxy.Hops(), p)
 }
 
 // SCPClient represents a client capable of downloading remote files using SCP
@@ -76,25 +134,35 @@ type simpleClient struct {
 }
 
 func (c *simpleClient) DownloadFile(remoteSource, localDestination string) error {
-	args := fmt.Sprintf("%s %s@%s:%s %s", strings.Join(c.flags, " "), c.conf.Username, c.conf.Host, remoteSource, localDestination)
+	args := append(append([]string{}, c.flags...), fmt.Sprintf("%s@%s:%s", c.conf.Username, c.conf.Host, remoteSource), localDestination)
 	cmd, err := exec.LookPath("scp")
 	if err != nil {
 		return ErrSCPNotInstalled
 	}
-	command := exec.Command(cmd, strings.Split(args, " ")...)
-	logging.Debugf("Running SCP with:\n%s %s", cmd, args)
+	command := exec.Command(cmd, args...)
+	logging.Debugf("Running SCP with:\n%s %s", cmd, strings.Join(args, " "))
 	output, err := command.CombinedOutput()
 	logging.Debugf("Got the following output from SCP:\n%s", string(output))
 	return err
 }
 
-// New will initialize a new SCP Client based on the specified configuration
+// New will initialize a new SCP Client based on the specified configuration.
+// Files are downloaded with SFTP, without depending on any SSH binaries.
 func New(conf Config) (SCPClient, error) {
 	conf, err := parseConfig(conf)
 	if err != nil {
 		return nil, err
 	}
+	return &sshClient{conf: conf}, nil
+}
 
+// NewSystem will initialize a client that runs the scp binary of the machine,
+// which is only available if OpenSSH is installed
+func NewSystem(conf Config) (SCPClient, error) {
+	conf, err := parseConfig(conf)
+	if err != nil {
+		return nil, err
+	}
 	return initSimpleClient(conf)
 }
 
@@ -108,45 +176,69 @@ func parseConfig(conf Config) (Config, error) {
 	if conf.Port <= 0 {
 		conf.Port = DefaultPort
 	}
-	if conf.Proxy != nil {
-		if conf.Proxy.Host == "" {
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultTimeout
+	}
+	// Copy the proxies, so the defaults don't change the caller's config
+	var proxy *Proxy
+	for _, hop := range conf.Proxy.Hops() {
+		p := *hop
+		if p.Host == "" {
 			return conf, ErrNoProxyHost
 		}
-		if conf.Proxy.Port <= 0 {
-			conf.Proxy.Port = DefaultPort
+		if p.Port <= 0 {
+			p.Port = DefaultPort
 		}
-		if conf.Proxy.Username == "" {
-			conf.Proxy.Username = conf.Username
+		if p.Username == "" {
+			p.Username = conf.Username
 		}
+		p.Proxy = proxy
+		proxy = &p
 	}
+	conf.Proxy = proxy
 	return conf, nil
 }
 
 func initSimpleClient(conf Config) (SCPClient, error) {
 	client := &simpleClient{
 		conf:  conf,
-		flags: simpleClientDefaultFlags,
+		flags: append([]string{}, simpleClientDefaultFlags...),
 	}
 	if conf.Proxy != nil {
-		client.flags = append(client.flags, createProxyCommand(*conf.Proxy))
+		client.flags = append(client.flags, "-o", createProxyCommand(*conf.Proxy))
 	}
 	if conf.Port != DefaultPort {
-		client.flags = append(client.flags, fmt.Sprintf("-P %d", conf.Port))
+		client.flags = append(client.flags, "-P", strconv.Itoa(conf.Port))
 	}
 	if conf.Key != "" {
-		client.flags = append(client.flags, fmt.Sprintf("-i %s", conf.Key))
+		client.flags = append(client.flags, "-i", conf.Key)
 	}
 	return client, nil
 }
 
+// createProxyCommand returns the ProxyCommand option for the last hop. Earlier
+// hops are passed with -J, which can't specify their keys, so they must be
+// in the ssh-agent or the default keys.
 func createProxyCommand(proxy Proxy) string {
-	flags := []string{}
+	flags := []string{"ssh"}
 	if proxy.Port != DefaultPort {
-		flags = append(flags, fmt.Sprintf("-P %d", proxy.Port))
+		flags = append(flags, "-p", strconv.Itoa(proxy.Port))
 	}
 	if proxy.Key != "" {
-		flags = append(flags, fmt.Sprintf("-i %s", proxy.Key))
+		flags = append(flags, "-i", shellQuote(proxy.Key))
+	}
+	if proxy.Proxy != nil {
+		jumps := []string{}
+		for _, hop := range proxy.Proxy.Hops() {
+			jumps = append(jumps, fmt.Sprintf("%s@%s", hop.Username, net.JoinHostPort(hop.Host, strconv.Itoa(hop.Port))))
+		}
+		flags = append(flags, "-J", strings.Join(jumps, ","))
 	}
-	flags = append(flags, fmt.Sprintf("-W %%h:%%p %s@%s", proxy.Username, proxy.Host))
-	return fmt.Sprintf("-o ProxyCommand='ssh %s'", strings.Join(flags, " "))
+	flags = append(flags, "-W", "%h:%p", fmt.Sprintf("%s@%s", proxy.Username, proxy.Host))
+	// The whole option is one argument, but ssh runs the command with a shell
+	return fmt.Sprintf("ProxyCommand=%s", strings.Join(flags, " "))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
 }
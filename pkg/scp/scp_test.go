@@ -0,0 +1,81 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package scp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	proxy := &Proxy{Host: "bastion"}
+	conf, err := parseConfig(Config{Username: "ec2-user", Host: "host", Proxy: proxy})
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if conf.Port != DefaultPort || conf.Timeout != DefaultTimeout || conf.Proxy.Port != DefaultPort {
+		t.Errorf("Expected defaults to be set, got %+v", conf)
+	}
+	if conf.Proxy.Username != "ec2-user" {
+		t.Errorf("Expected proxy to use the same username, got %s", conf.Proxy.Username)
+	}
+	if proxy.Port != 0 || proxy.Username != "" {
+		t.Errorf("Expected the given proxy to not be changed, got %+v", proxy)
+	}
+	if _, err = parseConfig(Config{Username: "ec2-user", Host: "host", Proxy: &Proxy{}}); err != ErrNoProxyHost {
+		t.Errorf("Expected ErrNoProxyHost, got %v", err)
+	}
+	nested := &Proxy{Host: "second", Proxy: &Proxy{}}
+	if _, err = parseConfig(Config{Username: "ec2-user", Host: "host", Proxy: nested}); err != ErrNoProxyHost {
+		t.Errorf("Expected ErrNoProxyHost for first hop, got %v", err)
+	}
+}
+
+func TestParseProxyJump(t *testing.T) {
+	proxy, err := ParseProxyJump([]string{"alice@first:2222", "second"}, "key.pem")
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	if proxy.Host != "second" || proxy.Port != 0 || proxy.Username != "" || proxy.Key != "key.pem" {
+		t.Errorf("Got unexpected last hop: %+v", proxy)
+	}
+	first := proxy.Proxy
+	if first == nil || first.Host != "first" || first.Port != 2222 || first.Username != "alice" || first.Proxy != nil {
+		t.Errorf("Got unexpected first hop: %+v", first)
+	}
+	if proxy, err = ParseProxyJump(nil, "key.pem"); proxy != nil || err != nil {
+		t.Errorf("Expected no proxy without hops, got %+v (%v)", proxy, err)
+	}
+	for _, hop := range []string{"", "@host", "host:port", "host:0", "user@:22", "two hosts"} {
+		if _, err = ParseProxyJump([]string{hop}, ""); err != ErrInvalidProxy {
+			t.Errorf("Expected ErrInvalidProxy for %q, got %v", hop, err)
+		}
+	}
+}
+
+func TestCreateProxyCommand(t *testing.T) {
+	proxy, _ := ParseProxyJump([]string{"first", "bob@second:2222"}, "/path/with space/key.pem")
+	conf, _ := parseConfig(Config{Username: "ec2-user", Host: "10.0.0.1", Proxy: proxy})
+	client, _ := initSimpleClient(conf)
+	flags := client.(*simpleClient).flags
+	cmd := flags[len(flags)-1]
+	if flags[len(flags)-2] != "-o" || !strings.HasPrefix(cmd, "ProxyCommand=ssh ") {
+		t.Fatalf("Expected ProxyCommand as a single argument, got %q", flags)
+	}
+	expected := "ProxyCommand=ssh -p 2222 -i '/path/with space/key.pem' -J ec2-user@first:22 -W %h:%p bob@second"
+	if cmd != expected {
+		t.Errorf("Got unexpected proxy command:\n%s\nExpected:\n%s", cmd, expected)
+	}
+}
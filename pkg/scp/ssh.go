@@ -0,0 +1,254 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const agentSocketEnv = "SSH_AUTH_SOCK"
+
+var (
+	// ErrAuthFailed is returned if the server rejected all keys, either the
+	// specified key or the ones in the ssh-agent
+	ErrAuthFailed = errors.New("ssh authentication failed")
+	// ErrConnectionRefused is returned if nothing listens on the SSH port,
+	// e.g. because the instance is still booting
+	ErrConnectionRefused = errors.New("ssh connection refused")
+	// ErrConnectionTimeout is returned if the host could not be reached in time
+	ErrConnectionTimeout = errors.New("timed out while connecting")
+	// ErrFileNotFound is returned if the remote file doesn't exist
+	ErrFileNotFound = errors.New("remote file does not exist")
+	// ErrInvalidKey is returned if the private key file can't be read or parsed
+	ErrInvalidKey = errors.New("could not read private key")
+	// ErrNoAuthMethod is returned if neither a key nor an ssh-agent is available
+	ErrNoAuthMethod = errors.New("no private key specified and no ssh-agent available")
+)
+
+// sshClient downloads files with SFTP, using the SSH implementation in
+// golang.org/x/crypto instead of the scp binary
+type sshClient struct {
+	conf Config
+}
+
+func (c *sshClient) DownloadFile(remoteSource, localDestination string) error {
+	client, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		logging.Debugf("Could not start SFTP session: %s", err)
+		return err
+	}
+	defer sftpClient.Close()
+	remote, err := sftpClient.Open(remoteSource)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrFileNotFound
+		}
+		logging.Debugf("Could not open remote file %s: %s", remoteSource, err)
+		return err
+	}
+	defer remote.Close()
+
+	local, err := os.Create(localDestination)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(local, remote)
+	if cerr := local.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Don't leave a partial file behind
+		logging.Debugf("Failed to download %s: %s", remoteSource, err)
+		os.Remove(localDestination)
+		return err
+	}
+	return nil
+}
+
+// connect opens an SSH connection to the host, through the proxies if any
+// are configured
+func (c *sshClient) connect() (*ssh.Client, error) {
+	keys := dialAgent()
+	if keys != nil {
+		// Only needed while authenticating, which is done when returning
+		defer keys.Close()
+	}
+	target := &Proxy{
+		Username: c.conf.Username,
+		Host:     c.conf.Host,
+		Port:     c.conf.Port,
+		Key:      c.conf.Key,
+		Proxy:    c.conf.Proxy,
+	}
+	return c.dial(target, keys)
+}
+
+// dial connects to the host of the hop, after first connecting to all the
+// hops before it
+func (c *sshClient) dial(hop *Proxy, keys *agentConn) (*ssh.Client, error) {
+	addr := net.JoinHostPort(hop.Host, strconv.Itoa(hop.Port))
+	clientConf, err := c.clientConfig(hop.Username, hop.Key, keys)
+	if err != nil {
+		return nil, err
+	}
+	if hop.Proxy == nil {
+		logging.Debugf("Connecting to %s@%s", hop.Username, addr)
+		client, err := ssh.Dial("tcp", addr, clientConf)
+		if err != nil {
+			return nil, classifyError(addr, err)
+		}
+		return client, nil
+	}
+
+	proxyClient, err := c.dial(hop.Proxy, keys)
+	if err != nil {
+		return nil, err
+	}
+	logging.Debugf("Connecting to %s@%s through %s", hop.Username, addr, hop.Proxy.Host)
+	conn, err := proxyClient.Dial("tcp", addr)
+	if err != nil {
+		proxyClient.Close()
+		return nil, classifyError(addr, err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConf)
+	if err != nil {
+		conn.Close()
+		proxyClient.Close()
+		return nil, classifyError(addr, err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	go func() {
+		// Close the connection to the proxy with the connection through it
+		client.Wait()
+		proxyClient.Close()
+	}()
+	return client, nil
+}
+
+// CheckReachable connects and authenticates to the host of the config,
+// through its proxies, without doing anything else. It can be used to check
+// e.g. a bastion host before relying on it.
+func CheckReachable(conf Config) error {
+	conf, err := parseConfig(conf)
+	if err != nil {
+		return err
+	}
+	client, err := (&sshClient{conf: conf}).connect()
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+func (c *sshClient) clientConfig(username, keyPath string, keys *agentConn) (*ssh.ClientConfig, error) {
+	auth := []ssh.AuthMethod{}
+	if keyPath != "" {
+		signer, err := readPrivateKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if keys != nil {
+		auth = append(auth, ssh.PublicKeysCallback(keys.agent.Signers))
+	}
+	if len(auth) == 0 {
+		return nil, ErrNoAuthMethod
+	}
+	hostKeyCallback := c.conf.HostKeyCallback
+	if hostKeyCallback == nil {
+		// The hosts are temporary instances, there is no known host key
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         c.conf.Timeout,
+	}, nil
+}
+
+func readPrivateKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(filepath.FromSlash(path))
+	if err != nil {
+		logging.Debugf("Could not read private key %s: %s", path, err)
+		return nil, ErrInvalidKey
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		logging.Debugf("Could not parse private key %s: %s", path, err)
+		return nil, ErrInvalidKey
+	}
+	return signer, nil
+}
+
+type agentConn struct {
+	net.Conn
+	agent agent.Agent
+}
+
+// dialAgent connects to the running ssh-agent, if there is one
+func dialAgent() *agentConn {
+	socket := os.Getenv(agentSocketEnv)
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		logging.Debugf("Could not connect to ssh-agent: %s", err)
+		return nil
+	}
+	return &agentConn{conn, agent.NewClient(conn)}
+}
+
+// classifyError turns errors from connecting into one of the errors of this
+// package, when possible
+func classifyError(addr string, err error) error {
+	logging.Debugf("Got error when connecting to %s: %s", addr, err)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrConnectionTimeout
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED) || strings.Contains(msg, "connection refused"):
+		return ErrConnectionRefused
+	case strings.Contains(msg, "unable to authenticate"):
+		return ErrAuthFailed
+	case strings.Contains(msg, "i/o timeout"):
+		return ErrConnectionTimeout
+	}
+	return fmt.Errorf("could not connect to %s: %s", addr, err)
+}
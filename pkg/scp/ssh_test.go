@@ -0,0 +1,378 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package scp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// testServer is an in-process SSH server which serves SFTP from the local
+// file system and forwards direct-tcpip channels, so it can be a proxy
+type testServer struct {
+	listener   net.Listener
+	authorized ssh.PublicKey
+}
+
+func newTestServer(t *testing.T, authorized ssh.PublicKey) *testServer {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "ec2-user" && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, ErrAuthFailed
+		},
+	}
+	conf.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{listener: listener, authorized: authorized}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, conf)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serve(conn net.Conn, conf *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		switch newChan.ChannelType() {
+		case "session":
+			go serveSFTP(newChan)
+		case "direct-tcpip":
+			go forward(newChan)
+		default:
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func serveSFTP(newChan ssh.NewChannel) {
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	for req := range reqs {
+		// The payload is the length prefixed subsystem name
+		ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			channel.Close()
+			return
+		}
+		server.Serve()
+		channel.Close()
+		return
+	}
+}
+
+func forward(newChan ssh.NewChannel) {
+	// The payload starts with the length prefixed host and the port
+	payload := newChan.ExtraData()
+	hostLen := binary.BigEndian.Uint32(payload)
+	host := string(payload[4 : 4+hostLen])
+	port := binary.BigEndian.Uint32(payload[4+hostLen:])
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(channel, target)
+		channel.Close()
+	}()
+	io.Copy(target, channel)
+	target.Close()
+}
+
+func (s *testServer) host() string {
+	return s.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+func (s *testServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// testEnv has a temporary directory with a private key and a remote file
+type testEnv struct {
+	dir     string
+	key     *ecdsa.PrivateKey
+	keyPath string
+	remote  string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir("", "scp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Spaces in paths broke the scp command line
+	keyPath := filepath.Join(dir, "private key.pem")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := filepath.Join(dir, "mv-logs.tar.gz")
+	if err = ioutil.WriteFile(remote, []byte("logs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{dir: dir, key: key, keyPath: keyPath, remote: remote}
+}
+
+func (e *testEnv) publicKey(t *testing.T) ssh.PublicKey {
+	pub, err := ssh.NewPublicKey(&e.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func withoutAgent() func() {
+	orig, set := os.LookupEnv(agentSocketEnv)
+	os.Unsetenv(agentSocketEnv)
+	return func() {
+		if set {
+			os.Setenv(agentSocketEnv, orig)
+		}
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	defer withoutAgent()()
+	env := newTestEnv(t)
+	defer os.RemoveAll(env.dir)
+	server := newTestServer(t, env.publicKey(t))
+	defer server.listener.Close()
+
+	client, err := New(Config{Username: "ec2-user", Host: server.host(), Port: server.port(), Key: env.keyPath})
+	if err != nil {
+		t.Fatalf("Got unexpected error when creating client: %s", err)
+	}
+	local := filepath.Join(env.dir, "downloaded")
+	if err = client.DownloadFile(env.remote, local); err != nil {
+		t.Fatalf("Got unexpected error when downloading: %s", err)
+	}
+	if data, _ := ioutil.ReadFile(local); string(data) != "logs" {
+		t.Errorf("Got unexpected file content: %q", data)
+	}
+
+	err = client.DownloadFile(filepath.Join(env.dir, "missing"), filepath.Join(env.dir, "other"))
+	if err != ErrFileNotFound {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(env.dir, "other")); !os.IsNotExist(err) {
+		t.Error("Expected no local file to be created for missing remote file")
+	}
+}
+
+func TestDownloadFileErrors(t *testing.T) {
+	defer withoutAgent()()
+	env := newTestEnv(t)
+	defer os.RemoveAll(env.dir)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _ := ssh.NewPublicKey(&other.PublicKey)
+	server := newTestServer(t, otherPub)
+	defer server.listener.Close()
+	local := filepath.Join(env.dir, "downloaded")
+
+	client, _ := New(Config{Username: "ec2-user", Host: server.host(), Port: server.port(), Key: env.keyPath})
+	if err = client.DownloadFile(env.remote, local); err != ErrAuthFailed {
+		t.Errorf("Expected ErrAuthFailed, got %v", err)
+	}
+
+	// Nothing listens on the port after closing the listener
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	port := closed.Addr().(*net.TCPAddr).Port
+	client, _ = New(Config{Username: "ec2-user", Host: "127.0.0.1", Port: port, Key: env.keyPath})
+	if err = client.DownloadFile(env.remote, local); err != ErrConnectionRefused {
+		t.Errorf("Expected ErrConnectionRefused, got %v", err)
+	}
+
+	client, _ = New(Config{Username: "ec2-user", Host: server.host(), Port: server.port(), Key: env.remote})
+	if err = client.DownloadFile(env.remote, local); err != ErrInvalidKey {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+	client, _ = New(Config{Username: "ec2-user", Host: server.host(), Port: server.port()})
+	if err = client.DownloadFile(env.remote, local); err != ErrNoAuthMethod {
+		t.Errorf("Expected ErrNoAuthMethod, got %v", err)
+	}
+}
+
+func TestDownloadFileProxy(t *testing.T) {
+	defer withoutAgent()()
+	env := newTestEnv(t)
+	defer os.RemoveAll(env.dir)
+	target := newTestServer(t, env.publicKey(t))
+	defer target.listener.Close()
+	bastion := newTestServer(t, env.publicKey(t))
+	defer bastion.listener.Close()
+
+	client, err := New(Config{
+		Username: "ec2-user",
+		Host:     target.host(),
+		Port:     target.port(),
+		Key:      env.keyPath,
+		Proxy: &Proxy{
+			Host: bastion.host(),
+			Port: bastion.port(),
+			Key:  env.keyPath,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Got unexpected error when creating client: %s", err)
+	}
+	local := filepath.Join(env.dir, "downloaded")
+	if err = client.DownloadFile(env.remote, local); err != nil {
+		t.Fatalf("Got unexpected error when downloading through proxy: %s", err)
+	}
+	if data, _ := ioutil.ReadFile(local); string(data) != "logs" {
+		t.Errorf("Got unexpected file content: %q", data)
+	}
+
+	target.listener.Close()
+	if err = client.DownloadFile(env.remote, local); err != ErrConnectionRefused {
+		t.Errorf("Expected ErrConnectionRefused through proxy, got %v", err)
+	}
+}
+
+func TestDownloadFileMultipleHops(t *testing.T) {
+	defer withoutAgent()()
+	env := newTestEnv(t)
+	defer os.RemoveAll(env.dir)
+	target := newTestServer(t, env.publicKey(t))
+	defer target.listener.Close()
+	hops := []string{}
+	for i := 0; i < 3; i++ {
+		bastion := newTestServer(t, env.publicKey(t))
+		defer bastion.listener.Close()
+		hops = append(hops, fmt.Sprintf("ec2-user@%s:%d", bastion.host(), bastion.port()))
+	}
+	proxy, err := ParseProxyJump(hops, env.keyPath)
+	if err != nil {
+		t.Fatalf("Got unexpected error when parsing hops: %s", err)
+	}
+	if err = CheckReachable(Config{Username: proxy.Username, Host: proxy.Host, Port: proxy.Port, Key: proxy.Key, Proxy: proxy.Proxy}); err != nil {
+		t.Errorf("Expected last hop to be reachable, got: %s", err)
+	}
+
+	client, _ := New(Config{Username: "ec2-user", Host: target.host(), Port: target.port(), Key: env.keyPath, Proxy: proxy})
+	local := filepath.Join(env.dir, "downloaded")
+	if err = client.DownloadFile(env.remote, local); err != nil {
+		t.Fatalf("Got unexpected error when downloading through %d hops: %s", len(hops), err)
+	}
+	if data, _ := ioutil.ReadFile(local); string(data) != "logs" {
+		t.Errorf("Got unexpected file content: %q", data)
+	}
+
+	// Wrong key for the first hop only
+	proxy.Proxy.Proxy.Key = env.remote
+	if err = CheckReachable(Config{Username: "ec2-user", Host: target.host(), Port: target.port(), Key: env.keyPath, Proxy: proxy}); err != ErrInvalidKey {
+		t.Errorf("Expected ErrInvalidKey for first hop, got %v", err)
+	}
+}
+
+func TestDownloadFileAgent(t *testing.T) {
+	defer withoutAgent()()
+	env := newTestEnv(t)
+	defer os.RemoveAll(env.dir)
+	server := newTestServer(t, env.publicKey(t))
+	defer server.listener.Close()
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: env.key}); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(env.dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	os.Setenv(agentSocketEnv, socket)
+
+	client, _ := New(Config{Username: "ec2-user", Host: server.host(), Port: server.port()})
+	local := filepath.Join(env.dir, "downloaded")
+	if err = client.DownloadFile(env.remote, local); err != nil {
+		t.Fatalf("Got unexpected error when authenticating with agent: %s", err)
+	}
+}
@@ -0,0 +1,148 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package token
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+// sensitiveClaims are masked when inspecting a token, as they identify
+// the token itself
+var sensitiveClaims = []string{"jti"}
+
+// Inspection describes a token and if it can be used
+type Inspection struct {
+	// Token is the masked token
+	Token     string `json:"token"`
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id,omitempty"`
+	// Claims are all claims of the token, with sensitive claims masked
+	Claims    map[string]interface{} `json:"claims"`
+	ExpiresAt string                 `json:"expires_at,omitempty"`
+	NotBefore string                 `json:"not_before,omitempty"`
+	IssuedAt  string                 `json:"issued_at,omitempty"`
+	// SignatureVerified is true if the signature was verified with a key set
+	SignatureVerified bool   `json:"signature_verified"`
+	Valid             bool   `json:"valid"`
+	Error             string `json:"error,omitempty"`
+}
+
+// Inspect parses and validates the token. An inspection is returned for all
+// JWTs, along with the error if the token can't be used.
+func Inspect(raw string, opts Options) (*Inspection, error) {
+	t, err := Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	i := &Inspection{
+		Token:     Mask(strings.TrimSpace(raw)),
+		Algorithm: t.Header.Algorithm,
+		KeyID:     t.Header.KeyID,
+		Claims:    map[string]interface{}{},
+		ExpiresAt: formatTime(t.Claims.ExpiresAt),
+		NotBefore: formatTime(t.Claims.NotBefore),
+		IssuedAt:  formatTime(t.Claims.IssuedAt),
+	}
+	for name, value := range t.All {
+		i.Claims[name] = value
+		if s, ok := value.(string); ok && isSensitive(name, s) {
+			i.Claims[name] = Mask(s)
+		}
+	}
+	err = t.Validate(opts)
+	i.Valid = err == nil
+	i.SignatureVerified = err == nil && opts.KeySet != nil
+	if err != nil {
+		i.Error = err.Error()
+	}
+	return i, err
+}
+
+// isSensitive checks if a claim should be masked, which are the claims
+// identifying the token and any other tokens in the claims
+func isSensitive(name, value string) bool {
+	for _, s := range sensitiveClaims {
+		if name == s {
+			return true
+		}
+	}
+	return strings.HasPrefix(value, "eyJ") && strings.Count(value, ".") == 2
+}
+
+func formatTime(seconds float64) string {
+	if seconds == 0 {
+		return ""
+	}
+	return numericDate(seconds).UTC().Format(time.RFC3339)
+}
+
+// FormatInspection will format an inspection of a token for display. If
+// withJSON is true, the inspection will be formatted as JSON.
+func FormatInspection(i *Inspection, withJSON bool) (string, error) {
+	if withJSON {
+		data, err := json.MarshalIndent(i, "", "\t")
+		if err != nil {
+			logging.Errorf("Failed to marshal token inspection to JSON: %s", err)
+		}
+		return string(data), err
+	}
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "Token:\t%s\n", i.Token)
+	if i.KeyID != "" {
+		fmt.Fprintf(w, "Algorithm:\t%s (key %s)\n", i.Algorithm, i.KeyID)
+	} else {
+		fmt.Fprintf(w, "Algorithm:\t%s\n", i.Algorithm)
+	}
+	for _, t := range []struct{ name, value string }{
+		{"Issued at", i.IssuedAt},
+		{"Not before", i.NotBefore},
+		{"Expires at", i.ExpiresAt},
+	} {
+		if t.value != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", t.name, t.value)
+		}
+	}
+	if i.Valid {
+		fmt.Fprintf(w, "Valid:\tyes\n")
+	} else {
+		fmt.Fprintf(w, "Valid:\tno (%s)\n", i.Error)
+	}
+	if i.SignatureVerified {
+		fmt.Fprintf(w, "Signature:\tverified\n")
+	} else {
+		fmt.Fprintf(w, "Signature:\tnot verified\n")
+	}
+	fmt.Fprintf(w, "Claims:\t\n")
+	names := make([]string, 0, len(i.Claims))
+	for name := range i.Claims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, _ := json.Marshal(i.Claims[name])
+		fmt.Fprintf(w, "  %s:\t%s\n", name, value)
+	}
+	w.Flush()
+	return strings.TrimRight(b.String(), "\n"), nil
+}
@@ -0,0 +1,222 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	// Register the hashes used by the supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+var (
+	// ErrInvalidKeySet is returned if a JWKS file can't be parsed
+	ErrInvalidKeySet = errors.New("the key set is not a valid JWKS")
+	// ErrUnknownKey is returned if the key a token is signed with is not in
+	// the key set
+	ErrUnknownKey = errors.New("the token is signed with a key that is not in the key set")
+	// ErrUnsupportedAlgorithm is returned if a token is signed with an
+	// algorithm that can't be verified with public keys
+	ErrUnsupportedAlgorithm = errors.New("the token is signed with an unsupported algorithm")
+	// ErrInvalidSignature is returned if the signature of a token doesn't
+	// match any of the keys in the key set
+	ErrInvalidSignature = errors.New("the signature of the token is not valid")
+)
+
+// algorithms maps the supported JWS algorithms to the key type and hash
+var algorithms = map[string]struct {
+	keyType string
+	hash    crypto.Hash
+}{
+	"ES256": {"EC", crypto.SHA256},
+	"ES384": {"EC", crypto.SHA384},
+	"ES512": {"EC", crypto.SHA512},
+	"RS256": {"RSA", crypto.SHA256},
+	"RS384": {"RSA", crypto.SHA384},
+	"RS512": {"RSA", crypto.SHA512},
+	"PS256": {"RSA", crypto.SHA256},
+	"PS384": {"RSA", crypto.SHA384},
+	"PS512": {"RSA", crypto.SHA512},
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// KeySet holds the public keys of a JSON Web Key Set
+type KeySet struct {
+	keys []publicKey
+}
+
+type publicKey struct {
+	id      string
+	keyType string
+	key     crypto.PublicKey
+}
+
+// jsonWebKey has the fields of EC and RSA keys in a JWKS
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+// LoadKeySet reads a JWKS file
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logging.Errorf("Could not read the key set %s", path)
+		return nil, err
+	}
+	return ParseKeySet(data)
+}
+
+// ParseKeySet parses a JWKS. Keys that are not for signatures, or of other
+// types than EC and RSA, are skipped.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		logging.Debugf("Key set could not be unmarshaled: %s", err)
+		return nil, ErrInvalidKeySet
+	}
+	ks := &KeySet{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.KeyType {
+		case "EC":
+			key, err = k.ecdsaKey()
+		case "RSA":
+			key, err = k.rsaKey()
+		default:
+			logging.Debugf("Skipping key %s of unsupported type %s", k.KeyID, k.KeyType)
+			continue
+		}
+		if err != nil {
+			logging.Debugf("Key %s could not be parsed: %s", k.KeyID, err)
+			return nil, ErrInvalidKeySet
+		}
+		ks.keys = append(ks.keys, publicKey{id: k.KeyID, keyType: k.KeyType, key: key})
+	}
+	if len(ks.keys) == 0 {
+		logging.Debug("Key set has no signing keys")
+		return nil, ErrInvalidKeySet
+	}
+	return ks, nil
+}
+
+func (k jsonWebKey) ecdsaKey() (*ecdsa.PublicKey, error) {
+	curve, ok := curves[k.Curve]
+	if !ok {
+		return nil, errors.New("unsupported curve " + k.Curve)
+	}
+	x, err := decodeSegment(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeSegment(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("the point is not on the curve")
+	}
+	return key, nil
+}
+
+func (k jsonWebKey) rsaKey() (*rsa.PublicKey, error) {
+	n, err := decodeSegment(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeSegment(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 {
+		return nil, errors.New("invalid modulus or exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+// Verify checks the signature of the token against the key with the key ID
+// of the token, or against all keys if the token has no key ID
+func (ks *KeySet) Verify(t *Token) error {
+	alg, ok := algorithms[t.Header.Algorithm]
+	if !ok {
+		logging.Debugf("Token is signed with %s", t.Header.Algorithm)
+		return ErrUnsupportedAlgorithm
+	}
+	h := alg.hash.New()
+	h.Write([]byte(t.signed))
+	digest := h.Sum(nil)
+	candidates := 0
+	for _, k := range ks.keys {
+		if k.keyType != alg.keyType || (t.Header.KeyID != "" && k.id != t.Header.KeyID) {
+			continue
+		}
+		candidates++
+		if verifySignature(t.Header.Algorithm, k.key, alg.hash, digest, t.signature) {
+			return nil
+		}
+	}
+	if candidates == 0 {
+		return ErrUnknownKey
+	}
+	return ErrInvalidSignature
+}
+
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		// The signature is r and s concatenated, each the size of the curve
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	case *rsa.PublicKey:
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(k, hash, digest, signature, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	}
+	return false
+}
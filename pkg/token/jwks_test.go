@@ -0,0 +1,143 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var launchClaims = map[string]interface{}{"brkt.token_type": TypeLaunch}
+
+// sign returns a token with the claims signed with the key
+func sign(t *testing.T, alg, kid string, key crypto.Signer) string {
+	raw := unsigned(map[string]interface{}{"alg": alg, "kid": kid}, launchClaims)
+	signed := raw[:len(raw)-len(".c2lnbmF0dXJl")]
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case *rsa.PrivateKey:
+		if alg == "PS256" {
+			sig, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest[:], nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func TestVerify(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "EC", "kid": "ec-1", "use": "sig", "crv": "P-256", "x": %q, "y": %q},
+		{"kty": "RSA", "kid": "rsa-1", "n": %q, "e": "AQAB"},
+		{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+		{"kty": "RSA", "kid": "enc-1", "use": "enc", "n": "", "e": ""}
+	]}`, encodeInt(ecKey.X), encodeInt(ecKey.Y), encodeInt(rsaKey.N))
+	dir, err := ioutil.TempDir("", "jwks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	if err = ioutil.WriteFile(path, []byte(jwks), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ks, err := LoadKeySet(path)
+	if err != nil {
+		t.Fatalf("Got unexpected error when loading key set: %s", err)
+	}
+
+	tests := []struct {
+		token    string
+		expected error
+	}{
+		{sign(t, "ES256", "ec-1", ecKey), nil},
+		{sign(t, "ES256", "", ecKey), nil},
+		{sign(t, "RS256", "rsa-1", rsaKey), nil},
+		{sign(t, "PS256", "rsa-1", rsaKey), nil},
+		{sign(t, "ES256", "ec-1", otherKey), ErrInvalidSignature},
+		{sign(t, "ES256", "ec-2", ecKey), ErrUnknownKey},
+		{sign(t, "RS256", "ec-1", rsaKey), ErrUnknownKey},
+		{unsigned(map[string]interface{}{"alg": "HS256"}, launchClaims), ErrUnsupportedAlgorithm},
+		{unsigned(map[string]interface{}{"alg": "none"}, launchClaims), ErrUnsupportedAlgorithm},
+	}
+	for n, test := range tests {
+		tok, err := Parse(test.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tok.Validate(Options{KeySet: ks}); err != test.expected {
+			t.Errorf("Expected %v for token %d, got %v", test.expected, n, err)
+		}
+	}
+
+	i, err := Inspect(tests[0].token, Options{KeySet: ks})
+	if err != nil || !i.SignatureVerified {
+		t.Errorf("Expected signature to be verified, got %+v (%v)", i, err)
+	}
+}
+
+func TestParseKeySetInvalid(t *testing.T) {
+	for _, jwks := range []string{
+		"not json",
+		`{"keys": []}`,
+		`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "EC", "crv": "P-192", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "RSA", "n": "AQ", "e": "AQ"}]}`,
+	} {
+		if _, err := ParseKeySet([]byte(jwks)); err != ErrInvalidKeySet {
+			t.Errorf("Expected ErrInvalidKeySet for %s, got %v", jwks, err)
+		}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"keys": nil})
+	if _, err := ParseKeySet(data); err != ErrInvalidKeySet {
+		t.Errorf("Expected ErrInvalidKeySet without keys, got %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package token parses and validates the JWTs used as launch tokens
+package token
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
+)
+
+const (
+	// TypeLaunch is the token type of launch tokens
+	TypeLaunch = "launch"
+
+	// Leeway is how much the clocks of the CLI and the service may differ
+	// when checking if a token has expired or is valid yet
+	Leeway = time.Minute
+
+	// maskedLength is how much of a token is shown when it's masked, which
+	// is only the start of the header
+	maskedLength = 8
+)
+
+var (
+	// ErrMalformed is returned if a token is not a JWT
+	ErrMalformed = errors.New("the token is not a valid JWT")
+	// ErrNotLaunchToken is returned if a token is a JWT, but not a launch
+	// token
+	ErrNotLaunchToken = errors.New("the token is not a launch token")
+	// ErrExpired is returned if a token has expired
+	ErrExpired = errors.New("the token has expired")
+	// ErrNotYetValid is returned if a token is used before it's valid
+	ErrNotYetValid = errors.New("the token is not valid yet")
+	// ErrWrongDomain is returned if the issuer or audience of a token is
+	// another service domain than the one it's used with
+	ErrWrongDomain = errors.New("the token is for another service domain")
+
+	// Pattern matches JWTs like launch tokens in text, where the header and
+	// payload are base64 encoded JSON objects, which always start with "eyJ"
+	Pattern = regexp.MustCompile(`eyJ[A-Za-z0-9_+/=-]*\.eyJ[A-Za-z0-9_+/=-]*\.[A-Za-z0-9_+/=-]*`)
+)
+
+// Header is the header of a JWT
+type Header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// Claims are the registered claims of a JWT, and the token type. Times are
+// NumericDates, seconds since the epoch which may have a fractional part.
+type Claims struct {
+	TokenType string   `json:"brkt.token_type,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt float64  `json:"exp,omitempty"`
+	NotBefore float64  `json:"nbf,omitempty"`
+	IssuedAt  float64  `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Audience is the audience of a JWT, which can be a single string or a list
+type Audience []string
+
+// UnmarshalJSON accepts both a string and a list of strings
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = Audience(list)
+	return nil
+}
+
+// Token is a parsed JWT. Parsing doesn't validate the token, use Validate.
+type Token struct {
+	Header Header
+	Claims Claims
+	// All are all claims of the token, including unregistered ones
+	All map[string]interface{}
+
+	signed    string
+	signature []byte
+}
+
+// Options are what a token is validated against
+type Options struct {
+	// ServiceDomain is the domain the token is used with. If the issuer or
+	// audience of the token are host names, they must be in the domain.
+	ServiceDomain string
+	// KeySet is used to verify the signature of the token if specified
+	KeySet *KeySet
+	// Now is the time the token is used at, the current time if not set
+	Now time.Time
+}
+
+// Parse decodes the header and claims of a JWT
+func Parse(raw string) (*Token, error) {
+	parts := strings.Split(strings.TrimSpace(raw), ".")
+	if len(parts) != 3 {
+		// JWT is three parts
+		logging.Debug("Token does not seem to be a JWT")
+		return nil, ErrMalformed
+	}
+	t := &Token{signed: parts[0] + "." + parts[1]}
+	header, err := decodeSegment(parts[0])
+	if err != nil {
+		logging.Debugf("Token header could not be decoded: %s", err)
+		return nil, ErrMalformed
+	}
+	if err = json.Unmarshal(header, &t.Header); err != nil {
+		logging.Debugf("Token header could not be unmarshaled: %s", err)
+		return nil, ErrMalformed
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		logging.Debugf("Token payload could not be decoded: %s", err)
+		return nil, ErrMalformed
+	}
+	if err = json.Unmarshal(payload, &t.All); err != nil {
+		logging.Debugf("Token payload could not be unmarshaled: %s", err)
+		return nil, ErrMalformed
+	}
+	if err = json.Unmarshal(payload, &t.Claims); err != nil {
+		logging.Debugf("Token has claims of unexpected types: %s", err)
+		return nil, ErrMalformed
+	}
+	if t.signature, err = decodeSegment(parts[2]); err != nil {
+		logging.Debugf("Token signature could not be decoded: %s", err)
+		return nil, ErrMalformed
+	}
+	return t, nil
+}
+
+// numericDate returns the time of a NumericDate, truncated to whole seconds
+func numericDate(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+// decodeSegment decodes a part of a JWT, which should be base64url encoded
+// without padding, but standard base64 is accepted too
+func decodeSegment(seg string) ([]byte, error) {
+	seg = strings.TrimRight(seg, "=")
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return base64.RawStdEncoding.DecodeString(seg)
+	}
+	return data, nil
+}
+
+// IsLaunchToken checks if the token type is launch
+func (t *Token) IsLaunchToken() bool {
+	return strings.ToLower(t.Claims.TokenType) == TypeLaunch
+}
+
+// Validate checks that the token is a launch token that can be used now
+// with the service domain, and verifies the signature if a key set is given
+func (t *Token) Validate(opts Options) error {
+	if !t.IsLaunchToken() {
+		return ErrNotLaunchToken
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if t.Claims.NotBefore != 0 && now.Add(Leeway).Before(numericDate(t.Claims.NotBefore)) {
+		return ErrNotYetValid
+	}
+	if t.Claims.ExpiresAt != 0 && now.Add(-Leeway).After(numericDate(t.Claims.ExpiresAt)) {
+		return ErrExpired
+	}
+	if opts.ServiceDomain != "" {
+		if isHost(t.Claims.Issuer) && !inDomain(t.Claims.Issuer, opts.ServiceDomain) {
+			logging.Debugf("Token issuer %s is not in %s", t.Claims.Issuer, opts.ServiceDomain)
+			return ErrWrongDomain
+		}
+		hosts, matched := 0, false
+		for _, aud := range t.Claims.Audience {
+			if isHost(aud) {
+				hosts++
+				matched = matched || inDomain(aud, opts.ServiceDomain)
+			}
+		}
+		if hosts > 0 && !matched {
+			logging.Debugf("Token audience %v is not in %s", t.Claims.Audience, opts.ServiceDomain)
+			return ErrWrongDomain
+		}
+	}
+	if opts.KeySet != nil {
+		return opts.KeySet.Verify(t)
+	}
+	return nil
+}
+
+// isHost checks if an issuer or audience is a host name or URL, rather
+// than a plain name which can't be checked against a domain
+func isHost(value string) bool {
+	return strings.Contains(hostname(value), ".")
+}
+
+func inDomain(value, domain string) bool {
+	host := strings.ToLower(hostname(value))
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func hostname(value string) string {
+	if strings.Contains(value, "://") {
+		if u, err := url.Parse(value); err == nil {
+			return u.Hostname()
+		}
+	}
+	if i := strings.IndexAny(value, ":/"); i >= 0 {
+		return value[:i]
+	}
+	return value
+}
+
+// Mask returns the start of the token, so that it can be shown without
+// revealing it
+func Mask(raw string) string {
+	if len(raw) <= maskedLength {
+		return "..."
+	}
+	return raw[:maskedLength] + "..."
+}
+
+// MaskAll masks all the tokens in the text, which are found with Pattern
+func MaskAll(text string) string {
+	return Pattern.ReplaceAllStringFunc(text, Mask)
+}
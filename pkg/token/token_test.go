@@ -0,0 +1,149 @@
+//    Copyright 2018 Immutable Systems, Inc.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package token
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Unix(1520000000, 0)
+
+// unsigned returns a token with the claims and a dummy signature
+func unsigned(header, claims map[string]interface{}) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c) + ".c2lnbmF0dXJl"
+}
+
+func TestParse(t *testing.T) {
+	raw := unsigned(map[string]interface{}{"alg": "ES384", "kid": "key-1"}, map[string]interface{}{
+		"brkt.token_type": "Launch",
+		"aud":             "yetiapi.mgmt.brkt.com",
+		"exp":             1520003600,
+		"customer":        "acme",
+	})
+	tok, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("Got unexpected error when parsing token: %s", err)
+	}
+	if tok.Header.Algorithm != "ES384" || tok.Header.KeyID != "key-1" {
+		t.Errorf("Got unexpected header: %+v", tok.Header)
+	}
+	if !tok.IsLaunchToken() || tok.Claims.ExpiresAt != 1520003600 || len(tok.Claims.Audience) != 1 || tok.All["customer"] != "acme" {
+		t.Errorf("Got unexpected claims: %+v", tok.Claims)
+	}
+
+	// The payload of {"brkt.token_type":"launch"} with standard base64 and padding
+	if _, err = Parse("eyJhbGciOiJub25lIn0=.eyJicmt0LnRva2VuX3R5cGUiOiJsYXVuY2gifQ==.c2ln"); err != nil {
+		t.Errorf("Expected standard base64 to be accepted, got %s", err)
+	}
+	for _, raw := range []string{"", "not-a-token", "a.b", "eyJ.eyJ.c2ln", unsigned(nil, map[string]interface{}{"exp": "tomorrow"})} {
+		if _, err = Parse(raw); err != ErrMalformed {
+			t.Errorf("Expected ErrMalformed for %q, got %v", raw, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	launch := func(claims map[string]interface{}) map[string]interface{} {
+		claims["brkt.token_type"] = TypeLaunch
+		return claims
+	}
+	tests := []struct {
+		claims   map[string]interface{}
+		expected error
+	}{
+		{launch(map[string]interface{}{}), nil},
+		{map[string]interface{}{"brkt.token_type": "api"}, ErrNotLaunchToken},
+		{launch(map[string]interface{}{"exp": 1519990000}), ErrExpired},
+		// Within the leeway
+		{launch(map[string]interface{}{"exp": 1519999980, "nbf": 1520000030}), nil},
+		{launch(map[string]interface{}{"nbf": 1520003600}), ErrNotYetValid},
+		// NumericDates may have a fractional part
+		{launch(map[string]interface{}{"exp": 1520003600.25, "nbf": 1519996400.75, "iat": 1519996400.5}), nil},
+		{launch(map[string]interface{}{"exp": 1519990000.5}), ErrExpired},
+		{launch(map[string]interface{}{"iss": "https://yetiapi.mgmt.brkt.com/v1"}), nil},
+		{launch(map[string]interface{}{"iss": "https://yetiapi.staging.brkt.com"}), ErrWrongDomain},
+		{launch(map[string]interface{}{"iss": "yeti"}), nil},
+		{launch(map[string]interface{}{"aud": []string{"metavisor", "hsmproxy.mgmt.brkt.com:443"}}), nil},
+		{launch(map[string]interface{}{"aud": []string{"metavisor", "hsmproxy.example.com:443"}}), ErrWrongDomain},
+		{launch(map[string]interface{}{"aud": "notmgmt.brkt.com"}), ErrWrongDomain},
+	}
+	for _, test := range tests {
+		tok, err := Parse(unsigned(map[string]interface{}{"alg": "ES384"}, test.claims))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tok.Validate(Options{ServiceDomain: "mgmt.brkt.com", Now: testNow}); err != test.expected {
+			t.Errorf("Expected %v for %v, got %v", test.expected, test.claims, err)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	raw := unsigned(map[string]interface{}{"alg": "ES384", "kid": "key-1"}, map[string]interface{}{
+		"brkt.token_type": TypeLaunch,
+		"exp":             1519990000,
+		"jti":             "5a7d0e3c-2b1f-4c5e-9d8a-0f6b1c2d3e4f",
+		"customer":        "acme",
+	})
+	i, err := Inspect(raw, Options{Now: testNow})
+	if err != ErrExpired {
+		t.Errorf("Expected ErrExpired, got %v", err)
+	}
+	if i == nil {
+		t.Fatal("Expected inspection of expired token")
+	}
+	if i.Valid || i.Error != ErrExpired.Error() || i.ExpiresAt != "2018-03-02T11:26:40Z" || i.Claims["jti"] != "5a7d0e3c..." {
+		t.Errorf("Got unexpected inspection: %+v", i)
+	}
+	out, err := FormatInspection(i, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`Token:\s+eyJhbGci\.\.\.\n`, `Algorithm:\s+ES384 \(key key-1\)`, `Valid:\s+no \(the token has expired\)`, `customer:\s+"acme"`} {
+		if !regexp.MustCompile(expected).MatchString(out) {
+			t.Errorf("Expected %q in inspection:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, raw) || strings.Contains(out, "0f6b1c2d3e4f") {
+		t.Errorf("Expected token to be masked:\n%s", out)
+	}
+	if _, err = Inspect("not-a-token", Options{}); err != ErrMalformed {
+		t.Errorf("Expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestMask(t *testing.T) {
+	if m := Mask("eyJhbGciOiJFUzM4NCJ9.eyJ.sig"); m != "eyJhbGci..." {
+		t.Errorf("Got unexpected masked token: %s", m)
+	}
+	if m := Mask("short"); m != "..." {
+		t.Errorf("Expected short values to be masked completely, got %s", m)
+	}
+}
+
+func TestMaskAll(t *testing.T) {
+	text := "token=eyJhbGciOiJFUzM4NCJ9.eyJ0eXAiOiJsYXVuY2gifQ.sig\nkey=eyJhbGciOiJFUzM4NCJ9\n"
+	expected := "token=eyJhbGci...\nkey=eyJhbGciOiJFUzM4NCJ9\n"
+	if m := MaskAll(text); m != expected {
+		t.Errorf("Got unexpected masked text:\n%s\nExpected:\n%s", m, expected)
+	}
+}
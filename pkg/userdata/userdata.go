@@ -15,68 +15,320 @@
 package userdata
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"github.com/immutable/metavisor-cli/pkg/logging"
 )
 
-const mimeHeader = `From nobody Tue Dec  3 19:00:57 2013
-Content-Type: multipart/mixed; boundary="--===============HI-20131203==--"
-MIME-Version: 1.0
+const (
+	// MaxSize is the largest userdata EC2 accepts, after compression and
+	// before base64 encoding
+	MaxSize = 16 * 1024
 
-`
+	// maxLineLength is the longest line allowed in 7bit MIME parts, longer
+	// parts are base64 encoded
+	maxLineLength = 998
+	// base64LineLength is the length of lines in base64 encoded parts
+	base64LineLength = 76
+)
 
-const mimeFooter = `----===============HI-20131203==----
-`
+var (
+	// ErrTooLarge is returned if the encoded userdata is larger than MaxSize
+	ErrTooLarge = fmt.Errorf("userdata is larger than the limit of %d bytes", MaxSize)
+	// ErrInvalidUserdata is returned if userdata looks like a MIME multipart
+	// message, but could not be parsed
+	ErrInvalidUserdata = errors.New("userdata is not a valid MIME multipart message")
 
-const partTemplate = `----===============HI-20131203==--
-Content-Type: %s; charset="utf-8"
-MIME-Version: 1.0
-Content-Transfer-Encoding: 7bit
+	gzipMagic = []byte{0x1f, 0x8b}
 
-%s
-`
+	// scriptTypes maps the first line of userdata that is not MIME to the
+	// content type cloud-init gives it
+	scriptTypes = []struct {
+		prefix, contentType string
+	}{
+		{"#!", "text/x-shellscript"},
+		{"#cloud-config", "text/cloud-config"},
+		{"#include", "text/x-include-url"},
+		{"#cloud-boothook", "text/cloud-boothook"},
+		{"#upstart-job", "text/upstart-job"},
+		{"#part-handler", "text/part-handler"},
+	}
+)
+
+// Part is a single part of userdata, e.g. a script or the Metavisor config
+type Part struct {
+	ContentType string `json:"content_type"`
+	// Filename is the name cloud-init gives the part, it's optional
+	Filename string `json:"filename,omitempty"`
+	Content  string `json:"content"`
+}
 
 // Container holds userdata that is passed to the MV
 type Container interface {
 	// AddPart will add a part to the userdata container
 	AddPart(contentType, contentValue string)
-	// ToMIMEText will generate MIME text from the container
+	// Append will add parts, e.g. from parsed userdata, to the container
+	Append(parts ...Part)
+	// Parts returns the parts in the container, in order
+	Parts() []Part
+	// ToMIMEText will generate a MIME multipart message from the container
 	ToMIMEText() string
 }
 
 type container struct {
-	parts []containerPart
-}
-
-type containerPart struct {
-	contentType, contentValue string
+	parts []Part
+	// boundary is only set in tests, a random boundary is used otherwise
+	boundary string
 }
 
 // New will return an initialized Container
 func New() Container {
 	return &container{
-		parts: []containerPart{},
+		parts: []Part{},
 	}
 }
 
 func (c *container) AddPart(contentType, contentValue string) {
+	c.addPart(Part{ContentType: contentType, Content: contentValue})
+}
+
+func (c *container) Append(parts ...Part) {
+	for _, p := range parts {
+		c.addPart(p)
+	}
+}
+
+func (c *container) addPart(part Part) {
 	if c.parts == nil {
-		c.parts = []containerPart{}
+		c.parts = []Part{}
 	}
-	c.parts = append(c.parts, containerPart{
-		contentType:  contentType,
-		contentValue: contentValue,
-	})
+	c.parts = append(c.parts, part)
+}
+
+func (c *container) Parts() []Part {
+	parts := make([]Part, len(c.parts))
+	copy(parts, c.parts)
+	return parts
 }
 
-// I'm not sure if this is 100% correct MIME, but it matches
-// the old brkt-cli at least
 func (c *container) ToMIMEText() string {
 	b := new(bytes.Buffer)
-	b.WriteString(mimeHeader)
+	w := multipart.NewWriter(b)
+	if c.boundary != "" {
+		w.SetBoundary(c.boundary)
+	}
+	fmt.Fprintf(b, "Content-Type: multipart/mixed; boundary=%q\r\n", w.Boundary())
+	b.WriteString("MIME-Version: 1.0\r\n\r\n")
 	for _, p := range c.parts {
-		b.WriteString(fmt.Sprintf(partTemplate, p.contentType, p.contentValue))
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", mime.FormatMediaType(p.ContentType, map[string]string{"charset": "utf-8"}))
+		header.Set("MIME-Version", "1.0")
+		if p.Filename != "" {
+			header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": p.Filename}))
+		}
+		content := []byte(p.Content)
+		if is7bit(content) {
+			header.Set("Content-Transfer-Encoding", "7bit")
+		} else {
+			header.Set("Content-Transfer-Encoding", "base64")
+			content = encodeBase64(content)
+		}
+		// Writing to a bytes.Buffer never fails
+		pw, _ := w.CreatePart(header)
+		pw.Write(content)
 	}
-	b.WriteString(mimeFooter)
+	w.Close()
 	return b.String()
 }
+
+// is7bit checks if the content can be sent as is, without encoding
+func is7bit(content []byte) bool {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if len(line) > maxLineLength {
+			return false
+		}
+	}
+	for _, c := range content {
+		if c == 0 || c > 127 || c == '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeBase64(content []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(content)
+	b := new(bytes.Buffer)
+	for len(enc) > base64LineLength {
+		b.WriteString(enc[:base64LineLength] + "\r\n")
+		enc = enc[base64LineLength:]
+	}
+	b.WriteString(enc)
+	return b.Bytes()
+}
+
+// Encode returns the container as MIME text, gzipped if compress is set.
+// ErrTooLarge is returned if the result is larger than MaxSize.
+func Encode(c Container, compress bool) (string, error) {
+	text := c.ToMIMEText()
+	if compress {
+		compressed, err := Compress(text)
+		if err != nil {
+			return "", err
+		}
+		text = compressed
+	}
+	if len(text) > MaxSize {
+		logging.Errorf("The userdata is %d bytes, which is larger than the limit of %d bytes", len(text), MaxSize)
+		return "", ErrTooLarge
+	}
+	return text, nil
+}
+
+// Compress will gzip the userdata
+func Compress(data string) (string, error) {
+	buffer := new(bytes.Buffer)
+	writer := gzip.NewWriter(buffer)
+	_, err := writer.Write([]byte(data))
+	if err != nil {
+		logging.Debugf("Got error when gzipping userdata: %s", err)
+		return "", err
+	}
+	err = writer.Close()
+	if err != nil {
+		logging.Debugf("Got error when gzipping userdata: %s", err)
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// IsCompressed checks if the userdata is gzipped
+func IsCompressed(data string) bool {
+	return strings.HasPrefix(data, string(gzipMagic))
+}
+
+// Parse reads userdata back into a Container. The userdata can be gzipped,
+// and either a MIME message or a single script or config, in which case the
+// content type is based on the first line like cloud-init does.
+func Parse(data string) (Container, error) {
+	raw := []byte(data)
+	if IsCompressed(data) {
+		reader, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			logging.Debugf("Got error when un-gzipping userdata: %s", err)
+			return nil, err
+		}
+		raw, err = ioutil.ReadAll(reader)
+		if err != nil {
+			logging.Debugf("Got error when un-gzipping userdata: %s", err)
+			return nil, err
+		}
+	}
+	c := &container{parts: []Part{}}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return c, nil
+	}
+	// Userdata from older versions starts with an mbox "From" line
+	message := raw
+	if bytes.HasPrefix(message, []byte("From ")) {
+		if i := bytes.IndexByte(message, '\n'); i >= 0 {
+			message = message[i+1:]
+		}
+	}
+	reader := bufio.NewReader(bytes.NewReader(message))
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil || header.Get("Content-Type") == "" {
+		c.addPart(Part{ContentType: DetectContentType(string(raw)), Content: string(raw)})
+		return c, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		logging.Debugf("Got error when parsing content type of userdata: %s", err)
+		return nil, ErrInvalidUserdata
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		part, err := readPart(header, reader)
+		if err != nil {
+			return nil, err
+		}
+		c.addPart(part)
+		return c, nil
+	}
+	if err = parseMultipart(c, reader, params["boundary"]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseMultipart adds the parts of the message to the container, parts of
+// nested multipart messages are added in place of the nested message
+func parseMultipart(c *container, r io.Reader, boundary string) error {
+	if boundary == "" {
+		logging.Debug("Userdata has no MIME boundary")
+		return ErrInvalidUserdata
+	}
+	reader := multipart.NewReader(r, boundary)
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			logging.Debugf("Got error when reading MIME part of userdata: %s", err)
+			return ErrInvalidUserdata
+		}
+		mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err == nil && strings.HasPrefix(mediaType, "multipart/") {
+			if err = parseMultipart(c, p, params["boundary"]); err != nil {
+				return err
+			}
+			continue
+		}
+		part, err := readPart(p.Header, p)
+		if err != nil {
+			return err
+		}
+		part.Filename = p.FileName()
+		c.addPart(part)
+	}
+}
+
+func readPart(header textproto.MIMEHeader, r io.Reader) (Part, error) {
+	// The multipart reader decodes quoted-printable by itself, and line
+	// breaks are ignored when decoding base64
+	if strings.EqualFold(header.Get("Content-Transfer-Encoding"), "base64") {
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		logging.Debugf("Got error when reading MIME part of userdata: %s", err)
+		return Part{}, ErrInvalidUserdata
+	}
+	contentType := "text/plain"
+	if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		contentType = mediaType
+	}
+	return Part{ContentType: contentType, Content: string(content)}, nil
+}
+
+// DetectContentType returns the content type cloud-init gives userdata that
+// is not MIME, based on the first line
+func DetectContentType(data string) string {
+	for _, t := range scriptTypes {
+		if strings.HasPrefix(data, t.prefix) {
+			return t.contentType
+		}
+	}
+	return "text/plain"
+}
@@ -14,42 +14,143 @@
 
 package userdata
 
-import "testing"
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestEmptyContainer(t *testing.T) {
-	c := New()
-	expected := `From nobody Tue Dec  3 19:00:57 2013
-Content-Type: multipart/mixed; boundary="--===============HI-20131203==--"
-MIME-Version: 1.0
-
-----===============HI-20131203==----
-`
+	c := &container{boundary: "test-boundary"}
+	expected := "Content-Type: multipart/mixed; boundary=\"test-boundary\"\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"\r\n" +
+		"\r\n" +
+		"--test-boundary--\r\n"
 	text := c.ToMIMEText()
 	if text != expected {
-		t.Errorf("unexpected text.\nGot:\n%s\nExpected:\n%s", text, expected)
+		t.Errorf("unexpected text.\nGot:\n%q\nExpected:\n%q", text, expected)
 	}
 }
 
 func TestSimpleText(t *testing.T) {
+	c := &container{boundary: "test-boundary"}
+	c.AddPart("test/some-type", "This is some userdata")
+
+	expected := "Content-Type: multipart/mixed; boundary=\"test-boundary\"\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"\r\n" +
+		"--test-boundary\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"Content-Type: test/some-type; charset=utf-8\r\n" +
+		"Mime-Version: 1.0\r\n" +
+		"\r\n" +
+		"This is some userdata\r\n" +
+		"--test-boundary--\r\n"
+	if s := c.ToMIMEText(); s != expected {
+		t.Errorf("unexpected text.\nGot:\n%q\nExpected:\n%q", s, expected)
+	}
+}
+
+func TestRandomBoundary(t *testing.T) {
+	a, b := New(), New()
+	if a.ToMIMEText() == b.ToMIMEText() {
+		t.Error("Expected containers to have different boundaries")
+	}
+}
+
+func TestParseRoundTrip(t *testing.T) {
 	c := New()
-	cType := "test/some-type"
-	cVal := "This is some userdata"
-	c.AddPart(cType, cVal)
+	c.AddPart("text/brkt-config", `{"brkt": {"api_host": "yetiapi.example.com:443"}}`)
+	c.AddPart("text/x-shellscript", "#!/bin/bash\necho 'héllo'\n")
+	c.AddPart("text/cloud-config", "#cloud-config\nruncmd:\n  - ["+strings.Repeat("x", 2000)+"]\n")
+	for _, compress := range []bool{false, true} {
+		data, err := Encode(c, compress)
+		if err != nil {
+			t.Fatalf("Got unexpected error when encoding userdata: %s", err)
+		}
+		parsed, err := Parse(data)
+		if err != nil {
+			t.Fatalf("Got unexpected error when parsing userdata (compressed: %t): %s", compress, err)
+		}
+		if !reflect.DeepEqual(parsed.Parts(), c.Parts()) {
+			t.Errorf("Got unexpected parts (compressed: %t):\n%+v", compress, parsed.Parts())
+		}
+	}
+}
 
-	expected := `From nobody Tue Dec  3 19:00:57 2013
+func TestParseLegacy(t *testing.T) {
+	data := `From nobody Tue Dec  3 19:00:57 2013
 Content-Type: multipart/mixed; boundary="--===============HI-20131203==--"
 MIME-Version: 1.0
 
 ----===============HI-20131203==--
-Content-Type: test/some-type; charset="utf-8"
+Content-Type: text/brkt-config; charset="utf-8"
 MIME-Version: 1.0
 Content-Transfer-Encoding: 7bit
 
-This is some userdata
+{"brkt": {}}
+----===============HI-20131203==--
+Content-Type: text/x-shellscript; charset="utf-8"
+Content-Disposition: attachment; filename="setup.sh"
+
+#!/bin/sh
 ----===============HI-20131203==----
 `
+	c, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Got unexpected error when parsing userdata: %s", err)
+	}
+	expected := []Part{
+		{ContentType: "text/brkt-config", Content: `{"brkt": {}}`},
+		{ContentType: "text/x-shellscript", Filename: "setup.sh", Content: "#!/bin/sh"},
+	}
+	if !reflect.DeepEqual(c.Parts(), expected) {
+		t.Errorf("Got unexpected parts: %+v", c.Parts())
+	}
+}
 
-	if s := c.ToMIMEText(); s != expected {
-		t.Errorf("unexpected text.\nGot:\n%s\nExpected:\n%s", s, expected)
+func TestParseSingle(t *testing.T) {
+	tests := map[string]string{
+		"#!/bin/bash\necho hello\n":                       "text/x-shellscript",
+		"#cloud-config\npackages: [nginx]\n":              "text/cloud-config",
+		`{"brkt": {}}`:                                    "text/plain",
+		"Content-Type: text/x-shellscript\n\n#!/bin/sh\n": "text/x-shellscript",
+	}
+	for data, expected := range tests {
+		c, err := Parse(data)
+		if err != nil {
+			t.Fatalf("Got unexpected error when parsing %q: %s", data, err)
+		}
+		if parts := c.Parts(); len(parts) != 1 || parts[0].ContentType != expected {
+			t.Errorf("Expected single %s part for %q, got %+v", expected, data, parts)
+		}
+	}
+	if c, err := Parse(""); err != nil || len(c.Parts()) != 0 {
+		t.Errorf("Expected no parts for empty userdata, got %v (%v)", c, err)
+	}
+	if _, err := Parse("Content-Type: multipart/mixed\n\n"); err != ErrInvalidUserdata {
+		t.Errorf("Expected ErrInvalidUserdata without boundary, got %v", err)
+	}
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	random := make([]byte, MaxSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	c := New()
+	c.AddPart("text/x-shellscript", "#!/bin/sh\n# "+string(random))
+	if _, err := Encode(c, true); err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+
+	// Text that compresses well is fine
+	c = New()
+	c.AddPart("text/x-shellscript", "#!/bin/sh\n"+strings.Repeat("echo hello\n", MaxSize))
+	if _, err := Encode(c, false); err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge when not compressed, got %v", err)
+	}
+	if _, err := Encode(c, true); err != nil {
+		t.Errorf("Got unexpected error when encoding compressed userdata: %s", err)
 	}
 }